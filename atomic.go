@@ -0,0 +1,211 @@
+package useros
+
+import (
+	"errors"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// AtomicOptions configure WriteFileAtomic and CreateAtomic.
+type AtomicOptions struct {
+	// NoSync skips the fsync of the file and its directory, trading durability for speed.
+	NoSync bool
+
+	// ApplyPerm sets perm on a replaced file, instead of keeping its mode and ACL.
+	ApplyPerm bool
+}
+
+// AtomicFile is a temporary file that replaces its target when it is committed.
+// Closing it without Commit removes it.
+type AtomicFile struct {
+	File
+
+	o    OS
+	name string
+	opts AtomicOptions
+	done bool
+
+	// tmp is the name of the temporary file in o, which differs from
+	// the name of the file if o translates names, e.g. below a root.
+	tmp string
+}
+
+// WriteFileAtomic writes data to name as the user of o, like WriteFile, but readers see
+// either the old or the new content, also after a crash. See CreateAtomic.
+func WriteFileAtomic(o OS, name string, data []byte, perm os.FileMode, opts AtomicOptions) error {
+	f, err := CreateAtomic(o, name, perm, opts)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Commit()
+}
+
+// CreateAtomic creates a temporary file as the user of o in the directory of name, with perm
+// before umask. Commit syncs it and renames it to name, and syncs the directory. The temporary
+// file gets the ownership of the user and the group of the directory as any new file. A replaced
+// file keeps its mode and ACL, and in a sticky directory only a file of the user can be replaced.
+func CreateAtomic(o OS, name string, perm os.FileMode, opts AtomicOptions) (*AtomicFile, error) {
+	if _, err := atomicTarget(o, name); err != nil {
+		return nil, err
+	}
+
+	dir, base := filepath.Split(name)
+
+	for try := 0; try < 10000; try++ {
+		tmp := filepath.Join(dir, "."+base+".tmp"+strconv.FormatUint(uint64(rand.Uint32()), 36))
+
+		f, err := o.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &AtomicFile{File: f, o: o, name: name, opts: opts, tmp: tmp}, nil
+	}
+
+	return nil, logit(&os.PathError{Op: "createtemp", Path: name, Err: fs.ErrExist})
+}
+
+// atomicTarget returns the stat of the file that name would replace, and checks that it may be replaced.
+func atomicTarget(o OS, name string) (fs.FileInfo, error) {
+	existing, err := o.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if existing.IsDir() {
+		return nil, logit(&os.PathError{Op: "open", Path: name, Err: syscall.EISDIR})
+	}
+
+	dir, err := o.Stat(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	// In a sticky directory, only the owner of the file or directory can replace it
+	if dir.Mode()&os.ModeSticky > 0 {
+		u := o.CurrentUser()
+		ino, ok1 := inodeOf(existing)
+		dino, ok2 := inodeOf(dir)
+
+		if ok1 && ok2 && u.UID != 0 && ino.uid != u.UID && dino.uid != u.UID {
+			return nil, logit(&os.PathError{Op: "rename", Path: name, Err: syscall.EPERM})
+		}
+	}
+
+	return existing, nil
+}
+
+// Commit syncs the file, and renames it to its target. The file is closed, also on failure.
+func (f *AtomicFile) Commit() error {
+	if f.done {
+		return logit(&os.PathError{Op: "commit", Path: f.name, Err: fs.ErrClosed})
+	}
+
+	err := f.commit()
+	if err != nil {
+		f.Close()
+	}
+
+	return err
+}
+
+func (f *AtomicFile) commit() error {
+	// The target may have changed since the file was created
+	existing, err := atomicTarget(f.o, f.name)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil && existing.Mode().IsRegular() && !f.opts.ApplyPerm {
+		if err = f.keepAttrs(existing); err != nil {
+			return err
+		}
+	}
+
+	if !f.opts.NoSync {
+		if err = f.File.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err = f.File.Close(); err != nil {
+		return err
+	}
+
+	f.done = true
+
+	if err = f.o.Rename(f.tmp, f.name); err != nil {
+		f.o.Remove(f.tmp) //nolint:errcheck
+		return err
+	}
+
+	if f.opts.NoSync {
+		return nil
+	}
+
+	return syncDir(f.o, filepath.Dir(f.name))
+}
+
+// keepAttrs applies the mode and ACL of the replaced file.
+func (f *AtomicFile) keepAttrs(existing fs.FileInfo) error {
+	// The ACL can only be read if the user can open the replaced file
+	if r, err := f.o.Open(f.name); err == nil {
+		err = copyXattrs(f.File, r, f.o.CurrentUser(), f.o.CurrentUser(), PreserveACL)
+		r.Close()
+
+		if err != nil {
+			return logit(&os.PathError{Op: "commit", Path: f.name, Err: err})
+		}
+	}
+
+	return f.o.Chmod(f.tmp, existing.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+}
+
+// Close closes and removes the file, unless it was committed.
+func (f *AtomicFile) Close() error {
+	if f.done {
+		return nil
+	}
+
+	f.done = true
+	err := f.File.Close()
+
+	if rerr := f.o.Remove(f.tmp); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+// syncDir syncs a directory, if the user can open it.
+func syncDir(o OS, dir string) error {
+	d, err := o.Open(dir)
+	if errors.Is(err, fs.ErrPermission) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	// Not all platforms and file systems support syncing a directory
+	if err = d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateAtomicSticky(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		dir := filepath.Join(tree.Root, "tmp")
+
+		if err := os.Mkdir(dir, 0o777|os.ModeSticky); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chmod(dir, 0o777|os.ModeSticky); err != nil {
+			t.Fatal(err)
+		}
+
+		user1 := User{UID: 1000, GID: 1000}.OS()
+		user2 := User{UID: 1001, GID: 1001}.OS()
+
+		name := filepath.Join(dir, "file")
+
+		tree.AssertSuccess(WriteFileAtomic(user1, name, []byte("one"), 0o666, AtomicOptions{}))
+		tree.AssertOwnership(name, 1000, 1000)
+		tree.AssertSuccess(user1.Chmod(name, 0o666))
+
+		// Another user may write the file, but not replace it
+		tree.AssertDenied(WriteFileAtomic(user2, name, []byte("two"), 0o666, AtomicOptions{}))
+		tree.AssertSuccess(user2.WriteFile(name, []byte("two"), 0o666))
+		tree.AssertSuccess(WriteFileAtomic(user1, name, []byte("three"), 0o600, AtomicOptions{}))
+		tree.AssertContent(name, []byte("three"))
+		tree.AssertOwnership(name, 1000, 1000)
+
+		if info, err := os.Stat(name); err != nil || info.Mode() != 0o666 {
+			t.Errorf("expected mode to be kept, got %v: %v", info, err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	o := Default()
+
+	if err := WriteFileAtomic(o, name, []byte("one"), 0o640, AtomicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(name, 0o604); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replaced file keeps its mode
+	if err := WriteFileAtomic(o, name, []byte("two"), 0o600, AtomicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(name); err != nil || info.Mode() != 0o604 {
+		t.Errorf("expected mode 0604, got %v: %v", info, err)
+	}
+
+	// Until the commit, readers see the old content
+	f, err := CreateAtomic(o, name, 0o600, AtomicOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte("three")); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(name); err != nil || string(data) != "two" {
+		t.Errorf("expected old content, got %q: %v", data, err)
+	}
+
+	if err = f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(name); err != nil || string(data) != "three" {
+		t.Errorf("expected new content, got %q: %v", data, err)
+	}
+
+	// Closing without commit removes the temporary file
+	if f, err = CreateAtomic(o, name, 0o600, AtomicOptions{NoSync: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("expected one file, got %v: %v", entries, err)
+	}
+}
+
+func TestWriteFileAtomicRoot(t *testing.T) {
+	dir := t.TempDir()
+
+	o, err := NewOS(User{UID: -1, GID: -1}, WithRoot(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names are relative to the root, also for the temporary file
+	if err = WriteFileAtomic(o, "file", []byte("one"), 0o600, AtomicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "one" {
+		t.Errorf("expected content, got %q: %v", data, err)
+	}
+
+	f, err := CreateAtomic(o, "file", 0o600, AtomicOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("expected one file, got %v: %v", entries, err)
+	}
+}
@@ -0,0 +1,492 @@
+package useros
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Decision is the outcome of an audited operation.
+type Decision string
+
+const (
+	// Allowed operations succeeded.
+	Allowed Decision = "allow"
+	// Denied operations were refused by one of the components in DeniedBy.
+	Denied Decision = "deny"
+	// Failed operations were allowed, but failed for another reason, e.g. a missing file.
+	Failed Decision = "error"
+)
+
+// AuditEvent describes a single call on an audited OS or File.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+
+	// User is the user on whose behalf the operation is performed,
+	// ProcessUID the effective uid of the process that performs it.
+	User       User `json:"user"`
+	ProcessUID int  `json:"process_uid"`
+
+	Op     string      `json:"op"`
+	Path   string      `json:"path"`
+	Target string      `json:"target,omitempty"`
+	Flags  int         `json:"flags,omitempty"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+	UID    *int        `json:"uid,omitempty"`
+	GID    *int        `json:"gid,omitempty"`
+
+	Decision Decision      `json:"decision"`
+	DeniedBy string        `json:"denied_by,omitempty"`
+	Errno    syscall.Errno `json:"errno,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	// BytesRead and BytesWritten are set when a file is closed.
+	BytesRead    int64 `json:"bytes_read,omitempty"`
+	BytesWritten int64 `json:"bytes_written,omitempty"`
+
+	// Duration is the duration of the call, or the time a file was open for close events.
+	Duration time.Duration `json:"duration"`
+}
+
+// AuditSink receives audit events. Implementations must be safe for concurrent use.
+type AuditSink interface {
+	Audit(e *AuditEvent)
+}
+
+// AuditFunc is a function that implements AuditSink.
+type AuditFunc func(e *AuditEvent)
+
+// Audit calls f(e).
+func (f AuditFunc) Audit(e *AuditEvent) {
+	f(e)
+}
+
+// deniedBy returns the component that denied an operation, if the error is a denial.
+func deniedBy(err error) string {
+	switch {
+	case errors.Is(err, ErrPolicyDenied):
+		return "policy"
+	case errors.Is(err, syscall.EDQUOT):
+		return "quota"
+	case errors.Is(err, ErrPathEscapes):
+		return "root"
+	case errors.Is(err, fs.ErrPermission):
+		return "permissions"
+	}
+
+	return ""
+}
+
+// WithAudit returns an OS that reports every call on o, and on the files it opens, to sink.
+// Reads and writes are not reported individually, but summed in the event of Close.
+func WithAudit(o OS, sink AuditSink) OS {
+	return &auditOS{OS: o, sink: sink}
+}
+
+type auditOS struct {
+	OS
+	sink AuditSink
+}
+
+func (o *auditOS) emit(e *AuditEvent, start time.Time, err error) {
+	e.Time = start
+	e.User = o.CurrentUser()
+	e.ProcessUID = syscall.Geteuid()
+	e.Duration = time.Since(start)
+	e.Decision = Allowed
+
+	if err != nil {
+		e.Decision = Failed
+		e.Error = err.Error()
+
+		if e.DeniedBy = deniedBy(err); e.DeniedBy != "" {
+			e.Decision = Denied
+		}
+
+		if !errors.As(err, &e.Errno) && e.Decision == Denied {
+			e.Errno = syscall.EACCES
+		}
+	}
+
+	o.sink.Audit(e)
+}
+
+func (o *auditOS) audit(e AuditEvent, fn func() error) error {
+	start := time.Now()
+	err := fn()
+
+	o.emit(&e, start, err)
+
+	return err
+}
+
+func (o *auditOS) Chmod(name string, mode os.FileMode) error {
+	return o.audit(AuditEvent{Op: "chmod", Path: name, Mode: mode}, func() error { return o.OS.Chmod(name, mode) })
+}
+
+func (o *auditOS) Chown(name string, uid, gid int) error {
+	return o.audit(AuditEvent{Op: "chown", Path: name, UID: &uid, GID: &gid}, func() error { return o.OS.Chown(name, uid, gid) })
+}
+
+func (o *auditOS) Chtimes(name string, atime, mtime time.Time) error {
+	return o.audit(AuditEvent{Op: "chtimes", Path: name}, func() error { return o.OS.Chtimes(name, atime, mtime) })
+}
+
+func (o *auditOS) Lchown(name string, uid, gid int) error {
+	return o.audit(AuditEvent{Op: "lchown", Path: name, UID: &uid, GID: &gid}, func() error { return o.OS.Lchown(name, uid, gid) })
+}
+
+func (o *auditOS) Mkdir(name string, perm os.FileMode) error {
+	return o.audit(AuditEvent{Op: "mkdir", Path: name, Mode: perm}, func() error { return o.OS.Mkdir(name, perm) })
+}
+
+func (o *auditOS) MkdirAll(path string, perm os.FileMode) error {
+	return o.audit(AuditEvent{Op: "mkdirall", Path: path, Mode: perm}, func() error { return o.OS.MkdirAll(path, perm) })
+}
+
+func (o *auditOS) ReadFile(name string) ([]byte, error) {
+	e := AuditEvent{Op: "readfile", Path: name}
+
+	start := time.Now()
+	data, err := o.OS.ReadFile(name)
+
+	e.BytesRead = int64(len(data))
+
+	o.emit(&e, start, err)
+
+	return data, err
+}
+
+func (o *auditOS) Readlink(name string) (string, error) {
+	var target string
+
+	err := o.audit(AuditEvent{Op: "readlink", Path: name}, func() (err error) {
+		target, err = o.OS.Readlink(name)
+		return err
+	})
+
+	return target, err
+}
+
+func (o *auditOS) Remove(name string) error {
+	return o.audit(AuditEvent{Op: "remove", Path: name}, func() error { return o.OS.Remove(name) })
+}
+
+func (o *auditOS) RemoveAll(path string) error {
+	return o.removeAllContext(context.Background(), path)
+}
+
+func (o *auditOS) removeAllContext(ctx context.Context, path string) error {
+	return o.audit(AuditEvent{Op: "removeall", Path: path}, func() error { return removeAllContext(ctx, o.OS, path) })
+}
+
+func (o *auditOS) Rename(oldpath, newpath string) error {
+	return o.audit(AuditEvent{Op: "rename", Path: oldpath, Target: newpath}, func() error { return o.OS.Rename(oldpath, newpath) })
+}
+
+func (o *auditOS) Symlink(oldname, newname string) error {
+	return o.audit(AuditEvent{Op: "symlink", Path: newname, Target: oldname}, func() error { return o.OS.Symlink(oldname, newname) })
+}
+
+func (o *auditOS) Truncate(name string, size int64) error {
+	return o.audit(AuditEvent{Op: "truncate", Path: name}, func() error { return o.OS.Truncate(name, size) })
+}
+
+func (o *auditOS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	e := AuditEvent{Op: "writefile", Path: name, Flags: os.O_WRONLY | os.O_CREATE | os.O_TRUNC, Mode: perm}
+
+	start := time.Now()
+	err := o.OS.WriteFile(name, data, perm)
+
+	if err == nil {
+		e.BytesWritten = int64(len(data))
+	}
+
+	o.emit(&e, start, err)
+
+	return err
+}
+
+func (o *auditOS) Stat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+
+	err := o.audit(AuditEvent{Op: "stat", Path: name}, func() (err error) {
+		fi, err = o.OS.Stat(name)
+		return err
+	})
+
+	return fi, err
+}
+
+func (o *auditOS) Lstat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+
+	err := o.audit(AuditEvent{Op: "lstat", Path: name}, func() (err error) {
+		fi, err = o.OS.Lstat(name)
+		return err
+	})
+
+	return fi, err
+}
+
+func (o *auditOS) Create(name string) (File, error) {
+	return o.open("create", name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666, func() (File, error) { return o.OS.Create(name) })
+}
+
+func (o *auditOS) Open(name string) (File, error) {
+	return o.open("open", name, os.O_RDONLY, 0, func() (File, error) { return o.OS.Open(name) })
+}
+
+func (o *auditOS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return o.open("open", name, flag, perm, func() (File, error) { return o.OS.OpenFile(name, flag, perm) })
+}
+
+func (o *auditOS) open(op, name string, flag int, perm os.FileMode, fn func() (File, error)) (File, error) {
+	var f File
+
+	start := time.Now()
+
+	err := o.audit(AuditEvent{Op: op, Path: name, Flags: flag, Mode: perm}, func() (err error) {
+		f, err = fn()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditFile{File: f, os: o, flags: flag, opened: start}, nil
+}
+
+func (o *auditOS) ReadDir(name string) ([]os.DirEntry, error) {
+	var entries []os.DirEntry
+
+	err := o.audit(AuditEvent{Op: "readdir", Path: name}, func() (err error) {
+		entries, err = o.OS.ReadDir(name)
+		return err
+	})
+
+	return entries, err
+}
+
+func (o *auditOS) EvalSymlinks(name string) (string, error) {
+	var path string
+
+	err := o.audit(AuditEvent{Op: "evalsymlinks", Path: name}, func() (err error) {
+		path, err = o.OS.EvalSymlinks(name)
+		return err
+	})
+
+	return path, err
+}
+
+func (o *auditOS) Walk(name string, walkFn filepath.WalkFunc) error {
+	return o.audit(AuditEvent{Op: "walk", Path: name}, func() error { return o.OS.Walk(name, walkFn) })
+}
+
+// auditFile counts the bytes transferred, and reports failed reads and writes immediately.
+type auditFile struct {
+	File
+	os     *auditOS
+	flags  int
+	opened time.Time
+
+	mu            sync.Mutex
+	read, written int64
+}
+
+func (f *auditFile) count(op string, read, written int, err error) {
+	f.mu.Lock()
+	f.read += int64(read)
+	f.written += int64(written)
+	f.mu.Unlock()
+
+	if err != nil && !errors.Is(err, io.EOF) {
+		f.os.emit(&AuditEvent{Op: op, Path: f.Name()}, time.Now(), err)
+	}
+}
+
+func (f *auditFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.count("read", n, 0, err)
+
+	return n, err
+}
+
+func (f *auditFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.count("read", n, 0, err)
+
+	return n, err
+}
+
+func (f *auditFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{f}, r)
+}
+
+func (f *auditFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	f.count("write", 0, n, err)
+
+	return n, err
+}
+
+func (f *auditFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	f.count("write", 0, n, err)
+
+	return n, err
+}
+
+func (f *auditFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *auditFile) Chmod(mode os.FileMode) error {
+	return f.os.audit(AuditEvent{Op: "fchmod", Path: f.Name(), Mode: mode}, func() error { return f.File.Chmod(mode) })
+}
+
+func (f *auditFile) Chown(uid, gid int) error {
+	return f.os.audit(AuditEvent{Op: "fchown", Path: f.Name(), UID: &uid, GID: &gid}, func() error { return f.File.Chown(uid, gid) })
+}
+
+func (f *auditFile) Truncate(size int64) error {
+	return f.os.audit(AuditEvent{Op: "ftruncate", Path: f.Name()}, func() error { return f.File.Truncate(size) })
+}
+
+func (f *auditFile) Chdir() error {
+	return f.os.audit(AuditEvent{Op: "fchdir", Path: f.Name()}, f.File.Chdir)
+}
+
+// list audits a call that reads the directory, io.EOF at its end is not reported as a failure.
+func (f *auditFile) list(op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+
+	if errors.Is(err, io.EOF) {
+		f.os.emit(&AuditEvent{Op: op, Path: f.Name()}, start, nil)
+	} else {
+		f.os.emit(&AuditEvent{Op: op, Path: f.Name()}, start, err)
+	}
+
+	return err
+}
+
+func (f *auditFile) ReadDir(n int) ([]os.DirEntry, error) {
+	var entries []os.DirEntry
+
+	err := f.list("freaddir", func() (err error) {
+		entries, err = f.File.ReadDir(n)
+		return err
+	})
+
+	return entries, err
+}
+
+func (f *auditFile) Readdir(n int) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+
+	err := f.list("freaddir", func() (err error) {
+		infos, err = f.File.Readdir(n)
+		return err
+	})
+
+	return infos, err
+}
+
+func (f *auditFile) Readdirnames(n int) ([]string, error) {
+	var names []string
+
+	err := f.list("freaddir", func() (err error) {
+		names, err = f.File.Readdirnames(n)
+		return err
+	})
+
+	return names, err
+}
+
+func (f *auditFile) Lock() error {
+	return f.os.audit(AuditEvent{Op: "lock", Path: f.Name()}, f.File.Lock)
+}
+
+func (f *auditFile) RLock() error {
+	return f.os.audit(AuditEvent{Op: "rlock", Path: f.Name()}, f.File.RLock)
+}
+
+func (f *auditFile) TryLock() (bool, error) {
+	var ok bool
+
+	err := f.os.audit(AuditEvent{Op: "trylock", Path: f.Name()}, func() (err error) {
+		ok, err = f.File.TryLock()
+		return err
+	})
+
+	return ok, err
+}
+
+func (f *auditFile) Unlock() error {
+	return f.os.audit(AuditEvent{Op: "unlock", Path: f.Name()}, f.File.Unlock)
+}
+
+func (f *auditFile) LockRange(ctx context.Context, start, length int64, exclusive bool) error {
+	return f.os.audit(AuditEvent{Op: "lockrange", Path: f.Name()}, func() error { return f.File.LockRange(ctx, start, length, exclusive) })
+}
+
+func (f *auditFile) TryLockRange(start, length int64, exclusive bool) (bool, error) {
+	var ok bool
+
+	err := f.os.audit(AuditEvent{Op: "trylockrange", Path: f.Name()}, func() (err error) {
+		ok, err = f.File.TryLockRange(start, length, exclusive)
+		return err
+	})
+
+	return ok, err
+}
+
+func (f *auditFile) UnlockRange(start, length int64) error {
+	return f.os.audit(AuditEvent{Op: "unlockrange", Path: f.Name()}, func() error { return f.File.UnlockRange(start, length) })
+}
+
+func (f *auditFile) Openat(name string, flag int, perm os.FileMode) (File, error) {
+	return f.os.open("openat", atPath(f, name), flag, perm, func() (File, error) { return f.File.Openat(name, flag, perm) })
+}
+
+func (f *auditFile) Mkdirat(name string, perm os.FileMode) error {
+	return f.os.audit(AuditEvent{Op: "mkdirat", Path: atPath(f, name), Mode: perm}, func() error { return f.File.Mkdirat(name, perm) })
+}
+
+func (f *auditFile) Unlinkat(name string) error {
+	return f.os.audit(AuditEvent{Op: "unlinkat", Path: atPath(f, name)}, func() error { return f.File.Unlinkat(name) })
+}
+
+func (f *auditFile) Renameat(oldname string, newdir File, newname string) error {
+	return f.os.audit(AuditEvent{Op: "renameat", Path: atPath(f, oldname), Target: atPath(newdir, newname)}, func() error { return f.File.Renameat(oldname, newdir, newname) })
+}
+
+func (f *auditFile) Statat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+
+	err := f.os.audit(AuditEvent{Op: "statat", Path: atPath(f, name)}, func() (err error) {
+		fi, err = f.File.Statat(name)
+		return err
+	})
+
+	return fi, err
+}
+
+func (f *auditFile) Close() error {
+	err := f.File.Close()
+
+	f.mu.Lock()
+	e := AuditEvent{Op: "close", Path: f.Name(), Flags: f.flags, BytesRead: f.read, BytesWritten: f.written}
+	f.mu.Unlock()
+
+	f.os.emit(&e, f.opened, err)
+
+	return err
+}
@@ -0,0 +1,174 @@
+package useros
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// AuditFile writes audit events as JSON lines to a file, which is rotated when it grows
+// beyond MaxSize bytes. Rotated files are renamed to name.1, name.2, ... up to MaxBackups.
+type AuditFile struct {
+	MaxSize    int64
+	MaxBackups int
+
+	mu     sync.Mutex
+	name   string
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// OpenAuditFile opens or creates an audit log file for appending.
+func OpenAuditFile(name string, maxSize int64, maxBackups int) (*AuditFile, error) {
+	a := &AuditFile{
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		name:       name,
+	}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *AuditFile) open() error {
+	f, err := os.OpenFile(a.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a.f, a.size = f, fi.Size()
+
+	return nil
+}
+
+// Audit writes the event. Errors are passed to LogHandler.
+func (a *AuditFile) Audit(e *AuditEvent) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		logit(err) //nolint:errcheck
+		return
+	}
+
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		logit(os.ErrClosed) //nolint:errcheck
+		return
+	}
+
+	if a.f != nil && a.MaxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.MaxSize {
+		logit(a.rotate()) //nolint:errcheck
+	}
+
+	// If the rotation failed, the file is reopened under its original name
+	if a.f == nil {
+		if err = a.open(); err != nil {
+			logit(err) //nolint:errcheck
+			return
+		}
+	}
+
+	n, err := a.f.Write(data)
+	a.size += int64(n)
+
+	logit(err) //nolint:errcheck
+}
+
+// rotate shifts the backups and reopens the file. The caller must hold the lock.
+// On failure, the file is left closed.
+func (a *AuditFile) rotate() error {
+	err := a.f.Close()
+	a.f = nil
+
+	if err != nil {
+		return err
+	}
+
+	if a.MaxBackups > 0 {
+		for i := a.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.name, i), fmt.Sprintf("%s.%d", a.name, i+1)) //nolint:errcheck
+		}
+
+		if err := os.Rename(a.name, a.name+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.name); err != nil {
+		return err
+	}
+
+	return a.open()
+}
+
+// Close closes the file.
+func (a *AuditFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return os.ErrClosed
+	}
+
+	a.closed = true
+
+	if a.f == nil {
+		return nil
+	}
+
+	err := a.f.Close()
+	a.f = nil
+
+	return err
+}
+
+// AuditRing keeps the last events in memory, e.g. for tests.
+type AuditRing struct {
+	mu     sync.Mutex
+	events []AuditEvent
+	next   int
+	full   bool
+}
+
+// NewAuditRing returns a ring that keeps the last n events.
+func NewAuditRing(n int) *AuditRing {
+	return &AuditRing{events: make([]AuditEvent, n)}
+}
+
+// Audit stores the event.
+func (r *AuditRing) Audit(e *AuditEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.events) == 0 {
+		return
+	}
+
+	r.events[r.next] = *e
+	r.next = (r.next + 1) % len(r.events)
+	r.full = r.full || r.next == 0
+}
+
+// Events returns the stored events, oldest first.
+func (r *AuditRing) Events() []AuditEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]AuditEvent(nil), r.events[:r.next]...)
+	}
+
+	return append(append([]AuditEvent(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
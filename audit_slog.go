@@ -0,0 +1,71 @@
+//go:build go1.21
+// +build go1.21
+
+package useros
+
+import (
+	"context"
+	"log/slog"
+)
+
+// AuditLogger writes audit events to a structured logger. Denied operations
+// are logged at warning level, the others at info level.
+type AuditLogger struct {
+	Logger *slog.Logger
+}
+
+// Audit logs the event.
+func (l AuditLogger) Audit(e *AuditEvent) {
+	level := slog.LevelInfo
+	if e.Decision == Denied {
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.Group("user", slog.Int("uid", e.User.UID), slog.Int("gid", e.User.GID), slog.Any("groups", e.User.Groups)),
+		slog.Int("process_uid", e.ProcessUID),
+		slog.String("op", e.Op),
+		slog.String("path", e.Path),
+		slog.String("decision", string(e.Decision)),
+		slog.Duration("duration", e.Duration),
+	}
+
+	if e.Target != "" {
+		attrs = append(attrs, slog.String("target", e.Target))
+	}
+
+	if e.Flags != 0 {
+		attrs = append(attrs, slog.Int("flags", e.Flags))
+	}
+
+	if e.Mode != 0 {
+		attrs = append(attrs, slog.String("mode", e.Mode.String()))
+	}
+
+	if e.UID != nil {
+		attrs = append(attrs, slog.Int("uid", *e.UID))
+	}
+
+	if e.GID != nil {
+		attrs = append(attrs, slog.Int("gid", *e.GID))
+	}
+
+	if e.Error != "" {
+		attrs = append(attrs, slog.String("denied_by", e.DeniedBy), slog.Int("errno", int(e.Errno)), slog.String("error", e.Error))
+	}
+
+	if e.BytesRead != 0 || e.BytesWritten != 0 {
+		attrs = append(attrs, slog.Int64("bytes_read", e.BytesRead), slog.Int64("bytes_written", e.BytesWritten))
+	}
+
+	// The record carries the start time of the operation
+	h := l.Logger.Handler()
+	if !h.Enabled(context.Background(), level) {
+		return
+	}
+
+	r := slog.NewRecord(e.Time, level, "audit", 0)
+	r.AddAttrs(attrs...)
+
+	logit(h.Handle(context.Background(), r)) //nolint:errcheck
+}
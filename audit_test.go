@@ -0,0 +1,184 @@
+package useros
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := ParsePolicy([]byte(`{"rules": [{"effect": "deny", "paths": ["*.exe"], "ops": ["create"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring := NewAuditRing(4)
+	o := WithAudit(p.Wrap(Default()), ring)
+
+	if err = o.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := o.Open(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	if err = o.WriteFile(filepath.Join(dir, "setup.exe"), nil, 0o600); err == nil {
+		t.Fatal("expected policy denial")
+	}
+
+	if _, err = o.Stat(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	events := ring.Events()
+
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(events))
+	}
+
+	if e := events[0]; e.Op != "open" || e.Decision != Allowed {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	if e := events[1]; e.Op != "close" || e.BytesRead != 5 || e.Decision != Allowed {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	if e := events[2]; e.Op != "writefile" || e.Decision != Denied || e.DeniedBy != "policy" || e.Errno != syscall.EACCES {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	if e := events[3]; e.Op != "stat" || e.Decision != Failed || e.Errno != syscall.ENOENT {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	// Write the events to a rotated file
+	name := filepath.Join(dir, "audit.log")
+
+	a, err := OpenAuditFile(name, 500, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, e := range events {
+			a.Audit(&e)
+		}
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{name, name + ".1"} {
+		fh, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := bufio.NewScanner(fh)
+
+		for s.Scan() {
+			var e AuditEvent
+
+			if err = json.Unmarshal(s.Bytes(), &e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		fh.Close()
+	}
+
+	if _, err = os.Stat(name + ".2"); !os.IsNotExist(err) {
+		t.Errorf("expected one backup, got %v", err)
+	}
+}
+
+func TestAuditFileRotateFailure(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "audit.log")
+
+	// The backup can't be replaced by the log
+	if err := os.MkdirAll(filepath.Join(name+".1", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := OpenAuditFile(name, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		a.Audit(&AuditEvent{Op: "stat", Path: name})
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := bytes.Count(data, []byte("\n")); n != 3 {
+		t.Errorf("expected 3 events, got %d", n)
+	}
+}
+
+func TestAuditFileCalls(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+
+	if err := os.WriteFile(name, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ring := NewAuditRing(16)
+
+	f, err := WithAudit(Default(), ring).OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors don't matter, every call is reported
+	f.Lock()                                      //nolint:errcheck
+	f.Unlock()                                    //nolint:errcheck
+	f.RLock()                                     //nolint:errcheck
+	f.TryLock()                                   //nolint:errcheck
+	f.LockRange(context.Background(), 0, 1, true) //nolint:errcheck
+	f.TryLockRange(0, 1, true)                    //nolint:errcheck
+	f.UnlockRange(0, 1)                           //nolint:errcheck
+	f.Chdir()                                     //nolint:errcheck
+	f.ReadDir(-1)                                 //nolint:errcheck
+	f.Readdir(-1)                                 //nolint:errcheck
+	f.Readdirnames(-1)                            //nolint:errcheck
+	f.Close()
+
+	var ops []string
+
+	for _, e := range ring.Events() {
+		ops = append(ops, e.Op)
+	}
+
+	expected := []string{"open", "lock", "unlock", "rlock", "trylock", "lockrange", "trylockrange", "unlockrange", "fchdir", "freaddir", "freaddir", "freaddir", "close"}
+
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %v, got %v", expected, ops)
+	}
+}
@@ -0,0 +1,81 @@
+package useros
+
+import (
+	"os"
+
+	"github.com/joshlf/go-acl"
+)
+
+// Access describes a single permission check of a user on a file or directory.
+type Access struct {
+	User User
+
+	// Path is the file or directory that is checked.
+	Path string
+
+	// Stat and ACL describe the checked file or directory. ACL is nil if not supported.
+	Stat os.FileInfo
+	ACL  acl.ACL
+
+	// Perm is the requested permission. It is zero for the object of an operation
+	// that needs no permission on the object itself, such as Remove, Rename,
+	// Chmod, Chown and Stat, so that an authorizer can still refuse it.
+	Perm Permission
+
+	// Op is the operation that is performed.
+	Op Op
+
+	// Traverse is set if a directory is searched on the way to the file of the operation.
+	Traverse bool
+}
+
+// Authorizer decides whether an access is allowed. It is consulted by the OS of
+// a user for each directory that is traversed and for each final access.
+// It is not consulted for uid 0, which has access to everything.
+type Authorizer interface {
+	// Authorize returns nil if the access is allowed, or an error, typically os.ErrPermission.
+	Authorize(a *Access) error
+}
+
+// AuthorizerFunc is a function that implements Authorizer.
+type AuthorizerFunc func(a *Access) error
+
+// Authorize calls f(a).
+func (f AuthorizerFunc) Authorize(a *Access) error {
+	return f(a)
+}
+
+// DefaultAuthorizer implements the standard permission model with mode bits and ACLs.
+// Wrap it to add restrictions on top of the permission model.
+var DefaultAuthorizer Authorizer = modeAuthorizer{}
+
+type modeAuthorizer struct{}
+
+func (modeAuthorizer) Authorize(a *Access) error {
+	if a.Perm == 0 {
+		return nil
+	}
+
+	return a.User.checkPermission(a.Stat, a.ACL, a.Perm)
+}
+
+// authorizer returns the authorizer of the OS.
+func (u *user) authorizer() Authorizer {
+	if u.auth == nil {
+		return DefaultAuthorizer
+	}
+
+	return u.auth
+}
+
+func (u *user) authorize(path string, stat os.FileInfo, a acl.ACL, perm Permission, op Op, traverse bool) error {
+	return u.authorizer().Authorize(&Access{
+		User:     u.User,
+		Path:     path,
+		Stat:     stat,
+		ACL:      a,
+		Perm:     perm,
+		Op:       op,
+		Traverse: traverse,
+	})
+}
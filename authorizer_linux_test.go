@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAuthorizer(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		var (
+			mu       sync.Mutex
+			accesses []Access
+		)
+
+		auth := AuthorizerFunc(func(a *Access) error {
+			mu.Lock()
+			accesses = append(accesses, *a)
+			mu.Unlock()
+
+			if !a.Traverse && a.Perm == Write && strings.HasSuffix(a.Path, ".locked") {
+				return os.ErrPermission
+			}
+
+			return DefaultAuthorizer.Authorize(a)
+		})
+
+		user1 := User{UID: 1000, GID: 1000}.OSWithAuthorizer(auth)
+		user2 := User{UID: 1001, GID: 1000}.OSWithAuthorizer(auth)
+
+		path := filepath.Join(tree.Root, "a", "f.locked")
+		tree.AssertSuccess(user1.WriteFile(path, nil, 0o644))
+		tree.AssertOwnership(path, 1000, 1000)
+
+		var traversed, created bool
+
+		for _, a := range accesses {
+			traversed = traversed || a.Traverse && a.Path == tree.Root && a.Perm == Execute && a.Op == OpCreate
+			created = created || !a.Traverse && a.Path == filepath.Join(tree.Root, "a") && a.Perm == Write && a.Op == OpCreate
+		}
+
+		if !traversed || !created {
+			t.Errorf("unexpected accesses %v", accesses)
+		}
+
+		// The default permission model still applies
+		tree.AssertDenied(user2.WriteFile(filepath.Join(tree.Root, "a", "g"), nil, 0o644))
+
+		// The authorizer adds restrictions
+		tree.AssertDenied(user1.WriteFile(path, []byte("data"), 0o644))
+		tree.AssertDenied(user1.Truncate(path, 0))
+		_, err := user1.ReadFile(path)
+		tree.AssertSuccess(err)
+	})
+}
+
+func TestAuthorizerObject(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		// Veto any operation on a file with the xattr user.locked
+		auth := AuthorizerFunc(func(a *Access) error {
+			if _, err := unix.Getxattr(a.Path, "user.locked", nil); !a.Traverse && err == nil {
+				return os.ErrPermission
+			}
+
+			return DefaultAuthorizer.Authorize(a)
+		})
+
+		user1 := User{UID: 1000, GID: 1000}.OSWithAuthorizer(auth)
+
+		base := filepath.Join(tree.Root, "a", "s")
+		path := filepath.Join(base, "f")
+		other := filepath.Join(base, "g")
+
+		tree.AssertSuccess(user1.Mkdir(base, 0o755))
+		tree.AssertSuccess(user1.WriteFile(path, nil, 0o644))
+		tree.AssertSuccess(user1.WriteFile(other, nil, 0o644))
+
+		sub := filepath.Join(base, "t")
+		locked := filepath.Join(sub, "x")
+
+		tree.AssertSuccess(user1.Mkdir(sub, 0o755))
+		tree.AssertSuccess(user1.WriteFile(locked, nil, 0o644))
+
+		f, err := user1.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+
+		dir, err := user1.Open(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer dir.Close()
+
+		for _, name := range []string{path, locked} {
+			if err = unix.Setxattr(name, "user.locked", []byte("1"), 0); err == unix.EOPNOTSUPP {
+				t.Skip("user xattrs not supported")
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tree.AssertDenied(user1.Remove(path))
+		tree.AssertDenied(user1.Rename(path, filepath.Join(base, "h")))
+		tree.AssertDenied(user1.Rename(other, path))
+		tree.AssertDenied(user1.Chmod(path, 0o600))
+		tree.AssertDenied(user1.Chown(path, 1000, 1000))
+		tree.AssertDenied(user1.Lchown(path, 1000, 1000))
+
+		_, err = user1.Stat(path)
+		tree.AssertDenied(err)
+
+		_, err = user1.Lstat(path)
+		tree.AssertDenied(err)
+
+		// The same holds for descriptors and entries of opened directories
+		tree.AssertDenied(f.Chmod(0o600))
+		tree.AssertDenied(f.Chown(1000, 1000))
+		tree.AssertDenied(dir.Unlinkat("f"))
+		tree.AssertDenied(dir.Renameat("f", dir, "h"))
+		tree.AssertDenied(dir.Renameat("g", dir, "f"))
+
+		_, err = dir.Statat("f")
+		tree.AssertDenied(err)
+
+		tree.AssertDenied(user1.RemoveAll(sub))
+
+		if _, err = os.Lstat(locked); err != nil {
+			t.Error(err)
+		}
+
+		if err = unix.Removexattr(path, "user.locked"); err != nil {
+			t.Fatal(err)
+		}
+
+		tree.AssertSuccess(user1.Chmod(path, 0o600))
+		tree.AssertSuccess(user1.Rename(other, path))
+		tree.AssertSuccess(user1.Remove(path))
+	})
+}
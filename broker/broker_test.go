@@ -0,0 +1,296 @@
+//go:build linux
+// +build linux
+
+package broker
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func serve(t *testing.T, s *Server) (string, string) {
+	dir, err := os.MkdirTemp("/tmp", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if err = os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "root")
+	socket := filepath.Join(dir, "socket")
+
+	if err = os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	if err = os.Chmod(socket, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Roots = []string{root}
+
+	go s.Serve(l) //nolint:errcheck
+
+	return socket, root
+}
+
+func TestBroker(t *testing.T) {
+	socket, root := serve(t, &Server{})
+
+	c, err := Dial(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err = os.WriteFile(filepath.Join(root, "file"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := c.Open(filepath.Join(root, "file"), os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := io.ReadAll(f); err != nil || string(data) != "hello" {
+		t.Errorf("unexpected content %q: %v", data, err)
+	}
+
+	f.Close()
+
+	f, err = c.Open(filepath.Join(root, "new"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteString("world"); err != nil {
+		t.Error(err)
+	}
+
+	f.Close()
+
+	if fi, err := c.Stat(filepath.Join(root, "new")); err != nil || fi.Size() != 5 || fi.Mode() != 0o600 || fi.Name() != "new" {
+		t.Errorf("unexpected stat %v: %v", fi, err)
+	}
+
+	if err = c.Mkdir(filepath.Join(root, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Rename(filepath.Join(root, "new"), filepath.Join(root, "dir", "moved")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := c.ReadDir(filepath.Join(root, "dir"))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "moved" || entries[0].IsDir() {
+		t.Errorf("unexpected entries %v: %v", entries, err)
+	}
+
+	if err = c.Remove(filepath.Join(root, "dir")); !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("expected ENOTEMPTY, got %v", err)
+	}
+
+	if err = c.Remove(filepath.Join(root, "dir", "moved")); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = c.Lstat(filepath.Join(root, "dir", "moved")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	// Escapes out of the roots
+	if err = os.Symlink("/etc", filepath.Join(root, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Symlink("/tmp/broker-dangling", filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/etc/hostname", root + "/../socket", root + "/etc/hostname", root + "/etc"} {
+		if _, err = c.Open(name, os.O_RDONLY, 0); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("expected ErrPermission for %s, got %v", name, err)
+		}
+	}
+
+	if _, err = c.Open(filepath.Join(root, "dangling"), os.O_WRONLY|os.O_CREATE, 0o644); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected ErrPermission for dangling symlink, got %v", err)
+	}
+
+	if fi, err := c.Lstat(filepath.Join(root, "etc")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("unexpected lstat %v: %v", fi, err)
+	}
+
+	// Symlinks within the roots are followed from the descriptor of their directory
+	for link, target := range map[string]string{"alias": "file", "absolute": filepath.Join(root, "file"), "up": "..", "pending": "dir/created"} {
+		if err = os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"alias", "absolute", "dir/../alias"} {
+		if fi, err := c.Stat(filepath.Join(root, name)); err != nil || fi.Size() != 5 {
+			t.Errorf("unexpected stat of %s %v: %v", name, fi, err)
+		}
+	}
+
+	if _, err = c.Open(filepath.Join(root, "up", "socket"), os.O_RDONLY, 0); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected ErrPermission, got %v", err)
+	}
+
+	if f, err = c.Open(filepath.Join(root, "pending"), os.O_WRONLY|os.O_CREATE, 0o644); err != nil {
+		t.Error(err)
+	} else {
+		f.Close()
+	}
+
+	if _, err = os.Stat(filepath.Join(root, "dir", "created")); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = c.Open("relative", os.O_RDONLY, 0); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("expected EINVAL, got %v", err)
+	}
+
+	if _, err = c.Open(filepath.Join(root, "file"), os.O_RDONLY|syscall.O_NOATIME, 0); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("expected EINVAL, got %v", err)
+	}
+}
+
+func TestBrokerLimits(t *testing.T) {
+	socket, root := serve(t, &Server{Rate: 0.001, Burst: 2, MaxConns: 1})
+
+	c, err := Dial(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if _, err = Dial(socket); !errors.Is(err, syscall.EUSERS) {
+		t.Errorf("expected EUSERS, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = c.Stat(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = c.Stat(root); !errors.Is(err, syscall.EAGAIN) {
+		t.Errorf("expected EAGAIN, got %v", err)
+	}
+}
+
+// TestBrokerPeer runs the test binary as an unprivileged user, which connects to the broker.
+func TestBrokerPeer(t *testing.T) {
+	if socket := os.Getenv("BROKER_SOCKET"); socket != "" {
+		runPeer(t, socket, os.Getenv("BROKER_ROOT"))
+		return
+	}
+
+	if syscall.Geteuid() != 0 {
+		t.Skip("must run as root")
+	}
+
+	socket, root := serve(t, &Server{})
+
+	for name, perm := range map[string]os.FileMode{"private": 0o600, "public": 0o644} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "shared"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(filepath.Join(root, "shared"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test binary might live in a directory that is not accessible to the user
+	binary := filepath.Join(filepath.Dir(socket), "test")
+
+	data, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(binary, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(binary, "-test.run=^TestBrokerPeer$", "-test.v")
+	cmd.Env = append(os.Environ(), "BROKER_SOCKET="+socket, "BROKER_ROOT="+root)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: 1000, Gid: 1000},
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("peer failed: %v\n%s", err, out)
+	}
+
+	fi, err := os.Stat(filepath.Join(root, "shared", "mine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 1000 {
+		t.Errorf("file created by peer is owned by %d:%d", st.Uid, st.Gid)
+	}
+}
+
+func runPeer(t *testing.T, socket, root string) {
+	c, err := Dial(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if _, err = c.Open(filepath.Join(root, "private"), os.O_RDONLY, 0); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected ErrPermission, got %v", err)
+	}
+
+	if _, err = c.Open(filepath.Join(root, "public"), os.O_WRONLY, 0); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected ErrPermission, got %v", err)
+	}
+
+	if _, err = c.Open(filepath.Join(root, "public"), os.O_RDONLY, 0); err != nil {
+		t.Error(err)
+	}
+
+	if err = c.Mkdir(filepath.Join(root, "dir"), 0o755); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected ErrPermission, got %v", err)
+	}
+
+	if err = c.Remove(filepath.Join(root, "public")); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected ErrPermission, got %v", err)
+	}
+
+	f, err := c.Open(filepath.Join(root, "shared", "mine"), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+}
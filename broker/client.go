@@ -0,0 +1,247 @@
+//go:build linux
+// +build linux
+
+package broker
+
+import (
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Client talks to a broker. It is safe for concurrent use, requests are sent one at a time.
+type Client struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+	id   uint64
+}
+
+// Dial connects to the broker listening on the given socket.
+func Dial(socket string) (*Client, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{conn: conn}
+
+	if err = c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Client) handshake() error {
+	if err := writeFrame(c.conn, &Hello{Version: Version}, -1); err != nil {
+		return err
+	}
+
+	// The server answers with a hello, or with a response carrying an error
+	var hello struct {
+		Hello
+		Error *Error `json:"error,omitempty"`
+	}
+
+	if err := readFrame(c.conn, nil, &hello); err != nil {
+		return err
+	}
+
+	if hello.Error != nil {
+		return syscall.Errno(hello.Error.Errno)
+	}
+
+	if hello.Version != Version {
+		return syscall.EPROTONOSUPPORT
+	}
+
+	return nil
+}
+
+// Close closes the connection to the broker.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Open opens the named file with the permissions of the calling process.
+func (c *Client) Open(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	resp, fd, err := c.do(&Request{
+		Op:    OpOpen,
+		Path:  name,
+		Flags: flag,
+		Mode:  uint32(perm.Perm()),
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if resp.Error != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.Errno(resp.Error.Errno)}
+	}
+
+	if fd < 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrFrame}
+	}
+
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// Stat returns the file info of the named file, following symlinks.
+func (c *Client) Stat(name string) (fs.FileInfo, error) {
+	return c.stat(OpStat, name)
+}
+
+// Lstat returns the file info of the named file, not following a final symlink.
+func (c *Client) Lstat(name string) (fs.FileInfo, error) {
+	return c.stat(OpLstat, name)
+}
+
+func (c *Client) stat(op, name string) (fs.FileInfo, error) {
+	resp, err := c.call(op, &Request{Op: op, Path: name})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Stat == nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: ErrFrame}
+	}
+
+	return resp.Stat.fileInfo(), nil
+}
+
+// ReadDir returns the entries of the named directory.
+func (c *Client) ReadDir(name string) ([]fs.DirEntry, error) {
+	resp, err := c.call("readdir", &Request{Op: OpReadDir, Path: name})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(resp.Entries))
+
+	for _, e := range resp.Entries {
+		entries = append(entries, e.entry())
+	}
+
+	return entries, nil
+}
+
+// Mkdir creates the named directory.
+func (c *Client) Mkdir(name string, perm fs.FileMode) error {
+	_, err := c.call("mkdir", &Request{Op: OpMkdir, Path: name, Mode: uint32(perm.Perm())})
+
+	return err
+}
+
+// Remove removes the named file or empty directory.
+func (c *Client) Remove(name string) error {
+	_, err := c.call("remove", &Request{Op: OpUnlink, Path: name})
+
+	return err
+}
+
+// Rename renames oldpath to newpath.
+func (c *Client) Rename(oldpath, newpath string) error {
+	resp, _, err := c.do(&Request{Op: OpRename, Path: oldpath, Target: newpath})
+	if err == nil && resp.Error != nil {
+		err = syscall.Errno(resp.Error.Errno)
+	}
+
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	return nil
+}
+
+// call performs a request that does not return a file, and converts failures to *os.PathError.
+func (c *Client) call(op string, r *Request) (*Response, error) {
+	resp, fd, err := c.do(r)
+	if fd >= 0 {
+		syscall.Close(fd)
+	}
+
+	if err == nil && resp.Error != nil {
+		err = syscall.Errno(resp.Error.Errno)
+	}
+
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: r.Path, Err: err}
+	}
+
+	return resp, nil
+}
+
+// do sends a request and reads its response, with the passed file descriptor if any.
+func (c *Client) do(r *Request) (*Response, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.id++
+	r.ID = c.id
+
+	if err := writeFrame(c.conn, r, -1); err != nil {
+		return nil, -1, err
+	}
+
+	// The descriptor is attached to the first bytes of the frame
+	hdr := make([]byte, 4)
+	oob := make([]byte, unix.CmsgSpace(4))
+
+	n, oobn, _, _, err := c.conn.ReadMsgUnix(hdr, oob)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	fd, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, -1, err
+	}
+
+	var resp Response
+
+	if err = readFrame(c.conn, hdr[:n], &resp); err == nil && resp.ID != r.ID {
+		err = ErrFrame
+	}
+
+	if err != nil {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+
+		return nil, -1, err
+	}
+
+	return &resp, fd, nil
+}
+
+// parseRights returns the descriptor passed in the control messages, or -1.
+func parseRights(oob []byte) (int, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1, err
+	}
+
+	fd := -1
+
+	for _, msg := range msgs {
+		fds, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+
+		for _, f := range fds {
+			if fd < 0 {
+				fd = f
+			} else {
+				syscall.Close(f)
+			}
+		}
+	}
+
+	return fd, nil
+}
@@ -0,0 +1,202 @@
+// Package broker implements a file access broker. A daemon running as root
+// listens on a unix socket, identifies every peer with SO_PEERCRED and performs
+// the requests of the peer through useros with exactly the permissions of the
+// peer. Opened files are passed back as file descriptors, so unprivileged
+// processes can access files below a configured set of roots without setuid
+// helpers, while every request can be audited.
+//
+// # Wire protocol
+//
+// The protocol runs over a SOCK_STREAM unix socket. Every message is a frame
+// consisting of a 4 byte big endian length, followed by that many bytes of a
+// JSON encoded object. Frames are limited to MaxFrameSize bytes.
+//
+// After connecting, the client sends a Hello frame with the protocol version
+// it speaks, and the server answers with a Hello frame with the version it
+// will use, or with a Response carrying an error if the version is not
+// supported. The current version is 1.
+//
+// Afterwards the client sends Request frames, and the server answers each of
+// them with exactly one Response frame, in order. The id of a response equals
+// the id of the request. Requests have an op field:
+//
+//   - "open": open path with flags and mode (as for open(2)). The file
+//     descriptor is passed in an SCM_RIGHTS control message that is
+//     attached to the response frame.
+//   - "stat", "lstat": return Stat of path, following the final symlink or not.
+//   - "readdir": return the Entries of the directory at path.
+//   - "mkdir": create the directory path with mode.
+//   - "unlink": remove the file or empty directory path.
+//   - "rename": rename path to target.
+//
+// Failed requests carry an Error with the errno and a message. Paths must be
+// absolute and resolve below one of the roots of the server: symlinks are
+// resolved one component at a time from a descriptor of the root, and may not
+// leave the roots. When a peer
+// exceeds its request rate, requests fail with EAGAIN.
+package broker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Version is the protocol version implemented by this package.
+const Version = 1
+
+// MaxFrameSize is the maximal size of a frame.
+const MaxFrameSize = 1 << 20
+
+// Operations.
+const (
+	OpOpen    = "open"
+	OpStat    = "stat"
+	OpLstat   = "lstat"
+	OpReadDir = "readdir"
+	OpMkdir   = "mkdir"
+	OpUnlink  = "unlink"
+	OpRename  = "rename"
+)
+
+// ErrFrame is returned for frames that exceed MaxFrameSize or cannot be decoded.
+var ErrFrame = errors.New("invalid broker frame")
+
+// Hello is exchanged at the start of a connection.
+type Hello struct {
+	Version int `json:"version"`
+}
+
+// Request is sent by the client.
+type Request struct {
+	ID     uint64 `json:"id"`
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	Flags  int    `json:"flags,omitempty"`
+	Mode   uint32 `json:"mode,omitempty"`
+}
+
+// Response is sent by the server for each request.
+type Response struct {
+	ID      uint64  `json:"id"`
+	Error   *Error  `json:"error,omitempty"`
+	Stat    *Stat   `json:"stat,omitempty"`
+	Entries []Entry `json:"entries,omitempty"`
+}
+
+// Error describes a failed request.
+type Error struct {
+	Errno   int    `json:"errno"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the errno, so that errors.Is works with os.ErrNotExist and the like.
+func (e *Error) Unwrap() error {
+	return syscall.Errno(e.Errno)
+}
+
+// Stat is the wire representation of a file's status.
+type Stat struct {
+	Name  string      `json:"name"`
+	Size  int64       `json:"size"`
+	Mode  fs.FileMode `json:"mode"`
+	Mtime int64       `json:"mtime"`
+	UID   uint32      `json:"uid"`
+	GID   uint32      `json:"gid"`
+	Ino   uint64      `json:"ino"`
+	Nlink uint64      `json:"nlink"`
+}
+
+// fileInfo wraps the stat as fs.FileInfo.
+func (s *Stat) fileInfo() fs.FileInfo {
+	return statInfo{s}
+}
+
+type statInfo struct {
+	*Stat
+}
+
+func (s statInfo) Name() string       { return s.Stat.Name }
+func (s statInfo) Size() int64        { return s.Stat.Size }
+func (s statInfo) Mode() fs.FileMode  { return s.Stat.Mode }
+func (s statInfo) ModTime() time.Time { return time.Unix(0, s.Mtime) }
+func (s statInfo) IsDir() bool        { return s.Stat.Mode.IsDir() }
+func (s statInfo) Sys() interface{}   { return s.Stat }
+
+// Entry is a directory entry.
+type Entry struct {
+	Name string      `json:"name"`
+	Type fs.FileMode `json:"type"`
+}
+
+// entry wraps the entry as fs.DirEntry.
+func (e Entry) entry() fs.DirEntry {
+	return dirEntry{e}
+}
+
+type dirEntry struct {
+	Entry
+}
+
+func (e dirEntry) Name() string               { return e.Entry.Name }
+func (e dirEntry) IsDir() bool                { return e.Entry.Type.IsDir() }
+func (e dirEntry) Type() fs.FileMode          { return e.Entry.Type }
+func (e dirEntry) Info() (fs.FileInfo, error) { return nil, os.ErrInvalid }
+
+func encodeFrame(v interface{}) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > MaxFrameSize {
+		return nil, ErrFrame
+	}
+
+	frame := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+
+	return append(frame, body...), nil
+}
+
+// readFrame reads the rest of a frame of which the first bytes are already read in hdr.
+func readFrame(r io.Reader, hdr []byte, v interface{}) error {
+	if len(hdr) < 4 {
+		missing := make([]byte, 4-len(hdr))
+
+		if _, err := io.ReadFull(r, missing); err != nil {
+			return err
+		}
+
+		hdr = append(hdr, missing...)
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:4])
+	if size > MaxFrameSize {
+		return fmt.Errorf("%w: size %d", ErrFrame, size)
+	}
+
+	body := make([]byte, size)
+	n := copy(body, hdr[4:])
+
+	if _, err := io.ReadFull(r, body[n:]); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrFrame, err)
+	}
+
+	return nil
+}
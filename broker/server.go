@@ -0,0 +1,662 @@
+//go:build linux
+// +build linux
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/peterverraedt/useros"
+	"golang.org/x/sys/unix"
+)
+
+// OpenFlags are the open(2) flags a peer may pass. O_CLOEXEC is always added.
+const OpenFlags = unix.O_ACCMODE | unix.O_CREAT | unix.O_EXCL | unix.O_TRUNC | unix.O_APPEND |
+	unix.O_NONBLOCK | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_SYNC | unix.O_DSYNC | unix.O_CLOEXEC
+
+// Server serves broker requests on a unix socket.
+type Server struct {
+	// Roots are the directories below which peers may access files.
+	Roots []string
+
+	// Rate is the number of requests per second a single uid may issue, zero means unlimited.
+	Rate float64
+
+	// Burst is the number of requests a uid may issue at once, at least one.
+	Burst int
+
+	// MaxConns is the number of concurrent connections per uid, zero means unlimited.
+	MaxConns int
+
+	// Log is called after each request, e.g. to keep an audit trail. Optional.
+	Log func(peer useros.User, r *Request, err error)
+
+	once  sync.Once
+	roots []string
+	err   error
+	mu    sync.Mutex
+	peers map[int]*peer
+}
+
+// peer keeps the limits of a single uid.
+type peer struct {
+	conns  int
+	tokens float64
+	last   time.Time
+}
+
+// ErrEscape is returned when a path resolves outside the roots of the server.
+var ErrEscape = errors.New("path outside broker roots")
+
+// Serve accepts connections on the listener and serves each of them.
+func (s *Server) Serve(l *net.UnixListener) error {
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(c) //nolint:errcheck
+	}
+}
+
+func (s *Server) init() error {
+	s.once.Do(func() {
+		s.peers = map[int]*peer{}
+
+		for _, root := range s.Roots {
+			r, err := filepath.EvalSymlinks(root)
+			if err == nil && !filepath.IsAbs(r) {
+				r, err = filepath.Abs(r)
+			}
+
+			if err != nil {
+				s.err = err
+				return
+			}
+
+			s.roots = append(s.roots, r)
+		}
+	})
+
+	return s.err
+}
+
+// ServeConn serves a single connection until it is closed.
+func (s *Server) ServeConn(c *net.UnixConn) error {
+	defer c.Close()
+
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	u, err := useros.FromUnixConn(c)
+	if err != nil {
+		return err
+	}
+
+	if !s.connect(u.UID) {
+		return writeFrame(c, &Response{Error: toError(syscall.EUSERS)}, -1)
+	}
+
+	defer s.disconnect(u.UID)
+
+	var hello Hello
+
+	if err = readFrame(c, nil, &hello); err != nil {
+		return err
+	}
+
+	if hello.Version != Version {
+		return writeFrame(c, &Response{Error: toError(syscall.EPROTONOSUPPORT)}, -1)
+	}
+
+	if err = writeFrame(c, &Hello{Version: Version}, -1); err != nil {
+		return err
+	}
+
+	h := &handler{
+		server: s,
+		os:     u.OS(),
+	}
+
+	for {
+		var r Request
+
+		err := readFrame(c, nil, &r)
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var (
+			resp = &Response{ID: r.ID}
+			fd   = -1
+			f    useros.File
+		)
+
+		if !s.allow(u.UID) {
+			err = syscall.EAGAIN
+		} else {
+			f, err = h.handle(&r, resp)
+		}
+
+		if s.Log != nil {
+			s.Log(u, &r, err)
+		}
+
+		if err != nil {
+			resp.Error = toError(err)
+		} else if f != nil {
+			fd = int(f.Fd())
+		}
+
+		err = writeFrame(c, resp, fd)
+
+		if errors.Is(err, ErrFrame) {
+			err = writeFrame(c, &Response{ID: r.ID, Error: toError(syscall.E2BIG)}, -1)
+		}
+
+		if f != nil {
+			f.Close()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connect registers a new connection of uid and reports whether it is allowed.
+func (s *Server) connect(uid int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[uid]
+	if !ok {
+		p = &peer{
+			tokens: s.capacity(),
+			last:   time.Now(),
+		}
+
+		s.peers[uid] = p
+	}
+
+	if s.MaxConns > 0 && p.conns >= s.MaxConns {
+		return false
+	}
+
+	p.conns++
+
+	return true
+}
+
+func (s *Server) disconnect(uid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.peers[uid]; p != nil {
+		p.conns--
+
+		// Forget idle peers whose bucket is full again
+		if p.conns == 0 && (s.Rate == 0 || p.tokens+time.Since(p.last).Seconds()*s.Rate >= s.capacity()) {
+			delete(s.peers, uid)
+		}
+	}
+}
+
+// allow takes a token from the bucket of uid.
+func (s *Server) allow(uid int) bool {
+	if s.Rate <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.peers[uid]
+	now := time.Now()
+
+	p.tokens += now.Sub(p.last).Seconds() * s.Rate
+	p.last = now
+
+	if p.tokens > s.capacity() {
+		p.tokens = s.capacity()
+	}
+
+	if p.tokens < 1 {
+		return false
+	}
+
+	p.tokens--
+
+	return true
+}
+
+// capacity returns the size of the token bucket of a peer.
+func (s *Server) capacity() float64 {
+	if s.Burst < 1 {
+		return 1
+	}
+
+	return float64(s.Burst)
+}
+
+// rootOf returns the innermost root that contains path, without resolving symlinks.
+func (s *Server) rootOf(path string) (string, bool) {
+	var found string
+
+	for _, root := range s.roots {
+		if (path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/")) && len(root) > len(found) {
+			found = root
+		}
+	}
+
+	return found, found != ""
+}
+
+type handler struct {
+	server *Server
+	os     useros.OS
+}
+
+func (h *handler) handle(r *Request, resp *Response) (useros.File, error) {
+	switch r.Op {
+	case OpOpen:
+		return h.open(r)
+	case OpStat, OpLstat:
+		return nil, h.stat(r, resp)
+	case OpReadDir:
+		return nil, h.readDir(r, resp)
+	case OpMkdir:
+		e, err := h.resolve(r.Path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		defer e.Close()
+
+		if e.name == "" {
+			return nil, &os.PathError{Op: "mkdir", Path: r.Path, Err: syscall.EEXIST}
+		}
+
+		return nil, e.dir.Mkdirat(e.name, fs.FileMode(r.Mode)&fs.ModePerm)
+	case OpUnlink:
+		e, err := h.resolve(r.Path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		defer e.Close()
+
+		if e.name == "" {
+			return nil, &os.PathError{Op: "unlink", Path: r.Path, Err: syscall.EBUSY}
+		}
+
+		return nil, e.dir.Unlinkat(e.name)
+	case OpRename:
+		e, err := h.resolve(r.Path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		defer e.Close()
+
+		t, err := h.resolve(r.Target, false)
+		if err != nil {
+			return nil, err
+		}
+
+		defer t.Close()
+
+		if e.name == "" || t.name == "" {
+			return nil, &os.LinkError{Op: "rename", Old: r.Path, New: r.Target, Err: syscall.EBUSY}
+		}
+
+		return nil, e.dir.Renameat(e.name, t.dir, t.name)
+	default:
+		return nil, syscall.ENOSYS
+	}
+}
+
+func (h *handler) open(r *Request) (useros.File, error) {
+	if r.Flags&^OpenFlags != 0 {
+		return nil, syscall.EINVAL
+	}
+
+	e, err := h.resolve(r.Path, r.Flags&unix.O_NOFOLLOW == 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer e.Close()
+
+	if e.name == "" {
+		return h.os.OpenFile(e.root, r.Flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	}
+
+	// Openat never follows a symlink, any that appeared in the meantime is refused
+	return e.dir.Openat(e.name, r.Flags|unix.O_CLOEXEC, fs.FileMode(r.Mode)&fs.ModePerm)
+}
+
+func (h *handler) stat(r *Request, resp *Response) error {
+	e, err := h.resolve(r.Path, r.Op == OpStat)
+	if err != nil {
+		return err
+	}
+
+	defer e.Close()
+
+	var fi fs.FileInfo
+
+	if e.name == "" {
+		fi, err = h.os.Lstat(e.root)
+	} else {
+		fi, err = e.dir.Statat(e.name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	resp.Stat = toStat(fi)
+
+	// Report the name that was asked for, not the one of the symlink target
+	resp.Stat.Name = filepath.Base(r.Path)
+
+	return nil
+}
+
+func (h *handler) readDir(r *Request, resp *Response) error {
+	e, err := h.resolve(r.Path, true)
+	if err != nil {
+		return err
+	}
+
+	defer e.Close()
+
+	var f useros.File
+
+	if e.name == "" {
+		f, err = h.os.OpenFile(e.root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	} else {
+		f, err = e.dir.Openat(e.name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	resp.Entries = make([]Entry, 0, len(entries))
+
+	for _, e := range entries {
+		resp.Entries = append(resp.Entries, Entry{
+			Name: e.Name(),
+			Type: e.Type(),
+		})
+	}
+
+	return nil
+}
+
+// entry is a resolved path: the entry name of the opened directory dir,
+// or the root itself if name is empty.
+type entry struct {
+	dir  useros.File
+	name string
+	root string
+}
+
+func (e *entry) Close() error {
+	return e.dir.Close()
+}
+
+// resolve resolves the requested path as the peer, component by component from
+// a descriptor of the root that contains it, so that symlinks and renames cannot
+// move the resolution outside the roots. A final symlink is followed only if
+// follow is set. Each directory is opened with the at-methods of the OS of
+// the peer, which check the search permission on the opened descriptors.
+func (h *handler) resolve(name string, follow bool) (*entry, error) {
+	if !filepath.IsAbs(name) {
+		return nil, &os.PathError{Op: "resolve", Path: name, Err: syscall.EINVAL}
+	}
+
+	var (
+		dirs  []useros.File
+		names []string
+		root  string
+		rest  []string
+		links int
+	)
+
+	closeAll := func() {
+		for _, d := range dirs {
+			d.Close()
+		}
+
+		dirs, names = nil, nil
+	}
+
+	// start restarts the resolution of the absolute path at the root that contains it
+	start := func(path string) error {
+		closeAll()
+
+		path = filepath.Clean(path)
+
+		var ok bool
+
+		if root, ok = h.server.rootOf(path); !ok {
+			return &os.PathError{Op: "resolve", Path: name, Err: ErrEscape}
+		}
+
+		d, err := h.os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+
+		dirs, names = []useros.File{d}, []string{""}
+		rest = append(split(strings.TrimPrefix(path, root)), rest...)
+
+		return nil
+	}
+
+	if err := start(name); err != nil {
+		return nil, err
+	}
+
+	var base string
+
+	for len(rest) > 0 {
+		dir := dirs[len(dirs)-1]
+		c := rest[0]
+		rest = rest[1:]
+
+		switch c {
+		case ".":
+			continue
+		case "..":
+			if len(dirs) == 1 {
+				closeAll()
+				return nil, &os.PathError{Op: "resolve", Path: name, Err: ErrEscape}
+			}
+
+			dir.Close()
+			dirs, names = dirs[:len(dirs)-1], names[:len(names)-1]
+
+			continue
+		}
+
+		fi, err := dir.Statat(c)
+		if len(rest) == 0 && (errors.Is(err, fs.ErrNotExist) || err == nil && (!follow || fi.Mode()&fs.ModeSymlink == 0)) {
+			base = c
+			break
+		} else if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			target, err := readlinkAt(dir, c)
+			if links++; err == nil && links > useros.MaxSymlinks {
+				err = &os.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+			}
+
+			if err == nil && filepath.IsAbs(target) {
+				err = start(target)
+			} else if err == nil {
+				rest = append(split(target), rest...)
+			}
+
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+
+			continue
+		}
+
+		d, err := dir.Openat(c, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		dirs, names = append(dirs, d), append(names, c)
+	}
+
+	// A path that ends in a directory other than the root is looked up in its parent
+	if base == "" && len(dirs) > 1 {
+		base = names[len(names)-1]
+		dirs[len(dirs)-1].Close()
+		dirs = dirs[:len(dirs)-1]
+	}
+
+	for _, d := range dirs[:len(dirs)-1] {
+		d.Close()
+	}
+
+	return &entry{dir: dirs[len(dirs)-1], name: base, root: root}, nil
+}
+
+// split returns the components of a path.
+func split(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+// readlinkAt returns the target of the symlink name in dir, read through
+// a descriptor of the symlink itself.
+func readlinkAt(dir useros.File, name string) (string, error) {
+	f, err := dir.Openat(name, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+
+		n, err := unix.Readlinkat(int(f.Fd()), "", buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: f.Name(), Err: err}
+		}
+
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+func toStat(fi fs.FileInfo) *Stat {
+	s := &Stat{
+		Name:  fi.Name(),
+		Size:  fi.Size(),
+		Mode:  fi.Mode(),
+		Mtime: fi.ModTime().UnixNano(),
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		s.UID = st.Uid
+		s.GID = st.Gid
+		s.Ino = st.Ino
+		s.Nlink = uint64(st.Nlink)
+	}
+
+	return s
+}
+
+// toError converts an error to its wire representation.
+func toError(err error) *Error {
+	var e syscall.Errno
+
+	switch {
+	case errors.As(err, &e):
+	case errors.Is(err, ErrEscape), errors.Is(err, os.ErrPermission):
+		e = syscall.EACCES
+	case errors.Is(err, os.ErrNotExist):
+		e = syscall.ENOENT
+	case errors.Is(err, os.ErrExist):
+		e = syscall.EEXIST
+	default:
+		e = syscall.EIO
+	}
+
+	return &Error{
+		Errno:   int(e),
+		Message: err.Error(),
+	}
+}
+
+// writeFrame writes a frame, with fd attached if it is not negative.
+func writeFrame(c *net.UnixConn, v interface{}, fd int) error {
+	frame, err := encodeFrame(v)
+	if err != nil {
+		return err
+	}
+
+	var oob []byte
+
+	if fd >= 0 {
+		oob = unix.UnixRights(fd)
+	}
+
+	n, _, err := c.WriteMsgUnix(frame, oob, nil)
+	if err != nil {
+		return err
+	}
+
+	if n < len(frame) {
+		_, err = c.Write(frame[n:])
+	}
+
+	if err != nil {
+		return fmt.Errorf("write frame: %w", err)
+	}
+
+	return nil
+}
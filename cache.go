@@ -0,0 +1,194 @@
+package useros
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joshlf/go-acl"
+)
+
+// PermissionCache caches the mode, owner and ACL of files by device and inode, so
+// that permission checks don't read the ACL xattrs of every ancestor on each call.
+// Files are still statted, and an entry is only used while the ctime, mode and
+// owner of the file are unchanged and its TTL has not expired. A cache is safe for
+// concurrent use, and concurrent lookups of the same file are collapsed into one.
+// When the cache is full, the least recently used entry is evicted.
+// The returned ACLs are shared and must not be modified, e.g. by an Authorizer.
+type PermissionCache struct {
+	ttl time.Duration
+	max int
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[[2]uint64]*list.Element
+	calls   map[[2]uint64]*cacheCall
+	stats   CacheStats
+
+	// lru holds the entries, the most recently used at the front.
+	lru *list.List
+}
+
+// CacheStats are the metrics of a PermissionCache.
+type CacheStats struct {
+	// Hits and Misses count the lookups, Shared the misses that waited for a concurrent lookup.
+	Hits   uint64
+	Misses uint64
+	Shared uint64
+
+	// Invalidations count the entries that were outdated, Evictions those removed for space.
+	Invalidations uint64
+	Evictions     uint64
+
+	// Entries is the number of cached entries.
+	Entries int
+}
+
+type cacheEntry struct {
+	key      [2]uint64
+	ctime    int64
+	mode     os.FileMode
+	uid, gid int
+	acl      acl.ACL
+	expires  time.Time
+}
+
+type cacheCall struct {
+	wg  sync.WaitGroup
+	acl acl.ACL
+	err error
+}
+
+// NewPermissionCache returns a cache whose entries expire after ttl, holding at most maxEntries entries.
+func NewPermissionCache(ttl time.Duration, maxEntries int) *PermissionCache {
+	return &PermissionCache{
+		ttl:     ttl,
+		max:     maxEntries,
+		now:     time.Now,
+		entries: map[[2]uint64]*list.Element{},
+		calls:   map[[2]uint64]*cacheCall{},
+		lru:     list.New(),
+	}
+}
+
+// Stats returns the metrics of the cache.
+func (c *PermissionCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+
+	return stats
+}
+
+// Purge removes all entries.
+func (c *PermissionCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[[2]uint64]*list.Element{}
+	c.lru.Init()
+}
+
+// get returns the ACL of the file with the given stat.
+func (c *PermissionCache) get(name string, stat os.FileInfo) (acl.ACL, error) {
+	ino, ok := inodeOf(stat)
+	if !ok {
+		return getACL(name)
+	}
+
+	key := [2]uint64{ino.dev, ino.ino}
+
+	c.mu.Lock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+
+		if e.ctime == ino.ctime && e.mode == stat.Mode() && e.uid == ino.uid && e.gid == ino.gid && c.now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.stats.Hits++
+			c.mu.Unlock()
+
+			return e.acl, nil
+		}
+
+		c.remove(el)
+		c.stats.Invalidations++
+	}
+
+	c.stats.Misses++
+
+	// Wait for a concurrent lookup of the same file
+	if call, ok := c.calls[key]; ok {
+		c.stats.Shared++
+		c.mu.Unlock()
+		call.wg.Wait()
+
+		return call.acl, call.err
+	}
+
+	call := &cacheCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.acl, call.err = getACL(name)
+
+	// The ACL is read by path, it is only stored if the path still refers to the same inode
+	after, err := os.Stat(name)
+	same := err == nil && sameInode(ino, after)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+
+	if call.err == nil && same {
+		c.store(&cacheEntry{
+			key:     key,
+			ctime:   ino.ctime,
+			mode:    stat.Mode(),
+			uid:     ino.uid,
+			gid:     ino.gid,
+			acl:     call.acl,
+			expires: c.now().Add(c.ttl),
+		})
+	}
+
+	c.mu.Unlock()
+	call.wg.Done()
+
+	return call.acl, call.err
+}
+
+// sameInode reports whether fi is the unchanged inode ino.
+func sameInode(ino inodeInfo, fi os.FileInfo) bool {
+	other, ok := inodeOf(fi)
+
+	return ok && other.dev == ino.dev && other.ino == ino.ino && other.ctime == ino.ctime
+}
+
+// store adds an entry, evicting the least recently used entry if the cache is full.
+// The caller must hold the lock.
+func (c *PermissionCache) store(e *cacheEntry) {
+	if c.max <= 0 {
+		return
+	}
+
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+
+	for len(c.entries) >= c.max {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+}
+
+// remove removes an entry. The caller must hold the lock.
+func (c *PermissionCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	c.lru.Remove(el)
+}
@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/joshlf/go-acl"
+)
+
+func TestPermissionCache(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		dir := filepath.Join(tree.Root, "x", "y")
+
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Grant access to both directories with an ACL
+		for _, d := range []string{filepath.Join(tree.Root, "x"), dir} {
+			a := append(acl.FromUnix(0o700), acl.Entry{Tag: acl.TagUser, Qualifier: "1000", Perms: 5}, acl.Entry{Tag: acl.TagMask, Perms: 7})
+
+			if err := acl.Set(d, a); errors.Is(err, syscall.EOPNOTSUPP) {
+				t.Skip("ACLs not supported")
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cache := NewPermissionCache(time.Minute, 100)
+
+		o, err := NewOS(User{UID: 1000, GID: 1000}, WithCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = o.Stat(filepath.Join(dir, "file"))
+		tree.AssertSuccess(err)
+
+		misses := cache.Stats().Misses
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				if _, err := o.Stat(filepath.Join(dir, "file")); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if stats := cache.Stats(); stats.Misses != misses || stats.Hits < 10 {
+			t.Errorf("expected only hits, got %+v", stats)
+		}
+
+		// Removing the ACL changes the ctime, and invalidates the entry
+		if err = acl.Set(dir, acl.FromUnix(0o700)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = o.Stat(filepath.Join(dir, "file"))
+		tree.AssertDenied(err)
+
+		if stats := cache.Stats(); stats.Invalidations != 1 {
+			t.Errorf("expected an invalidation, got %+v", stats)
+		}
+	})
+}
+
+func TestPermissionCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+
+	stats := map[string]os.FileInfo{}
+
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, name)
+
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats[name] = fi
+	}
+
+	cache := NewPermissionCache(time.Minute, 2)
+
+	get := func(name, stat string) {
+		t.Helper()
+
+		if _, err := cache.get(filepath.Join(dir, name), stats[stat]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An ACL read from a path that no longer refers to the statted file is not stored
+	get("a", "b")
+
+	if s := cache.Stats(); s.Entries != 0 {
+		t.Errorf("expected no entries, got %+v", s)
+	}
+
+	// The least recently used entry is evicted
+	get("a", "a")
+	get("b", "b")
+	get("a", "a")
+	get("c", "c")
+
+	if s := cache.Stats(); s.Entries != 2 || s.Evictions != 1 || s.Hits != 1 {
+		t.Errorf("expected b to be evicted, got %+v", s)
+	}
+
+	get("a", "a")
+
+	if s := cache.Stats(); s.Hits != 2 {
+		t.Errorf("expected a hit for a, got %+v", s)
+	}
+}
@@ -0,0 +1,80 @@
+package useros
+
+// Check is a kind of access check performed by CheckMany and CheckUsers.
+type Check int
+
+const (
+	// CheckReadInode checks whether the inode can be statted, see User.CanReadInode.
+	CheckReadInode Check = 1 << iota
+
+	// CheckWriteInode checks whether the inode can be created, renamed or removed, see User.CanWriteInode.
+	CheckWriteInode
+
+	// CheckReadObject checks whether the file can be read, see User.CanReadObject.
+	CheckReadObject
+
+	// CheckWriteObject checks whether the file can be written, see User.CanWriteObject.
+	CheckWriteObject
+)
+
+var allChecks = []Check{CheckReadInode, CheckWriteInode, CheckReadObject, CheckWriteObject}
+
+// CheckResult is the result of the checks on a path for a user.
+type CheckResult struct {
+	Path string
+	User User
+
+	// Allowed are the checks that succeeded.
+	Allowed Check
+
+	// Err is the error of the first check that failed, in the order of the Check constants.
+	Err error
+}
+
+// CheckMany performs the checks on each of the paths, and returns a result per path.
+// The results equal those of the corresponding Can* functions, but the stat and ACL
+// of each directory are only read once, and common ancestors are traversed once.
+func (u User) CheckMany(paths []string, checks Check) []CheckResult {
+	c := newChecker()
+	cu := &user{User: u}
+
+	results := make([]CheckResult, len(paths))
+
+	for i, path := range paths {
+		results[i] = c.run(cu, path, checks)
+	}
+
+	return results
+}
+
+// CheckUsers performs the checks on the path for each of the users, and returns a result per user.
+// The stat and ACL of each directory are only read once for all users.
+func CheckUsers(path string, users []User, checks Check) []CheckResult {
+	c := newChecker()
+
+	results := make([]CheckResult, len(users))
+
+	for i, u := range users {
+		results[i] = c.run(&user{User: u}, path, checks)
+	}
+
+	return results
+}
+
+func (c *checker) run(u *user, path string, checks Check) CheckResult {
+	r := CheckResult{Path: path, User: u.User}
+
+	for _, k := range allChecks {
+		if checks&k == 0 {
+			continue
+		}
+
+		if err := c.check(u, path, k); err == nil {
+			r.Allowed |= k
+		} else if r.Err == nil {
+			r.Err = err
+		}
+	}
+
+	return r
+}
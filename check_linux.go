@@ -0,0 +1,194 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/joshlf/go-acl"
+)
+
+// checker performs checks like hasInodeAccess and hasObjectAccess, but
+// remembers the stats, ACLs, resolutions and search checks it needs.
+type checker struct {
+	stats    map[string]*checkStat
+	resolved map[string]*checkResolved
+	searched map[checkSearch]error
+}
+
+type checkStat struct {
+	stat os.FileInfo
+	err  error
+
+	acl       acl.ACL
+	aclErr    error
+	aclLoaded bool
+}
+
+type checkResolved struct {
+	dirs []string
+	err  error
+}
+
+type checkSearch struct {
+	u   *user
+	dir string
+	op  Op
+}
+
+func newChecker() *checker {
+	return &checker{
+		stats:    map[string]*checkStat{},
+		resolved: map[string]*checkResolved{},
+		searched: map[checkSearch]error{},
+	}
+}
+
+func (c *checker) check(u *user, path string, k Check) error {
+	switch k {
+	case CheckReadInode:
+		_, err := c.inodeAccess(u, path, Execute, OpStat)
+		return err
+	case CheckWriteInode:
+		_, err := c.inodeAccess(u, path, Write, OpWrite)
+		return err
+	case CheckReadObject:
+		return c.objectAccess(u, path, Read, OpRead)
+	default:
+		return c.objectAccess(u, path, Write, OpWrite)
+	}
+}
+
+// stat returns the stat of a path, following symlinks.
+func (c *checker) stat(path string) *checkStat {
+	s, ok := c.stats[path]
+	if !ok {
+		s = &checkStat{}
+		s.stat, s.err = os.Stat(path)
+		c.stats[path] = s
+	}
+
+	return s
+}
+
+// acl returns the stat and ACL of a path.
+func (c *checker) acl(path string) (os.FileInfo, acl.ACL, error) {
+	s := c.stat(path)
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+
+	if !s.aclLoaded {
+		s.acl, s.aclErr = getACL(path)
+		s.aclLoaded = true
+	}
+
+	return s.stat, s.acl, s.aclErr
+}
+
+// traversed returns the directories traversed to reach the directory dir, see TraversedDirectories.
+func (c *checker) traversed(dir string) ([]string, error) {
+	r, ok := c.resolved[dir]
+	if !ok {
+		r = &checkResolved{}
+		r.dirs, r.err = ResolveSymlinks(dir)
+		c.resolved[dir] = r
+	}
+
+	return r.dirs, r.err
+}
+
+// search checks whether the user can search a directory.
+func (c *checker) search(u *user, dir string, op Op) error {
+	key := checkSearch{u, dir, op}
+
+	if err, ok := c.searched[key]; ok {
+		return err
+	}
+
+	err := c.searchDir(u, dir, op)
+	c.searched[key] = err
+
+	return err
+}
+
+func (c *checker) searchDir(u *user, dir string, op Op) error {
+	stat, a, err := c.acl(dir)
+	if err != nil {
+		return err
+	}
+
+	if !stat.IsDir() {
+		return syscall.ENOTDIR
+	}
+
+	return on(u.authorize(dir, stat, a, Execute, op, true), dir)
+}
+
+// inodeAccess is hasInodeAccess with shared lookups.
+func (c *checker) inodeAccess(u *user, name string, perm Permission, op Op) (os.FileInfo, error) {
+	parent := filepath.Dir(filepath.Clean(name))
+
+	if u.UID == 0 {
+		s := c.stat(parent)
+		if s.err != nil {
+			return nil, s.err
+		}
+
+		if !s.stat.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+
+		return s.stat, nil
+	}
+
+	dirs, err := c.traversed(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if err = c.search(u, dir, op); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+
+	last := dirs[len(dirs)-1]
+
+	stat, a, err := c.acl(last)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the directory of the inode for the write permission if asked
+	if perm == Write {
+		return stat, on(u.authorize(last, stat, a, perm, op, false), last)
+	}
+
+	return stat, nil
+}
+
+// objectAccess is hasObjectAccess with shared lookups.
+func (c *checker) objectAccess(u *user, name string, perm Permission, op Op) error {
+	if u.UID == 0 {
+		return c.stat(name).err
+	}
+
+	if _, err := c.inodeAccess(u, name, Execute, op); err != nil {
+		return err
+	}
+
+	stat, a, err := c.acl(name)
+	if err != nil {
+		return err
+	}
+
+	return on(u.authorize(name, stat, a, perm, op, false), name)
+}
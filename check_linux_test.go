@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckMany(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		for dir, mode := range map[string]os.FileMode{"open": 0o755, "closed": 0o700, "writable": 0o777} {
+			if err := os.Mkdir(filepath.Join(tree.Root, dir), mode); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chmod(filepath.Join(tree.Root, dir), mode); err != nil {
+				t.Fatal(err)
+			}
+
+			for file, fmode := range map[string]os.FileMode{"public": 0o644, "private": 0o600, "shared": 0o666} {
+				if err := os.WriteFile(filepath.Join(tree.Root, dir, file), nil, fmode); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.Chmod(filepath.Join(tree.Root, dir, file), fmode); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		var paths []string
+
+		for _, dir := range []string{"open", "closed", "writable", "missing"} {
+			for _, file := range []string{"public", "private", "shared", "missing"} {
+				paths = append(paths, filepath.Join(tree.Root, dir, file))
+			}
+		}
+
+		all := CheckReadInode | CheckWriteInode | CheckReadObject | CheckWriteObject
+
+		users := []User{{UID: 0, GID: 0}, {UID: 1000, GID: 1000}, {UID: 1001, GID: 1001, Groups: []int{1000}}}
+
+		for _, u := range users {
+			for i, r := range u.CheckMany(paths, all) {
+				assertCheck(t, u, paths[i], r)
+			}
+		}
+
+		for _, path := range paths {
+			for i, r := range CheckUsers(path, users, all) {
+				assertCheck(t, users[i], path, r)
+			}
+		}
+	})
+}
+
+// assertCheck compares a result with the individual checks.
+func assertCheck(t *testing.T, u User, path string, r CheckResult) {
+	t.Helper()
+
+	var (
+		allowed  Check
+		firstErr error
+	)
+
+	checks := []func(string) error{u.CanReadInode, u.CanWriteInode, u.CanReadObject, u.CanWriteObject}
+
+	for i, k := range allChecks {
+		if err := checks[i](path); err == nil {
+			allowed |= k
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if r.Path != path || r.User.UID != u.UID {
+		t.Errorf("%s: unexpected result for %s as %d", path, r.Path, r.User.UID)
+	}
+
+	if r.Allowed != allowed {
+		t.Errorf("%s as %d: expected %b, got %b", path, u.UID, allowed, r.Allowed)
+	}
+
+	if fmt.Sprint(r.Err) != fmt.Sprint(firstErr) {
+		t.Errorf("%s as %d: expected error %v, got %v", path, u.UID, firstErr, r.Err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+// checker performs the checks one by one, as there is nothing to share on this platform.
+type checker struct{}
+
+func newChecker() *checker {
+	return &checker{}
+}
+
+func (c *checker) check(u *user, path string, k Check) error {
+	switch k {
+	case CheckReadInode:
+		return u.canReadInode(path, OpStat)
+	case CheckWriteInode:
+		return u.canWriteInode(path, OpWrite)
+	case CheckReadObject:
+		return u.hasObjectAccess(path, Read, OpRead)
+	default:
+		return u.hasObjectAccess(path, Write, OpWrite)
+	}
+}
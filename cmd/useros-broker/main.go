@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+// Command useros-broker runs a file access broker on a unix socket.
+// It must run as root, and lets every peer open, stat, list, create,
+// remove and rename files below the given roots with the permissions
+// of the peer, as identified by SO_PEERCRED.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/peterverraedt/useros"
+	"github.com/peterverraedt/useros/broker"
+)
+
+type roots []string
+
+func (r *roots) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *roots) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func main() {
+	var (
+		s      broker.Server
+		socket string
+		mode   uint
+	)
+
+	flag.StringVar(&socket, "socket", "/run/useros-broker.sock", "path of the unix socket")
+	flag.UintVar(&mode, "socket-mode", 0o666, "permissions of the unix socket")
+	flag.Var((*roots)(&s.Roots), "root", "directory below which files may be accessed, can be repeated")
+	flag.Float64Var(&s.Rate, "rate", 100, "requests per second per uid, 0 for unlimited")
+	flag.IntVar(&s.Burst, "burst", 200, "burst of requests per uid")
+	flag.IntVar(&s.MaxConns, "max-conns", 16, "concurrent connections per uid, 0 for unlimited")
+	flag.Parse()
+
+	if len(s.Roots) == 0 {
+		log.Fatal("at least one -root is required")
+	}
+
+	s.Log = func(peer useros.User, r *broker.Request, err error) {
+		log.Printf("uid=%d gid=%d op=%s path=%q target=%q flags=%#o err=%v", peer.UID, peer.GID, r.Op, r.Path, r.Target, r.Flags, err)
+	}
+
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = os.Chmod(socket, os.FileMode(mode)); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(s.Serve(l))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+// Command useros-broker runs a file access broker on a unix socket.
+// It is only supported on linux.
+package main
+
+import "log"
+
+func main() {
+	log.Fatal("useros-broker is only supported on linux")
+}
@@ -0,0 +1,319 @@
+package useros
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// readDirBatch is the number of directory entries read between context checks.
+const readDirBatch = 256
+
+// WithContext returns an OS whose operations are bound to ctx. Long-running
+// operations check ctx between path components and directory entries, and return
+// ctx.Err() once it is done. If ctx can be cancelled, each blocking call runs in
+// a separate goroutine, so the caller returns when ctx is done even if the call
+// hangs, e.g. on a stuck network mount. Such a call still completes in the
+// background: a file that it opens is closed, but a modification may still happen.
+func WithContext(ctx context.Context, o OS) OS {
+	return &ctxOS{OS: o, ctx: ctx}
+}
+
+type ctxOS struct {
+	OS
+	ctx context.Context
+}
+
+// do runs fn, unless or until the context is done.
+func (o *ctxOS) do(fn func() error) error {
+	_, err := call(o.ctx, func() (struct{}, error) { return struct{}{}, fn() }, nil)
+	return err
+}
+
+// result is the outcome of a call.
+type result[T any] struct {
+	value T
+	err   error
+}
+
+// call runs fn, unless or until ctx is done. The result of fn is passed back over
+// a channel, so a call that completes after the caller has given up touches no
+// state of the caller. Its result is then passed to cleanup, if fn succeeded.
+func call[T any](ctx context.Context, fn func() (T, error), cleanup func(T)) (T, error) {
+	var zero T
+
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	var (
+		mu        sync.Mutex
+		abandoned bool
+		done      = make(chan result[T], 1)
+	)
+
+	go func() {
+		value, err := fn()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !abandoned {
+			done <- result[T]{value, err}
+		} else if err == nil && cleanup != nil {
+			cleanup(value)
+		}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		mu.Lock()
+		defer mu.Unlock()
+
+		// The call may have completed in the meantime
+		select {
+		case r := <-done:
+			return r.value, r.err
+		default:
+			abandoned = true
+			return zero, ctx.Err()
+		}
+	}
+}
+
+func (o *ctxOS) Chmod(name string, mode os.FileMode) error {
+	return o.do(func() error { return o.OS.Chmod(name, mode) })
+}
+
+func (o *ctxOS) Chown(name string, uid, gid int) error {
+	return o.do(func() error { return o.OS.Chown(name, uid, gid) })
+}
+
+func (o *ctxOS) Chtimes(name string, atime, mtime time.Time) error {
+	return o.do(func() error { return o.OS.Chtimes(name, atime, mtime) })
+}
+
+func (o *ctxOS) Lchown(name string, uid, gid int) error {
+	return o.do(func() error { return o.OS.Lchown(name, uid, gid) })
+}
+
+func (o *ctxOS) Mkdir(name string, perm os.FileMode) error {
+	return o.do(func() error { return o.OS.Mkdir(name, perm) })
+}
+
+// MkdirAll checks the context before each path component.
+func (o *ctxOS) MkdirAll(path string, perm os.FileMode) error {
+	return mkdirAll(o, path, perm)
+}
+
+// ReadFile checks the context between reads.
+func (o *ctxOS) ReadFile(name string) ([]byte, error) {
+	f, err := o.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var (
+		data []byte
+		buf  = make([]byte, 64*1024)
+	)
+
+	for {
+		n, err := call(o.ctx, func() (int, error) { return f.Read(buf) }, nil)
+
+		data = append(data, buf[:n]...)
+
+		if errors.Is(err, io.EOF) {
+			return data, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (o *ctxOS) Readlink(name string) (string, error) {
+	return call(o.ctx, func() (string, error) { return o.OS.Readlink(name) }, nil)
+}
+
+func (o *ctxOS) Remove(name string) error {
+	return o.do(func() error { return o.OS.Remove(name) })
+}
+
+// RemoveAll checks the context before each entry if the wrapped OS supports it,
+// otherwise the call is abandoned like any other call.
+func (o *ctxOS) RemoveAll(path string) error {
+	return o.do(func() error { return removeAllContext(o.ctx, o.OS, path) })
+}
+
+// contextRemover is implemented by an OS that checks a context while removing a tree.
+type contextRemover interface {
+	removeAllContext(ctx context.Context, path string) error
+}
+
+// removeAllContext removes path in o, checking ctx before each entry if o supports it.
+func removeAllContext(ctx context.Context, o OS, path string) error {
+	if r, ok := o.(contextRemover); ok {
+		return r.removeAllContext(ctx, path)
+	}
+
+	return o.RemoveAll(path)
+}
+
+func (o *ctxOS) Rename(oldpath, newpath string) error {
+	return o.do(func() error { return o.OS.Rename(oldpath, newpath) })
+}
+
+func (o *ctxOS) Symlink(oldname, newname string) error {
+	return o.do(func() error { return o.OS.Symlink(oldname, newname) })
+}
+
+func (o *ctxOS) Truncate(name string, size int64) error {
+	return o.do(func() error { return o.OS.Truncate(name, size) })
+}
+
+func (o *ctxOS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return o.do(func() error { return o.OS.WriteFile(name, data, perm) })
+}
+
+func (o *ctxOS) Stat(name string) (os.FileInfo, error) {
+	return call(o.ctx, func() (os.FileInfo, error) { return o.OS.Stat(name) }, nil)
+}
+
+func (o *ctxOS) Lstat(name string) (os.FileInfo, error) {
+	return call(o.ctx, func() (os.FileInfo, error) { return o.OS.Lstat(name) }, nil)
+}
+
+func (o *ctxOS) Create(name string) (File, error) {
+	return o.open(func() (File, error) { return o.OS.Create(name) })
+}
+
+func (o *ctxOS) Open(name string) (File, error) {
+	return o.open(func() (File, error) { return o.OS.Open(name) })
+}
+
+func (o *ctxOS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return o.open(func() (File, error) { return o.OS.OpenFile(name, flag, perm) })
+}
+
+func (o *ctxOS) open(fn func() (File, error)) (File, error) {
+	return call(o.ctx, fn, func(f File) { f.Close() })
+}
+
+// ReadDir checks the context between batches of entries.
+func (o *ctxOS) ReadDir(name string) ([]os.DirEntry, error) {
+	f, err := o.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var entries []os.DirEntry
+
+	for {
+		batch, err := call(o.ctx, func() ([]os.DirEntry, error) { return f.ReadDir(readDirBatch) }, nil)
+
+		entries = append(entries, batch...)
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// readDirNames returns the sorted names in a directory, checking the context between batches.
+func (o *ctxOS) readDirNames(name string) ([]string, error) {
+	entries, err := o.ReadDir(name)
+
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+
+	return names, err
+}
+
+func (o *ctxOS) EvalSymlinks(name string) (string, error) {
+	return call(o.ctx, func() (string, error) { return o.OS.EvalSymlinks(name) }, nil)
+}
+
+// Walk walks the tree like filepath.Walk, and checks the context before each entry.
+// The walk function is always called from the goroutine of the caller.
+func (o *ctxOS) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := o.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = o.walk(root, info, walkFn)
+	}
+
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+
+	return err
+}
+
+func (o *ctxOS) walk(path string, info fs.FileInfo, walkFn filepath.WalkFunc) error {
+	if err := o.ctx.Err(); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+
+	names, err := o.readDirNames(path)
+	if ctxErr := o.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	err1 := walkFn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+
+		fileInfo, err := o.Lstat(filename)
+		if ctxErr := o.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if err != nil {
+			if err := walkFn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+		} else {
+			err = o.walk(filename, fileInfo, walkFn)
+			if err != nil {
+				if !fileInfo.IsDir() || err != filepath.SkipDir {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
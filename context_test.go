@@ -0,0 +1,93 @@
+package useros
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hangingOS blocks in Stat until release is closed.
+type hangingOS struct {
+	OS
+	release chan struct{}
+}
+
+func (o *hangingOS) Stat(name string) (os.FileInfo, error) {
+	<-o.release
+	return o.OS.Stat(name)
+}
+
+func TestWithContext(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"a/1", "a/2", "b/1", "b/2"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := WithContext(ctx, Default())
+
+	var walked int
+
+	err := o.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if walked++; walked == 3 {
+			cancel()
+		}
+
+		return err
+	})
+	if !errors.Is(err, context.Canceled) || walked != 3 {
+		t.Errorf("expected cancellation after 3 entries, got %v after %d", err, walked)
+	}
+
+	if err = o.RemoveAll(filepath.Join(dir, "a")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "a/1")); err != nil {
+		t.Error(err)
+	}
+
+	// A live context behaves as the wrapped OS
+	o = WithContext(context.Background(), Default())
+
+	if entries, err := o.ReadDir(dir); err != nil || len(entries) != 2 || entries[0].Name() != "a" {
+		t.Errorf("unexpected result %v, %v", entries, err)
+	}
+
+	if err = o.MkdirAll(filepath.Join(dir, "c/d/e"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = o.RemoveAll(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Errorf("expected removal, got %v", err)
+	}
+
+	// A hanging call is abandoned at the deadline
+	h := &hangingOS{OS: Default(), release: make(chan struct{})}
+	defer close(h.release)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	if _, err = WithContext(ctx, h).Stat(dir); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("call returned after %s", d)
+	}
+}
@@ -0,0 +1,313 @@
+package useros
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Preserve selects the attributes that Copy and CopyTree copy to the destination.
+type Preserve int
+
+const (
+	// PreserveMode copies the permission bits, including setuid, setgid and sticky.
+	PreserveMode Preserve = 1 << iota
+
+	// PreserveTimes copies the access and modification times.
+	PreserveTimes
+
+	// PreserveACL copies the access and default ACLs.
+	PreserveACL
+
+	// PreserveXattrs copies the extended attributes in the user namespace, and
+	// in all namespaces if both users are root.
+	PreserveXattrs
+
+	PreserveAll = PreserveMode | PreserveTimes | PreserveACL | PreserveXattrs
+)
+
+// CopyOptions configure Copy, CopyTree and Move.
+type CopyOptions struct {
+	// Preserve are the attributes that are copied, as far as the destination user may set them.
+	Preserve Preserve
+
+	// Overwrite replaces existing files, and merges into existing directories.
+	// Otherwise an existing destination is an error satisfying errors.Is(err, fs.ErrExist).
+	Overwrite bool
+
+	// FollowSymlinks makes CopyTree copy the targets of symlinks instead of the links.
+	FollowSymlinks bool
+}
+
+// Copy copies the file src, as read by the user of srcOS, to dst, as written by the user
+// of dstOS. Symlinks are followed. If both files are on the same file system, the data is
+// reflinked or copied within the kernel with copy_file_range where possible.
+func Copy(srcOS OS, src string, dstOS OS, dst string, opts CopyOptions) error {
+	info, err := srcOS.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return logit(&os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR})
+	}
+
+	return copyFile(srcOS, src, info, dstOS, dst, opts)
+}
+
+// CopyTree copies the directory tree src, as read by the user of srcOS, to dst, as written by
+// the user of dstOS, like Copy for each file. Symlinks are copied as links, unless FollowSymlinks
+// is set. The attributes of directories are applied after their contents have been copied. The
+// copy stops at the first error, leaving the files copied so far.
+func CopyTree(srcOS OS, src string, dstOS OS, dst string, opts CopyOptions) error {
+	type dirAttrs struct {
+		src, dst string
+		info     fs.FileInfo
+	}
+
+	var dirs []dirAttrs
+
+	err := WalkDir(srcOS, src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := dst
+		if rel := relativeComponents(src, path); len(rel) > 0 {
+			target = filepath.Join(dst, filepath.Join(rel...))
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 && opts.FollowSymlinks {
+			if info, err = srcOS.Stat(path); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case info.IsDir() && d.Type()&fs.ModeSymlink != 0:
+			// WalkDir does not descend into symlinks
+			return CopyTree(srcOS, path+string(os.PathSeparator), dstOS, target, opts)
+		case info.IsDir():
+			dirs = append(dirs, dirAttrs{path, target, info})
+
+			return copyMkdir(dstOS, target, opts)
+		case info.Mode()&fs.ModeSymlink != 0:
+			return copySymlink(srcOS, path, dstOS, target, opts)
+		case info.Mode().IsRegular():
+			return copyFile(srcOS, path, info, dstOS, target, opts)
+		default:
+			return logit(&os.PathError{Op: "copy", Path: path, Err: fs.ErrInvalid})
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Apply the attributes bottom-up, so that the contents are written first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = copyAttrs(srcOS, dirs[i].src, dirs[i].info, dstOS, dirs[i].dst, nil, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Move renames src to dst. If both are on the same OS but on different file systems, or if the OS
+// differ, the tree is copied with CopyTree and then removed. A failed copy leaves src in place.
+func Move(srcOS OS, src string, dstOS OS, dst string, opts CopyOptions) error {
+	if srcOS == dstOS {
+		err := srcOS.Rename(src, dst)
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+	}
+
+	if err := CopyTree(srcOS, src, dstOS, dst, opts); err != nil {
+		return err
+	}
+
+	return srcOS.RemoveAll(src)
+}
+
+// CopyFS copies the file system fsys into the directory dir as the user of o, like os.CopyFS:
+// dir is created if necessary, files are created with mode 0o666 plus the execute bits of the
+// source, directories with mode 0o777, both before umask. Existing files are not overwritten,
+// and symlinks in fsys are not supported. Copying stops at the first error.
+func CopyFS(o OS, dir string, fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(path))
+
+		if d.IsDir() {
+			return o.MkdirAll(target, 0o777)
+		}
+
+		if !d.Type().IsRegular() {
+			return logit(&os.PathError{Op: "CopyFS", Path: path, Err: fs.ErrInvalid})
+		}
+
+		r, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer r.Close()
+
+		info, err := r.Stat()
+		if err != nil {
+			return err
+		}
+
+		w, err := o.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666|info.Mode()&0o111)
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(w, r); err != nil {
+			w.Close()
+			return logit(&os.PathError{Op: "CopyFS", Path: target, Err: err})
+		}
+
+		return w.Close()
+	})
+}
+
+func copyFile(srcOS OS, src string, info fs.FileInfo, dstOS OS, dst string, opts CopyOptions) error {
+	r, err := srcOS.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !opts.Overwrite {
+		flag |= os.O_EXCL
+	}
+
+	// With the mode preserved, the file is only accessible by its owner until it is complete
+	perm := os.FileMode(0o666)
+	if opts.Preserve&PreserveMode > 0 {
+		perm = 0o600
+	}
+
+	w, err := dstOS.OpenFile(dst, flag, perm)
+	if err != nil {
+		return err
+	}
+
+	if err = copyData(w, r, info); err != nil {
+		w.Close()
+		return logit(&os.PathError{Op: "copy", Path: dst, Err: err})
+	}
+
+	if err = copyAttrs(srcOS, src, info, dstOS, dst, &copyFiles{r, w}, opts); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// copyData copies the contents of r to w, within the kernel if possible.
+func copyData(w, r File, info fs.FileInfo) error {
+	if ok, err := copyKernel(w, r, info); ok || err != nil {
+		return err
+	}
+
+	_, err := io.Copy(w, r)
+
+	return err
+}
+
+func copyMkdir(dstOS OS, dst string, opts CopyOptions) error {
+	perm := os.FileMode(0o777)
+	if opts.Preserve&PreserveMode > 0 {
+		perm = 0o700
+	}
+
+	err := dstOS.Mkdir(dst, perm)
+	if opts.Overwrite && errors.Is(err, fs.ErrExist) {
+		if info, serr := dstOS.Stat(dst); serr == nil && info.IsDir() {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func copySymlink(srcOS OS, src string, dstOS OS, dst string, opts CopyOptions) error {
+	target, err := srcOS.Readlink(src)
+	if err != nil {
+		return err
+	}
+
+	err = dstOS.Symlink(target, dst)
+	if opts.Overwrite && errors.Is(err, fs.ErrExist) {
+		if err = dstOS.Remove(dst); err == nil {
+			err = dstOS.Symlink(target, dst)
+		}
+	}
+
+	return err
+}
+
+// copyFiles are the opened source and destination of a copy.
+type copyFiles struct {
+	r, w File
+}
+
+// copyAttrs copies the preserved attributes of src to dst. Attributes that the destination user
+// may not set are skipped. Extended attributes are copied through files, which are opened for
+// directories if files is nil.
+func copyAttrs(srcOS OS, src string, info fs.FileInfo, dstOS OS, dst string, files *copyFiles, opts CopyOptions) error {
+	if opts.Preserve&(PreserveACL|PreserveXattrs) > 0 {
+		if files == nil {
+			r, err := srcOS.Open(src)
+			if err != nil {
+				return err
+			}
+
+			defer r.Close()
+
+			w, err := dstOS.Open(dst)
+			if err != nil {
+				return err
+			}
+
+			defer w.Close()
+
+			files = &copyFiles{r, w}
+		}
+
+		if err := copyXattrs(files.w, files.r, srcOS.CurrentUser(), dstOS.CurrentUser(), opts.Preserve); err != nil {
+			return logit(&os.PathError{Op: "copy", Path: dst, Err: err})
+		}
+	}
+
+	if opts.Preserve&PreserveMode > 0 {
+		if err := dstOS.Chmod(dst, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+
+	if opts.Preserve&PreserveTimes > 0 {
+		if err := dstOS.Chtimes(dst, accessTime(info), info.ModTime()); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyChunk is the maximum length of a single copy_file_range call.
+const copyChunk = 1 << 30
+
+// aclXattrs are the extended attributes that hold the ACLs of a file.
+var aclXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// rawFile returns the os.File of a file whose writes are not tracked by a wrapper, such as a quota.
+func rawFile(f File) (*os.File, bool) {
+	switch f := f.(type) {
+	case osFile:
+		return f.File, true
+	case *file:
+		return f.File, true
+	default:
+		return nil, false
+	}
+}
+
+// copyKernel copies the contents of r to w with a reflink or copy_file_range, if both are
+// on the same file system. It reports whether the data was copied.
+func copyKernel(w, r File, info fs.FileInfo) (bool, error) {
+	wf, ok1 := rawFile(w)
+	rf, ok2 := rawFile(r)
+
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+
+	winfo, err := wf.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	src, ok1 := inodeOf(info)
+	dst, ok2 := inodeOf(winfo)
+
+	if !ok1 || !ok2 || src.dev != dst.dev {
+		return false, nil
+	}
+
+	if unix.IoctlFileClone(int(wf.Fd()), int(rf.Fd())) == nil {
+		return true, nil
+	}
+
+	var copied int64
+
+	for {
+		n, err := unix.CopyFileRange(int(rf.Fd()), nil, int(wf.Fd()), nil, copyChunk, 0)
+
+		switch {
+		case err == nil && n == 0:
+			return true, nil
+		case err == nil:
+			copied += int64(n)
+		case copied == 0 && (errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EOPNOTSUPP)):
+			// Not supported by the file system, copy in user space
+			return false, nil
+		default:
+			return true, err
+		}
+	}
+}
+
+// copyXattrs copies the preserved extended attributes from r to w. They are only read
+// in the namespaces that the source user may read, and only written if the destination
+// user owns w.
+func copyXattrs(w, r File, srcUser, dstUser User, preserve Preserve) error {
+	winfo, err := w.Stat()
+	if err != nil {
+		return err
+	}
+
+	if ino, ok := inodeOf(winfo); !ok || dstUser.UID != 0 && ino.uid != dstUser.UID {
+		return nil
+	}
+
+	names, err := listXattrs(int(r.Fd()))
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		isACL := name == aclXattrs[0] || name == aclXattrs[1]
+
+		switch {
+		case isACL && preserve&PreserveACL == 0:
+			continue
+		case !isACL && preserve&PreserveXattrs == 0:
+			continue
+		case !isACL && !strings.HasPrefix(name, "user.") && (srcUser.UID != 0 || dstUser.UID != 0):
+			continue
+		}
+
+		value, err := getXattr(int(r.Fd()), name)
+		if errors.Is(err, syscall.ENODATA) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err = unix.Fsetxattr(int(w.Fd()), name, value, 0); errors.Is(err, syscall.EOPNOTSUPP) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listXattrs(fd int) ([]string, error) {
+	size, err := unix.Flistxattr(fd, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+
+	if size, err = unix.Flistxattr(fd, buf); err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+
+	return names, nil
+}
+
+func getXattr(fd int, name string) ([]byte, error) {
+	size, err := unix.Fgetxattr(fd, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+
+	size, err = unix.Fgetxattr(fd, name, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:size], nil
+}
+
+// accessTime returns the access time of a file.
+func accessTime(info fs.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyBetweenUsers(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		reader := User{UID: 1000, GID: 1000}.OS()
+		writer := User{UID: 1001, GID: 1001}.OS()
+
+		src := filepath.Join(tree.Root, "src")
+		out := filepath.Join(tree.Root, "out")
+		dst := filepath.Join(out, "dst")
+
+		for dir, uid := range map[string]int{src: 1000, out: 1001} {
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chown(dir, uid, uid); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tree.AssertSuccess(reader.WriteFile(filepath.Join(src, "public"), []byte("hello"), 0o644))
+		tree.AssertSuccess(reader.WriteFile(filepath.Join(src, "private"), []byte("secret"), 0o600))
+
+		if err := unix.Setxattr(filepath.Join(src, "public"), "user.tag", []byte("x"), 0); errors.Is(err, syscall.EOPNOTSUPP) {
+			t.Skip("xattrs not supported")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		// The writer cannot read the private file, nor write outside its directory
+		tree.AssertDenied(CopyTree(writer, src, writer, filepath.Join(out, "denied"), CopyOptions{}))
+		tree.AssertDenied(Copy(reader, filepath.Join(src, "public"), writer, filepath.Join(tree.Root, "a", "f"), CopyOptions{}))
+
+		tree.AssertSuccess(writer.Mkdir(dst, 0o755))
+		tree.AssertSuccess(Copy(reader, filepath.Join(src, "private"), writer, filepath.Join(dst, "private"), CopyOptions{Preserve: PreserveAll}))
+		tree.AssertSuccess(Copy(reader, filepath.Join(src, "public"), writer, filepath.Join(dst, "public"), CopyOptions{Preserve: PreserveAll}))
+		tree.AssertOwnership(filepath.Join(dst, "private"), 1001, 1001)
+		tree.AssertContent(filepath.Join(dst, "private"), []byte("secret"))
+
+		buf := make([]byte, 8)
+
+		if n, err := unix.Getxattr(filepath.Join(dst, "public"), "user.tag", buf); err != nil || string(buf[:n]) != "x" {
+			t.Errorf("expected xattr to be copied, got %q: %v", buf[:n], err)
+		}
+
+		if info, err := os.Stat(filepath.Join(dst, "private")); err != nil || info.Mode() != 0o600 {
+			t.Errorf("expected mode 0600, got %v: %v", info, err)
+		}
+	})
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import (
+	"io/fs"
+	"time"
+)
+
+func copyKernel(w, r File, info fs.FileInfo) (bool, error) {
+	return false, nil
+}
+
+func copyXattrs(w, r File, srcUser, dstUser User, preserve Preserve) error {
+	return nil
+}
+
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,98 @@
+package useros
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestCopyTree(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	o := Default()
+
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "sub", "file"), []byte("hello"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("sub/file", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, name := range []string{filepath.Join(src, "sub", "file"), filepath.Join(src, "sub")} {
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CopyTree(o, src, o, dst, CopyOptions{Preserve: PreserveAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dst, "sub", "file")); err != nil || string(data) != "hello" {
+		t.Errorf("unexpected content %q: %v", data, err)
+	}
+
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "sub/file" {
+		t.Errorf("unexpected link %q: %v", target, err)
+	}
+
+	for name, mode := range map[string]fs.FileMode{"sub": fs.ModeDir | 0o750, "sub/file": 0o640} {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode() != mode || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: expected %v at %v, got %v at %v", name, mode, mtime, info.Mode(), info.ModTime())
+		}
+	}
+
+	if err := Copy(o, filepath.Join(src, "link"), o, filepath.Join(dst, "sub", "file"), CopyOptions{}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected existing file, got %v", err)
+	}
+
+	if err := CopyTree(o, src, o, dst, CopyOptions{Overwrite: true}); err != nil {
+		t.Error(err)
+	}
+
+	// Move within the same file system renames
+	if err := Move(o, dst, o, filepath.Join(dir, "moved"), CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "moved", "sub", "file")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCopyFS(t *testing.T) {
+	dir := t.TempDir()
+
+	fsys := fstest.MapFS{
+		"a/b/file": {Data: []byte("hello"), Mode: 0o755},
+		"c":        {Data: []byte("world"), Mode: 0o600},
+	}
+
+	if err := CopyFS(Default(), dir, fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "a", "b", "file")); err != nil || info.Mode()&0o100 == 0 {
+		t.Errorf("expected executable file, got %v: %v", info, err)
+	}
+
+	if err := CopyFS(Default(), dir, fsys); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected existing file, got %v", err)
+	}
+}
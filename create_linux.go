@@ -0,0 +1,298 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// New inodes are created by root, but must never be visible with the ownership of root.
+// Files are created unnamed with O_TMPFILE and linked into place once their owner, group
+// and mode are set on the descriptor. Directories and symlinks, and files on file systems
+// without O_TMPFILE, are prepared under a hidden temporary name and then renamed or linked
+// into place, without replacing an entry that appeared in the meantime. The default ACL of
+// the directory is inherited by the kernel on creation.
+
+// createFile creates the new file name in the directory with stat dir, and opens it with flag.
+func (u *user) createFile(name string, flag int, perm os.FileMode, dir os.FileInfo) (*os.File, error) {
+	dirfd, err := openParent(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer unix.Close(dirfd)
+
+	return u.createAt(dirfd, name, filepath.Base(name), flag, perm, dir)
+}
+
+// mkdirNew creates the new directory name in the directory with stat dir.
+func (u *user) mkdirNew(name string, perm os.FileMode, dir os.FileInfo) error {
+	dirfd, err := openParent(name)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	return u.mkdirAt(dirfd, name, filepath.Base(name), perm, dir)
+}
+
+// symlinkNew creates the new symlink newname to oldname in the directory with stat dir.
+func (u *user) symlinkNew(oldname, newname string, dir os.FileInfo) error {
+	dirfd, err := openParent(newname)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	return u.symlinkAt(dirfd, oldname, newname, filepath.Base(newname), dir)
+}
+
+func openParent(name string) (int, error) {
+	dir := filepath.Dir(name)
+
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+
+	return fd, nil
+}
+
+// createAt creates the new file name in dirfd, and opens it with flag. path is the name of the file.
+func (u *user) createAt(dirfd int, path, name string, flag int, perm os.FileMode, dir os.FileInfo) (*os.File, error) {
+	if err := existsAt(dirfd, path, name, "open"); err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Openat(dirfd, ".", unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, uint32(perm.Perm()))
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EISDIR) {
+		return u.createHiddenAt(dirfd, path, name, flag, perm, dir)
+	} else if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	tmp := os.NewFile(uintptr(fd), path)
+	defer tmp.Close()
+
+	if err = u.initNew(tmp, perm, dir); err != nil {
+		return nil, err
+	}
+
+	// Linking the magic link does not need CAP_DAC_READ_SEARCH, unlike AT_EMPTY_PATH
+	if err = unix.Linkat(unix.AT_FDCWD, fdPath(osFile{tmp}), dirfd, name, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return reopen(tmp, flag)
+}
+
+// createHiddenAt creates the new file name in dirfd under a hidden name, and links it into place.
+func (u *user) createHiddenAt(dirfd int, path, name string, flag int, perm os.FileMode, dir os.FileInfo) (*os.File, error) {
+	var fd int
+
+	tmp, err := hiddenAt(name, func(hidden string) (err error) {
+		fd, err = unix.Openat(dirfd, hidden, unix.O_RDWR|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+		return err
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	defer unix.Unlinkat(dirfd, tmp, 0) //nolint:errcheck
+
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+
+	if err = u.initNew(f, perm, dir); err != nil {
+		return nil, err
+	}
+
+	// Unlike rename, link never replaces an existing entry
+	if err = unix.Linkat(dirfd, tmp, dirfd, name, 0); err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return reopen(f, flag)
+}
+
+// initNew sets the owner, group and mode of a new file on its descriptor.
+func (u *user) initNew(f *os.File, perm os.FileMode, dir os.FileInfo) error {
+	if err := f.Chown(u.UID, u.gidForNewFiles(dir)); err != nil {
+		return err
+	}
+
+	if u.umask == nil {
+		return nil
+	}
+
+	return f.Chmod(perm &^ *u.umask)
+}
+
+// reopen opens a new file with the flags that were asked for, through the magic link of its descriptor.
+func reopen(f *os.File, flag int) (*os.File, error) {
+	fd, err := unix.Open(fdPath(osFile{f}), flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC|oNoFollow)|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: f.Name(), Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// mkdirAt creates the new directory name in dirfd. path is the name of the directory.
+func (u *user) mkdirAt(dirfd int, path, name string, perm os.FileMode, dir os.FileInfo) error {
+	if err := existsAt(dirfd, path, name, "mkdir"); err != nil {
+		return err
+	}
+
+	tmp, err := hiddenAt(name, func(hidden string) error {
+		return unix.Mkdirat(dirfd, hidden, uint32(perm.Perm()))
+	})
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	// The user can replace the temporary name, so change it on a descriptor
+	err = u.initNewAt(dirfd, tmp, unix.O_RDONLY|unix.O_DIRECTORY, func(fd int) error {
+		if u.umask == nil {
+			return nil
+		}
+
+		// Keep the set-group-ID bit inherited from the directory
+		mode := uint32(perm.Perm() &^ *u.umask)
+		if dir.Mode()&os.ModeSetgid != 0 {
+			mode |= unix.S_ISGID
+		}
+
+		return unix.Fchmod(fd, mode)
+	}, dir)
+	if err == nil {
+		err = renameNoReplace(dirfd, tmp, name)
+	}
+
+	if err != nil {
+		unix.Unlinkat(dirfd, tmp, unix.AT_REMOVEDIR) //nolint:errcheck
+
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// symlinkAt creates the new symlink name to oldname in dirfd. path is the name of the symlink.
+func (u *user) symlinkAt(dirfd int, oldname, path, name string, dir os.FileInfo) error {
+	if err := existsAt(dirfd, path, name, "symlink"); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: path, Err: syscall.EEXIST}
+	}
+
+	tmp, err := hiddenAt(name, func(hidden string) error {
+		return unix.Symlinkat(oldname, dirfd, hidden)
+	})
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: path, Err: err}
+	}
+
+	err = u.initNewAt(dirfd, tmp, unix.O_PATH, nil, dir)
+	if err == nil {
+		err = renameNoReplace(dirfd, tmp, name)
+	}
+
+	if err != nil {
+		unix.Unlinkat(dirfd, tmp, 0) //nolint:errcheck
+
+		return &os.LinkError{Op: "symlink", Old: oldname, New: path, Err: err}
+	}
+
+	return nil
+}
+
+// initNewAt sets the owner of the new entry tmp in dirfd and calls chmod, if not nil, on a
+// descriptor of it. The entry must still be the one created by this process.
+func (u *user) initNewAt(dirfd int, tmp string, flag int, chmod func(fd int) error, dir os.FileInfo) error {
+	fd, err := unix.Openat(dirfd, tmp, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+
+	if err = unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	if int(st.Uid) != os.Geteuid() || st.Mode&unix.S_IFMT != unix.S_IFDIR && st.Nlink != 1 {
+		return syscall.EEXIST
+	}
+
+	if err = unix.Fchownat(fd, "", u.UID, u.gidForNewFiles(dir), unix.AT_EMPTY_PATH); err != nil || chmod == nil {
+		return err
+	}
+
+	return chmod(fd)
+}
+
+// existsAt returns EEXIST if name exists in dirfd, so that nothing is created for it.
+func existsAt(dirfd int, path, name, op string) error {
+	var st unix.Stat_t
+
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		return &os.PathError{Op: op, Path: path, Err: syscall.EEXIST}
+	}
+
+	return nil
+}
+
+// hiddenCreated is called with each hidden name that is created.
+var hiddenCreated = func(string) {}
+
+// hiddenAt calls create with hidden temporary names for name until one does not exist yet,
+// and returns the name that was created.
+func hiddenAt(name string, create func(hidden string) error) (string, error) {
+	for try := 0; try < 10000; try++ {
+		hidden := "." + name + ".tmp" + strconv.FormatUint(uint64(rand.Uint32()), 36)
+
+		err := create(hidden)
+		if err == nil {
+			hiddenCreated(hidden)
+		}
+
+		if err != unix.EEXIST {
+			return hidden, err
+		}
+	}
+
+	return "", syscall.EEXIST
+}
+
+// renameNoReplace renames oldname to newname in dirfd, unless newname exists.
+func renameNoReplace(dirfd int, oldname, newname string) error {
+	err := unix.Renameat2(dirfd, oldname, dirfd, newname, unix.RENAME_NOREPLACE)
+	if err != unix.EINVAL && err != unix.ENOSYS {
+		return err
+	}
+
+	// Without RENAME_NOREPLACE, a link is created and the old name removed for files,
+	// while a directory can only be checked before it is renamed
+	if err = unix.Linkat(dirfd, oldname, dirfd, newname, 0); err == nil {
+		return unix.Unlinkat(dirfd, oldname, 0)
+	} else if err != unix.EPERM {
+		return err
+	}
+
+	if err = existsAt(dirfd, newname, newname, "rename"); err != nil {
+		return syscall.EEXIST
+	}
+
+	return unix.Renameat(dirfd, oldname, dirfd, newname)
+}
@@ -0,0 +1,168 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchDir returns a function that returns the inotify events in dir since the call.
+func watchDir(t *testing.T, dir string) func() map[string][]uint32 {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { unix.Close(fd) })
+
+	if _, err = unix.InotifyAddWatch(fd, dir, unix.IN_ALL_EVENTS&^(unix.IN_ACCESS|unix.IN_OPEN|unix.IN_CLOSE_NOWRITE)); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() map[string][]uint32 {
+		events := map[string][]uint32{}
+		buf := make([]byte, 64*1024)
+
+		for {
+			n, err := unix.Read(fd, buf)
+			if err != nil || n <= 0 {
+				return events
+			}
+
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				var e unix.InotifyEvent
+
+				binary.Read(bytes.NewReader(buf[off:off+unix.SizeofInotifyEvent]), binary.LittleEndian, &e) //nolint:errcheck
+
+				name := string(bytes.TrimRight(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+int(e.Len)], "\x00"))
+				events[name] = append(events[name], e.Mask)
+
+				off += unix.SizeofInotifyEvent + int(e.Len)
+			}
+		}
+	}
+}
+
+func TestCreateNoRootOwnedEntries(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		o := User{UID: 1000, GID: 1000}.OS()
+		dir := filepath.Join(tree.Root, "a")
+		events := watchDir(t, dir)
+
+		tree.AssertSuccess(o.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0o644))
+		tree.AssertSuccess(o.Mkdir(filepath.Join(dir, "sub"), 0o755))
+		tree.AssertSuccess(o.Symlink("f", filepath.Join(dir, "link")))
+
+		tree.AssertOwnership(filepath.Join(dir, "f"), 1000, 1000)
+		tree.AssertOwnership(filepath.Join(dir, "sub"), 1000, 1000)
+		tree.AssertOwnership(filepath.Join(dir, "link"), 1000, 1000)
+
+		// The final names appear with their ownership, no attributes change afterwards.
+		// Unnamed O_TMPFILE inodes are reported as #inode, temporary names are hidden.
+		for name, masks := range events() {
+			for _, mask := range masks {
+				if !strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "#") && mask&unix.IN_ATTRIB != 0 {
+					t.Errorf("%s: attributes changed after creation", name)
+				}
+			}
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				t.Errorf("temporary file %s left behind", e.Name())
+			}
+		}
+
+		// A denied creation creates nothing
+		if err = os.Mkdir(filepath.Join(tree.Root, "ro"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		events = watchDir(t, filepath.Join(tree.Root, "ro"))
+
+		_, err = o.OpenFile(filepath.Join(tree.Root, "ro", "f"), os.O_WRONLY|os.O_CREATE, 0o644)
+		tree.AssertDenied(err)
+		tree.AssertDenied(o.Mkdir(filepath.Join(tree.Root, "ro", "sub"), 0o755))
+		tree.AssertDenied(o.Symlink("f", filepath.Join(tree.Root, "ro", "link")))
+
+		if e := events(); len(e) > 0 {
+			t.Errorf("expected no events, got %v", e)
+		}
+
+		// Existing entries are not replaced
+		_, err = o.OpenFile(filepath.Join(dir, "f"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		tree.AssertError(err, os.ErrExist)
+		tree.AssertError(o.Mkdir(filepath.Join(dir, "f"), 0o755), os.ErrExist)
+		tree.AssertError(o.Symlink("x", filepath.Join(dir, "sub")), os.ErrExist)
+		tree.AssertContent(filepath.Join(dir, "f"), []byte("data"))
+	})
+}
+
+func TestCreateSwappedTemporary(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		o, err := NewOS(User{UID: 1000, GID: 1000}, WithUmask(0o022))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Join(tree.Root, "a")
+		target := filepath.Join(tree.Root, "secret")
+
+		if err = os.WriteFile(target, []byte("secret"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		defer func(f func(string)) { hiddenCreated = f }(hiddenCreated)
+
+		// Replace the temporary directory by a symlink, and the temporary symlink by a hardlink
+		hiddenCreated = func(hidden string) {
+			name := filepath.Join(dir, hidden)
+
+			if err := os.Rename(name, name+".moved"); err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.HasPrefix(hidden, ".sub.") {
+				err = os.Symlink(target, name)
+			} else {
+				err = os.Link(target, name)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = o.Mkdir(filepath.Join(dir, "sub"), 0o777); err == nil {
+			t.Error("expected mkdir to fail")
+		}
+
+		if err = o.Symlink("f", filepath.Join(dir, "link")); err == nil {
+			t.Error("expected symlink to fail")
+		}
+
+		tree.AssertOwnership(target, 0, 0)
+
+		fi, err := os.Stat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != 0o600 {
+			t.Errorf("expected mode 0600, got %v", fi.Mode())
+		}
+	})
+}
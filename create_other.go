@@ -0,0 +1,71 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import (
+	"os"
+)
+
+// createFile creates the new file name in the directory with stat dir, and opens it with flag.
+func (u *user) createFile(name string, flag int, perm os.FileMode, dir os.FileInfo) (*os.File, error) {
+	f, err := os.OpenFile(name, flag|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = u.chownNewFile(name, u.gidForNewFiles(dir)); err == nil {
+		err = u.applyUmask(name, perm)
+	}
+
+	if err != nil {
+		os.Remove(name) //nolint:errcheck
+		f.Close()
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// mkdirNew creates the new directory name in the directory with stat dir.
+func (u *user) mkdirNew(name string, perm os.FileMode, dir os.FileInfo) error {
+	if err := os.Mkdir(name, perm); err != nil {
+		return err
+	}
+
+	if err := u.chownNewFile(name, u.gidForNewFiles(dir)); err != nil {
+		return err
+	}
+
+	return u.applyUmask(name, perm)
+}
+
+// symlinkNew creates the new symlink newname to oldname in the directory with stat dir.
+func (u *user) symlinkNew(oldname, newname string, dir os.FileInfo) error {
+	if err := os.Symlink(oldname, newname); err != nil {
+		return err
+	}
+
+	return u.chownNewFile(newname, u.gidForNewFiles(dir))
+}
+
+// applyUmask sets the permissions of a new file or directory according to the umask of the OS.
+// The set-group-ID bit that a directory inherits from its parent is kept.
+func (u *user) applyUmask(name string, perm os.FileMode) error {
+	if u.umask == nil {
+		return nil
+	}
+
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+
+	mode := perm &^ *u.umask
+	if fi.IsDir() {
+		mode |= fi.Mode() & os.ModeSetgid
+	}
+
+	return os.Chmod(name, mode)
+}
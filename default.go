@@ -15,6 +15,9 @@ func Default() OS {
 
 type def struct {
 	Before, After func()
+
+	// log receives the errors of the OS, if set.
+	log func(error)
 }
 
 func (d *def) CurrentUser() User {
@@ -30,121 +33,145 @@ func (d *def) CurrentUser() User {
 func (d *def) Chmod(name string, mode os.FileMode) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Chmod(name, mode)
+	return d.logit(os.Chmod(name, mode))
 }
 
 func (d *def) Chown(name string, uid, gid int) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Chown(name, uid, gid)
+	return d.logit(os.Chown(name, uid, gid))
 }
 
 func (d *def) Chtimes(name string, atime, mtime time.Time) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Chtimes(name, atime, mtime)
+	return d.logit(os.Chtimes(name, atime, mtime))
 }
 
 func (d *def) Lchown(name string, uid, gid int) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Lchown(name, uid, gid)
+	return d.logit(os.Lchown(name, uid, gid))
 }
 
 func (d *def) Mkdir(name string, perm os.FileMode) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Mkdir(name, perm)
+	return d.logit(os.Mkdir(name, perm))
 }
 
 func (d *def) MkdirAll(path string, perm os.FileMode) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.MkdirAll(path, perm)
+	return d.logit(os.MkdirAll(path, perm))
 }
 
 func (d *def) ReadFile(name string) ([]byte, error) {
 	d.wrap()
 	defer d.unwrap()
-	return os.ReadFile(name)
+
+	data, err := os.ReadFile(name)
+
+	return data, d.logit(err)
 }
 
 func (d *def) Readlink(name string) (string, error) {
 	d.wrap()
 	defer d.unwrap()
-	return os.Readlink(name)
+
+	target, err := os.Readlink(name)
+
+	return target, d.logit(err)
 }
 
 func (d *def) Remove(name string) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Remove(name)
+	return d.logit(os.Remove(name))
 }
 
 func (d *def) RemoveAll(path string) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.RemoveAll(path)
+	return d.logit(os.RemoveAll(path))
 }
 
 func (d *def) Rename(oldpath, newpath string) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Rename(oldpath, newpath)
+	return d.logit(os.Rename(oldpath, newpath))
 }
 
 func (d *def) Symlink(oldname, newname string) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Symlink(oldname, newname)
+	return d.logit(os.Symlink(oldname, newname))
 }
 
 func (d *def) Truncate(name string, size int64) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.Truncate(name, size)
+	return d.logit(os.Truncate(name, size))
 }
 
 func (d *def) WriteFile(name string, data []byte, perm os.FileMode) error {
 	d.wrap()
 	defer d.unwrap()
-	return os.WriteFile(name, data, perm)
+	return d.logit(os.WriteFile(name, data, perm))
 }
 
 func (d *def) Stat(name string) (os.FileInfo, error) {
 	d.wrap()
 	defer d.unwrap()
-	return os.Stat(name)
+
+	s, err := os.Stat(name)
+
+	return s, d.logit(err)
 }
 
 func (d *def) Lstat(name string) (os.FileInfo, error) {
 	d.wrap()
 	defer d.unwrap()
-	return os.Lstat(name)
+
+	s, err := os.Lstat(name)
+
+	return s, d.logit(err)
 }
 
 func (d *def) Create(name string) (File, error) {
 	d.wrap()
 	defer d.unwrap()
-	return os.Create(name)
+
+	f, err := newOSFile(os.Create(name))
+
+	return f, d.logit(err)
 }
 
 func (d *def) Open(name string) (File, error) {
 	d.wrap()
 	defer d.unwrap()
-	return os.Open(name)
+
+	f, err := newOSFile(os.Open(name))
+
+	return f, d.logit(err)
 }
 
 func (d *def) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
 	d.wrap()
 	defer d.unwrap()
-	return os.OpenFile(name, flag, perm)
+
+	f, err := newOSFile(os.OpenFile(name, flag, perm))
+
+	return f, d.logit(err)
 }
 
 func (d *def) ReadDir(name string) ([]os.DirEntry, error) {
 	d.wrap()
 	defer d.unwrap()
-	return os.ReadDir(name)
+
+	entries, err := os.ReadDir(name)
+
+	return entries, d.logit(err)
 }
 
 func (d *def) EvalSymlinks(name string) (string, error) {
@@ -153,16 +180,27 @@ func (d *def) EvalSymlinks(name string) (string, error) {
 
 	abs, err := filepath.Abs(name)
 	if err != nil {
-		return "", err
+		return "", d.logit(err)
 	}
 
-	return filepath.EvalSymlinks(abs)
+	resolved, err := filepath.EvalSymlinks(abs)
+
+	return resolved, d.logit(err)
 }
 
 func (d *def) Walk(name string, walkFn filepath.WalkFunc) error {
 	d.wrap()
 	defer d.unwrap()
-	return filepath.Walk(name, walkFn)
+	return d.logit(filepath.Walk(name, walkFn))
+}
+
+// logit logs to the logger of the OS. Unlike the OS of a user, it does not fall back to LogHandler.
+func (d *def) logit(err error) error {
+	if d.log == nil {
+		return err
+	}
+
+	return logTo(d.log, err)
 }
 
 func (d *def) wrap() {
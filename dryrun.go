@@ -0,0 +1,1396 @@
+package useros
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PlanStep is a call on a DryRun with its predicted outcome.
+type PlanStep struct {
+	Op   string
+	Path string
+
+	// Target is the new path of a rename, or the target of a symlink.
+	Target string
+
+	// Err is the predicted error, or nil if the step would succeed.
+	Err error
+}
+
+// DryRun is an OS that performs the permission checks of the OS of a user, without changing
+// anything. The effects of the steps that would succeed are simulated, so that later steps
+// see them: a planned Mkdir makes creates inside it valid, and a planned Remove makes the file
+// disappear. Files that are opened for writing discard the data written to them. Plan returns
+// every call in order, with its predicted outcome.
+type DryRun struct {
+	u *user
+
+	mu sync.Mutex
+
+	// nodes are the files changed by the plan, by absolute path. Removed files are nil.
+	nodes map[string]*dryNode
+	plan  []PlanStep
+}
+
+// dryNode is a file as seen by the plan.
+type dryNode struct {
+	info os.FileInfo
+
+	// origin is the path of the real file that backs the node, and real its stat.
+	// Both are empty for files created by the plan.
+	origin string
+	real   os.FileInfo
+
+	// target is the target of a symlink created by the plan.
+	target string
+
+	// data is the content of a file written by the plan, if written is set.
+	data    []byte
+	written bool
+}
+
+// dryInfo are the attributes of a file changed by the plan.
+type dryInfo struct {
+	name     string
+	size     int64
+	mode     os.FileMode
+	modTime  time.Time
+	uid, gid int
+}
+
+func (i *dryInfo) Name() string       { return i.name }
+func (i *dryInfo) Size() int64        { return i.size }
+func (i *dryInfo) Mode() os.FileMode  { return i.mode }
+func (i *dryInfo) ModTime() time.Time { return i.modTime }
+func (i *dryInfo) IsDir() bool        { return i.mode.IsDir() }
+
+// NewDryRun returns a DryRun for the user, with the umask, authorizer and cache of the options.
+func NewDryRun(u User, options ...Option) *DryRun {
+	c := &config{}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return &DryRun{u: u.dryUser(c), nodes: map[string]*dryNode{}}
+}
+
+// Plan returns the steps so far.
+func (d *DryRun) Plan() []PlanStep {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]PlanStep(nil), d.plan...)
+}
+
+// do performs a step of the plan.
+func (d *DryRun) do(op, path, target string, fn func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := fn()
+	d.plan = append(d.plan, PlanStep{Op: op, Path: path, Target: target, Err: err})
+
+	return err
+}
+
+// lookup returns the node of an absolute path without following symlinks.
+func (d *DryRun) lookup(path string) (*dryNode, error) {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if n, ok := d.nodes[dir]; ok {
+			switch {
+			case dir == path && n != nil:
+				return n, nil
+			case n == nil || n.origin == "" || !n.info.IsDir():
+				return nil, &os.PathError{Op: "lstat", Path: path, Err: syscall.ENOENT}
+			}
+
+			// Below a directory of the plan, the real files are found at its origin
+			return d.realNode(filepath.Join(n.origin, strings.TrimPrefix(path, dir)), path)
+		}
+
+		if dir == filepath.Dir(dir) {
+			return d.realNode(path, path)
+		}
+	}
+}
+
+func (d *DryRun) realNode(origin, path string) (*dryNode, error) {
+	fi, err := os.Lstat(origin)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+
+	n := &dryNode{info: fi, origin: origin, real: fi}
+
+	if fi.Name() != filepath.Base(path) {
+		n.info = copyInfo(fi, filepath.Base(path))
+	}
+
+	return n, nil
+}
+
+func copyInfo(fi os.FileInfo, name string) *dryInfo {
+	i := &dryInfo{name: name, size: fi.Size(), mode: fi.Mode(), modTime: fi.ModTime()}
+
+	if ino, ok := inodeOf(fi); ok {
+		i.uid, i.gid = ino.uid, ino.gid
+	}
+
+	return i
+}
+
+// change replaces the node of path by a copy whose attributes are changed by fn.
+func (d *DryRun) change(path string, n *dryNode, fn func(i *dryInfo)) *dryNode {
+	c := *n
+	i := copyInfo(n.info, filepath.Base(path))
+	fn(i)
+	c.info = i
+	d.nodes[path] = &c
+
+	return &c
+}
+
+// create adds a new file of the user to the directory dir.
+func (d *DryRun) create(path string, dir *dryNode, mode os.FileMode, perm os.FileMode) *dryNode {
+	perm &= os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	if d.u.umask != nil && mode&os.ModeSymlink == 0 {
+		perm &^= *d.u.umask
+	}
+
+	// Directories inherit the set-group-ID bit
+	if mode.IsDir() && dir.info.Mode()&os.ModeSetgid != 0 {
+		perm |= os.ModeSetgid
+	}
+
+	n := &dryNode{
+		info: &dryInfo{
+			name:    filepath.Base(path),
+			mode:    mode | perm,
+			modTime: time.Now(),
+			uid:     d.u.UID,
+			gid:     d.u.gidForNewFiles(dir.info),
+		},
+		written: true,
+	}
+
+	d.nodes[path] = n
+
+	return n
+}
+
+// drop removes path and everything below it from the plan.
+func (d *DryRun) drop(path string) {
+	for p := range d.nodes {
+		if strings.HasPrefix(p, path+string(os.PathSeparator)) {
+			delete(d.nodes, p)
+		}
+	}
+
+	d.nodes[path] = nil
+}
+
+// children returns the names in the directory path, sorted.
+func (d *DryRun) children(path string, n *dryNode) ([]string, error) {
+	seen := map[string]struct{}{}
+
+	if n.origin != "" {
+		names, err := readDirNames(n.origin)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			seen[name] = struct{}{}
+		}
+	}
+
+	for p := range d.nodes {
+		if filepath.Dir(p) == path && p != path {
+			seen[filepath.Base(p)] = struct{}{}
+		}
+	}
+
+	var names []string
+
+	for name := range seen {
+		if _, err := d.lookup(filepath.Join(path, name)); err == nil {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return f.Readdirnames(-1)
+}
+
+// readlink returns the target of a symlink node.
+func (n *dryNode) readlink() (string, error) {
+	if n.origin == "" {
+		return n.target, nil
+	}
+
+	return os.Readlink(n.origin)
+}
+
+// resolve resolves name as the kernel would in the plan, and returns the searched directories,
+// the resolved path and its node. The node is nil if only the last component does not exist.
+func (d *DryRun) resolve(name string, follow bool) ([]string, string, *dryNode, error) {
+	if name == "" {
+		return nil, "", nil, &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOENT}
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	var (
+		dirs  []string
+		cur   = string(os.PathSeparator)
+		rest  = split(abs)
+		links = 0
+	)
+
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+
+		next := filepath.Join(cur, c)
+		last := !hasComponents(rest)
+
+		if len(dirs) == 0 || dirs[len(dirs)-1] != cur {
+			dirs = append(dirs, cur)
+		}
+
+		n, err := d.lookup(next)
+		if os.IsNotExist(err) && last {
+			return dirs, next, nil, nil
+		} else if err != nil {
+			return dirs, next, nil, err
+		}
+
+		if n.info.Mode()&os.ModeSymlink != 0 && (!last || follow) {
+			if links++; links > MaxSymlinks {
+				return dirs, next, nil, &os.PathError{Op: "lstat", Path: name, Err: syscall.ELOOP}
+			}
+
+			target, err := n.readlink()
+			if err != nil {
+				return dirs, next, nil, err
+			}
+
+			if filepath.IsAbs(target) {
+				cur = string(os.PathSeparator)
+			}
+
+			rest = append(split(target), rest...)
+
+			continue
+		}
+
+		if !last && !n.info.IsDir() {
+			return dirs, next, nil, &os.PathError{Op: "lstat", Path: next, Err: syscall.ENOTDIR}
+		}
+
+		cur = next
+	}
+
+	n, err := d.lookup(cur)
+
+	return dirs, cur, n, err
+}
+
+func hasComponents(rest []string) bool {
+	for _, c := range rest {
+		if c != "" && c != "." {
+			return true
+		}
+	}
+
+	return false
+}
+
+// entry resolves name and checks that the user can search its directories.
+func (d *DryRun) entry(name string, follow bool, op Op) (string, *dryNode, error) {
+	dirs, path, n, err := d.resolve(name, follow)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, dir := range dirs {
+		dn, err := d.lookup(dir)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if err = d.check(dir, dn, Execute, op, true); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return path, n, nil
+}
+
+// existing is entry for a file that must exist.
+func (d *DryRun) existing(name string, follow bool, op Op) (string, *dryNode, error) {
+	path, n, err := d.entry(name, follow, op)
+	if err == nil && n == nil {
+		err = &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOENT}
+	}
+
+	return path, n, err
+}
+
+// checkDir checks a permission of the user on the directory of path, and returns the directory.
+func (d *DryRun) checkDir(path string, perm Permission, op Op) (*dryNode, error) {
+	dir := filepath.Dir(path)
+
+	n, err := d.lookup(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return n, d.check(dir, n, perm, op, false)
+}
+
+// owns checks whether the user owns a node.
+func (d *DryRun) owns(n *dryNode) error {
+	if ino, ok := inodeOf(n.info); ok && d.u.UID != 0 && ino.uid != d.u.UID {
+		return os.ErrPermission
+	}
+
+	return nil
+}
+
+func (d *DryRun) CurrentUser() User {
+	return d.u.User
+}
+
+func (d *DryRun) Chmod(name string, mode os.FileMode) error {
+	return d.do("chmod", name, "", func() error { return d.chmod(name, mode) })
+}
+
+func (d *DryRun) chmod(name string, mode os.FileMode) error {
+	path, n, err := d.existing(name, true, OpChmod)
+	if err != nil {
+		return err
+	}
+
+	if err = d.owns(n); err != nil {
+		return err
+	}
+
+	d.change(path, n, func(i *dryInfo) {
+		i.mode = i.mode&os.ModeType | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	})
+
+	return nil
+}
+
+func (d *DryRun) Chown(name string, uid, gid int) error {
+	return d.do("chown", name, "", func() error { return d.chown(name, uid, gid, true) })
+}
+
+func (d *DryRun) Lchown(name string, uid, gid int) error {
+	return d.do("lchown", name, "", func() error { return d.chown(name, uid, gid, false) })
+}
+
+func (d *DryRun) chown(name string, uid, gid int, follow bool) error {
+	path, n, err := d.existing(name, follow, OpChown)
+	if err != nil {
+		return err
+	}
+
+	if err = d.owns(n); err != nil {
+		return err
+	}
+
+	if err = d.u.checkChown(uid, gid); err != nil {
+		return err
+	}
+
+	d.change(path, n, func(i *dryInfo) {
+		if uid >= 0 {
+			i.uid = uid
+		}
+
+		if gid >= 0 {
+			i.gid = gid
+		}
+	})
+
+	return nil
+}
+
+func (d *DryRun) Chtimes(name string, atime, mtime time.Time) error {
+	return d.do("chtimes", name, "", func() error {
+		path, n, err := d.existing(name, true, OpChtimes)
+		if err != nil {
+			return err
+		}
+
+		if err = d.check(path, n, Write, OpChtimes, false); err != nil {
+			return err
+		}
+
+		d.change(path, n, func(i *dryInfo) { i.modTime = mtime })
+
+		return nil
+	})
+}
+
+func (d *DryRun) Mkdir(name string, perm os.FileMode) error {
+	return d.do("mkdir", name, "", func() error { return d.mkdir(name, perm) })
+}
+
+func (d *DryRun) mkdir(name string, perm os.FileMode) error {
+	path, n, err := d.entry(name, false, OpCreate)
+	if err != nil {
+		return err
+	}
+
+	if n != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EEXIST}
+	}
+
+	dir, err := d.checkDir(path, Write, OpCreate)
+	if err != nil {
+		return err
+	}
+
+	d.create(path, dir, os.ModeDir, perm)
+
+	return nil
+}
+
+func (d *DryRun) MkdirAll(path string, perm os.FileMode) error {
+	return d.do("mkdirall", path, "", func() error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		var missing []string
+
+		for dir := abs; ; dir = filepath.Dir(dir) {
+			_, _, n, err := d.resolve(dir, true)
+			if err == nil && n != nil {
+				if !n.info.IsDir() {
+					return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+				}
+
+				break
+			}
+
+			missing = append(missing, dir)
+
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+
+		for i := len(missing) - 1; i >= 0; i-- {
+			if err := d.mkdir(missing[i], perm); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (d *DryRun) ReadFile(name string) ([]byte, error) {
+	var data []byte
+
+	err := d.do("readfile", name, "", func() error {
+		_, n, err := d.open(name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+
+		data, err = n.content()
+
+		return err
+	})
+
+	return data, err
+}
+
+// content returns the content of a regular file node.
+func (n *dryNode) content() ([]byte, error) {
+	if n.written {
+		return append([]byte(nil), n.data...), nil
+	}
+
+	return os.ReadFile(n.origin)
+}
+
+func (d *DryRun) Readlink(name string) (string, error) {
+	var target string
+
+	err := d.do("readlink", name, "", func() error {
+		_, n, err := d.existing(name, false, OpRead)
+		if err != nil {
+			return err
+		}
+
+		if n.info.Mode()&os.ModeSymlink == 0 {
+			return &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+		}
+
+		target, err = n.readlink()
+
+		return err
+	})
+
+	return target, err
+}
+
+func (d *DryRun) Remove(name string) error {
+	return d.do("remove", name, "", func() error {
+		path, n, err := d.existing(name, false, OpDelete)
+		if err != nil {
+			return err
+		}
+
+		dir, err := d.checkDir(path, Write, OpDelete)
+		if err != nil {
+			return err
+		}
+
+		if dir.info.Mode()&os.ModeSticky > 0 {
+			if err = d.owns(n); err != nil {
+				return err
+			}
+		}
+
+		if n.info.IsDir() {
+			if names, err := d.children(path, n); err != nil {
+				return err
+			} else if len(names) > 0 {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+
+		d.drop(path)
+
+		return nil
+	})
+}
+
+func (d *DryRun) RemoveAll(path string) error {
+	return d.do("removeall", path, "", func() error {
+		if path == "" {
+			return nil
+		}
+
+		if endsWithDot(path) {
+			return &os.PathError{Op: "RemoveAll", Path: path, Err: syscall.EINVAL}
+		}
+
+		p, n, err := d.entry(path, false, OpDelete)
+		if err != nil || n == nil {
+			return err
+		}
+
+		return d.removeAll(p, n)
+	})
+}
+
+// removeAll removes a tree like rm -rf: the contents of a directory are removed even if
+// the directory itself cannot be removed, which needs permission to list and search it.
+func (d *DryRun) removeAll(path string, n *dryNode) error {
+	dir, denied := d.checkDir(path, Write, OpDelete)
+	if denied == nil && dir.info.Mode()&os.ModeSticky > 0 {
+		denied = d.owns(n)
+	}
+
+	if n.info.IsDir() {
+		names, err := d.children(path, n)
+		if err != nil {
+			return err
+		}
+
+		if len(names) > 0 {
+			if err = d.check(path, n, Read, OpList, false); err == nil {
+				err = d.check(path, n, Execute, OpDelete, true)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, name := range names {
+			child, err1 := d.lookup(filepath.Join(path, name))
+			if err1 == nil {
+				err1 = d.removeAll(filepath.Join(path, name), child)
+			}
+
+			if err == nil {
+				err = err1
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if denied != nil {
+		return denied
+	}
+
+	d.drop(path)
+
+	return nil
+}
+
+func (d *DryRun) Rename(oldpath, newpath string) error {
+	return d.do("rename", oldpath, newpath, func() error {
+		op, n, err := d.existing(oldpath, false, OpDelete)
+		if err != nil {
+			return err
+		}
+
+		np, replaced, err := d.entry(newpath, false, OpCreate)
+		if err != nil {
+			return err
+		}
+
+		if _, err = d.checkDir(op, Write, OpDelete); err != nil {
+			return err
+		}
+
+		if _, err = d.checkDir(np, Write, OpCreate); err != nil {
+			return err
+		}
+
+		switch {
+		case op == np:
+			return nil
+		case strings.HasPrefix(np, op+string(os.PathSeparator)):
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EINVAL}
+		case replaced == nil:
+		case n.info.IsDir() && !replaced.info.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTDIR}
+		case !n.info.IsDir() && replaced.info.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EISDIR}
+		case replaced.info.IsDir():
+			if names, err := d.children(np, replaced); err != nil {
+				return err
+			} else if len(names) > 0 {
+				return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTEMPTY}
+			}
+		}
+
+		d.move(op, np, n)
+
+		return nil
+	})
+}
+
+// move moves the node n at oldpath, and the changes below it, to newpath.
+func (d *DryRun) move(oldpath, newpath string, n *dryNode) {
+	moved := map[string]*dryNode{}
+
+	for p, c := range d.nodes {
+		if strings.HasPrefix(p, oldpath+string(os.PathSeparator)) {
+			moved[newpath+strings.TrimPrefix(p, oldpath)] = c
+		}
+	}
+
+	d.drop(oldpath)
+	d.drop(newpath)
+
+	for p, c := range moved {
+		d.nodes[p] = c
+	}
+
+	c := *n
+	c.info = copyInfo(n.info, filepath.Base(newpath))
+	d.nodes[newpath] = &c
+}
+
+func (d *DryRun) Symlink(oldname, newname string) error {
+	return d.do("symlink", newname, oldname, func() error {
+		path, n, err := d.entry(newname, false, OpCreate)
+		if err != nil {
+			return err
+		}
+
+		if n != nil {
+			return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EEXIST}
+		}
+
+		dir, err := d.checkDir(path, Write, OpCreate)
+		if err != nil {
+			return err
+		}
+
+		d.create(path, dir, os.ModeSymlink, os.ModePerm).target = oldname
+
+		return nil
+	})
+}
+
+func (d *DryRun) Truncate(name string, size int64) error {
+	return d.do("truncate", name, "", func() error {
+		path, n, err := d.existing(name, true, OpWrite)
+		if err != nil {
+			return err
+		}
+
+		if n.info.IsDir() {
+			return &os.PathError{Op: "truncate", Path: name, Err: syscall.EISDIR}
+		}
+
+		if err = d.check(path, n, Write, OpWrite, false); err != nil {
+			return err
+		}
+
+		d.resize(path, n, size)
+
+		return nil
+	})
+}
+
+// resize changes the size of a file, its content is only known if it was written by the plan.
+func (d *DryRun) resize(path string, n *dryNode, size int64) {
+	c := d.change(path, n, func(i *dryInfo) { i.size = size })
+
+	if !c.written && size == 0 {
+		c.data, c.written = nil, true
+	}
+
+	if c.written && int64(len(c.data)) >= size {
+		c.data = c.data[:size]
+	} else if c.written {
+		c.data = append(c.data, make([]byte, size-int64(len(c.data)))...)
+	}
+}
+
+func (d *DryRun) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return d.do("writefile", name, "", func() error {
+		path, n, err := d.open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+
+		c := d.change(path, n, func(i *dryInfo) { i.size = int64(len(data)) })
+		c.data, c.written = append([]byte(nil), data...), true
+
+		return nil
+	})
+}
+
+func (d *DryRun) Stat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+
+	err := d.do("stat", name, "", func() (err error) {
+		fi, err = d.stat(name, true)
+		return err
+	})
+
+	return fi, err
+}
+
+func (d *DryRun) Lstat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+
+	err := d.do("lstat", name, "", func() (err error) {
+		fi, err = d.stat(name, false)
+		return err
+	})
+
+	return fi, err
+}
+
+func (d *DryRun) stat(name string, follow bool) (os.FileInfo, error) {
+	_, n, err := d.existing(name, follow, OpStat)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.info, nil
+}
+
+func (d *DryRun) Create(name string) (File, error) {
+	return d.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (d *DryRun) Open(name string) (File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (d *DryRun) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	var f File
+
+	err := d.do("open", name, "", func() error {
+		path, n, err := d.open(name, flag, perm)
+		if err != nil {
+			return err
+		}
+
+		f, err = d.newFile(name, path, n, flag)
+
+		return err
+	})
+
+	return f, err
+}
+
+// open checks the permissions to open a file like OpenFile, and simulates its creation or truncation.
+func (d *DryRun) open(name string, flag int, perm os.FileMode) (string, *dryNode, error) {
+	if flag&oDirectory != 0 && flag&os.O_CREATE != 0 {
+		return "", nil, &os.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+
+	excl := flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL
+
+	path, n, err := d.entry(name, !excl && flag&oNoFollow == 0, openOp(flag))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if n == nil {
+		if flag&os.O_CREATE == 0 {
+			return "", nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+		}
+
+		dir, err := d.checkDir(path, Write, OpCreate)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return path, d.create(path, dir, 0, perm), nil
+	}
+
+	mode := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+
+	switch {
+	case excl:
+		return "", nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+	case n.info.Mode()&os.ModeSymlink != 0:
+		return "", nil, &os.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
+	case flag&oDirectory != 0 && !n.info.IsDir():
+		return "", nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOTDIR}
+	case n.info.IsDir() && (mode != os.O_RDONLY || flag&os.O_TRUNC != 0):
+		return "", nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+
+	if mode != os.O_WRONLY {
+		if err = d.check(path, n, Read, OpRead, false); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if mode != os.O_RDONLY || flag&os.O_TRUNC != 0 {
+		if err = d.check(path, n, Write, OpWrite, false); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if flag&oNoAtime != 0 && d.owns(n) != nil {
+		return "", nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	}
+
+	if flag&os.O_TRUNC != 0 && n.info.Mode().IsRegular() {
+		d.resize(path, n, 0)
+		n = d.nodes[path]
+	}
+
+	return path, n, nil
+}
+
+func (d *DryRun) ReadDir(name string) ([]os.DirEntry, error) {
+	var entries []os.DirEntry
+
+	err := d.do("readdir", name, "", func() error {
+		path, n, err := d.open(name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+
+		entries, err = d.readDir(path, n)
+
+		return err
+	})
+
+	return entries, err
+}
+
+// readDir lists a directory node, which needs search permission.
+func (d *DryRun) readDir(path string, n *dryNode) ([]os.DirEntry, error) {
+	if !n.info.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	if err := d.check(path, n, Execute, OpList, true); err != nil {
+		return nil, err
+	}
+
+	names, err := d.children(path, n)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]os.DirEntry, 0, len(names))
+
+	for _, name := range names {
+		if c, err := d.lookup(filepath.Join(path, name)); err == nil {
+			entries = append(entries, fs.FileInfoToDirEntry(c.info))
+		}
+	}
+
+	return entries, nil
+}
+
+func (d *DryRun) EvalSymlinks(name string) (string, error) {
+	var path string
+
+	err := d.do("evalsymlinks", name, "", func() (err error) {
+		path, _, err = d.existing(name, true, OpStat)
+		return err
+	})
+
+	return path, err
+}
+
+// Walk walks the tree as it would be after the plan so far, like filepath.Walk.
+// The steps of the walk itself are not added to the plan.
+func (d *DryRun) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := d.locked(func() (os.FileInfo, error) { return d.stat(root, false) })
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = d.walk(root, info, walkFn)
+	}
+
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		err = nil
+	}
+
+	d.mu.Lock()
+	d.plan = append(d.plan, PlanStep{Op: "walk", Path: root, Err: err})
+	d.mu.Unlock()
+
+	return err
+}
+
+func (d *DryRun) locked(fn func() (os.FileInfo, error)) (os.FileInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return fn()
+}
+
+func (d *DryRun) walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+
+	d.mu.Lock()
+
+	var entries []os.DirEntry
+
+	p, n, err := d.open(path, os.O_RDONLY, 0)
+	if err == nil {
+		entries, err = d.readDir(p, n)
+	}
+
+	d.mu.Unlock()
+
+	err1 := walkFn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, e := range entries {
+		filename := filepath.Join(path, e.Name())
+
+		fileInfo, err := d.locked(func() (os.FileInfo, error) { return d.stat(filename, false) })
+		if err != nil {
+			if err := walkFn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+		} else {
+			err = d.walk(filename, fileInfo, walkFn)
+			if err != nil {
+				if !fileInfo.IsDir() || err != filepath.SkipDir {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// dryFile is a file opened by a DryRun. Reads are served by the real file if it is unchanged
+// by the plan, writes are discarded, and changes are simulated in the plan.
+type dryFile struct {
+	File
+	d    *DryRun
+	name string
+	path string
+	flag int
+
+	// offset is the offset of sequential reads and writes, the descriptor of the
+	// backing file is only read at an offset.
+	offset int64
+	listed bool
+}
+
+func (d *DryRun) newFile(name, path string, n *dryNode, flag int) (File, error) {
+	src := os.DevNull
+	if !n.written && n.origin != "" && flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		src = n.origin
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dryFile{File: osFile{f}, d: d, name: name, path: path, flag: flag}, nil
+}
+
+func (f *dryFile) Name() string {
+	return f.name
+}
+
+func (f *dryFile) Stat() (os.FileInfo, error) {
+	return f.d.locked(func() (os.FileInfo, error) {
+		n, err := f.d.lookup(f.path)
+		if err != nil {
+			return nil, err
+		}
+
+		return n.info, nil
+	})
+}
+
+// grow records that size bytes would be written at off.
+func (f *dryFile) grow(off int64, size int) (int, error) {
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	n, err := f.d.lookup(f.path)
+	if err != nil {
+		return 0, err
+	}
+
+	if end := off + int64(size); end > n.info.Size() {
+		f.d.change(f.path, n, func(i *dryInfo) { i.size = end }).written = false
+	}
+
+	return size, nil
+}
+
+func (f *dryFile) Read(b []byte) (int, error) {
+	n, err := f.File.ReadAt(b, f.offset)
+	f.offset += int64(n)
+
+	// As for a read of the end of a file, a short read is not an error
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *dryFile) Write(b []byte) (int, error) {
+	n, err := f.grow(f.offset, len(b))
+	f.offset += int64(n)
+
+	return n, err
+}
+
+func (f *dryFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+
+		offset += fi.Size()
+	default:
+		offset = -1
+	}
+
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+// Sync has nothing to flush, the data written is discarded.
+func (f *dryFile) Sync() error {
+	return nil
+}
+
+func (f *dryFile) WriteAt(b []byte, off int64) (int, error) {
+	return f.grow(off, len(b))
+}
+
+func (f *dryFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *dryFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{f}, r)
+}
+
+func (f *dryFile) Truncate(size int64) error {
+	return f.d.do("ftruncate", f.name, "", func() error {
+		if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+			return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+		}
+
+		n, err := f.d.lookup(f.path)
+		if err != nil {
+			return err
+		}
+
+		f.d.resize(f.path, n, size)
+
+		return nil
+	})
+}
+
+func (f *dryFile) Chmod(mode os.FileMode) error {
+	return f.d.do("fchmod", f.name, "", func() error { return f.d.chmod(f.path, mode) })
+}
+
+func (f *dryFile) Chown(uid, gid int) error {
+	return f.d.do("fchown", f.name, "", func() error { return f.d.chown(f.path, uid, gid, false) })
+}
+
+func (f *dryFile) Chdir() error {
+	return f.d.do("fchdir", f.name, "", func() error {
+		n, err := f.d.lookup(f.path)
+		if err != nil {
+			return err
+		}
+
+		if !n.info.IsDir() {
+			return &os.PathError{Op: "chdir", Path: f.name, Err: syscall.ENOTDIR}
+		}
+
+		return f.d.check(f.path, n, Execute, OpList, true)
+	})
+}
+
+// The locks are only checked against the open mode, as by the OS of a user.
+// No lock is taken, so the locks of a plan never conflict.
+
+func (f *dryFile) lock(op string, exclusive, ranged bool) error {
+	return f.d.do(op, f.name, "", func() error {
+		mode := f.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+
+		if exclusive && mode == os.O_RDONLY || !exclusive && ranged && mode == os.O_WRONLY {
+			return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+		}
+
+		return nil
+	})
+}
+
+func (f *dryFile) Lock() error {
+	return f.lock("lock", true, false)
+}
+
+func (f *dryFile) RLock() error {
+	return f.lock("rlock", false, false)
+}
+
+func (f *dryFile) TryLock() (bool, error) {
+	err := f.lock("trylock", true, false)
+
+	return err == nil, err
+}
+
+func (f *dryFile) Unlock() error {
+	return f.d.do("unlock", f.name, "", func() error { return nil })
+}
+
+func (f *dryFile) LockRange(ctx context.Context, start, length int64, exclusive bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return f.lock("lockrange", exclusive, true)
+}
+
+func (f *dryFile) TryLockRange(start, length int64, exclusive bool) (bool, error) {
+	err := f.lock("trylockrange", exclusive, true)
+
+	return err == nil, err
+}
+
+func (f *dryFile) UnlockRange(start, length int64) error {
+	return f.d.do("unlockrange", f.name, "", func() error { return nil })
+}
+
+func (f *dryFile) ReadDir(count int) ([]os.DirEntry, error) {
+	if f.listed {
+		if count > 0 {
+			return nil, io.EOF
+		}
+
+		return nil, nil
+	}
+
+	f.d.mu.Lock()
+
+	var entries []os.DirEntry
+
+	n, err := f.d.lookup(f.path)
+	if err == nil {
+		entries, err = f.d.readDir(f.path, n)
+	}
+
+	f.d.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	f.listed = true
+
+	return entries, nil
+}
+
+func (f *dryFile) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := f.ReadDir(count)
+
+	infos := make([]os.FileInfo, 0, len(entries))
+
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil {
+			infos = append(infos, fi)
+		}
+	}
+
+	return infos, err
+}
+
+func (f *dryFile) Readdirnames(count int) ([]string, error) {
+	entries, err := f.ReadDir(count)
+
+	names := make([]string, 0, len(entries))
+
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	return names, err
+}
+
+func (f *dryFile) Openat(name string, flag int, perm os.FileMode) (File, error) {
+	var g File
+
+	err := f.d.do("openat", atPath(f, name), "", func() error {
+		if err := checkAtName("openat", name); err != nil {
+			return err
+		}
+
+		path, n, err := f.d.open(filepath.Join(f.path, name), flag|oNoFollow, perm)
+		if err != nil {
+			return err
+		}
+
+		g, err = f.d.newFile(atPath(f, name), path, n, flag)
+
+		return err
+	})
+
+	return g, err
+}
+
+func (f *dryFile) Mkdirat(name string, perm os.FileMode) error {
+	return f.d.do("mkdirat", atPath(f, name), "", func() error {
+		if err := checkAtName("mkdirat", name); err != nil {
+			return err
+		}
+
+		return f.d.mkdir(filepath.Join(f.path, name), perm)
+	})
+}
+
+func (f *dryFile) Unlinkat(name string) error {
+	if err := checkAtName("unlinkat", name); err != nil {
+		return err
+	}
+
+	return f.d.Remove(filepath.Join(f.path, name))
+}
+
+func (f *dryFile) Renameat(oldname string, newdir File, newname string) error {
+	if err := checkAtName("renameat", oldname); err != nil {
+		return err
+	}
+
+	if err := checkAtName("renameat", newname); err != nil {
+		return err
+	}
+
+	dir := newdir.Name()
+	if g, ok := newdir.(*dryFile); ok {
+		dir = g.path
+	}
+
+	return f.d.Rename(filepath.Join(f.path, oldname), filepath.Join(dir, newname))
+}
+
+func (f *dryFile) Statat(name string) (os.FileInfo, error) {
+	if err := checkAtName("statat", name); err != nil {
+		return nil, err
+	}
+
+	return f.d.Lstat(filepath.Join(f.path, name))
+}
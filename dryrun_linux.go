@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"syscall"
+
+	"github.com/joshlf/go-acl"
+)
+
+func (u User) dryUser(c *config) *user {
+	u, _ = u.withDefaults()
+
+	return &user{User: u, auth: c.auth, umask: c.umask, cache: c.cache}
+}
+
+func (i *dryInfo) Sys() interface{} {
+	return &syscall.Stat_t{Uid: uint32(i.uid), Gid: uint32(i.gid), Size: i.size}
+}
+
+// check checks a permission of the user on a node, with the ACL of its real file.
+func (d *DryRun) check(path string, n *dryNode, perm Permission, op Op, traverse bool) error {
+	if d.u.UID == 0 {
+		return nil
+	}
+
+	var (
+		a   acl.ACL
+		err error
+	)
+
+	if n.real != nil {
+		if a, err = d.u.getACL(n.origin, n.real); err != nil {
+			return err
+		}
+	}
+
+	return on(d.u.authorize(path, n.info, a, perm, op, traverse), path)
+}
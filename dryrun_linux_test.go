@@ -0,0 +1,174 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDryRun(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		d := NewDryRun(User{UID: 1000, GID: 1000}, WithUmask(0o022))
+		a := filepath.Join(tree.Root, "a")
+
+		// Later steps see the effects of earlier ones
+		tree.AssertSuccess(d.Mkdir(filepath.Join(a, "new"), 0o777))
+		tree.AssertSuccess(d.WriteFile(filepath.Join(a, "new", "f"), []byte("data"), 0o666))
+		tree.AssertSuccess(d.Symlink("f", filepath.Join(a, "new", "link")))
+
+		data, err := d.ReadFile(filepath.Join(a, "new", "link"))
+		tree.AssertSuccess(err)
+
+		if string(data) != "data" {
+			t.Errorf("expected the planned content, got %q", data)
+		}
+
+		fi, err := d.Stat(filepath.Join(a, "new"))
+		tree.AssertSuccess(err)
+
+		if err == nil && fi.Mode() != os.ModeDir|0o755 {
+			t.Errorf("expected the umask to apply, got %v", fi.Mode())
+		}
+
+		tree.AssertSuccess(d.Rename(filepath.Join(a, "new"), filepath.Join(a, "moved")))
+		tree.AssertNotExist(d.Chmod(filepath.Join(a, "new", "f"), 0o600))
+		tree.AssertSuccess(d.Chmod(filepath.Join(a, "moved", "f"), 0o600))
+		tree.AssertError(d.Remove(filepath.Join(a, "moved")), syscall.ENOTEMPTY)
+		tree.AssertSuccess(d.RemoveAll(filepath.Join(a, "moved")))
+		tree.AssertNotExist(d.Remove(filepath.Join(a, "moved")))
+
+		// Existing directories of other users
+		tree.AssertDenied(d.Mkdir(filepath.Join(a, "d", "x"), 0o755))
+		tree.AssertDenied(d.Chown(filepath.Join(a, "d"), 1000, 1000))
+		tree.AssertSuccess(d.Rename(filepath.Join(a, "d"), filepath.Join(a, "x")))
+		tree.AssertDenied(d.Mkdir(filepath.Join(a, "x", "e", "y"), 0o755))
+		tree.AssertSuccess(d.RemoveAll(filepath.Join(tree.Root, "b", "missing")))
+
+		_, err = d.ReadDir(a)
+		tree.AssertDenied(err)
+
+		f, err := d.Create(filepath.Join(a, "g"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.WriteString("discarded")
+		tree.AssertSuccess(err)
+		tree.AssertSuccess(f.Close())
+
+		if fi, err = d.Stat(filepath.Join(a, "g")); err == nil && fi.Size() != 9 {
+			t.Errorf("expected the planned size, got %d", fi.Size())
+		}
+
+		// Nothing is changed
+		entries, err := os.ReadDir(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(entries) != 1 || entries[0].Name() != "d" {
+			t.Errorf("expected only d, got %v", entries)
+		}
+
+		plan := d.Plan()
+
+		if len(plan) != 19 {
+			t.Fatalf("expected 19 steps, got %d", len(plan))
+		}
+
+		if s := plan[5]; s.Op != "rename" || s.Target != filepath.Join(a, "moved") || s.Err != nil {
+			t.Errorf("unexpected step %v", s)
+		}
+
+		if s := plan[11]; s.Op != "mkdir" || !os.IsPermission(s.Err) {
+			t.Errorf("unexpected step %v", s)
+		}
+	})
+}
+
+func TestDryRunFile(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		d := NewDryRun(User{UID: 1000, GID: 1000})
+		dir := filepath.Join(tree.Root, "w")
+		name := filepath.Join(dir, "f")
+
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(name, []byte("hello"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := d.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+
+		// Locks are checked, but not taken
+		tree.AssertError(f.Lock(), syscall.EBADF)
+		tree.AssertSuccess(f.RLock())
+		_, err = f.TryLockRange(0, 1, true)
+		tree.AssertError(err, syscall.EBADF)
+		tree.AssertSuccess(f.LockRange(context.Background(), 0, 1, false))
+
+		g, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer g.Close()
+
+		tree.AssertSuccess(unix.Flock(int(g.Fd()), unix.LOCK_EX|unix.LOCK_NB))
+
+		lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart, Len: 1}
+		tree.AssertSuccess(unix.FcntlFlock(g.Fd(), unix.F_OFD_SETLK, &lk))
+
+		// Seeks are simulated
+		off, err := f.Seek(1, io.SeekStart)
+		tree.AssertSuccess(err)
+
+		data, err := io.ReadAll(f)
+		tree.AssertSuccess(err)
+
+		if off != 1 || string(data) != "ello" {
+			t.Errorf("expected ello at 1, got %q at %d", data, off)
+		}
+
+		if off, err = f.Seek(-2, io.SeekEnd); err != nil || off != 3 {
+			t.Errorf("expected offset 3, got %d: %v", off, err)
+		}
+
+		tree.AssertSuccess(f.Sync())
+
+		// The working directory doesn't change
+		wd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := d.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer h.Close()
+
+		tree.AssertSuccess(h.Chdir())
+		tree.AssertError(f.Chdir(), syscall.ENOTDIR)
+
+		if cwd, _ := os.Getwd(); cwd != wd { //nolint:errcheck
+			t.Errorf("working directory changed to %s", cwd)
+		}
+	})
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+func (u User) dryUser(c *config) *user {
+	return &user{User: u, umask: c.umask}
+}
+
+func (i *dryInfo) Sys() interface{} {
+	return nil
+}
+
+// check is not supported on this platform, every step is predicted to succeed.
+func (d *DryRun) check(path string, n *dryNode, perm Permission, op Op, traverse bool) error {
+	return nil
+}
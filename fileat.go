@@ -0,0 +1,22 @@
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// checkAtName checks that name is a single path component, as required by the at-methods of File.
+func checkAtName(op, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') || strings.ContainsRune(name, os.PathSeparator) {
+		return logit(&os.PathError{Op: op, Path: name, Err: syscall.EINVAL})
+	}
+
+	return nil
+}
+
+// atPath returns the name of the entry name in the directory dir.
+func atPath(dir File, name string) string {
+	return filepath.Join(dir.Name(), name)
+}
@@ -0,0 +1,367 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Openat opens the entry name of the directory, see File.
+func (f osFile) Openat(name string, flag int, perm os.FileMode) (File, error) {
+	if err := checkAtName("openat", name); err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Openat(int(f.Fd()), name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, logit(&os.PathError{Op: "openat", Path: atPath(f, name), Err: err})
+	}
+
+	return osFile{os.NewFile(uintptr(fd), atPath(f, name))}, nil
+}
+
+// Mkdirat creates the directory name in the directory, see File.
+func (f osFile) Mkdirat(name string, perm os.FileMode) error {
+	if err := checkAtName("mkdirat", name); err != nil {
+		return err
+	}
+
+	if err := unix.Mkdirat(int(f.Fd()), name, uint32(perm.Perm())); err != nil {
+		return logit(&os.PathError{Op: "mkdirat", Path: atPath(f, name), Err: err})
+	}
+
+	return nil
+}
+
+// Unlinkat removes the file or empty directory name from the directory, see File.
+func (f osFile) Unlinkat(name string) error {
+	if err := checkAtName("unlinkat", name); err != nil {
+		return err
+	}
+
+	var st unix.Stat_t
+
+	if err := unix.Fstatat(int(f.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return logit(&os.PathError{Op: "unlinkat", Path: atPath(f, name), Err: err})
+	}
+
+	return logit(unlinkAt(f.File, atPath(f, name), name, removeFlags(&st)))
+}
+
+// Renameat renames the entry oldname of the directory to newname in newdir, see File.
+func (f osFile) Renameat(oldname string, newdir File, newname string) error {
+	if err := checkAtName("renameat", oldname); err != nil {
+		return err
+	}
+
+	if err := checkAtName("renameat", newname); err != nil {
+		return err
+	}
+
+	if err := unix.Renameat(int(f.Fd()), oldname, int(newdir.Fd()), newname); err != nil {
+		return logit(&os.LinkError{Op: "renameat", Old: atPath(f, oldname), New: atPath(newdir, newname), Err: err})
+	}
+
+	return nil
+}
+
+// Statat returns the stat of the entry name of the directory, see File.
+func (f osFile) Statat(name string) (os.FileInfo, error) {
+	if err := checkAtName("statat", name); err != nil {
+		return nil, err
+	}
+
+	return statAt(f.File, name)
+}
+
+// statAt returns the stat of an entry without following a symlink, through an O_PATH descriptor.
+func statAt(dir *os.File, name string) (os.FileInfo, error) {
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, logit(&os.PathError{Op: "statat", Path: atPath(osFile{dir}, name), Err: err})
+	}
+
+	f := os.NewFile(uintptr(fd), atPath(osFile{dir}, name))
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// removeFlags returns the flags of unlinkat to remove a file with the given stat.
+func removeFlags(st *unix.Stat_t) int {
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		return unix.AT_REMOVEDIR
+	}
+
+	return 0
+}
+
+// Openat opens the entry name of the directory as the user. The user must be able to search
+// the directory, and the entry is checked like OpenFile, on the opened descriptor.
+func (f *file) Openat(name string, flag int, perm os.FileMode) (File, error) {
+	g, err := f.openat(name, flag, perm)
+	if err != nil {
+		return nil, f.u.logit(err)
+	}
+
+	return g, f.u.logit(nil)
+}
+
+func (f *file) openat(name string, flag int, perm os.FileMode) (File, error) {
+	if err := checkAtName("openat", name); err != nil {
+		return nil, err
+	}
+
+	dir, err := f.u.checkFile(f, Execute, openOp(flag), true)
+	if err != nil {
+		return nil, err
+	}
+
+	path := atPath(f, name)
+
+	// O_PATH only needs search permission on the directory
+	if flag&oPath != 0 {
+		fd, err := unix.Openat(int(f.Fd()), name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: "openat", Path: path, Err: err}
+		}
+
+		return &file{osFile{os.NewFile(uintptr(fd), path)}, f.u}, nil
+	}
+
+	var st unix.Stat_t
+
+	err = unix.Fstatat(int(f.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW)
+
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "openat", Path: path, Err: syscall.EEXIST}
+	case err == nil:
+		return f.openExistingAt(name, flag)
+	case err != unix.ENOENT || flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "openat", Path: path, Err: err}
+	case flag&oDirectory != 0:
+		return nil, &os.PathError{Op: "openat", Path: path, Err: syscall.EINVAL}
+	}
+
+	return f.createFileAt(dir, name, flag, perm)
+}
+
+// openExistingAt opens an existing entry, and checks the permissions on the opened descriptor.
+// The entry is first opened with O_PATH, which has no side effects and doesn't block on
+// a FIFO, and only reopened with the requested flags once the permissions are checked.
+// O_TRUNC is applied last.
+func (f *file) openExistingAt(name string, flag int) (File, error) {
+	path := atPath(f, name)
+
+	fd, err := unix.Openat(int(f.Fd()), name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: path, Err: err}
+	}
+
+	p := &file{osFile{os.NewFile(uintptr(fd), path)}, f.u}
+	defer p.Close()
+
+	// O_PATH opens a symlink itself, refuse it as O_NOFOLLOW does
+	if stat, err := p.Stat(); err != nil {
+		return nil, err
+	} else if stat.Mode()&os.ModeSymlink != 0 {
+		return nil, &os.PathError{Op: "openat", Path: path, Err: syscall.ELOOP}
+	}
+
+	if err = f.u.checkOpenFile(p, flag); err != nil {
+		return nil, err
+	}
+
+	h, err := reopen(p.File, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &file{osFile{h}, f.u}
+
+	if flag&os.O_TRUNC != 0 {
+		// The descriptor may be read-only, truncate the opened file through its magic link
+		if err = unix.Truncate(fdPath(g), 0); err != nil {
+			g.Close()
+			return nil, &os.PathError{Op: "truncate", Path: path, Err: err}
+		}
+	}
+
+	return g, nil
+}
+
+// checkOpenFile checks the permissions of an opened file like checkOpenExisting.
+func (u *user) checkOpenFile(f File, flag int) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	mode := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+
+	switch {
+	case flag&oDirectory != 0 && !stat.IsDir():
+		return &os.PathError{Op: "openat", Path: f.Name(), Err: syscall.ENOTDIR}
+	case stat.IsDir() && (mode != os.O_RDONLY || flag&os.O_TRUNC != 0):
+		return &os.PathError{Op: "openat", Path: f.Name(), Err: syscall.EISDIR}
+	}
+
+	if mode != os.O_WRONLY {
+		if _, err = u.checkFile(f, Read, OpRead, false); err != nil {
+			return err
+		}
+	}
+
+	if mode != os.O_RDONLY || flag&os.O_TRUNC != 0 {
+		if _, err = u.checkFile(f, Write, OpWrite, false); err != nil {
+			return err
+		}
+	}
+
+	// Only the owner may suppress the update of the access time
+	if flag&oNoAtime != 0 && u.UID != 0 && u.checkOwnership(stat) != nil {
+		return &os.PathError{Op: "openat", Path: f.Name(), Err: syscall.EPERM}
+	}
+
+	return nil
+}
+
+// createFileAt creates a new file, owned by the user.
+func (f *file) createFileAt(dir os.FileInfo, name string, flag int, perm os.FileMode) (File, error) {
+	path := atPath(f, name)
+
+	if _, err := f.u.checkFile(f, Write, OpCreate, false); err != nil {
+		return nil, err
+	}
+
+	g, err := f.u.createAt(int(f.Fd()), path, name, flag, perm, dir)
+	if os.IsExist(err) && flag&os.O_EXCL == 0 {
+		// Created in the meantime
+		return f.openExistingAt(name, flag)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &file{osFile{g}, f.u}, nil
+}
+
+// Mkdirat creates the directory name in the directory as the user.
+func (f *file) Mkdirat(name string, perm os.FileMode) error {
+	if err := checkAtName("mkdirat", name); err != nil {
+		return f.u.logit(err)
+	}
+
+	dir, err := f.u.checkFile(f, Execute, OpCreate, true)
+	if err == nil {
+		_, err = f.u.checkFile(f, Write, OpCreate, false)
+	}
+
+	if err != nil {
+		return f.u.logit(err)
+	}
+
+	return f.u.logit(f.u.mkdirAt(int(f.Fd()), atPath(f, name), name, perm, dir))
+}
+
+// Unlinkat removes the file or empty directory name from the directory as the user.
+func (f *file) Unlinkat(name string) error {
+	if err := checkAtName("unlinkat", name); err != nil {
+		return f.u.logit(err)
+	}
+
+	st, err := f.u.checkUnlinkAt(f, name)
+	if err != nil {
+		return f.u.logit(err)
+	}
+
+	return f.u.logit(unlinkAt(f.File, atPath(f, name), name, removeFlags(st)))
+}
+
+// checkUnlinkAt checks whether the user can remove the entry name of dir, and returns its stat.
+func (u *user) checkUnlinkAt(dir File, name string) (*unix.Stat_t, error) {
+	stat, err := u.checkFile(dir, Execute, OpDelete, true)
+	if err == nil {
+		_, err = u.checkFile(dir, Write, OpDelete, false)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var st unix.Stat_t
+
+	if err = unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, &os.PathError{Op: "unlinkat", Path: atPath(dir, name), Err: err}
+	}
+
+	// In a sticky directory, only the owner can remove an entry
+	if stat.Mode()&os.ModeSticky > 0 && u.UID != 0 && st.Uid != uint32(u.UID) {
+		return nil, on(os.ErrPermission, atPath(dir, name))
+	}
+
+	if err = u.authorizeObjectAt(dir, name, OpDelete); err != nil {
+		return nil, err
+	}
+
+	return &st, nil
+}
+
+// Renameat renames the entry oldname of the directory to newname in newdir as the user.
+// Both directories are checked as for Unlinkat, and an entry replaced by the rename too.
+func (f *file) Renameat(oldname string, newdir File, newname string) error {
+	if err := checkAtName("renameat", oldname); err != nil {
+		return f.u.logit(err)
+	}
+
+	if err := checkAtName("renameat", newname); err != nil {
+		return f.u.logit(err)
+	}
+
+	if _, err := f.u.checkUnlinkAt(f, oldname); err != nil {
+		return f.u.logit(err)
+	}
+
+	_, err := f.u.checkUnlinkAt(newdir, newname)
+
+	var pathErr *os.PathError
+
+	// The new entry does not need to exist, but its directory must be writable
+	if errors.As(err, &pathErr) && errors.Is(pathErr.Err, syscall.ENOENT) {
+		err = nil
+	}
+
+	if err != nil {
+		return f.u.logit(err)
+	}
+
+	if err = unix.Renameat(int(f.Fd()), oldname, int(newdir.Fd()), newname); err != nil {
+		return f.u.logit(&os.LinkError{Op: "renameat", Old: atPath(f, oldname), New: atPath(newdir, newname), Err: err})
+	}
+
+	return f.u.logit(nil)
+}
+
+// Statat returns the stat of the entry name of the directory, which must be searchable by the user.
+func (f *file) Statat(name string) (os.FileInfo, error) {
+	if err := checkAtName("statat", name); err != nil {
+		return nil, f.u.logit(err)
+	}
+
+	if _, err := f.u.checkFile(f, Execute, OpStat, true); err != nil {
+		return nil, f.u.logit(err)
+	}
+
+	if err := f.u.authorizeObjectAt(f, name, OpStat); err != nil {
+		return nil, f.u.logit(err)
+	}
+
+	fi, err := statAt(f.File, name)
+
+	return fi, f.u.logit(err)
+}
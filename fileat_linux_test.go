@@ -0,0 +1,190 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileAt(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		o := User{UID: 1000, GID: 1000}.OS()
+
+		tree.AssertSuccess(o.Mkdir(filepath.Join(tree.Root, "a", "cap"), 0o755))
+
+		d, err := o.Open(filepath.Join(tree.Root, "a", "cap"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer d.Close()
+
+		// The directory stays usable after it is moved
+		if err = os.Rename(filepath.Join(tree.Root, "a", "cap"), filepath.Join(tree.Root, "a", "moved")); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Join(tree.Root, "a", "moved")
+
+		tree.AssertSuccess(d.Mkdirat("sub", 0o755))
+		tree.AssertOwnership(filepath.Join(dir, "sub"), 1000, 1000)
+
+		f, err := d.Openat("f", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		tree.AssertSuccess(err)
+
+		if err == nil {
+			_, err = f.WriteString("data")
+			tree.AssertSuccess(err)
+			tree.AssertSuccess(f.Close())
+		}
+
+		tree.AssertOwnership(filepath.Join(dir, "f"), 1000, 1000)
+		tree.AssertContent(filepath.Join(dir, "f"), []byte("data"))
+
+		_, err = d.Openat("f", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		tree.AssertError(err, os.ErrExist)
+
+		_, err = d.Statat("f")
+		tree.AssertSuccess(err)
+
+		// Names must be single components, and symlinks are not followed
+		_, err = d.Openat("../b", os.O_RDONLY, 0)
+		tree.AssertError(err, syscall.EINVAL)
+
+		tree.AssertSuccess(o.Symlink(filepath.Join(tree.Root, "b"), filepath.Join(dir, "link")))
+
+		_, err = d.Openat("link", os.O_RDONLY, 0)
+		tree.AssertError(err, syscall.ELOOP)
+
+		fi, err := d.Statat("link")
+		tree.AssertSuccess(err)
+
+		if err == nil && fi.Mode()&os.ModeSymlink == 0 {
+			t.Error("expected the stat of the symlink")
+		}
+
+		sub, err := d.Openat("sub", os.O_RDONLY|oDirectory, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer sub.Close()
+
+		tree.AssertSuccess(d.Renameat("f", sub, "g"))
+		tree.AssertContent(filepath.Join(dir, "sub", "g"), []byte("data"))
+		tree.AssertError(d.Unlinkat("sub"), syscall.ENOTEMPTY)
+		tree.AssertSuccess(sub.Unlinkat("g"))
+		tree.AssertSuccess(d.Unlinkat("sub"))
+		tree.AssertSuccess(d.Unlinkat("link"))
+		tree.AssertNotExist(d.Unlinkat("link"))
+
+		// Another user cannot modify the directory through a handle
+		if err = os.Chmod(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = os.Rename(dir, filepath.Join(tree.Root, "shared")); err != nil {
+			t.Fatal(err)
+		}
+
+		tree.AssertSuccess(o.WriteFile(filepath.Join(tree.Root, "shared", "f"), nil, 0o644))
+
+		s, err := User{UID: 1001, GID: 1001}.OS().Open(filepath.Join(tree.Root, "shared"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		_, err = s.Statat("f")
+		tree.AssertSuccess(err)
+		tree.AssertDenied(s.Mkdirat("x", 0o755))
+		tree.AssertDenied(s.Unlinkat("f"))
+
+		_, err = s.Openat("x", os.O_WRONLY|os.O_CREATE, 0o644)
+		tree.AssertDenied(err)
+
+		_, err = s.Openat("f", os.O_WRONLY, 0)
+		tree.AssertDenied(err)
+
+		_, err = s.Openat("f", os.O_RDONLY|os.O_TRUNC, 0)
+		tree.AssertDenied(err)
+
+		// A FIFO that cannot be read is refused before it is opened, which would block
+		if err = syscall.Mkfifo(filepath.Join(tree.Root, "shared", "fifo"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := s.Openat("fifo", os.O_RDONLY, 0)
+			done <- err
+		}()
+
+		select {
+		case err = <-done:
+			tree.AssertDenied(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("openat blocked on a FIFO")
+		}
+	})
+}
+
+func TestFileDescriptorChecks(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		o := User{UID: 1000, GID: 1000}.OS()
+		name := filepath.Join(tree.Root, "a", "f")
+
+		tree.AssertSuccess(o.WriteFile(name, nil, 0o644))
+
+		f, err := o.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+
+		// Replace the path by a file of another user, the opened file is still owned
+		if err = os.Rename(name, name+".old"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = os.Chown(name, 1001, 1001); err != nil {
+			t.Fatal(err)
+		}
+
+		tree.AssertSuccess(f.Chmod(0o600))
+		tree.AssertSuccess(f.Chown(1000, 1000))
+		tree.AssertDenied(f.Chown(1001, 1000))
+
+		fi, err := os.Stat(name + ".old")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != 0o600 {
+			t.Errorf("expected the opened file to be changed, got %v", fi.Mode())
+		}
+
+		if fi, err = os.Stat(name); err == nil && fi.Mode().Perm() != 0o644 {
+			t.Errorf("expected the new file to be unchanged, got %v", fi.Mode())
+		}
+
+		// Ownership is checked on the opened file too
+		if err = os.Chown(name+".old", 1001, 1001); err != nil {
+			t.Fatal(err)
+		}
+
+		tree.AssertDenied(f.Chmod(0o644))
+	})
+}
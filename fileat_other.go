@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import (
+	"os"
+	"syscall"
+)
+
+func (f osFile) Openat(name string, flag int, perm os.FileMode) (File, error) {
+	return nil, logit(&os.PathError{Op: "openat", Path: atPath(f, name), Err: syscall.ENOTSUP})
+}
+
+func (f osFile) Mkdirat(name string, perm os.FileMode) error {
+	return logit(&os.PathError{Op: "mkdirat", Path: atPath(f, name), Err: syscall.ENOTSUP})
+}
+
+func (f osFile) Unlinkat(name string) error {
+	return logit(&os.PathError{Op: "unlinkat", Path: atPath(f, name), Err: syscall.ENOTSUP})
+}
+
+func (f osFile) Renameat(oldname string, newdir File, newname string) error {
+	return logit(&os.PathError{Op: "renameat", Path: atPath(f, oldname), Err: syscall.ENOTSUP})
+}
+
+func (f osFile) Statat(name string) (os.FileInfo, error) {
+	return nil, logit(&os.PathError{Op: "statat", Path: atPath(f, name), Err: syscall.ENOTSUP})
+}
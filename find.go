@@ -0,0 +1,321 @@
+package useros
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileType is a type of file in a Query.
+type FileType int
+
+const (
+	// TypeAny matches all files.
+	TypeAny FileType = iota
+	TypeRegular
+	TypeDir
+	TypeSymlink
+	// TypeOther matches devices, pipes and sockets.
+	TypeOther
+)
+
+func (t FileType) match(mode fs.FileMode) bool {
+	switch t {
+	case TypeRegular:
+		return mode.IsRegular()
+	case TypeDir:
+		return mode.IsDir()
+	case TypeSymlink:
+		return mode&fs.ModeSymlink != 0
+	case TypeOther:
+		return mode.Type()&^(fs.ModeDir|fs.ModeSymlink) != 0
+	default:
+		return true
+	}
+}
+
+// Query selects the entries returned by Find. Unset fields match all entries.
+type Query struct {
+	// Name matches the base name, with path.Match syntax.
+	Name string
+
+	// Path matches the slash-separated path relative to the root of Find, with
+	// path.Match syntax for each component and ** for any number of components.
+	Path string
+
+	Type FileType
+
+	// MinSize and MaxSize bound the size in bytes.
+	MinSize *int64
+	MaxSize *int64
+
+	// ModifiedAfter and ModifiedBefore bound the modification time.
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+
+	// UID and GID match the owner and group.
+	UID *int
+	GID *int
+
+	// ModeAll are the mode bits that must all be set, ModeAny those of which one must be set.
+	ModeAll fs.FileMode
+	ModeAny fs.FileMode
+
+	// Access is the permission that the user must have on the entry. Symlinks are followed.
+	Access Permission
+
+	// MaxDepth limits the depth below the root, if positive.
+	MaxDepth int
+}
+
+// needsInfo reports whether the query can only be evaluated with the stat of an entry.
+func (q *Query) needsInfo() bool {
+	return q.MinSize != nil || q.MaxSize != nil || !q.ModifiedAfter.IsZero() || !q.ModifiedBefore.IsZero() ||
+		q.UID != nil || q.GID != nil || q.ModeAll != 0 || q.ModeAny != 0 || q.Access != 0
+}
+
+// Find returns the paths below root, including root, that match the query, as discovered by the
+// user of o: directories without read and execute permission are not descended into, and entries
+// in directories without execute permission are only matched if the query needs no stat, i.e. on
+// name, path and type. Entries that the user cannot access are skipped without error.
+func Find(o OS, root string, q Query) ([]string, error) {
+	var (
+		matches   []string
+		pattern   []string
+		u, isUser = o.(*user)
+	)
+
+	if q.Path != "" {
+		pattern = strings.Split(q.Path, "/")
+
+		if err := checkPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := path.Match(q.Name, ""); err != nil {
+		return nil, err
+	}
+
+	if !isUser {
+		u = &user{User: o.CurrentUser()}
+	}
+
+	err := walkDir(o, root, 1, func(name string, d fs.DirEntry, search error, err error) error {
+		if errors.Is(err, fs.ErrPermission) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		rel := relativeComponents(root, name)
+
+		ok, err := q.match(o, u, isUser, name, d, rel, pattern, search)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			matches = append(matches, name)
+		}
+
+		if d.IsDir() && (q.MaxDepth > 0 && len(rel) >= q.MaxDepth || pattern != nil && !canDescend(pattern, rel)) {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+
+	return matches, err
+}
+
+func (q *Query) match(o OS, u *user, isUser bool, name string, d fs.DirEntry, rel, pattern []string, search error) (bool, error) {
+	if q.Name != "" {
+		if ok, _ := path.Match(q.Name, d.Name()); !ok { //nolint:errcheck
+			return false, nil
+		}
+	}
+
+	if pattern != nil && !matchSegments(pattern, rel) {
+		return false, nil
+	}
+
+	if !q.Type.match(d.Type()) {
+		return false, nil
+	}
+
+	if !q.needsInfo() {
+		return true, nil
+	}
+
+	// Without search permission on the directory, the entry cannot be statted
+	if search != nil {
+		return false, nil
+	}
+
+	var (
+		info fs.FileInfo
+		err  error
+	)
+
+	// The listing of a user OS comes from the os package
+	if isUser {
+		info, err = d.Info()
+	} else {
+		info, err = o.Lstat(name)
+	}
+
+	if errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if !q.matchInfo(info) {
+		return false, nil
+	}
+
+	if q.Access == 0 {
+		return true, nil
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if info, err = o.Stat(name); err != nil {
+			return false, nil
+		}
+	}
+
+	return u.hasEntryAccess(name, info, q.Access, OpStat) == nil, nil
+}
+
+func (q *Query) matchInfo(info fs.FileInfo) bool {
+	switch {
+	case q.MinSize != nil && info.Size() < *q.MinSize:
+	case q.MaxSize != nil && info.Size() > *q.MaxSize:
+	case !q.ModifiedAfter.IsZero() && !info.ModTime().After(q.ModifiedAfter):
+	case !q.ModifiedBefore.IsZero() && !info.ModTime().Before(q.ModifiedBefore):
+	case info.Mode()&q.ModeAll != q.ModeAll:
+	case q.ModeAny != 0 && info.Mode()&q.ModeAny == 0:
+	default:
+		if q.UID == nil && q.GID == nil {
+			return true
+		}
+
+		ino, ok := inodeOf(info)
+
+		return ok && (q.UID == nil || *q.UID == ino.uid) && (q.GID == nil || *q.GID == ino.gid)
+	}
+
+	return false
+}
+
+// Glob returns the names of all files matching pattern as discovered by the user of o,
+// like filepath.Glob, but a ** component also matches any number of directories.
+// Directories are only read as far as needed to match the pattern.
+func Glob(o OS, pattern string) ([]string, error) {
+	components := strings.Split(filepath.ToSlash(pattern), "/")
+
+	if err := checkPattern(components); err != nil {
+		return nil, err
+	}
+
+	// Start at the longest prefix without meta characters
+	i := 0
+	for i < len(components)-1 && !hasMeta(components[i]) {
+		i++
+	}
+
+	if !hasMeta(components[i]) {
+		if _, err := o.Lstat(pattern); err != nil {
+			return nil, nil
+		}
+
+		return []string{pattern}, nil
+	}
+
+	root := filepath.FromSlash(strings.Join(components[:i], "/"))
+
+	switch {
+	case i == 1 && components[0] == "":
+		root = string(os.PathSeparator)
+	case i == 0:
+		root = "."
+	}
+
+	rest := components[i:]
+
+	var matches []string
+
+	err := walkDir(o, root, 1, func(name string, d fs.DirEntry, _ error, err error) error {
+		if err != nil {
+			// As filepath.Glob, ignore I/O errors
+			return nil
+		}
+
+		rel := relativeComponents(root, name)
+		if len(rel) == 0 {
+			return nil
+		}
+
+		if matchSegments(rest, rel) {
+			matches = append(matches, name)
+		}
+
+		if d.IsDir() && !canDescend(rest, rel) {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+
+	return matches, err
+}
+
+// relativeComponents returns the components of name below root.
+func relativeComponents(root, name string) []string {
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == "." {
+		return nil
+	}
+
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
+
+// canDescend reports whether paths below dir can match the pattern.
+func canDescend(pattern, dir []string) bool {
+	for len(dir) > 0 {
+		if len(pattern) == 0 {
+			return false
+		}
+
+		if pattern[0] == "**" {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern[0], dir[0]); !ok { //nolint:errcheck
+			return false
+		}
+
+		pattern, dir = pattern[1:], dir[1:]
+	}
+
+	return len(pattern) > 0
+}
+
+func checkPattern(components []string) error {
+	for _, c := range components {
+		if _, err := path.Match(c, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hasMeta(component string) bool {
+	return strings.ContainsAny(component, `*?[\`)
+}
@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindPermissions(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		for _, dir := range []struct {
+			name string
+			perm os.FileMode
+		}{{"f", 0o755}, {"f/g", 0o700}, {"h", 0o744}, {"h/i", 0o755}} {
+			if err := os.Mkdir(filepath.Join(tree.Root, dir.name), dir.perm); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chmod(filepath.Join(tree.Root, dir.name), dir.perm); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range []string{"f/file", "f/g/file", "h/file"} {
+			if err := os.WriteFile(filepath.Join(tree.Root, name), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		o := User{UID: 1000, GID: 1000}.OS()
+		size := int64(0)
+
+		for _, test := range []struct {
+			query    Query
+			expected []string
+		}{
+			// Names in a directory without search permission can be listed, but not statted
+			{Query{Name: "*file*"}, []string{"f/file", "h/file"}},
+			{Query{Name: "*file*", MaxSize: &size}, []string{"f/file"}},
+			{Query{Path: "h/*"}, []string{"h/file", "h/i"}},
+			{Query{Path: "h/*", Access: Read}, nil},
+			{Query{Type: TypeRegular, Access: Read}, []string{"f/file"}},
+			{Query{Type: TypeRegular, Access: Write}, nil},
+		} {
+			matches, err := Find(o, tree.Root, test.query)
+			tree.AssertSuccess(err)
+
+			var rel []string
+
+			for _, m := range matches {
+				r, _ := filepath.Rel(tree.Root, m) //nolint:errcheck
+				rel = append(rel, r)
+			}
+
+			if !reflect.DeepEqual(rel, test.expected) {
+				t.Errorf("%+v: expected %v, got %v", test.query, test.expected, rel)
+			}
+		}
+
+		matches, err := Glob(o, filepath.Join(tree.Root, "**", "file"))
+		tree.AssertSuccess(err)
+
+		if len(matches) != 2 {
+			t.Errorf("unexpected matches %v", matches)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGlobFind(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, size := range map[string]int{"a/x.go": 10, "a/b/y.go": 100, "a/b/c/z.go": 1000, "a/b/c/z.txt": 0, "d/x.go": 1} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-time.Hour)
+
+	if err := os.Chtimes(filepath.Join(dir, "d/x.go"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	join := func(names ...string) []string {
+		for i, name := range names {
+			names[i] = filepath.Join(dir, name)
+		}
+
+		return names
+	}
+
+	for pattern, expected := range map[string][]string{
+		"*/x.go":    join("a/x.go", "d/x.go"),
+		"a/**/*.go": join("a/b/c/z.go", "a/b/y.go", "a/x.go"),
+		"**/z.*":    join("a/b/c/z.go", "a/b/c/z.txt"),
+		"a/b":       join("a/b"),
+		"a/missing": nil,
+	} {
+		matches, err := Glob(Default(), filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(matches, expected) {
+			t.Errorf("%s: expected %v, got %v", pattern, expected, matches)
+		}
+	}
+
+	if _, err := Glob(Default(), filepath.Join(dir, "[")); err == nil {
+		t.Error("expected bad pattern")
+	}
+
+	size := int64(10)
+	recent := time.Now().Add(-time.Minute)
+
+	for _, test := range []struct {
+		query    Query
+		expected []string
+	}{
+		{Query{Name: "*.go", MinSize: &size}, join("a/b/c/z.go", "a/b/y.go", "a/x.go")},
+		{Query{Name: "*.go", MaxSize: &size}, join("a/x.go", "d/x.go")},
+		{Query{Type: TypeDir, MaxDepth: 1}, join("", "a", "d")},
+		{Query{Path: "a/*/*", Type: TypeRegular}, join("a/b/y.go")},
+		{Query{Type: TypeRegular, ModifiedBefore: recent}, join("d/x.go")},
+		{Query{Name: "z.*", ModeAll: 0o644, Access: Read}, join("a/b/c/z.go", "a/b/c/z.txt")},
+	} {
+		matches, err := Find(Default(), dir, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(matches, test.expected) {
+			t.Errorf("%+v: expected %v, got %v", test.query, test.expected, matches)
+		}
+	}
+}
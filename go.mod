@@ -2,9 +2,9 @@ module github.com/peterverraedt/useros
 
 go 1.20
 
-require github.com/joshlf/go-acl v0.0.0-20200411065538-eae00ae38531
-
 require (
-	github.com/joshlf/testutil v0.0.0-20170608050642-b5d8aa79d93d // indirect
-	golang.org/x/sys v0.6.0 // indirect
+	github.com/joshlf/go-acl v0.0.0-20200411065538-eae00ae38531
+	golang.org/x/sys v0.6.0
 )
+
+require github.com/joshlf/testutil v0.0.0-20170608050642-b5d8aa79d93d // indirect
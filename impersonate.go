@@ -0,0 +1,10 @@
+package useros
+
+import "errors"
+
+// ErrCannotImpersonate is returned by CanImpersonate, and by NewOS in strict mode,
+// if the process cannot enforce the permissions of another user.
+var ErrCannotImpersonate = errors.New("process cannot impersonate other users")
+
+// canImpersonate is replaced in tests.
+var canImpersonate = CanImpersonate
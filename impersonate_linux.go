@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// impersonationCapabilities are the capabilities needed to act on behalf of other users.
+var impersonationCapabilities = []struct {
+	bit  uint
+	name string
+}{
+	{unix.CAP_DAC_OVERRIDE, "CAP_DAC_OVERRIDE"},
+	{unix.CAP_CHOWN, "CAP_CHOWN"},
+	{unix.CAP_FOWNER, "CAP_FOWNER"},
+	{unix.CAP_DAC_READ_SEARCH, "CAP_DAC_READ_SEARCH"},
+}
+
+// CanImpersonate checks whether the process can act on behalf of other users,
+// i.e. whether it has the effective capabilities CAP_DAC_OVERRIDE, CAP_CHOWN,
+// CAP_FOWNER and CAP_DAC_READ_SEARCH. These are normally held by root only.
+// If not, an error wrapping ErrCannotImpersonate lists the missing capabilities.
+func CanImpersonate() error {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCannotImpersonate, err)
+	}
+
+	defer f.Close()
+
+	caps, err := parseCapEff(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCannotImpersonate, err)
+	}
+
+	var missing []string
+
+	for _, c := range impersonationCapabilities {
+		if caps&(1<<c.bit) == 0 {
+			missing = append(missing, c.name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: euid %d lacks %s", ErrCannotImpersonate, syscall.Geteuid(), strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// parseCapEff returns the effective capabilities from the contents of /proc/<pid>/status.
+func parseCapEff(r io.Reader) (uint64, error) {
+	s := bufio.NewScanner(r)
+
+	for s.Scan() {
+		value, ok := strings.CutPrefix(s.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+
+		return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+	}
+
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("no CapEff in status")
+}
@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseCapEff(t *testing.T) {
+	status := "Name:\tcat\nCapInh:\t0000000000000000\nCapPrm:\t000001ffffffffff\nCapEff:\t000001ffffffffff\n"
+
+	caps, err := parseCapEff(strings.NewReader(status))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if caps != 0x1ffffffffff {
+		t.Errorf("unexpected capabilities %x", caps)
+	}
+
+	if _, err = parseCapEff(strings.NewReader("Name:\tcat\n")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	if syscall.Geteuid() == 0 {
+		if err := CanImpersonate(); err != nil {
+			t.Errorf("root cannot impersonate: %v", err)
+		}
+	}
+
+	defer func(f func() error) { canImpersonate = f }(canImpersonate)
+
+	canImpersonate = func() error { return ErrCannotImpersonate }
+
+	if _, err := NewOS(User{UID: 12345, GID: 12345}, WithStrict()); !errors.Is(err, ErrCannotImpersonate) {
+		t.Errorf("expected ErrCannotImpersonate, got %v", err)
+	}
+
+	if _, err := NewOS(User{UID: 12345, GID: 12345}); err != nil {
+		t.Errorf("unexpected error in non-strict mode: %v", err)
+	}
+
+	o, err := NewOS(User{UID: -1, GID: -1}, WithStrict())
+	if err != nil {
+		t.Fatalf("unexpected error for the process user: %v", err)
+	}
+
+	if _, ok := o.(*user); !ok {
+		t.Errorf("expected checked OS, got %T", o)
+	}
+}
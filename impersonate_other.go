@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+// CanImpersonate checks whether the process can act on behalf of other users.
+// Permissions are not enforced on this platform, so it always fails.
+func CanImpersonate() error {
+	return ErrCannotImpersonate
+}
@@ -0,0 +1,69 @@
+package useros
+
+import (
+	"context"
+	"os"
+)
+
+// osFile adds the locking methods of File to an os.File.
+type osFile struct {
+	*os.File
+}
+
+// newOSFile wraps the result of an os function that opens a file.
+func newOSFile(f *os.File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return osFile{f}, nil
+}
+
+// Lock places an exclusive flock on the file, waiting until it is available.
+// The file must be opened for writing.
+func (f osFile) Lock() error {
+	return flock(f.File, true, true)
+}
+
+// RLock places a shared flock on the file, waiting until it is available.
+// As flock(2), it works on a file opened in any mode.
+func (f osFile) RLock() error {
+	return flock(f.File, false, true)
+}
+
+// TryLock places an exclusive flock on the file if it is available, and reports whether it did.
+func (f osFile) TryLock() (bool, error) {
+	err := flock(f.File, true, false)
+	if isLocked(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Unlock removes the flock of the file.
+func (f osFile) Unlock() error {
+	return funlock(f.File)
+}
+
+// LockRange places an open file description lock (F_OFD_SETLKW) on length bytes at start,
+// or up to the end of the file if length is zero, waiting until it is available or ctx is
+// done. An exclusive lock requires the file to be opened for writing, a shared lock for reading.
+func (f osFile) LockRange(ctx context.Context, start, length int64, exclusive bool) error {
+	return lockRange(ctx, f.File, start, length, exclusive)
+}
+
+// TryLockRange places an open file description lock on a range if it is available, and reports whether it did.
+func (f osFile) TryLockRange(start, length int64, exclusive bool) (bool, error) {
+	err := tryLockRange(f.File, start, length, exclusive)
+	if isLocked(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// UnlockRange removes the open file description locks on a range.
+func (f osFile) UnlockRange(start, length int64) error {
+	return unlockRange(f.File, start, length)
+}
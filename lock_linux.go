@@ -0,0 +1,147 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxLockPoll is the maximum interval between attempts of LockRange with a cancellable context.
+const maxLockPoll = 100 * time.Millisecond
+
+// checkLockMode checks that the open mode of f allows a lock. Exclusive locks
+// need a descriptor opened for writing; shared locks need one opened for
+// reading only for byte-range locks, as flock does not care.
+func checkLockMode(f *os.File, op string, exclusive, ranged bool) error {
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return logit(&os.PathError{Op: op, Path: f.Name(), Err: err})
+	}
+
+	mode := flags & unix.O_ACCMODE
+
+	if exclusive && mode == unix.O_RDONLY || !exclusive && ranged && mode == unix.O_WRONLY {
+		return logit(&os.PathError{Op: op, Path: f.Name(), Err: syscall.EBADF})
+	}
+
+	return nil
+}
+
+func flock(f *os.File, exclusive, wait bool) error {
+	if err := checkLockMode(f, "flock", exclusive, false); err != nil {
+		return err
+	}
+
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+
+	return flockErr(f, unix.Flock(int(f.Fd()), how))
+}
+
+func funlock(f *os.File) error {
+	return flockErr(f, unix.Flock(int(f.Fd()), unix.LOCK_UN))
+}
+
+func flockErr(f *os.File, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+
+	return logit(&os.PathError{Op: "flock", Path: f.Name(), Err: err})
+}
+
+// isLocked reports whether err is returned for a lock that is held by someone else.
+func isLocked(err error) bool {
+	return errors.Is(err, syscall.EWOULDBLOCK) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES)
+}
+
+func lockRange(ctx context.Context, f *os.File, start, length int64, exclusive bool) error {
+	if err := checkLockMode(f, "fcntl", exclusive, true); err != nil {
+		return err
+	}
+
+	// Without cancellation, wait in the kernel
+	if ctx.Done() == nil {
+		return setLock(f, unix.F_OFD_SETLKW, lockKind(exclusive), start, length)
+	}
+
+	for wait := time.Millisecond; ; wait *= 2 {
+		err := setLock(f, unix.F_OFD_SETLK, lockKind(exclusive), start, length)
+		if !isLocked(err) {
+			return err
+		}
+
+		if wait > maxLockPoll {
+			wait = maxLockPoll
+		}
+
+		t := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func tryLockRange(f *os.File, start, length int64, exclusive bool) error {
+	if err := checkLockMode(f, "fcntl", exclusive, true); err != nil {
+		return err
+	}
+
+	return setLock(f, unix.F_OFD_SETLK, lockKind(exclusive), start, length)
+}
+
+func unlockRange(f *os.File, start, length int64) error {
+	return setLock(f, unix.F_OFD_SETLK, unix.F_UNLCK, start, length)
+}
+
+func lockKind(exclusive bool) int16 {
+	if exclusive {
+		return unix.F_WRLCK
+	}
+
+	return unix.F_RDLCK
+}
+
+func setLock(f *os.File, cmd int, kind int16, start, length int64) error {
+	lk := unix.Flock_t{
+		Type:   kind,
+		Whence: io.SeekStart,
+		Start:  start,
+		Len:    length,
+	}
+
+	err := unix.FcntlFlock(f.Fd(), cmd, &lk)
+	if err == nil {
+		return nil
+	}
+
+	err = &os.PathError{Op: "fcntl", Path: f.Name(), Err: err}
+
+	if isLocked(err) {
+		return err
+	}
+
+	return logit(err)
+}
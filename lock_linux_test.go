@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+	o := Default()
+
+	if err := os.WriteFile(name, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := o.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	w, err := o.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	// Exclusive locks need a file opened for writing
+	if err = r.Lock(); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("expected EBADF, got %v", err)
+	}
+
+	if err = r.RLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := w.TryLock(); ok || err != nil {
+		t.Errorf("expected lock to be held, got %v: %v", ok, err)
+	}
+
+	if err = r.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := w.TryLock(); !ok || err != nil {
+		t.Errorf("expected lock, got %v: %v", ok, err)
+	}
+
+	if err = w.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Byte-range locks conflict between open file descriptions
+	if err = w.LockRange(context.Background(), 0, 2, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := r.TryLockRange(1, 1, false); ok || err != nil {
+		t.Errorf("expected range to be locked, got %v: %v", ok, err)
+	}
+
+	if ok, err := r.TryLockRange(2, 0, false); !ok || err != nil {
+		t.Errorf("expected range to be free, got %v: %v", ok, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err = r.LockRange(ctx, 0, 1, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline, got %v", err)
+	}
+
+	if err = w.UnlockRange(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.LockRange(context.Background(), 0, 1, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockWriteOnly(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+
+	l, err := Default().OpenFile(name, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// A shared flock does not need a readable descriptor
+	if err = l.RLock(); err != nil {
+		t.Errorf("expected shared lock, got %v", err)
+	}
+
+	if err = l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A shared byte-range lock does
+	if _, err = l.TryLockRange(0, 1, false); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("expected EBADF, got %v", err)
+	}
+}
+
+func TestLockUser(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		o := User{UID: 1000, GID: 1000}.OS()
+		name := filepath.Join(tree.Root, "a", "file")
+
+		tree.AssertSuccess(o.WriteFile(name, nil, 0o644))
+
+		f, err := o.Open(name)
+		tree.AssertSuccess(err)
+
+		if f == nil {
+			return
+		}
+
+		defer f.Close()
+
+		tree.AssertSuccess(f.RLock())
+		tree.AssertSuccess(f.Unlock())
+
+		if err = f.Lock(); !errors.Is(err, syscall.EBADF) {
+			t.Errorf("expected EBADF, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+func flock(f *os.File, exclusive, wait bool) error {
+	return logit(&os.PathError{Op: "flock", Path: f.Name(), Err: syscall.ENOTSUP})
+}
+
+func funlock(f *os.File) error {
+	return logit(&os.PathError{Op: "flock", Path: f.Name(), Err: syscall.ENOTSUP})
+}
+
+func isLocked(err error) bool {
+	return false
+}
+
+func lockRange(ctx context.Context, f *os.File, start, length int64, exclusive bool) error {
+	return logit(&os.PathError{Op: "fcntl", Path: f.Name(), Err: syscall.ENOTSUP})
+}
+
+func tryLockRange(f *os.File, start, length int64, exclusive bool) error {
+	return logit(&os.PathError{Op: "fcntl", Path: f.Name(), Err: syscall.ENOTSUP})
+}
+
+func unlockRange(f *os.File, start, length int64) error {
+	return logit(&os.PathError{Op: "fcntl", Path: f.Name(), Err: syscall.ENOTSUP})
+}
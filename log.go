@@ -5,18 +5,33 @@ import (
 	"runtime"
 )
 
-// LogHandler is a configurable log handler
+// LogHandler is a configurable log handler. It is used by OS instances without
+// their own logger, see WithLogger.
 var LogHandler func(error)
 
 func logit(err error) error {
-	if LogHandler == nil {
+	return logTo(LogHandler, err)
+}
+
+// logit logs to the logger of the OS, or to LogHandler if it has none.
+func (u *user) logit(err error) error {
+	if u.log == nil {
+		return logTo(LogHandler, err)
+	}
+
+	return logTo(u.log, err)
+}
+
+// logTo passes err with the location of the caller of its caller to handler.
+func logTo(handler func(error), err error) error {
+	if handler == nil {
 		return err
 	}
 
-	_, file, line, _ := runtime.Caller(1)
+	_, file, line, _ := runtime.Caller(2)
 
 	if err != nil {
-		LogHandler(fmt.Errorf("ERR at %s %d: %w", file, line, err))
+		handler(fmt.Errorf("ERR at %s %d: %w", file, line, err))
 	}
 
 	return err
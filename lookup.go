@@ -0,0 +1,111 @@
+package useros
+
+import (
+	osuser "os/user"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LookupCacheTTL is the duration for which users resolved by LookupUser and LookupUID are cached.
+var LookupCacheTTL = time.Minute
+
+// LookupUser looks up a user by name in the user database (/etc/passwd or NSS).
+// The primary and all supplementary groups from the group database are returned in Groups.
+func LookupUser(name string) (User, error) {
+	return lookupCache.get("name:"+name, func() (*osuser.User, error) {
+		return osuser.Lookup(name)
+	})
+}
+
+// LookupUID looks up a user by uid in the user database (/etc/passwd or NSS).
+// The primary and all supplementary groups from the group database are returned in Groups.
+func LookupUID(uid int) (User, error) {
+	return lookupCache.get("uid:"+strconv.Itoa(uid), func() (*osuser.User, error) {
+		return osuser.LookupId(strconv.Itoa(uid))
+	})
+}
+
+type lookupEntry struct {
+	user    User
+	expires time.Time
+}
+
+type userCache struct {
+	sync.Mutex
+	entries map[string]lookupEntry
+}
+
+var lookupCache = &userCache{entries: map[string]lookupEntry{}}
+
+func (c *userCache) get(key string, lookup func() (*osuser.User, error)) (User, error) {
+	c.Lock()
+	entry, ok := c.entries[key]
+	c.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.user.clone(), nil
+	}
+
+	u, err := lookup()
+	if err != nil {
+		return User{}, err
+	}
+
+	result, err := fromUser(u)
+	if err != nil {
+		return User{}, err
+	}
+
+	c.Lock()
+	c.entries[key] = lookupEntry{
+		user:    result,
+		expires: time.Now().Add(LookupCacheTTL),
+	}
+	c.Unlock()
+
+	return result.clone(), nil
+}
+
+// fromUser converts a user from the os/user package.
+// The primary group is always part of Groups, so that it is never empty.
+func fromUser(u *osuser.User) (User, error) {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return User{}, err
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return User{}, err
+	}
+
+	result := User{
+		UID:    uid,
+		GID:    gid,
+		Groups: []int{gid},
+	}
+
+	ids, err := u.GroupIds()
+	if err != nil {
+		return User{}, err
+	}
+
+	for _, id := range ids {
+		g, err := strconv.Atoi(id)
+		if err != nil {
+			return User{}, err
+		}
+
+		if !contains(result.Groups, g) {
+			result.Groups = append(result.Groups, g)
+		}
+	}
+
+	return result, nil
+}
+
+func (u User) clone() User {
+	u.Groups = append([]int{}, u.Groups...)
+	return u
+}
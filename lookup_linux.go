@@ -0,0 +1,133 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FromPID returns the user as which the process with the given pid accesses files,
+// i.e. the filesystem uid and gid and the supplementary groups from /proc/<pid>/status.
+func FromPID(pid int) (User, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return User{}, err
+	}
+
+	defer f.Close()
+
+	var (
+		u              User
+		hasUID, hasGID bool
+		scanner        = bufio.NewScanner(f)
+	)
+
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		if key != "Uid" && key != "Gid" && key != "Groups" {
+			continue
+		}
+
+		ids, err := parseIDs(value)
+		if err != nil {
+			return User{}, err
+		}
+
+		switch {
+		// real, effective, saved set and filesystem id
+		case key == "Uid" && len(ids) == 4:
+			u.UID = ids[3]
+			hasUID = true
+		case key == "Gid" && len(ids) == 4:
+			u.GID = ids[3]
+			hasGID = true
+		case key == "Groups":
+			u.Groups = ids
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return User{}, err
+	}
+
+	if !hasUID || !hasGID {
+		return User{}, fmt.Errorf("%w: no uid or gid in status of pid %d", os.ErrInvalid, pid)
+	}
+
+	// Make sure Groups is never empty
+	if !contains(u.Groups, u.GID) {
+		u.Groups = append([]int{u.GID}, u.Groups...)
+	}
+
+	return u, nil
+}
+
+func parseIDs(s string) ([]int, error) {
+	var ids []int
+
+	for _, field := range strings.Fields(s) {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// FromUnixConn returns the user of the peer of a unix socket, as reported by SO_PEERCRED.
+// The supplementary groups are resolved with LookupUID. If the uid is not known in the user
+// database, only the primary group of the peer is used.
+func FromUnixConn(conn *net.UnixConn) (User, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return User{}, err
+	}
+
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	if credErr != nil {
+		return User{}, credErr
+	}
+
+	u, err := LookupUID(int(cred.Uid))
+	if err != nil {
+		return User{
+			UID:    int(cred.Uid),
+			GID:    int(cred.Gid),
+			Groups: []int{int(cred.Gid)},
+		}, nil
+	}
+
+	u.GID = int(cred.Gid)
+
+	if !contains(u.Groups, u.GID) {
+		u.Groups = append(u.Groups, u.GID)
+	}
+
+	return u, nil
+}
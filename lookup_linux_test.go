@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	u, err := LookupUID(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.UID != 0 || u.GID != 0 || !contains(u.Groups, 0) {
+		t.Errorf("unexpected user %v", u)
+	}
+
+	v, err := LookupUser("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.UID != u.UID || v.GID != u.GID || !equal(v.Groups, u.Groups) {
+		t.Errorf("lookup by name %v differs from lookup by uid %v", v, u)
+	}
+
+	// Cached results must not share the groups slice
+	v.Groups[0] = -1
+
+	if w, _ := LookupUser("root"); w.Groups[0] == -1 {
+		t.Error("cached user was modified")
+	}
+}
+
+func TestFromPID(t *testing.T) {
+	u, err := FromPID(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.UID != syscall.Geteuid() || u.GID != syscall.Getegid() || len(u.Groups) == 0 {
+		t.Errorf("unexpected user %v", u)
+	}
+
+	if _, err := FromPID(-1); err == nil {
+		t.Error("expected error for invalid pid")
+	}
+}
+
+func TestFromUnixConn(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "socket")
+	defer f.Close()
+	defer syscall.Close(fds[1])
+
+	c, err := net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	u, err := FromUnixConn(c.(*net.UnixConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.UID != syscall.Geteuid() || u.GID != syscall.Getegid() || !contains(u.Groups, u.GID) {
+		t.Errorf("unexpected user %v", u)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import "net"
+
+// FromPID returns the user as which the process with the given pid accesses files.
+// It is only supported on linux.
+func FromPID(pid int) (User, error) {
+	return User{}, ErrNotSupported
+}
+
+// FromUnixConn returns the user of the peer of a unix socket.
+// It is only supported on linux.
+func FromUnixConn(conn *net.UnixConn) (User, error) {
+	return User{}, ErrNotSupported
+}
@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestOpenFlags compares OpenFile of a user with the kernel for combinations of flags and files.
+func TestOpenFlags(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		dir := filepath.Join(tree.Root, "o")
+
+		if err := os.Mkdir(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chmod(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+
+		files := map[string]struct {
+			mode os.FileMode
+			uid  int
+		}{
+			"rw":     {0o600, 1000},
+			"ro":     {0o400, 1000},
+			"wo":     {0o200, 1000},
+			"none":   {0o000, 1000},
+			"other":  {0o644, 1001},
+			"shared": {0o666, 1001},
+		}
+
+		for name, f := range files {
+			path := filepath.Join(dir, name)
+
+			if err := os.WriteFile(path, nil, f.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chmod(path, f.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chown(path, f.uid, f.uid); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := os.Mkdir(filepath.Join(dir, "dir"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink("rw", filepath.Join(dir, "link")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink("target", filepath.Join(dir, "dangling")); err != nil {
+			t.Fatal(err)
+		}
+
+		names := []string{"rw", "ro", "wo", "none", "other", "shared", "dir", "link", "dangling", "new"}
+
+		flags := []int{
+			os.O_RDONLY,
+			os.O_WRONLY,
+			os.O_RDWR,
+			os.O_RDONLY | os.O_TRUNC,
+			os.O_WRONLY | os.O_APPEND,
+			os.O_RDONLY | os.O_APPEND,
+			os.O_RDONLY | syscall.O_DIRECTORY,
+			os.O_RDONLY | syscall.O_NOFOLLOW,
+			os.O_RDONLY | syscall.O_NOATIME,
+			unix.O_PATH,
+			unix.O_PATH | syscall.O_NOFOLLOW,
+			unix.O_PATH | syscall.O_DIRECTORY,
+			os.O_WRONLY | os.O_CREATE,
+			os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+			os.O_WRONLY | os.O_CREATE | os.O_EXCL,
+			os.O_WRONLY | os.O_CREATE | syscall.O_NOFOLLOW,
+			os.O_RDONLY | os.O_CREATE | syscall.O_DIRECTORY,
+		}
+
+		u := User{UID: 1000, GID: 1000, Groups: []int{1000}}
+		kernel, emulated := u.SedeuidOS(), u.OS()
+
+		open := func(o OS, path string, flag int) error {
+			f, err := o.OpenFile(path, flag, 0o644)
+			if err == nil {
+				f.Close()
+			}
+
+			// Remove created files, so that each open sees the same tree
+			for _, name := range []string{"new", "target"} {
+				os.Remove(filepath.Join(dir, name)) //nolint:errcheck
+			}
+
+			return err
+		}
+
+		for _, name := range names {
+			for _, flag := range flags {
+				path := filepath.Join(dir, name)
+
+				expected := openResult(open(kernel, path, flag))
+				got := openResult(open(emulated, path, flag))
+
+				if got != expected {
+					t.Errorf("%s with flags %#o: expected %s, got %s", name, flag, expected, got)
+				}
+			}
+		}
+	})
+}
+
+// openResult classifies the error of an open, permission errors are not distinguished.
+func openResult(err error) string {
+	var errno syscall.Errno
+
+	switch {
+	case err == nil:
+		return "success"
+	case os.IsPermission(err):
+		return "permission denied"
+	case errors.As(err, &errno):
+		return errno.Error()
+	default:
+		return fmt.Sprint(err)
+	}
+}
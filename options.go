@@ -0,0 +1,180 @@
+package useros
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy controls which symlinks an OS returned by NewOS follows.
+type SymlinkPolicy int
+
+const (
+	// SymlinksFollow follows all symlinks, as the os package does.
+	SymlinksFollow SymlinkPolicy = iota
+
+	// SymlinksNoMagic refuses to follow procfs magic links, e.g. /proc/self/fd/0, with ELOOP.
+	SymlinksNoMagic
+
+	// SymlinksRefuse refuses to follow any symlink with ELOOP. Symlinks can
+	// still be created, removed, renamed and read with Lstat and Readlink.
+	SymlinksRefuse
+)
+
+// Option configures an OS returned by NewOS.
+type Option func(*config)
+
+type config struct {
+	log      func(error)
+	audit    AuditSink
+	umask    *os.FileMode
+	root     string
+	auth     Authorizer
+	cache    *PermissionCache
+	strict   bool
+	symlinks SymlinkPolicy
+}
+
+// WithLogger passes the errors of the OS to log, instead of to LogHandler.
+func WithLogger(log func(error)) Option {
+	return func(c *config) {
+		c.log = log
+	}
+}
+
+// WithAuditSink reports every operation of the OS to sink, see WithAudit.
+func WithAuditSink(sink AuditSink) Option {
+	return func(c *config) {
+		c.audit = sink
+	}
+}
+
+// WithUmask sets the permissions of new files and directories to the requested
+// permissions without the bits in umask, regardless of the umask of the process.
+// It is only supported on linux.
+func WithUmask(umask os.FileMode) Option {
+	return func(c *config) {
+		m := umask & os.ModePerm
+		c.umask = &m
+	}
+}
+
+// WithRoot confines the OS to the directory dir, as a Root does. Names are
+// relative to dir, and names or symlinks that escape it fail with ErrPathEscapes.
+func WithRoot(dir string) Option {
+	return func(c *config) {
+		c.root = dir
+	}
+}
+
+// WithAuthorizer decides the permission checks of the OS by a, see User.OSWithAuthorizer.
+func WithAuthorizer(a Authorizer) Option {
+	return func(c *config) {
+		c.auth = a
+	}
+}
+
+// WithCache looks up the ACLs of the permission checks in cache. A cache
+// can be shared by the OS instances of many users.
+func WithCache(cache *PermissionCache) Option {
+	return func(c *config) {
+		c.cache = cache
+	}
+}
+
+// WithStrict fails closed: NewOS returns an error wrapping ErrCannotImpersonate if
+// the user differs from the user of the process and CanImpersonate fails, instead
+// of returning an OS whose operations fail or partially succeed. Permissions are
+// also checked if the user equals the user of the process.
+func WithStrict() Option {
+	return func(c *config) {
+		c.strict = true
+	}
+}
+
+// WithSymlinks sets the symlink policy of the OS.
+func WithSymlinks(p SymlinkPolicy) Option {
+	return func(c *config) {
+		c.symlinks = p
+	}
+}
+
+// NewOS returns the OS of the user configured with options. Each OS carries
+// its own configuration, so OS instances with different options can be used
+// concurrently. On linux, NewOS(u) is equivalent to u.OS(). Other platforms
+// don't check permissions, so NewOS fails there if u is not the user of the
+// process, or if an option needs permission checks.
+func NewOS(u User, options ...Option) (OS, error) {
+	c := &config{}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	if c.strict && !u.isProcess() {
+		if err := canImpersonate(); err != nil {
+			return nil, logit(fmt.Errorf("uid %d: %w", u.UID, err))
+		}
+	}
+
+	o, err := u.newOS(c)
+	if err != nil {
+		return nil, logit(err)
+	}
+
+	var (
+		resolve   func(op, name string, follow bool) (string, error)
+		unresolve = func(name string) string { return name }
+		r         Resolver
+	)
+
+	if c.root != "" {
+		root, err := openRoot(o, c.root)
+		if err != nil {
+			return nil, err
+		}
+
+		resolve = root.resolve
+		unresolve = func(name string) string {
+			rel, err := filepath.Rel(root.name, name)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+				return name
+			}
+
+			return rel
+		}
+
+		r = Resolver{Dir: root.name, Flags: ResolveBeneath}
+	}
+
+	switch c.symlinks {
+	case SymlinksNoMagic:
+		r.Flags |= ResolveNoMagicLinks
+	case SymlinksRefuse:
+		r.Flags |= ResolveNoSymlinks
+	}
+
+	if c.symlinks != SymlinksFollow {
+		if resolve == nil {
+			resolve = symlinkResolver(r)
+		} else {
+			resolve = chain(symlinkResolver(r), resolve)
+		}
+	}
+
+	if resolve != nil {
+		o = &pathOS{OS: o, resolve: resolve, unresolve: unresolve}
+	}
+
+	if c.audit != nil {
+		o = WithAudit(o, c.audit)
+	}
+
+	return o, nil
+}
+
+// needsChecks reports whether the configuration requires the checked OS, even for the user of the process.
+func (c *config) needsChecks() bool {
+	return c.strict || c.auth != nil || c.cache != nil || c.umask != nil
+}
@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestNewOS(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "root/sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("sub", filepath.Join(dir, "root/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("../..", filepath.Join(dir, "root/sub/up")); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []error
+
+	ring := NewAuditRing(100)
+	u := User{UID: -1, GID: -1}
+
+	o, err := NewOS(u,
+		WithRoot(filepath.Join(dir, "root")),
+		WithUmask(0o077),
+		WithLogger(func(err error) { logged = append(logged, err) }),
+		WithAuditSink(ring),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = o.MkdirAll("a/b", 0o777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = o.WriteFile("link/file", []byte("data"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mode := range map[string]os.FileMode{"root/a/b": os.ModeDir | 0o700, "root/sub/file": 0o600} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode() != mode {
+			t.Errorf("%s: expected mode %s, got %s", name, mode, fi.Mode())
+		}
+	}
+
+	if data, err := o.ReadFile("sub/file"); err != nil || string(data) != "data" {
+		t.Errorf("unexpected result %q, %v", data, err)
+	}
+
+	if path, err := o.EvalSymlinks("link/file"); err != nil || path != "sub/file" {
+		t.Errorf("unexpected result %q, %v", path, err)
+	}
+
+	for _, name := range []string{"../root", "/etc/passwd", "sub/up/x"} {
+		if _, err = o.Stat(name); !errors.Is(err, ErrPathEscapes) {
+			t.Errorf("%s: expected escape, got %v", name, err)
+		}
+	}
+
+	var walked []string
+
+	if err = o.Walk("sub", func(path string, info os.FileInfo, err error) error {
+		walked = append(walked, path)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(walked) != 3 || walked[0] != "sub" || walked[1] != "sub/file" || walked[2] != "sub/up" {
+		t.Errorf("unexpected walk %v", walked)
+	}
+
+	if _, err = o.Open("missing"); err == nil || len(logged) == 0 {
+		t.Errorf("expected logged error, got %v and %v", err, logged)
+	}
+
+	if len(ring.Events()) == 0 {
+		t.Error("expected audit events")
+	}
+
+	// Refuse symlinks
+	o, err = NewOS(u, WithRoot(filepath.Join(dir, "root")), WithSymlinks(SymlinksRefuse))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = o.Stat("link/file"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("expected ELOOP, got %v", err)
+	}
+
+	if _, err = o.Stat("link"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("expected ELOOP, got %v", err)
+	}
+
+	if _, err = o.Lstat("link"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = o.Stat("sub/file"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = NewOS(u, WithRoot(filepath.Join(dir, "missing"))); err == nil {
+		t.Error("expected error for missing root")
+	}
+
+	// A logger alone doesn't require permission checks
+	logged = nil
+
+	if o, err = NewOS(u, WithLogger(func(err error) { logged = append(logged, err) })); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := o.(*def); !ok {
+		t.Errorf("expected the default OS, got %T", o)
+	}
+
+	if _, err = o.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) || len(logged) != 1 {
+		t.Errorf("expected a logged error, got %v and %v", err, logged)
+	}
+}
@@ -0,0 +1,300 @@
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the only protocol version spoken by the server.
+const Version = "9P2000.L"
+
+// Message types of 9P2000.L. Only the messages handled by the server are listed.
+const (
+	Tlerror    uint8 = 6
+	Rlerror    uint8 = 7
+	Tstatfs    uint8 = 8
+	Rstatfs    uint8 = 9
+	Tlopen     uint8 = 12
+	Rlopen     uint8 = 13
+	Tlcreate   uint8 = 14
+	Rlcreate   uint8 = 15
+	Tsymlink   uint8 = 16
+	Rsymlink   uint8 = 17
+	Treadlink  uint8 = 22
+	Rreadlink  uint8 = 23
+	Tgetattr   uint8 = 24
+	Rgetattr   uint8 = 25
+	Tsetattr   uint8 = 26
+	Rsetattr   uint8 = 27
+	Txattrwalk uint8 = 30
+	Rxattrwalk uint8 = 31
+	Treaddir   uint8 = 40
+	Rreaddir   uint8 = 41
+	Tfsync     uint8 = 50
+	Rfsync     uint8 = 51
+	Tlock      uint8 = 52
+	Rlock      uint8 = 53
+	Tgetlock   uint8 = 54
+	Rgetlock   uint8 = 55
+	Tmkdir     uint8 = 72
+	Rmkdir     uint8 = 73
+	Trenameat  uint8 = 74
+	Rrenameat  uint8 = 75
+	Tunlinkat  uint8 = 76
+	Runlinkat  uint8 = 77
+	Tversion   uint8 = 100
+	Rversion   uint8 = 101
+	Tattach    uint8 = 104
+	Rattach    uint8 = 105
+	Tflush     uint8 = 108
+	Rflush     uint8 = 109
+	Twalk      uint8 = 110
+	Rwalk      uint8 = 111
+	Tread      uint8 = 116
+	Rread      uint8 = 117
+	Twrite     uint8 = 118
+	Rwrite     uint8 = 119
+	Tclunk     uint8 = 120
+	Rclunk     uint8 = 121
+	Tremove    uint8 = 122
+	Rremove    uint8 = 123
+)
+
+// Special values for tags, fids and uids.
+const (
+	NoTag uint16 = 0xffff
+	NoFid uint32 = 0xffffffff
+	NoUID uint32 = 0xffffffff
+)
+
+// maxWalkElem is the maximal number of names in a single walk.
+const maxWalkElem = 16
+
+// Qid types.
+const (
+	QTDIR     uint8 = 0x80
+	QTSYMLINK uint8 = 0x02
+	QTFILE    uint8 = 0x00
+)
+
+// Getattr request mask bits.
+const (
+	GetattrMode        uint64 = 0x00000001
+	GetattrNlink       uint64 = 0x00000002
+	GetattrUID         uint64 = 0x00000004
+	GetattrGID         uint64 = 0x00000008
+	GetattrRdev        uint64 = 0x00000010
+	GetattrAtime       uint64 = 0x00000020
+	GetattrMtime       uint64 = 0x00000040
+	GetattrCtime       uint64 = 0x00000080
+	GetattrIno         uint64 = 0x00000100
+	GetattrSize        uint64 = 0x00000200
+	GetattrBlocks      uint64 = 0x00000400
+	GetattrBasic       uint64 = 0x000007ff
+	GetattrBtime       uint64 = 0x00000800
+	GetattrGen         uint64 = 0x00001000
+	GetattrDataVersion uint64 = 0x00002000
+	GetattrAll         uint64 = 0x00003fff
+)
+
+// Setattr valid bits.
+const (
+	SetattrMode     uint32 = 0x00000001
+	SetattrUID      uint32 = 0x00000002
+	SetattrGID      uint32 = 0x00000004
+	SetattrSize     uint32 = 0x00000008
+	SetattrAtime    uint32 = 0x00000010
+	SetattrMtime    uint32 = 0x00000020
+	SetattrCtime    uint32 = 0x00000040
+	SetattrAtimeSet uint32 = 0x00000080
+	SetattrMtimeSet uint32 = 0x00000100
+)
+
+// Lock types, flags and status values.
+const (
+	LockTypeRead   uint8  = 0
+	LockTypeWrite  uint8  = 1
+	LockTypeUnlock uint8  = 2
+	LockFlagsBlock uint32 = 1
+	LockSuccess    uint8  = 0
+	LockBlocked    uint8  = 1
+	LockError      uint8  = 2
+)
+
+// ErrMessage is returned when a message cannot be decoded.
+var ErrMessage = errors.New("malformed 9p message")
+
+// Qid is the server's unique identification of a file.
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// buffer encodes and decodes the little endian wire format of 9P.
+// Decoding errors are sticky and reported by err.
+type buffer struct {
+	data []byte
+	bad  bool
+}
+
+func (b *buffer) u8() uint8 {
+	if len(b.data) < 1 {
+		b.bad = true
+		return 0
+	}
+
+	v := b.data[0]
+	b.data = b.data[1:]
+
+	return v
+}
+
+func (b *buffer) u16() uint16 {
+	if len(b.data) < 2 {
+		b.bad = true
+		return 0
+	}
+
+	v := binary.LittleEndian.Uint16(b.data)
+	b.data = b.data[2:]
+
+	return v
+}
+
+func (b *buffer) u32() uint32 {
+	if len(b.data) < 4 {
+		b.bad = true
+		return 0
+	}
+
+	v := binary.LittleEndian.Uint32(b.data)
+	b.data = b.data[4:]
+
+	return v
+}
+
+func (b *buffer) u64() uint64 {
+	if len(b.data) < 8 {
+		b.bad = true
+		return 0
+	}
+
+	v := binary.LittleEndian.Uint64(b.data)
+	b.data = b.data[8:]
+
+	return v
+}
+
+func (b *buffer) str() string {
+	n := int(b.u16())
+	if len(b.data) < n {
+		b.bad = true
+		return ""
+	}
+
+	v := string(b.data[:n])
+	b.data = b.data[n:]
+
+	return v
+}
+
+func (b *buffer) bytes(n int) []byte {
+	if n < 0 || len(b.data) < n {
+		b.bad = true
+		return nil
+	}
+
+	v := b.data[:n]
+	b.data = b.data[n:]
+
+	return v
+}
+
+func (b *buffer) qid() Qid {
+	return Qid{
+		Type:    b.u8(),
+		Version: b.u32(),
+		Path:    b.u64(),
+	}
+}
+
+func (b *buffer) err() error {
+	if b.bad {
+		return ErrMessage
+	}
+
+	return nil
+}
+
+func (b *buffer) putU8(v uint8) *buffer {
+	b.data = append(b.data, v)
+	return b
+}
+
+func (b *buffer) putU16(v uint16) *buffer {
+	b.data = binary.LittleEndian.AppendUint16(b.data, v)
+	return b
+}
+
+func (b *buffer) putU32(v uint32) *buffer {
+	b.data = binary.LittleEndian.AppendUint32(b.data, v)
+	return b
+}
+
+func (b *buffer) putU64(v uint64) *buffer {
+	b.data = binary.LittleEndian.AppendUint64(b.data, v)
+	return b
+}
+
+func (b *buffer) putStr(v string) *buffer {
+	b.putU16(uint16(len(v)))
+	b.data = append(b.data, v...)
+
+	return b
+}
+
+func (b *buffer) putBytes(v []byte) *buffer {
+	b.data = append(b.data, v...)
+	return b
+}
+
+func (b *buffer) putQid(q Qid) *buffer {
+	return b.putU8(q.Type).putU32(q.Version).putU64(q.Path)
+}
+
+// newMessage starts a message with room for the size header.
+func newMessage(typ uint8, tag uint16) *buffer {
+	b := &buffer{data: make([]byte, 4, 64)}
+	return b.putU8(typ).putU16(tag)
+}
+
+// message finalizes the size header and returns the encoded message.
+func (b *buffer) message() []byte {
+	binary.LittleEndian.PutUint32(b.data, uint32(len(b.data)))
+	return b.data
+}
+
+// readMessage reads a single message and returns its type, tag and body.
+func readMessage(r io.Reader, msize uint32) (uint8, uint16, *buffer, error) {
+	var hdr [7]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(hdr[:4])
+	if size < 7 || size > msize {
+		return 0, 0, nil, fmt.Errorf("%w: size %d", ErrMessage, size)
+	}
+
+	body := make([]byte, size-7)
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return hdr[4], binary.LittleEndian.Uint16(hdr[5:]), &buffer{data: body}, nil
+}
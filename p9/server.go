@@ -0,0 +1,1657 @@
+//go:build linux
+// +build linux
+
+// Package p9 implements a 9P2000.L file server on top of useros.
+// Each attach is mapped to a useros.User, and all file operations
+// on behalf of that attach go through the user's OS, so clients get
+// exactly the permissions of the user they attach as.
+package p9
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/peterverraedt/useros"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMessageSize is the maximal message size if none is configured.
+const DefaultMessageSize = 1 << 20
+
+// MinMessageSize is the smallest msize a client can negotiate.
+const MinMessageSize = 4096
+
+// Server serves the directory tree below Root over 9P2000.L.
+type Server struct {
+	// Root is the exported directory. The aname of an attach selects a subdirectory.
+	Root string
+
+	// Users maps the uname and n_uname of an attach to a user.
+	// If nil, the user is looked up in the user database.
+	Users func(uname string, uid uint32) (useros.User, error)
+
+	// MessageSize is the maximal negotiated msize, at least MinMessageSize.
+	MessageSize uint32
+}
+
+// Serve accepts connections on the listener and serves each of them.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(c) //nolint:errcheck
+	}
+}
+
+// ServeConn serves a single 9P connection until it is closed.
+// Requests are handled concurrently, responses are written as they complete.
+func (s *Server) ServeConn(rw io.ReadWriteCloser) error {
+	c := &conn{
+		server:  s,
+		rw:      rw,
+		msize:   s.messageSize(),
+		fids:    map[uint32]*fid{},
+		pending: map[uint16]chan struct{}{},
+	}
+
+	defer c.close()
+
+	for {
+		typ, tag, body, err := readMessage(rw, c.msize)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// A version message resets the session, handle it before reading further
+		if typ == Tversion {
+			c.wg.Wait()
+			c.respond(c.version(tag, body))
+
+			continue
+		}
+
+		c.wg.Add(1)
+
+		done := c.start(tag)
+
+		go func() {
+			defer c.wg.Done()
+			defer c.finish(tag, done)
+
+			r, err := c.handle(typ, tag, body)
+			c.respond(tag, r, err)
+		}()
+	}
+}
+
+func (s *Server) messageSize() uint32 {
+	switch {
+	case s.MessageSize == 0:
+		return DefaultMessageSize
+	case s.MessageSize < MinMessageSize:
+		return MinMessageSize
+	default:
+		return s.MessageSize
+	}
+}
+
+func (s *Server) lookup(uname string, uid uint32) (useros.User, error) {
+	if s.Users != nil {
+		return s.Users(uname, uid)
+	}
+
+	if uid != NoUID {
+		return useros.LookupUID(int(uid))
+	}
+
+	return useros.LookupUser(uname)
+}
+
+type conn struct {
+	server *Server
+	rw     io.ReadWriteCloser
+	msize  uint32
+	wg     sync.WaitGroup
+	wmu    sync.Mutex
+
+	// mu guards fids and pending, the requests in flight by tag
+	mu      sync.Mutex
+	fids    map[uint32]*fid
+	pending map[uint16]chan struct{}
+}
+
+// fid is the server side state of a client fid. The user, root and xattr
+// fields never change, the state is guarded by mu.
+type fid struct {
+	user    useros.User
+	os      useros.OS
+	root    string
+	xattr   []byte
+	isXattr bool
+
+	mu sync.Mutex
+	fidState
+	dirents []dirent
+}
+
+// fidState is the state of a fid that changes when it is opened or created.
+type fidState struct {
+	path  string
+	qid   Qid
+	file  useros.File
+	flags int
+}
+
+// state returns a copy of the state of the fid.
+func (f *fid) state() fidState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.fidState
+}
+
+// release takes the opened file from the fid, to close it.
+func (f *fid) release() useros.File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file := f.file
+	f.file = nil
+
+	return file
+}
+
+type dirent struct {
+	qid  Qid
+	typ  uint8
+	name string
+}
+
+func (c *conn) respond(tag uint16, b *buffer, err error) {
+	if err != nil {
+		b = newMessage(Rlerror, tag).putU32(errno(err))
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.rw.Write(b.message()) //nolint:errcheck
+}
+
+func (c *conn) close() {
+	c.wg.Wait()
+	c.clunkAll()
+	c.rw.Close()
+}
+
+func (c *conn) clunkAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, f := range c.fids {
+		if file := f.release(); file != nil {
+			file.Close()
+		}
+
+		delete(c.fids, id)
+	}
+}
+
+// start registers the request with the tag as in flight.
+func (c *conn) start(tag uint16) chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	done := make(chan struct{})
+	c.pending[tag] = done
+
+	return done
+}
+
+// finish marks the request with the tag as answered.
+func (c *conn) finish(tag uint16, done chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending[tag] == done {
+		delete(c.pending, tag)
+	}
+
+	close(done)
+}
+
+// flush waits until the request with the old tag is answered, as a Tflush
+// must only be answered after the response to the request it flushes.
+func (c *conn) flush(tag uint16, b *buffer) (*buffer, error) {
+	oldtag := b.u16()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	done, ok := c.pending[oldtag]
+	c.mu.Unlock()
+
+	if ok && oldtag != tag {
+		<-done
+	}
+
+	return newMessage(Rflush, tag), nil
+}
+
+func (c *conn) get(id uint32) (*fid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return f, nil
+}
+
+func (c *conn) put(id uint32, f *fid) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.fids[id]; ok {
+		return syscall.EBADF
+	}
+
+	c.fids[id] = f
+
+	return nil
+}
+
+func (c *conn) remove(id uint32) (*fid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	delete(c.fids, id)
+
+	return f, nil
+}
+
+func (c *conn) version(tag uint16, b *buffer) (uint16, *buffer, error) {
+	msize := b.u32()
+	version := b.str()
+
+	if err := b.err(); err != nil {
+		return tag, nil, err
+	}
+
+	if msize < MinMessageSize {
+		return tag, nil, syscall.EINVAL
+	}
+
+	c.clunkAll()
+
+	if msize < c.msize {
+		c.msize = msize
+	}
+
+	if !strings.HasPrefix(version, Version) {
+		version = "unknown"
+	} else {
+		version = Version
+	}
+
+	return tag, newMessage(Rversion, tag).putU32(c.msize).putStr(version), nil
+}
+
+func (c *conn) handle(typ uint8, tag uint16, b *buffer) (*buffer, error) {
+	switch typ {
+	case Tattach:
+		return c.attach(tag, b)
+	case Twalk:
+		return c.walk(tag, b)
+	case Tlopen:
+		return c.lopen(tag, b)
+	case Tlcreate:
+		return c.lcreate(tag, b)
+	case Tread:
+		return c.read(tag, b)
+	case Twrite:
+		return c.write(tag, b)
+	case Tclunk:
+		return c.clunk(tag, b)
+	case Tremove:
+		return c.removeFid(tag, b)
+	case Treaddir:
+		return c.readdir(tag, b)
+	case Tgetattr:
+		return c.getattr(tag, b)
+	case Tsetattr:
+		return c.setattr(tag, b)
+	case Tmkdir:
+		return c.mkdir(tag, b)
+	case Tsymlink:
+		return c.symlink(tag, b)
+	case Treadlink:
+		return c.readlink(tag, b)
+	case Tunlinkat:
+		return c.unlinkat(tag, b)
+	case Trenameat:
+		return c.renameat(tag, b)
+	case Txattrwalk:
+		return c.xattrwalk(tag, b)
+	case Tlock:
+		return c.lock(tag, b)
+	case Tgetlock:
+		return c.getlock(tag, b)
+	case Tfsync:
+		return c.fsync(tag, b)
+	case Tstatfs:
+		return c.statfs(tag, b)
+	case Tflush:
+		return c.flush(tag, b)
+	default:
+		return nil, syscall.ENOSYS
+	}
+}
+
+func (c *conn) attach(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	afid := b.u32()
+	uname := b.str()
+	aname := b.str()
+	uid := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	if afid != NoFid {
+		return nil, syscall.EINVAL
+	}
+
+	u, err := c.server.lookup(uname, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Paths below the attach root are checked against its resolved path
+	root, err := filepath.EvalSymlinks(c.server.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fid{
+		user: u,
+		os:   u.OS(),
+	}
+
+	res, err := useros.Resolver{Dir: root, Flags: useros.ResolveBeneath}.Resolve("." + filepath.Clean("/"+aname))
+	if err != nil {
+		return nil, err
+	}
+
+	f.root = res.Path
+	f.path = f.root
+
+	fi, err := f.os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	f.qid = qidOf(fi)
+
+	if err := c.put(id, f); err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rattach, tag).putQid(f.qid), nil
+}
+
+func (c *conn) walk(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	newid := b.u32()
+	n := int(b.u16())
+
+	if n > maxWalkElem {
+		return nil, syscall.EINVAL
+	}
+
+	names := make([]string, n)
+	for i := range names {
+		names[i] = b.str()
+	}
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st := f.state()
+
+	// An opened fid can't be walked, not even to clone it
+	if st.file != nil {
+		return nil, syscall.EBADF
+	}
+
+	nf := &fid{
+		user: f.user,
+		os:   f.os,
+		root: f.root,
+	}
+
+	nf.path, nf.qid = st.path, st.qid
+
+	qids := make([]Qid, 0, n)
+
+	for i, name := range names {
+		var (
+			next string
+			fi   os.FileInfo
+		)
+
+		// Symlinks are resolved by the client, never walked through
+		if nf.qid.Type&QTDIR == 0 {
+			err = syscall.ENOTDIR
+		} else {
+			next, err = nf.child(nf.path, name)
+		}
+
+		if err == nil {
+			fi, err = nf.os.Lstat(next)
+		}
+
+		if err != nil && i == 0 {
+			return nil, err
+		} else if err != nil {
+			break
+		}
+
+		nf.path = next
+		nf.qid = qidOf(fi)
+		qids = append(qids, nf.qid)
+	}
+
+	if len(qids) == n {
+		if id == newid {
+			c.mu.Lock()
+			if f.state().file != nil {
+				c.mu.Unlock()
+				return nil, syscall.EBADF
+			}
+			c.fids[id] = nf
+			c.mu.Unlock()
+		} else if err := c.put(newid, nf); err != nil {
+			return nil, err
+		}
+	}
+
+	r := newMessage(Rwalk, tag).putU16(uint16(len(qids)))
+	for _, q := range qids {
+		r.putQid(q)
+	}
+
+	return r, nil
+}
+
+// child returns the path of the named entry in the directory dir of the fid.
+// Walking to ".." from the attach root stays at the root.
+func (f *fid) child(dir, name string) (string, error) {
+	var path string
+
+	switch {
+	case name == ".." && dir == f.root:
+		path = f.root
+	case name == "..":
+		path = filepath.Dir(dir)
+	case name == ".":
+		path = dir
+	case name == "", strings.ContainsRune(name, '/'):
+		return "", syscall.EINVAL
+	default:
+		path = filepath.Join(dir, name)
+	}
+
+	return f.resolve(path)
+}
+
+// entry returns the path of the named entry in the directory dir of the fid,
+// refusing the special names "." and "..".
+func (f *fid) entry(dir, name string) (string, error) {
+	if name == "." || name == ".." {
+		return "", syscall.EINVAL
+	}
+
+	return f.child(dir, name)
+}
+
+// resolve checks that the directories of path are below the attach root and not symlinks,
+// as operations by name follow symlinks in the directories of a path. A directory that is
+// replaced by a symlink after it was walked is refused with ELOOP.
+func (f *fid) resolve(path string) (string, error) {
+	if path == f.root {
+		return path, nil
+	}
+
+	dir := filepath.Dir(path)
+
+	rel, err := filepath.Rel(f.root, dir)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := useros.Resolver{Dir: f.root, Flags: useros.ResolveBeneath}.Resolve(rel)
+	if err != nil {
+		return "", err
+	}
+
+	if res.Path != dir {
+		return "", syscall.ELOOP
+	}
+
+	return path, nil
+}
+
+// target returns the path of the fid itself, after checking it with resolve.
+func (f *fid) target() (fidState, error) {
+	st := f.state()
+
+	_, err := f.resolve(st.path)
+
+	return st, err
+}
+
+// openFlags are the Linux open flags that are passed from Tlopen and Tlcreate.
+const openFlags = syscall.O_ACCMODE | syscall.O_TRUNC | syscall.O_APPEND | syscall.O_NONBLOCK |
+	syscall.O_DSYNC | syscall.O_SYNC | syscall.O_DIRECTORY | syscall.O_NOFOLLOW
+
+func (c *conn) lopen(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	flags := int(b.u32()) & openFlags
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.target()
+	if err != nil {
+		return nil, err
+	}
+
+	if st.file != nil || f.isXattr {
+		return nil, syscall.EBADF
+	}
+
+	var file useros.File
+
+	// A final symlink is never followed, the client resolves it. As open(2),
+	// O_TRUNC also truncates a file opened read-only.
+	if st.qid.Type&QTDIR != 0 || flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		file, err = f.os.OpenFile(st.path, os.O_RDONLY|flags&syscall.O_TRUNC|syscall.O_NOFOLLOW, 0)
+	} else {
+		file, err = f.openWrite(st.path, flags)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = f.opened(st.path, st.qid, file, flags); err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rlopen, tag).putQid(st.qid).putU32(c.iounit()), nil
+}
+
+// opened sets the opened file of the fid, unless a concurrent request opened it first.
+func (f *fid) opened(path string, qid Qid, file useros.File, flags int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		file.Close()
+		return syscall.EBADF
+	}
+
+	f.fidState = fidState{path: path, qid: qid, file: file, flags: flags}
+
+	return nil
+}
+
+// openWrite opens an existing file for writing after checking the permissions explicitly.
+func (f *fid) openWrite(path string, flags int) (useros.File, error) {
+	fi, err := f.os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil, syscall.ELOOP
+	}
+
+	if flags&syscall.O_ACCMODE == syscall.O_RDWR {
+		if err := f.user.CanReadObject(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := f.user.CanWriteObject(path); err != nil {
+		return nil, err
+	}
+
+	return f.os.OpenFile(path, flags|syscall.O_NOFOLLOW, 0)
+}
+
+func (c *conn) lcreate(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	name := b.str()
+	flags := int(b.u32()) & openFlags
+	mode := b.u32()
+	gid := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st := f.state()
+
+	if st.file != nil || f.isXattr {
+		return nil, syscall.EBADF
+	}
+
+	path, err := f.entry(st.path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := f.os.OpenFile(path, flags|os.O_CREATE|os.O_EXCL, fileMode(mode).Perm())
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := file.Stat()
+	if err == nil {
+		err = f.chgrp(fi, gid, file.Chown)
+	}
+
+	if err != nil {
+		file.Close()
+		f.os.Remove(path) //nolint:errcheck
+
+		return nil, err
+	}
+
+	qid := qidOf(fi)
+
+	if err = f.opened(path, qid, file, flags); err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rlcreate, tag).putQid(qid).putU32(c.iounit()), nil
+}
+
+// chgrp changes the group of a newly created inode to the requested gid, if it differs.
+func (f *fid) chgrp(fi os.FileInfo, gid uint32, chown func(uid, gid int) error) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || gid == NoUID || st.Gid == gid {
+		return nil
+	}
+
+	return chown(int(st.Uid), int(gid))
+}
+
+func (c *conn) iounit() uint32 {
+	return c.msize - 24
+}
+
+func (c *conn) read(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	offset := b.u64()
+	count := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+
+	var data []byte
+
+	st := f.state()
+
+	switch {
+	case f.isXattr:
+		if offset < uint64(len(f.xattr)) {
+			data = f.xattr[offset:]
+		}
+
+		if len(data) > int(count) {
+			data = data[:count]
+		}
+	case st.file != nil:
+		data = make([]byte, count)
+
+		n, err := st.file.ReadAt(data, int64(offset))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		data = data[:n]
+	default:
+		return nil, syscall.EBADF
+	}
+
+	return newMessage(Rread, tag).putU32(uint32(len(data))).putBytes(data), nil
+}
+
+func (c *conn) write(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	offset := b.u64()
+	count := b.u32()
+	data := b.bytes(int(count))
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st := f.state()
+
+	if st.file == nil {
+		return nil, syscall.EBADF
+	}
+
+	var n int
+
+	// WriteAt is refused by the os package for files opened with O_APPEND
+	if st.flags&syscall.O_APPEND != 0 {
+		n, err = st.file.Write(data)
+	} else {
+		n, err = st.file.WriteAt(data, int64(offset))
+	}
+
+	if err != nil && n == 0 {
+		return nil, err
+	}
+
+	return newMessage(Rwrite, tag).putU32(uint32(n)), nil
+}
+
+func (c *conn) clunk(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.remove(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if file := f.release(); file != nil {
+		if err := file.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return newMessage(Rclunk, tag), nil
+}
+
+func (c *conn) removeFid(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	// The fid is clunked, even if the remove fails
+	f, err := c.remove(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if file := f.release(); file != nil {
+		file.Close()
+	}
+
+	st, err := f.target()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.os.Remove(st.path); err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rremove, tag), nil
+}
+
+func (c *conn) readdir(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	offset := b.u64()
+	count := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cached entries belong to the fid
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil || f.qid.Type&QTDIR == 0 {
+		return nil, syscall.EBADF
+	}
+
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+
+	// Read the complete directory when starting from the beginning,
+	// later calls continue from the cached list.
+	if offset == 0 || f.dirents == nil {
+		if f.dirents, err = f.readdir(); err != nil {
+			return nil, err
+		}
+	}
+
+	data := &buffer{}
+
+	for i := offset; i < uint64(len(f.dirents)); i++ {
+		d := f.dirents[i]
+
+		if len(data.data)+24+len(d.name) > int(count) {
+			break
+		}
+
+		data.putQid(d.qid).putU64(i + 1).putU8(d.typ).putStr(d.name)
+	}
+
+	return newMessage(Rreaddir, tag).putU32(uint32(len(data.data))).putBytes(data.data), nil
+}
+
+func (f *fid) readdir() ([]dirent, error) {
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries, err := f.file.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := f.qid
+
+	if f.path != f.root {
+		if fi, err := f.os.Stat(filepath.Dir(f.path)); err == nil {
+			parent = qidOf(fi)
+		}
+	}
+
+	result := []dirent{
+		{qid: f.qid, typ: syscall.DT_DIR, name: "."},
+		{qid: parent, typ: syscall.DT_DIR, name: ".."},
+	}
+
+	for _, entry := range entries {
+		d := dirent{
+			name: entry.Name(),
+			typ:  direntType(entry.Type()),
+		}
+
+		if fi, err := entry.Info(); err == nil {
+			d.qid = qidOf(fi)
+		}
+
+		result = append(result, d)
+	}
+
+	return result, nil
+}
+
+func (c *conn) getattr(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	_ = b.u64() // request mask, we always return the basic set
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var fi os.FileInfo
+
+	if st := f.state(); st.file != nil {
+		fi, err = st.file.Stat()
+	} else if st, err = f.target(); err == nil {
+		fi, err = f.os.Lstat(st.path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, useros.ErrTypeAssertion
+	}
+
+	r := newMessage(Rgetattr, tag).
+		putU64(GetattrBasic).
+		putQid(qidOf(fi)).
+		putU32(st.Mode).
+		putU32(st.Uid).
+		putU32(st.Gid).
+		putU64(uint64(st.Nlink)).
+		putU64(uint64(st.Rdev)).
+		putU64(uint64(st.Size)).
+		putU64(uint64(st.Blksize)).
+		putU64(uint64(st.Blocks)).
+		putU64(uint64(st.Atim.Sec)).
+		putU64(uint64(st.Atim.Nsec)).
+		putU64(uint64(st.Mtim.Sec)).
+		putU64(uint64(st.Mtim.Nsec)).
+		putU64(uint64(st.Ctim.Sec)).
+		putU64(uint64(st.Ctim.Nsec)).
+		putU64(0). // btime
+		putU64(0).
+		putU64(0). // gen
+		putU64(0)  // data version
+
+	return r, nil
+}
+
+func (c *conn) setattr(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	valid := b.u32()
+	mode := b.u32()
+	uid := b.u32()
+	gid := b.u32()
+	size := b.u64()
+	atime := time.Unix(int64(b.u64()), int64(b.u64()))
+	mtime := time.Unix(int64(b.u64()), int64(b.u64()))
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.target()
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.os.Lstat(st.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the owner of a symlink can be changed, the other attributes would follow it
+	if fi.Mode()&os.ModeSymlink != 0 && valid&(SetattrMode|SetattrSize|SetattrAtime|SetattrMtime) != 0 {
+		return nil, syscall.ELOOP
+	}
+
+	if valid&SetattrMode != 0 {
+		if err := f.os.Chmod(st.path, fileMode(mode)); err != nil {
+			return nil, err
+		}
+	}
+
+	if valid&(SetattrUID|SetattrGID) != 0 {
+		sys, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil, useros.ErrTypeAssertion
+		}
+
+		if valid&SetattrUID == 0 {
+			uid = sys.Uid
+		}
+
+		if valid&SetattrGID == 0 {
+			gid = sys.Gid
+		}
+
+		if err := f.os.Lchown(st.path, int(uid), int(gid)); err != nil {
+			return nil, err
+		}
+	}
+
+	if valid&SetattrSize != 0 {
+		if err := f.os.Truncate(st.path, int64(size)); err != nil {
+			return nil, err
+		}
+	}
+
+	if valid&(SetattrAtime|SetattrMtime) != 0 {
+		now := time.Now()
+
+		switch {
+		case valid&SetattrAtime == 0:
+			atime = accessTime(fi)
+		case valid&SetattrAtimeSet == 0:
+			atime = now
+		}
+
+		switch {
+		case valid&SetattrMtime == 0:
+			mtime = fi.ModTime()
+		case valid&SetattrMtimeSet == 0:
+			mtime = now
+		}
+
+		if err := f.os.Chtimes(st.path, atime, mtime); err != nil {
+			return nil, err
+		}
+	}
+
+	return newMessage(Rsetattr, tag), nil
+}
+
+func (c *conn) mkdir(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	name := b.str()
+	mode := b.u32()
+	gid := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := f.entry(f.state().path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.os.Mkdir(path, fileMode(mode)); err != nil {
+		return nil, err
+	}
+
+	fi, err := f.created(path, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rmkdir, tag).putQid(qidOf(fi)), nil
+}
+
+func (c *conn) symlink(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	name := b.str()
+	target := b.str()
+	gid := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := f.entry(f.state().path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.os.Symlink(target, path); err != nil {
+		return nil, err
+	}
+
+	fi, err := f.created(path, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rsymlink, tag).putQid(qidOf(fi)), nil
+}
+
+// created applies the requested gid to a newly created inode and returns its stat.
+// The inode is removed again if this fails.
+func (f *fid) created(path string, gid uint32) (os.FileInfo, error) {
+	fi, err := f.os.Lstat(path)
+	if err == nil {
+		err = f.chgrp(fi, gid, func(uid, gid int) error {
+			return f.os.Lchown(path, uid, gid)
+		})
+	}
+
+	if err != nil {
+		f.os.Remove(path) //nolint:errcheck
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+func (c *conn) readlink(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.target()
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := f.os.Readlink(st.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rreadlink, tag).putStr(target), nil
+}
+
+func (c *conn) unlinkat(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	name := b.str()
+	flags := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := f.entry(f.state().path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case flags&unix.AT_REMOVEDIR != 0 && !fi.IsDir():
+		return nil, syscall.ENOTDIR
+	case flags&unix.AT_REMOVEDIR == 0 && fi.IsDir():
+		return nil, syscall.EISDIR
+	}
+
+	if err := f.os.Remove(path); err != nil {
+		return nil, err
+	}
+
+	return newMessage(Runlinkat, tag), nil
+}
+
+func (c *conn) renameat(tag uint16, b *buffer) (*buffer, error) {
+	oldid := b.u32()
+	oldname := b.str()
+	newid := b.u32()
+	newname := b.str()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	olddir, err := c.get(oldid)
+	if err != nil {
+		return nil, err
+	}
+
+	newdir, err := c.get(newid)
+	if err != nil {
+		return nil, err
+	}
+
+	oldpath, err := olddir.entry(olddir.state().path, oldname)
+	if err != nil {
+		return nil, err
+	}
+
+	newpath, err := newdir.entry(newdir.state().path, newname)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := olddir.os.Rename(oldpath, newpath); err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rrenameat, tag), nil
+}
+
+func (c *conn) xattrwalk(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	newid := b.u32()
+	name := b.str()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.target()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := f.getxattr(st.path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	nf := &fid{
+		user:    f.user,
+		os:      f.os,
+		root:    f.root,
+		xattr:   data,
+		isXattr: true,
+	}
+
+	nf.path, nf.qid = st.path, st.qid
+
+	if err := c.put(newid, nf); err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rxattrwalk, tag).putU64(uint64(len(data))), nil
+}
+
+// getxattr reads the named extended attribute, or the list of attribute names if name is empty.
+// Attributes in the user namespace require read access, the trusted namespace is reserved for root.
+func (f *fid) getxattr(path, name string) ([]byte, error) {
+	if _, err := f.os.Lstat(path); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(name, "user."):
+		if err := f.user.CanReadObject(path); err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(name, "trusted.") && f.user.UID != 0:
+		return nil, syscall.ENODATA
+	}
+
+	get := func(dest []byte) (int, error) {
+		if name == "" {
+			return unix.Llistxattr(path, dest)
+		}
+
+		return unix.Lgetxattr(path, name, dest)
+	}
+
+	for {
+		size, err := get(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, size)
+
+		n, err := get(data)
+		if errors.Is(err, syscall.ERANGE) {
+			// The attribute grew in between both calls
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if name == "" {
+			return f.filterXattrs(data[:n]), nil
+		}
+
+		return data[:n], nil
+	}
+}
+
+// filterXattrs removes attribute names that the user is not allowed to see from a list.
+func (f *fid) filterXattrs(list []byte) []byte {
+	if f.user.UID == 0 {
+		return list
+	}
+
+	var result []byte
+
+	for _, name := range strings.SplitAfter(string(list), "\x00") {
+		if name != "" && !strings.HasPrefix(name, "trusted.") {
+			result = append(result, name...)
+		}
+	}
+
+	return result
+}
+
+func (c *conn) lock(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	typ := b.u8()
+	_ = b.u32() // flags, blocking locks are retried by the client
+	start := b.u64()
+	length := b.u64()
+	_ = b.u32() // proc_id
+	_ = b.str() // client_id
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st := f.state()
+
+	if st.file == nil {
+		return nil, syscall.EBADF
+	}
+
+	locked := true
+
+	switch typ {
+	case LockTypeRead, LockTypeWrite:
+		locked, err = st.file.TryLockRange(int64(start), int64(length), typ == LockTypeWrite)
+	default:
+		err = st.file.UnlockRange(int64(start), int64(length))
+	}
+
+	status := LockSuccess
+
+	if err != nil {
+		status = LockError
+	} else if !locked {
+		status = LockBlocked
+	}
+
+	return newMessage(Rlock, tag).putU8(status), nil
+}
+
+func (c *conn) getlock(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+	typ := b.u8()
+	start := b.u64()
+	length := b.u64()
+	procID := b.u32()
+	clientID := b.str()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st := f.state()
+
+	if st.file == nil {
+		return nil, syscall.EBADF
+	}
+
+	lk := unix.Flock_t{
+		Type:   lockType(typ),
+		Whence: io.SeekStart,
+		Start:  int64(start),
+		Len:    int64(length),
+	}
+
+	if err := unix.FcntlFlock(st.file.Fd(), unix.F_OFD_GETLK, &lk); err != nil {
+		return nil, err
+	}
+
+	typ = LockTypeUnlock
+
+	switch lk.Type {
+	case unix.F_RDLCK:
+		typ = LockTypeRead
+	case unix.F_WRLCK:
+		typ = LockTypeWrite
+	}
+
+	r := newMessage(Rgetlock, tag).
+		putU8(typ).
+		putU64(uint64(lk.Start)).
+		putU64(uint64(lk.Len)).
+		putU32(procID).
+		putStr(clientID)
+
+	return r, nil
+}
+
+func lockType(typ uint8) int16 {
+	switch typ {
+	case LockTypeRead:
+		return unix.F_RDLCK
+	case LockTypeWrite:
+		return unix.F_WRLCK
+	default:
+		return unix.F_UNLCK
+	}
+}
+
+func (c *conn) fsync(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st := f.state()
+
+	if st.file == nil {
+		return nil, syscall.EBADF
+	}
+
+	if err := st.file.Sync(); err != nil {
+		return nil, err
+	}
+
+	return newMessage(Rfsync, tag), nil
+}
+
+func (c *conn) statfs(tag uint16, b *buffer) (*buffer, error) {
+	id := b.u32()
+
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+
+	f, err := c.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.target()
+	if err != nil {
+		return nil, err
+	}
+
+	// The file system of a symlink is the one of its directory
+	path := st.path
+	if st.qid.Type&QTSYMLINK != 0 {
+		path = filepath.Dir(path)
+	}
+
+	if _, err := f.os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	var sfs syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &sfs); err != nil {
+		return nil, err
+	}
+
+	r := newMessage(Rstatfs, tag).
+		putU32(uint32(sfs.Type)).
+		putU32(uint32(sfs.Bsize)).
+		putU64(sfs.Blocks).
+		putU64(sfs.Bfree).
+		putU64(sfs.Bavail).
+		putU64(sfs.Files).
+		putU64(sfs.Ffree).
+		putU64(uint64(uint32(sfs.Fsid.X__val[0])) | uint64(uint32(sfs.Fsid.X__val[1]))<<32).
+		putU32(uint32(sfs.Namelen))
+
+	return r, nil
+}
+
+func qidOf(fi os.FileInfo) Qid {
+	q := Qid{Type: QTFILE}
+
+	switch {
+	case fi.IsDir():
+		q.Type = QTDIR
+	case fi.Mode()&os.ModeSymlink != 0:
+		q.Type = QTSYMLINK
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		q.Path = st.Ino
+		q.Version = uint32(st.Mtim.Nsec) ^ uint32(st.Mtim.Sec)
+	}
+
+	return q
+}
+
+func direntType(mode os.FileMode) uint8 {
+	switch {
+	case mode.IsDir():
+		return syscall.DT_DIR
+	case mode&os.ModeSymlink != 0:
+		return syscall.DT_LNK
+	case mode&os.ModeNamedPipe != 0:
+		return syscall.DT_FIFO
+	case mode&os.ModeSocket != 0:
+		return syscall.DT_SOCK
+	case mode&os.ModeCharDevice != 0:
+		return syscall.DT_CHR
+	case mode&os.ModeDevice != 0:
+		return syscall.DT_BLK
+	default:
+		return syscall.DT_REG
+	}
+}
+
+// fileMode converts the permission bits of a unix mode to an os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+
+	return m
+}
+
+func accessTime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+}
+
+// errno converts an error to the errno sent in Rlerror.
+func errno(err error) uint32 {
+	var e syscall.Errno
+
+	switch {
+	case errors.As(err, &e):
+		return uint32(e)
+	case errors.Is(err, os.ErrPermission):
+		return uint32(syscall.EACCES)
+	case errors.Is(err, os.ErrNotExist):
+		return uint32(syscall.ENOENT)
+	case errors.Is(err, os.ErrExist):
+		return uint32(syscall.EEXIST)
+	case errors.Is(err, ErrMessage):
+		return uint32(syscall.EINVAL)
+	default:
+		return uint32(syscall.EIO)
+	}
+}
@@ -0,0 +1,462 @@
+//go:build linux
+// +build linux
+
+package p9
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/peterverraedt/useros"
+	"golang.org/x/sys/unix"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+// rpc sends a request and returns the response body, or the errno of an Rlerror.
+func (c *client) rpc(typ uint8, fill func(b *buffer)) (*buffer, syscall.Errno) {
+	c.tag++
+
+	b := newMessage(typ, c.tag)
+	fill(b)
+
+	if _, err := c.conn.Write(b.message()); err != nil {
+		c.t.Fatal(err)
+	}
+
+	rtyp, rtag, body, err := readMessage(c.conn, DefaultMessageSize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	if rtag != c.tag {
+		c.t.Fatalf("unexpected tag %d, expected %d", rtag, c.tag)
+	}
+
+	if rtyp == Rlerror {
+		return nil, syscall.Errno(body.u32())
+	}
+
+	if rtyp != typ+1 {
+		c.t.Fatalf("unexpected response type %d for %d", rtyp, typ)
+	}
+
+	return body, 0
+}
+
+func (c *client) must(typ uint8, fill func(b *buffer)) *buffer {
+	b, errno := c.rpc(typ, fill)
+	if errno != 0 {
+		c.t.Fatalf("request %d: %s", typ, errno)
+	}
+
+	return b
+}
+
+func (c *client) walk(fid, newfid uint32, names ...string) (*buffer, syscall.Errno) {
+	return c.rpc(Twalk, func(b *buffer) {
+		b.putU32(fid).putU32(newfid).putU16(uint16(len(names)))
+
+		for _, name := range names {
+			b.putStr(name)
+		}
+	})
+}
+
+func newClient(t *testing.T, s *Server) *client {
+	local, remote := net.Pipe()
+
+	go s.ServeConn(remote) //nolint:errcheck
+
+	t.Cleanup(func() { local.Close() })
+
+	c := &client{t: t, conn: local}
+
+	r := c.must(Tversion, func(b *buffer) { b.putU32(65536).putStr(Version) })
+	if msize, version := r.u32(), r.str(); msize != 65536 || version != Version {
+		t.Fatalf("unexpected version %d %s", msize, version)
+	}
+
+	return c
+}
+
+func (c *client) attach(fid uint32, uid uint32) {
+	c.must(Tattach, func(b *buffer) { b.putU32(fid).putU32(NoFid).putStr("").putStr("").putU32(uid) })
+}
+
+func newServer(t *testing.T) *Server {
+	if syscall.Geteuid() != 0 {
+		t.Skip("must run as root")
+	}
+
+	root, err := os.MkdirTemp("/tmp", "p9")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	if err := os.Chmod(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	home := filepath.Join(root, "home")
+
+	if err := os.Mkdir(home, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chown(home, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Server{
+		Root: root,
+		Users: func(uname string, uid uint32) (useros.User, error) {
+			return useros.User{UID: int(uid), GID: int(uid), Groups: []int{int(uid)}}, nil
+		},
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+	c.attach(0, 1000)
+
+	if _, errno := c.walk(0, 1, "home"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	c.must(Tlcreate, func(b *buffer) {
+		b.putU32(1).putStr("f").putU32(syscall.O_RDWR).putU32(0640).putU32(1000)
+	})
+
+	body := []byte("hello")
+
+	r := c.must(Twrite, func(b *buffer) { b.putU32(1).putU64(0).putU32(uint32(len(body))).putBytes(body) })
+	if n := r.u32(); n != uint32(len(body)) {
+		t.Errorf("short write %d", n)
+	}
+
+	r = c.must(Tread, func(b *buffer) { b.putU32(1).putU64(0).putU32(100) })
+	if data := r.bytes(int(r.u32())); string(data) != string(body) {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	r = c.must(Tgetattr, func(b *buffer) { b.putU32(1).putU64(GetattrAll) })
+	r.u64()
+	r.qid()
+
+	if mode, uid, gid := r.u32(), r.u32(), r.u32(); mode&0777 != 0640 || uid != 1000 || gid != 1000 {
+		t.Errorf("unexpected attributes %o %d %d", mode, uid, gid)
+	}
+
+	c.must(Tclunk, func(b *buffer) { b.putU32(1) })
+
+	if _, errno := c.walk(0, 2, "home"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	c.must(Tmkdir, func(b *buffer) { b.putU32(2).putStr("sub").putU32(0755).putU32(1000) })
+	c.must(Tsymlink, func(b *buffer) { b.putU32(2).putStr("l").putStr("f").putU32(1000) })
+
+	if _, errno := c.walk(2, 3, "l"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	r = c.must(Treadlink, func(b *buffer) { b.putU32(3) })
+	if target := r.str(); target != "f" {
+		t.Errorf("unexpected symlink target %s", target)
+	}
+
+	c.must(Trenameat, func(b *buffer) { b.putU32(2).putStr("f").putU32(2).putStr("g") })
+
+	if _, errno := c.walk(0, 4, "home"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	c.must(Tlopen, func(b *buffer) { b.putU32(4).putU32(syscall.O_RDONLY) })
+
+	r = c.must(Treaddir, func(b *buffer) { b.putU32(4).putU64(0).putU32(4096) })
+
+	data := &buffer{data: r.bytes(int(r.u32()))}
+
+	var names []string
+
+	for len(data.data) > 0 {
+		data.qid()
+		data.u64()
+		data.u8()
+		names = append(names, data.str())
+	}
+
+	sort.Strings(names)
+
+	if len(names) != 5 || names[2] != "g" || names[3] != "l" || names[4] != "sub" {
+		t.Errorf("unexpected directory entries %v", names)
+	}
+
+	if _, errno := c.walk(2, 5, "g"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	c.must(Tlopen, func(b *buffer) { b.putU32(5).putU32(syscall.O_RDWR) })
+
+	r = c.must(Tlock, func(b *buffer) {
+		b.putU32(5).putU8(LockTypeWrite).putU32(0).putU64(0).putU64(0).putU32(1).putStr("test")
+	})
+	if status := r.u8(); status != LockSuccess {
+		t.Errorf("lock failed with status %d", status)
+	}
+
+	c.must(Txattrwalk, func(b *buffer) { b.putU32(5).putU32(6).putStr("") })
+
+	c.must(Tsetattr, func(b *buffer) {
+		b.putU32(5).putU32(SetattrMode | SetattrSize).putU32(0600).putU32(0).putU32(0).putU64(2)
+		b.putU64(0).putU64(0).putU64(0).putU64(0)
+	})
+
+	fi, err := os.Stat(filepath.Join(s.Root, "home", "g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Perm() != 0600 || fi.Size() != 2 {
+		t.Errorf("setattr not applied: %s %d", fi.Mode(), fi.Size())
+	}
+
+	if _, errno := c.rpc(Tunlinkat, func(b *buffer) { b.putU32(2).putStr("sub").putU32(0) }); errno != syscall.EISDIR {
+		t.Errorf("expected EISDIR, got %v", errno)
+	}
+
+	c.must(Tunlinkat, func(b *buffer) { b.putU32(2).putStr("sub").putU32(unix.AT_REMOVEDIR) })
+
+	if _, errno := c.walk(2, 7, ".."); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	if _, errno := c.walk(7, 8, "..", ".."); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	r = c.must(Tgetattr, func(b *buffer) { b.putU32(8).putU64(GetattrAll) })
+	r.u64()
+
+	root, err := os.Stat(s.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q := r.qid(); q.Path != root.Sys().(*syscall.Stat_t).Ino {
+		t.Errorf("walked out of the attach root")
+	}
+}
+
+func TestServerDenied(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+	c.attach(0, 1001)
+
+	if _, errno := c.walk(0, 1, "home"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	if _, errno := c.walk(1, 2, "f"); errno != syscall.EPERM && errno != syscall.EACCES {
+		t.Errorf("expected permission denied, got %v", errno)
+	}
+
+	if _, errno := c.rpc(Tlopen, func(b *buffer) { b.putU32(1).putU32(syscall.O_RDONLY) }); errno != syscall.EPERM && errno != syscall.EACCES {
+		t.Errorf("expected permission denied, got %v", errno)
+	}
+
+	if _, errno := c.rpc(Tmkdir, func(b *buffer) { b.putU32(0).putStr("x").putU32(0755).putU32(1001) }); errno != syscall.EPERM && errno != syscall.EACCES {
+		t.Errorf("expected permission denied, got %v", errno)
+	}
+
+	if _, errno := c.rpc(Tmkdir, func(b *buffer) { b.putU32(0).putStr("../x").putU32(0755).putU32(1001) }); errno != syscall.EINVAL {
+		t.Errorf("expected invalid argument, got %v", errno)
+	}
+}
+
+func TestServerSymlinks(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+	c.attach(0, 1000)
+
+	home := filepath.Join(s.Root, "home")
+
+	if err := os.Symlink("/etc", filepath.Join(home, "esc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(home, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Symlinks are never walked through, nor opened
+	r, errno := c.walk(0, 1, "home", "esc", "passwd")
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+
+	if n := r.u16(); n != 2 {
+		t.Errorf("walked %d components through a symlink", n)
+	}
+
+	if _, errno = c.walk(0, 1, "home", "esc"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	if _, errno = c.rpc(Tlopen, func(b *buffer) { b.putU32(1).putU32(syscall.O_RDONLY) }); errno != syscall.ELOOP {
+		t.Errorf("expected ELOOP, got %v", errno)
+	}
+
+	// A walked directory that is replaced by a symlink is not followed
+	if _, errno = c.walk(0, 2, "home", "sub"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	if err := os.Remove(filepath.Join(home, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("/etc", filepath.Join(home, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errno = c.walk(2, 3, "passwd"); errno == 0 {
+		t.Error("walked through a replaced directory")
+	}
+
+	if _, errno = c.rpc(Tmkdir, func(b *buffer) { b.putU32(2).putStr("x").putU32(0755).putU32(1000) }); errno == 0 {
+		t.Error("created through a replaced directory")
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	s := newServer(t)
+	local, remote := net.Pipe()
+
+	go s.ServeConn(remote) //nolint:errcheck
+
+	defer local.Close()
+
+	c := &client{t: t, conn: local}
+
+	if _, errno := c.rpc(Tversion, func(b *buffer) { b.putU32(64).putStr(Version) }); errno != syscall.EINVAL {
+		t.Errorf("expected EINVAL for a small msize, got %v", errno)
+	}
+}
+
+func TestServerFlush(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+	c.attach(0, 1000)
+
+	fifo := filepath.Join(s.Root, "home", "fifo")
+
+	if err := unix.Mkfifo(fifo, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chown(fifo, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errno := c.walk(0, 1, "home", "fifo"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	// Opening the fifo blocks until there is a writer
+	for _, b := range []*buffer{
+		newMessage(Tlopen, 100).putU32(1).putU32(syscall.O_RDONLY),
+		newMessage(Tflush, 101).putU16(100),
+	} {
+		if _, err := c.conn.Write(b.message()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) //nolint:errcheck
+
+	if _, _, _, err := readMessage(c.conn, DefaultMessageSize); err == nil {
+		t.Fatal("flush answered before the flushed request")
+	}
+
+	c.conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+	w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	for _, expected := range []uint16{100, 101} {
+		_, tag, _, err := readMessage(c.conn, DefaultMessageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tag != expected {
+			t.Errorf("expected response to tag %d, got %d", expected, tag)
+		}
+	}
+}
+
+func TestServerOpened(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+	c.attach(0, 1000)
+
+	if _, errno := c.walk(0, 1, "home"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	c.must(Tlcreate, func(b *buffer) {
+		b.putU32(1).putStr("f").putU32(syscall.O_RDWR).putU32(0640).putU32(1000)
+	})
+
+	body := []byte("hello")
+
+	c.must(Twrite, func(b *buffer) { b.putU32(1).putU64(0).putU32(uint32(len(body))).putBytes(body) })
+
+	// An opened fid can't be walked, and stays open
+	for _, newid := range []uint32{1, 2} {
+		if _, errno := c.walk(1, newid); errno != syscall.EBADF {
+			t.Errorf("expected EBADF, got %v", errno)
+		}
+	}
+
+	r := c.must(Tread, func(b *buffer) { b.putU32(1).putU64(0).putU32(100) })
+	if data := r.bytes(int(r.u32())); string(data) != string(body) {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	c.must(Tclunk, func(b *buffer) { b.putU32(1) })
+
+	// O_TRUNC truncates a file opened read-only
+	if _, errno := c.walk(0, 3, "home", "f"); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	c.must(Tlopen, func(b *buffer) { b.putU32(3).putU32(syscall.O_RDONLY | syscall.O_TRUNC) })
+
+	fi, err := os.Stat(filepath.Join(s.Root, "home", "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != 0 {
+		t.Errorf("expected an empty file, got size %d", fi.Size())
+	}
+}
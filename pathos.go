@@ -0,0 +1,295 @@
+package useros
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// pathOS maps every name with resolve before passing it to the wrapped OS.
+// It is used by NewOS to confine an OS to a root and to apply a symlink policy.
+type pathOS struct {
+	OS
+
+	// resolve returns the name to pass to the wrapped OS. A final symlink is
+	// followed if follow is set, otherwise the name refers to the link itself.
+	resolve func(op, name string, follow bool) (string, error)
+
+	// unresolve maps a name of the wrapped OS back, for Walk and EvalSymlinks.
+	unresolve func(name string) string
+}
+
+// symlinkResolver checks that name is allowed by the flags of the resolver, and returns it unchanged.
+func symlinkResolver(r Resolver) func(op, name string, follow bool) (string, error) {
+	return func(op, name string, follow bool) (string, error) {
+		check := filepath.Dir(filepath.Clean(name))
+		if follow {
+			check = name
+		}
+
+		if _, err := r.Resolve(check); errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.EXDEV) {
+			return "", logit(&os.PathError{Op: op, Path: name, Err: errors.Unwrap(err)})
+		}
+
+		return name, nil
+	}
+}
+
+// chain returns a resolve function that calls both functions in order.
+func chain(first, second func(op, name string, follow bool) (string, error)) func(op, name string, follow bool) (string, error) {
+	return func(op, name string, follow bool) (string, error) {
+		name, err := first(op, name, follow)
+		if err != nil {
+			return "", err
+		}
+
+		return second(op, name, follow)
+	}
+}
+
+func (o *pathOS) Chmod(name string, mode os.FileMode) error {
+	path, err := o.resolve("chmod", name, true)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Chmod(path, mode)
+}
+
+func (o *pathOS) Chown(name string, uid, gid int) error {
+	path, err := o.resolve("chown", name, true)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Chown(path, uid, gid)
+}
+
+func (o *pathOS) Chtimes(name string, atime, mtime time.Time) error {
+	path, err := o.resolve("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Chtimes(path, atime, mtime)
+}
+
+func (o *pathOS) Lchown(name string, uid, gid int) error {
+	path, err := o.resolve("lchown", name, false)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Lchown(path, uid, gid)
+}
+
+func (o *pathOS) Mkdir(name string, perm os.FileMode) error {
+	path, err := o.resolve("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Mkdir(path, perm)
+}
+
+// MkdirAll creates the directories one by one, so each of them is resolved.
+func (o *pathOS) MkdirAll(path string, perm os.FileMode) error {
+	return mkdirAll(o, path, perm)
+}
+
+func (o *pathOS) ReadFile(name string) ([]byte, error) {
+	path, err := o.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.OS.ReadFile(path)
+}
+
+func (o *pathOS) Readlink(name string) (string, error) {
+	path, err := o.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	return o.OS.Readlink(path)
+}
+
+func (o *pathOS) Remove(name string) error {
+	path, err := o.resolve("remove", name, false)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Remove(path)
+}
+
+func (o *pathOS) RemoveAll(name string) error {
+	return o.removeAllContext(context.Background(), name)
+}
+
+func (o *pathOS) removeAllContext(ctx context.Context, name string) error {
+	path, err := o.resolve("removeall", name, false)
+	if err != nil {
+		return err
+	}
+
+	return removeAllContext(ctx, o.OS, path)
+}
+
+func (o *pathOS) Rename(oldpath, newpath string) error {
+	from, err := o.resolve("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+
+	to, err := o.resolve("rename", newpath, false)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Rename(from, to)
+}
+
+// Symlink creates the link, its target is resolved when it is followed.
+func (o *pathOS) Symlink(oldname, newname string) error {
+	path, err := o.resolve("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Symlink(oldname, path)
+}
+
+func (o *pathOS) Truncate(name string, size int64) error {
+	path, err := o.resolve("truncate", name, true)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.Truncate(path, size)
+}
+
+func (o *pathOS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	path, err := o.resolve("open", name, true)
+	if err != nil {
+		return err
+	}
+
+	return o.OS.WriteFile(path, data, perm)
+}
+
+func (o *pathOS) Stat(name string) (os.FileInfo, error) {
+	path, err := o.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := o.OS.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return namedFileInfo{FileInfo: fi, name: filepath.Base(name)}, nil
+}
+
+func (o *pathOS) Lstat(name string) (os.FileInfo, error) {
+	path, err := o.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.OS.Lstat(path)
+}
+
+func (o *pathOS) Create(name string) (File, error) {
+	return o.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (o *pathOS) Open(name string) (File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *pathOS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	follow := flag&oNoFollow == 0 && flag&(os.O_CREATE|os.O_EXCL) != os.O_CREATE|os.O_EXCL
+
+	path, err := o.resolve("open", name, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.OS.OpenFile(path, flag, perm)
+}
+
+func (o *pathOS) ReadDir(name string) ([]os.DirEntry, error) {
+	path, err := o.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.OS.ReadDir(path)
+}
+
+func (o *pathOS) EvalSymlinks(name string) (string, error) {
+	path, err := o.resolve("evalsymlinks", name, true)
+	if err != nil {
+		return "", err
+	}
+
+	path, err = o.OS.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	return o.unresolve(path), nil
+}
+
+func (o *pathOS) Walk(name string, walkFn filepath.WalkFunc) error {
+	path, err := o.resolve("lstat", name, false)
+	if err != nil {
+		return walkFn(name, nil, err)
+	}
+
+	return o.OS.Walk(path, func(p string, info fs.FileInfo, err error) error {
+		return walkFn(name+strings.TrimPrefix(p, path), info, err)
+	})
+}
+
+// mkdirAll creates path and its missing parents one by one with o.Stat and o.Mkdir.
+func mkdirAll(o OS, path string, perm os.FileMode) error {
+	var dir string
+
+	if filepath.IsAbs(path) {
+		dir = string(os.PathSeparator)
+	}
+
+	for _, c := range strings.Split(path, string(os.PathSeparator)) {
+		if c == "" || c == "." {
+			continue
+		}
+
+		dir = filepath.Join(dir, c)
+
+		fi, err := o.Stat(dir)
+
+		switch {
+		case err == nil && !fi.IsDir():
+			return logit(&os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR})
+		case err == nil:
+			continue
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		}
+
+		if err = o.Mkdir(dir, perm); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+
+	return nil
+}
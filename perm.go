@@ -1,6 +1,10 @@
 package useros
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strings"
+)
 
 type Permission uint32
 
@@ -13,3 +17,51 @@ const (
 func (p Permission) Check(m os.FileMode) bool {
 	return uint32(p)&uint32(m) > 0
 }
+
+// Op is a kind of file operation, as passed to an Authorizer and checked by a Policy.
+type Op int
+
+// Operations. OpExec is not performed by OS, but can be checked with Policy.Check.
+const (
+	OpRead Op = 1 << iota
+	OpWrite
+	OpCreate
+	OpDelete
+	OpChmod
+	OpChown
+	OpChtimes
+	OpList
+	OpStat
+	OpExec
+
+	OpAll = OpRead | OpWrite | OpCreate | OpDelete | OpChmod | OpChown | OpChtimes | OpList | OpStat | OpExec
+)
+
+var opNames = []string{"read", "write", "create", "delete", "chmod", "chown", "chtimes", "list", "stat", "exec"}
+
+func (o Op) String() string {
+	var names []string
+
+	for i, name := range opNames {
+		if o&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	return strings.Join(names, "|")
+}
+
+// ParseOp parses the name of an operation, or "all".
+func ParseOp(name string) (Op, error) {
+	if name == "all" {
+		return OpAll, nil
+	}
+
+	for i, n := range opNames {
+		if n == name {
+			return 1 << i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown operation %q", name)
+}
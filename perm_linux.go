@@ -12,10 +12,11 @@ import (
 	"syscall"
 
 	"github.com/joshlf/go-acl"
+	"golang.org/x/sys/unix"
 )
 
 // returns: stat of parent dir, error
-func (u User) hasInodeAccess(name string, perm Permission) (os.FileInfo, acl.ACL, error) {
+func (u *user) hasInodeAccess(name string, perm Permission, op Op) (os.FileInfo, acl.ACL, error) {
 	// Root always has access if the directory exists
 	if u.UID == 0 {
 		stat, err := os.Stat(filepath.Dir(name))
@@ -27,10 +28,7 @@ func (u User) hasInodeAccess(name string, perm Permission) (os.FileInfo, acl.ACL
 			return nil, nil, syscall.ENOTDIR
 		}
 
-		a, err := acl.Get(filepath.Dir(name))
-		if errors.Is(err, syscall.EOPNOTSUPP) {
-			err = nil
-		}
+		a, err := u.getACL(filepath.Dir(name), stat)
 
 		return stat, a, err
 	}
@@ -62,12 +60,12 @@ func (u User) hasInodeAccess(name string, perm Permission) (os.FileInfo, acl.ACL
 			return nil, nil, syscall.ENOTDIR
 		}
 
-		a, err = acl.Get(dir)
-		if err != nil && !errors.Is(err, syscall.EOPNOTSUPP) {
+		a, err = u.getACL(dir, stat)
+		if err != nil {
 			return nil, nil, err
 		}
 
-		err = on(u.checkPermission(stat, a, Execute), dir)
+		err = on(u.authorize(dir, stat, a, Execute, op, true), dir)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -77,13 +75,13 @@ func (u User) hasInodeAccess(name string, perm Permission) (os.FileInfo, acl.ACL
 
 	// Check the last directory (directory of the inode) for the write permission if asked
 	if perm == Write && len(dirs) > 0 {
-		return stat, nil, on(u.checkPermission(stat, a, perm), dirs[len(dirs)-1])
+		return stat, nil, on(u.authorize(dirs[len(dirs)-1], stat, a, perm, op, false), dirs[len(dirs)-1])
 	}
 
 	return stat, a, nil
 }
 
-func (u User) checkDirExecuteOnly(name string) error {
+func (u *user) checkDirExecuteOnly(name string, op Op) error {
 	stat, err := os.Stat(name)
 	if err != nil {
 		return err
@@ -93,12 +91,151 @@ func (u User) checkDirExecuteOnly(name string) error {
 		return syscall.ENOTDIR
 	}
 
+	a, err := u.getACL(name, stat)
+	if err != nil {
+		return err
+	}
+
+	return on(u.authorize(name, stat, a, Execute, op, true), name)
+}
+
+// getACL returns the ACL of a file with the given stat, from the cache of the OS if it has one.
+func (u *user) getACL(name string, stat os.FileInfo) (acl.ACL, error) {
+	if u.cache != nil {
+		return u.cache.get(name, stat)
+	}
+
+	return getACL(name)
+}
+
+// getACL returns the ACL of a file, or nil if ACLs are not supported.
+func getACL(name string) (acl.ACL, error) {
 	a, err := acl.Get(name)
-	if err != nil && !errors.Is(err, syscall.EOPNOTSUPP) {
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil, nil
+	}
+
+	return a, err
+}
+
+// checkFile checks the permission on an opened file, on the inode of its descriptor.
+// The ACL is read through the descriptor, so a renamed or replaced path has no effect.
+func (u *user) checkFile(f File, perm Permission, op Op, traverse bool) (os.FileInfo, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if u.UID == 0 {
+		return stat, nil
+	}
+
+	a, err := u.getACL(fdPath(f), stat)
+	if err != nil {
+		return nil, err
+	}
+
+	return stat, on(u.authorize(f.Name(), stat, a, perm, op, traverse), f.Name())
+}
+
+// ownsFile checks whether the user owns an opened file.
+func (u User) ownsFile(f File) (os.FileInfo, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if u.UID == 0 {
+		return stat, nil
+	}
+
+	return stat, u.checkOwnership(stat)
+}
+
+// fdPath returns the magic link of the descriptor of an opened file.
+func fdPath(f File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// hasEntryAccess checks the permission on a file or directory with the given stat,
+// whose directory is known to be searchable.
+func (u *user) hasEntryAccess(name string, stat os.FileInfo, perm Permission, op Op) error {
+	if u.UID == 0 {
+		return nil
+	}
+
+	a, err := u.getACL(name, stat)
+	if err != nil {
 		return err
 	}
 
-	return on(u.checkPermission(stat, a, Execute), name)
+	return on(u.authorize(name, stat, a, perm, op, false), name)
+}
+
+// authorizeObject consults the authorizer on the object of an operation that needs no
+// permission on the object itself, e.g. to remove or stat it. The default permission
+// model allows these, so nothing is checked without an authorizer.
+func (u *user) authorizeObject(name string, op Op, follow bool) error {
+	if u.UID == 0 || u.auth == nil {
+		return nil
+	}
+
+	stat, err := os.Lstat(name)
+	if err == nil && follow && stat.Mode()&os.ModeSymlink != 0 {
+		stat, err = os.Stat(name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	a, err := u.getACL(name, stat)
+	if err != nil {
+		return err
+	}
+
+	return on(u.authorize(name, stat, a, 0, op, false), name)
+}
+
+// authorizeFile consults the authorizer on an opened file, like authorizeObject.
+func (u *user) authorizeFile(f File, op Op) error {
+	if u.UID == 0 || u.auth == nil {
+		return nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Symlinks have no ACL
+	var a acl.ACL
+
+	if stat.Mode()&os.ModeSymlink == 0 {
+		if a, err = u.getACL(fdPath(f), stat); err != nil {
+			return err
+		}
+	}
+
+	return on(u.authorize(f.Name(), stat, a, 0, op, false), f.Name())
+}
+
+// authorizeObjectAt consults the authorizer on the entry name of an opened directory,
+// like authorizeObject without following a symlink.
+func (u *user) authorizeObjectAt(dir File, name string, op Op) error {
+	if u.UID == 0 || u.auth == nil {
+		return nil
+	}
+
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "openat", Path: atPath(dir, name), Err: err}
+	}
+
+	f := os.NewFile(uintptr(fd), atPath(dir, name))
+	defer f.Close()
+
+	return u.authorizeFile(osFile{f}, op)
 }
 
 func (u User) gidForNewFiles(parent os.FileInfo) int {
@@ -114,14 +251,14 @@ func (u User) gidForNewFiles(parent os.FileInfo) int {
 	return int(stat_t.Gid)
 }
 
-func (u User) hasObjectAccess(name string, perm Permission) error {
+func (u *user) hasObjectAccess(name string, perm Permission, op Op) error {
 	// Root always has access if the object exists
 	if u.UID == 0 {
 		_, err := os.Stat(name)
 		return err
 	}
 
-	if _, _, err := u.hasInodeAccess(name, Execute); err != nil {
+	if _, _, err := u.hasInodeAccess(name, Execute, op); err != nil {
 		return err
 	}
 
@@ -130,12 +267,12 @@ func (u User) hasObjectAccess(name string, perm Permission) error {
 		return err
 	}
 
-	a, err := acl.Get(name)
-	if err != nil && !errors.Is(err, syscall.EOPNOTSUPP) {
+	a, err := u.getACL(name, stat)
+	if err != nil {
 		return err
 	}
 
-	return on(u.checkPermission(stat, a, perm), name)
+	return on(u.authorize(name, stat, a, perm, op, false), name)
 }
 
 func (u User) owns(name string) error {
@@ -164,10 +301,6 @@ func (u User) lowns(name string) error {
 	return u.checkOwnership(stat)
 }
 
-func (u User) chownNewFile(name string, gid int) error {
-	return os.Lchown(name, u.UID, gid)
-}
-
 func (u User) checkPermission(stat os.FileInfo, a acl.ACL, perms ...Permission) error {
 	stat_t, ok := stat.Sys().(*syscall.Stat_t)
 	if !ok {
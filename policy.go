@@ -0,0 +1,824 @@
+package useros
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrPolicyDenied is returned when an operation is denied by a Policy.
+// It matches os.ErrPermission with errors.Is.
+var ErrPolicyDenied error = policyDenied{}
+
+type policyDenied struct{}
+
+func (policyDenied) Error() string {
+	return "denied by policy"
+}
+
+func (policyDenied) Is(target error) bool {
+	return target == fs.ErrPermission
+}
+
+// Effect is the effect of a rule.
+type Effect string
+
+// Effects.
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Rule is a rule of a Policy. A rule matches an operation if the path matches one
+// of the globs in Paths, the operation is one of Ops, and the user is one of Users,
+// has an uid in one of UIDs, or is a member of one of Groups. Empty fields match anything.
+//
+// Globs starting with a slash are matched against the absolute path, with "**"
+// matching any number of path components. Other globs are matched against the
+// base name if they don't contain a slash, or against the end of the path otherwise.
+type Rule struct {
+	Effect Effect   `json:"effect"`
+	Paths  []string `json:"paths,omitempty"`
+	Ops    []string `json:"ops,omitempty"`
+	Users  []int    `json:"users,omitempty"`
+	UIDs   []string `json:"uids,omitempty"`
+	Groups []int    `json:"groups,omitempty"`
+
+	ops  Op
+	uids [][2]int
+}
+
+// PolicyConfig is the file format of a Policy. Rules are evaluated in order,
+// the first matching rule decides. If none matches, Default decides.
+type PolicyConfig struct {
+	Default Effect `json:"default,omitempty"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Policy is a set of site rules that is enforced on top of the permission model.
+// Wrap an OS with it, so that operations must pass both.
+type Policy struct {
+	mu     sync.RWMutex
+	config PolicyConfig
+
+	file  string
+	mtime time.Time
+	size  int64
+}
+
+// ParsePolicy parses a JSON policy, see PolicyConfig.
+func ParsePolicy(data []byte) (*Policy, error) {
+	config, err := parsePolicyConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Policy{config: config}, nil
+}
+
+// LoadPolicy loads a JSON policy from a file. Use Reload or Watch to pick up changes.
+func LoadPolicy(file string) (*Policy, error) {
+	p := &Policy{file: file}
+
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Reload reloads the policy file if it was modified. If the new file
+// is invalid, the current rules are kept and the error is returned.
+func (p *Policy) Reload() error {
+	if p.file == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(p.file)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	unchanged := fi.ModTime().Equal(p.mtime) && fi.Size() == p.size
+	p.mu.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+
+	config, err := parsePolicyConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.file, err)
+	}
+
+	p.mu.Lock()
+	p.config, p.mtime, p.size = config, fi.ModTime(), fi.Size()
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the policy file every interval until stop is called.
+// Reload errors are passed to onError, if not nil.
+func (p *Policy) Watch(interval time.Duration, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := p.Reload(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func parsePolicyConfig(data []byte) (PolicyConfig, error) {
+	var config PolicyConfig
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+
+	if config.Default == "" {
+		config.Default = Allow
+	}
+
+	if config.Default != Allow && config.Default != Deny {
+		return config, fmt.Errorf("invalid default effect %q", config.Default)
+	}
+
+	for i := range config.Rules {
+		if err := config.Rules[i].compile(); err != nil {
+			return config, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+
+	return config, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Effect != Allow && r.Effect != Deny {
+		return fmt.Errorf("invalid effect %q", r.Effect)
+	}
+
+	for _, pattern := range r.Paths {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return fmt.Errorf("%w: %s", err, pattern)
+		}
+	}
+
+	r.ops = 0
+
+	for _, name := range r.Ops {
+		op, err := ParseOp(name)
+		if err != nil {
+			return err
+		}
+
+		r.ops |= op
+	}
+
+	if len(r.Ops) == 0 {
+		r.ops = OpAll
+	}
+
+	r.uids = nil
+
+	for _, s := range r.UIDs {
+		from, to, ok := strings.Cut(s, "-")
+		if !ok {
+			to = from
+		}
+
+		a, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return fmt.Errorf("invalid uid range %q", s)
+		}
+
+		b, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || b < a {
+			return fmt.Errorf("invalid uid range %q", s)
+		}
+
+		r.uids = append(r.uids, [2]int{a, b})
+	}
+
+	return nil
+}
+
+// Check returns an error wrapping ErrPolicyDenied if the policy denies the
+// operation on the named file to the user.
+func (p *Policy) Check(u User, op Op, name string) error {
+	if !p.Allowed(u, op, name) {
+		return &os.PathError{Op: op.String(), Path: name, Err: ErrPolicyDenied}
+	}
+
+	return nil
+}
+
+// Allowed reports whether the policy allows all of the operations in op on the named file to the user.
+func (p *Policy) Allowed(u User, op Op, name string) bool {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+
+	name = filepath.ToSlash(name)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for i := 0; i < len(opNames); i++ {
+		if o := Op(1 << i); op&o != 0 && p.effect(u, o, name) == Deny {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Policy) effect(u User, op Op, name string) Effect {
+	for i := range p.config.Rules {
+		if r := &p.config.Rules[i]; r.matches(u, op, name) {
+			return r.Effect
+		}
+	}
+
+	return p.config.Default
+}
+
+func (r *Rule) matches(u User, op Op, name string) bool {
+	if r.ops&op == 0 || !r.matchesUser(u) {
+		return false
+	}
+
+	if len(r.Paths) == 0 {
+		return true
+	}
+
+	for _, pattern := range r.Paths {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matchesUser(u User) bool {
+	if len(r.Users) == 0 && len(r.UIDs) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+
+	if contains(r.Users, u.UID) {
+		return true
+	}
+
+	for _, rng := range r.uids {
+		if u.UID >= rng[0] && u.UID <= rng[1] {
+			return true
+		}
+	}
+
+	for _, g := range r.Groups {
+		if g == u.GID || contains(u.Groups, g) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchGlob matches a rule glob against an absolute slash-separated path.
+func matchGlob(pattern, name string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "/"):
+	case !strings.Contains(pattern, "/"):
+		ok, _ := path.Match(pattern, path.Base(name)) //nolint:errcheck
+
+		return ok
+	default:
+		pattern = "/**/" + pattern
+	}
+
+	return matchSegments(strings.Split(pattern, "/")[1:], strings.Split(name, "/")[1:])
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try to match the rest of the pattern at every depth
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok { //nolint:errcheck
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// Wrap returns an OS that checks the policy for the user of o before each operation.
+func (p *Policy) Wrap(o OS) OS {
+	return &policyOS{OS: o, policy: p}
+}
+
+type policyOS struct {
+	OS
+	policy *Policy
+}
+
+// check checks the rules for an operation that does not follow a final symlink.
+func (o *policyOS) check(op Op, name string) error {
+	return o.checkPath(op, name, false)
+}
+
+// checkFollow checks the rules for an operation that follows a final symlink.
+func (o *policyOS) checkFollow(op Op, name string) error {
+	return o.checkPath(op, name, true)
+}
+
+func (o *policyOS) checkPath(op Op, name string, follow bool) error {
+	u := o.CurrentUser()
+
+	if err := o.policy.Check(u, op, name); err != nil {
+		return logit(err)
+	}
+
+	// Rules must also hold for the real location of the file
+	real, err := o.realPath(name, follow, 0)
+	if err != nil {
+		return logit(err)
+	}
+
+	if real != filepath.Clean(name) {
+		if err := o.policy.Check(u, op, real); err != nil {
+			return logit(err)
+		}
+	}
+
+	return nil
+}
+
+// realPath returns the location of name with its symlinks resolved. The final component
+// is only resolved if follow is set, missing files are located in their nearest existing
+// ancestor and dangling symlinks at their target.
+func (o *policyOS) realPath(name string, follow bool, links int) (string, error) {
+	name = filepath.Clean(name)
+
+	if follow {
+		real, err := o.OS.EvalSymlinks(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return real, err
+		}
+	}
+
+	dir := filepath.Dir(name)
+	if dir == name {
+		return name, nil
+	}
+
+	real, err := o.realPath(dir, true, links)
+	if err != nil {
+		return "", err
+	}
+
+	real = filepath.Join(real, filepath.Base(name))
+
+	if !follow {
+		return real, nil
+	}
+
+	target, err := o.OS.Readlink(real)
+	if err != nil {
+		// Not a symlink
+		return real, nil
+	}
+
+	if links++; links > MaxSymlinks {
+		return "", &os.PathError{Op: "lstat", Path: name, Err: syscall.ELOOP}
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(real), target)
+	}
+
+	return o.realPath(target, true, links)
+}
+
+// exists reports whether the named file exists, for create checks.
+func (o *policyOS) exists(name string) bool {
+	_, err := o.OS.Lstat(name)
+
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+func (o *policyOS) Chmod(name string, mode os.FileMode) error {
+	if err := o.checkFollow(OpChmod, name); err != nil {
+		return err
+	}
+
+	return o.OS.Chmod(name, mode)
+}
+
+func (o *policyOS) Chown(name string, uid, gid int) error {
+	if err := o.checkFollow(OpChown, name); err != nil {
+		return err
+	}
+
+	return o.OS.Chown(name, uid, gid)
+}
+
+func (o *policyOS) Chtimes(name string, atime, mtime time.Time) error {
+	if err := o.checkFollow(OpChtimes, name); err != nil {
+		return err
+	}
+
+	return o.OS.Chtimes(name, atime, mtime)
+}
+
+func (o *policyOS) Lchown(name string, uid, gid int) error {
+	if err := o.check(OpChown, name); err != nil {
+		return err
+	}
+
+	return o.OS.Lchown(name, uid, gid)
+}
+
+func (o *policyOS) Mkdir(name string, perm os.FileMode) error {
+	if err := o.check(OpCreate, name); err != nil {
+		return err
+	}
+
+	return o.OS.Mkdir(name, perm)
+}
+
+func (o *policyOS) MkdirAll(name string, perm os.FileMode) error {
+	// Check every directory that would be created
+	for dir := filepath.Clean(name); !o.exists(dir); dir = filepath.Dir(dir) {
+		if err := o.check(OpCreate, dir); err != nil {
+			return err
+		}
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	return o.OS.MkdirAll(name, perm)
+}
+
+func (o *policyOS) ReadFile(name string) ([]byte, error) {
+	if err := o.checkFollow(OpRead, name); err != nil {
+		return nil, err
+	}
+
+	return o.OS.ReadFile(name)
+}
+
+func (o *policyOS) Readlink(name string) (string, error) {
+	if err := o.check(OpRead, name); err != nil {
+		return "", err
+	}
+
+	return o.OS.Readlink(name)
+}
+
+func (o *policyOS) Remove(name string) error {
+	if err := o.check(OpDelete, name); err != nil {
+		return err
+	}
+
+	return o.OS.Remove(name)
+}
+
+func (o *policyOS) RemoveAll(name string) error {
+	// Refuse to remove anything if any of the files may not be removed
+	err := o.OS.Walk(name, func(path string, info fs.FileInfo, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		return o.check(OpDelete, path)
+	})
+	if err != nil {
+		return err
+	}
+
+	return o.OS.RemoveAll(name)
+}
+
+func (o *policyOS) Rename(oldpath, newpath string) error {
+	if err := o.check(OpDelete, oldpath); err != nil {
+		return err
+	}
+
+	if err := o.check(OpCreate, newpath); err != nil {
+		return err
+	}
+
+	return o.OS.Rename(oldpath, newpath)
+}
+
+func (o *policyOS) Symlink(oldname, newname string) error {
+	if err := o.check(OpCreate, newname); err != nil {
+		return err
+	}
+
+	return o.OS.Symlink(oldname, newname)
+}
+
+func (o *policyOS) Truncate(name string, size int64) error {
+	if err := o.checkFollow(OpWrite, name); err != nil {
+		return err
+	}
+
+	return o.OS.Truncate(name, size)
+}
+
+func (o *policyOS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := o.checkOpen(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != nil {
+		return err
+	}
+
+	return o.OS.WriteFile(name, data, perm)
+}
+
+func (o *policyOS) Stat(name string) (os.FileInfo, error) {
+	if err := o.checkFollow(OpStat, name); err != nil {
+		return nil, err
+	}
+
+	return o.OS.Stat(name)
+}
+
+func (o *policyOS) Lstat(name string) (os.FileInfo, error) {
+	if err := o.check(OpStat, name); err != nil {
+		return nil, err
+	}
+
+	return o.OS.Lstat(name)
+}
+
+func (o *policyOS) Create(name string) (File, error) {
+	if err := o.checkOpen(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC); err != nil {
+		return nil, err
+	}
+
+	return o.wrap(o.OS.Create(name))
+}
+
+func (o *policyOS) Open(name string) (File, error) {
+	if err := o.checkFollow(OpRead, name); err != nil {
+		return nil, err
+	}
+
+	return o.wrap(o.OS.Open(name))
+}
+
+func (o *policyOS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := o.checkOpen(name, flag); err != nil {
+		return nil, err
+	}
+
+	return o.wrap(o.OS.OpenFile(name, flag, perm))
+}
+
+// wrap wraps an opened file in a policyFile.
+func (o *policyOS) wrap(f File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyFile{File: f, os: o}, nil
+}
+
+// checkOpen checks the operations implied by the open flags.
+func (o *policyOS) checkOpen(name string, flag int) error {
+	op := openOps(flag, flag&os.O_CREATE != 0 && !o.exists(name))
+
+	// O_EXCL creates and O_NOFOLLOW opens never follow a final symlink
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL || flag&oNoFollow != 0 {
+		return o.check(op, name)
+	}
+
+	return o.checkFollow(op, name)
+}
+
+// openOps returns the operations implied by the open flags, and by creating the file if create is set.
+func openOps(flag int, create bool) Op {
+	var op Op
+
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		op = OpRead
+	case os.O_WRONLY:
+		op = OpWrite
+	default:
+		op = OpRead | OpWrite
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		op |= OpWrite
+	}
+
+	if create {
+		op |= OpCreate
+	}
+
+	return op
+}
+
+func (o *policyOS) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := o.checkFollow(OpList, name); err != nil {
+		return nil, err
+	}
+
+	return o.OS.ReadDir(name)
+}
+
+func (o *policyOS) EvalSymlinks(name string) (string, error) {
+	if err := o.checkFollow(OpStat, name); err != nil {
+		return "", err
+	}
+
+	return o.OS.EvalSymlinks(name)
+}
+
+func (o *policyOS) Walk(name string, walkFn filepath.WalkFunc) error {
+	return o.OS.Walk(name, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return walkFn(path, info, err)
+		}
+
+		if err = o.check(OpStat, path); err != nil {
+			if err = walkFn(path, nil, err); err == nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		if err = walkFn(path, info, nil); err != nil || !info.IsDir() {
+			return err
+		}
+
+		// As filepath.Walk does for unreadable directories, report the error a second time
+		if err = o.check(OpList, path); err != nil {
+			if err = walkFn(path, info, err); err == nil {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		return nil
+	})
+}
+
+// policyFile checks the policy for the entries of a directory that is used as a capability.
+type policyFile struct {
+	File
+	os *policyOS
+}
+
+func (f *policyFile) Openat(name string, flag int, perm os.FileMode) (File, error) {
+	_, err := f.File.Statat(name)
+	create := flag&os.O_CREATE != 0 && errors.Is(err, fs.ErrNotExist)
+
+	if err := f.os.check(openOps(flag, create), atPath(f, name)); err != nil {
+		return nil, err
+	}
+
+	return f.os.wrap(f.File.Openat(name, flag, perm))
+}
+
+func (f *policyFile) Mkdirat(name string, perm os.FileMode) error {
+	if err := f.os.check(OpCreate, atPath(f, name)); err != nil {
+		return err
+	}
+
+	return f.File.Mkdirat(name, perm)
+}
+
+func (f *policyFile) Unlinkat(name string) error {
+	if err := f.os.check(OpDelete, atPath(f, name)); err != nil {
+		return err
+	}
+
+	return f.File.Unlinkat(name)
+}
+
+func (f *policyFile) Renameat(oldname string, newdir File, newname string) error {
+	if err := f.os.check(OpDelete, atPath(f, oldname)); err != nil {
+		return err
+	}
+
+	if err := f.os.check(OpCreate, atPath(newdir, newname)); err != nil {
+		return err
+	}
+
+	return f.File.Renameat(oldname, newdir, newname)
+}
+
+func (f *policyFile) Statat(name string) (os.FileInfo, error) {
+	if err := f.os.check(OpStat, atPath(f, name)); err != nil {
+		return nil, err
+	}
+
+	return f.File.Statat(name)
+}
+
+// The methods on the opened file itself check the policy for its name, which is
+// followed like the name that was opened.
+
+func (f *policyFile) Chmod(mode os.FileMode) error {
+	if err := f.os.checkFollow(OpChmod, f.Name()); err != nil {
+		return err
+	}
+
+	return f.File.Chmod(mode)
+}
+
+func (f *policyFile) Chown(uid, gid int) error {
+	if err := f.os.checkFollow(OpChown, f.Name()); err != nil {
+		return err
+	}
+
+	return f.File.Chown(uid, gid)
+}
+
+func (f *policyFile) Truncate(size int64) error {
+	if err := f.os.checkFollow(OpWrite, f.Name()); err != nil {
+		return err
+	}
+
+	return f.File.Truncate(size)
+}
+
+func (f *policyFile) ReadDir(n int) ([]os.DirEntry, error) {
+	if err := f.os.checkFollow(OpList, f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f.File.ReadDir(n)
+}
+
+func (f *policyFile) Readdir(n int) ([]os.FileInfo, error) {
+	if err := f.os.checkFollow(OpList, f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f.File.Readdir(n)
+}
+
+func (f *policyFile) Readdirnames(n int) ([]string, error) {
+	if err := f.os.checkFollow(OpList, f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f.File.Readdirnames(n)
+}
@@ -0,0 +1,231 @@
+package useros
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `{
+	"rules": [
+		{"effect": "deny", "paths": ["/srv/*/archive/**"], "ops": ["write", "create", "delete", "chmod"]},
+		{"effect": "deny", "paths": [".DS_Store", "*.exe"], "ops": ["create"]},
+		{"effect": "allow", "groups": [2000], "paths": ["*.csv"], "ops": ["read"]},
+		{"effect": "allow", "groups": [2000], "ops": ["stat", "list"]},
+		{"effect": "deny", "groups": [2000]},
+		{"effect": "deny", "uids": ["5000-5999"], "paths": ["/srv/**"]}
+	]
+}`
+
+func TestPolicy(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{UID: 1000, GID: 1000, Groups: []int{1000}}
+	analyst := User{UID: 1001, GID: 1000, Groups: []int{1000, 2000}}
+	guest := User{UID: 5001, GID: 5001}
+
+	tests := []struct {
+		user    User
+		op      Op
+		name    string
+		allowed bool
+	}{
+		{user, OpWrite, "/srv/a/archive/2020/file", false},
+		{user, OpCreate, "/srv/a/archive", false},
+		{user, OpRead, "/srv/a/archive/file", true},
+		{user, OpWrite, "/srv/a/current/file", true},
+		{user, OpCreate, "/home/user/dir/.DS_Store", false},
+		{user, OpCreate, "/home/user/setup.exe", false},
+		{user, OpWrite, "/home/user/setup.exe", true},
+		{analyst, OpRead, "/srv/a/data.csv", true},
+		{analyst, OpRead, "/srv/a/data.txt", false},
+		{analyst, OpWrite, "/srv/a/data.csv", false},
+		{analyst, OpRead | OpWrite, "/srv/a/data.csv", false},
+		{analyst, OpList, "/srv/a", true},
+		{guest, OpRead, "/srv/a/data.csv", false},
+		{guest, OpRead, "/home/guest/file", true},
+	}
+
+	for _, test := range tests {
+		if allowed := p.Allowed(test.user, test.op, test.name); allowed != test.allowed {
+			t.Errorf("%d %s %s: expected %v, got %v", test.user.UID, test.op, test.name, test.allowed, allowed)
+		}
+	}
+
+	if err = p.Check(analyst, OpWrite, "/srv/a/data.csv"); !errors.Is(err, ErrPolicyDenied) || !errors.Is(err, os.ErrPermission) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, invalid := range []string{
+		`{"rules": [{"effect": "maybe"}]}`,
+		`{"rules": [{"effect": "deny", "ops": ["fly"]}]}`,
+		`{"rules": [{"effect": "deny", "uids": ["10-1"]}]}`,
+		`{"rules": [{"effect": "deny", "paths": ["[a"]}]}`,
+		`{"default": "never", "rules": []}`,
+	} {
+		if _, err = ParsePolicy([]byte(invalid)); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+}
+
+func TestPolicyOS(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "policy.json")
+
+	if err = os.WriteFile(file, []byte(`{"rules": [{"effect": "deny", "paths": ["`+dir+`/*/archive/**"], "ops": ["write", "create", "delete"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := LoadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := p.Wrap(Default())
+
+	if err = o.MkdirAll(filepath.Join(dir, "a", "archive"), 0o755); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected ErrPolicyDenied, got %v", err)
+	}
+
+	if err = os.MkdirAll(filepath.Join(dir, "a", "archive"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = o.WriteFile(filepath.Join(dir, "a", "file"), nil, 0o644); err != nil {
+		t.Error(err)
+	}
+
+	if err = o.WriteFile(filepath.Join(dir, "a", "archive", "file"), nil, 0o644); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected ErrPolicyDenied, got %v", err)
+	}
+
+	// Symlinks don't bypass the policy
+	if err = o.Symlink(filepath.Join(dir, "a", "archive"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = o.Create(filepath.Join(dir, "link", "file")); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected ErrPolicyDenied, got %v", err)
+	}
+
+	// Neither do final symlinks, also if they are dangling
+	if err = os.WriteFile(filepath.Join(dir, "a", "archive", "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, target := range map[string]string{"flink": "file", "dangling": "new"} {
+		if err = o.Symlink(filepath.Join(dir, "a", "archive", target), filepath.Join(dir, "a", name)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = o.WriteFile(filepath.Join(dir, "a", name), []byte("data"), 0o644); !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s: expected ErrPolicyDenied, got %v", name, err)
+		}
+	}
+
+	if _, err = o.Stat(filepath.Join(dir, "a", "flink")); err != nil {
+		t.Error(err)
+	}
+
+	// Nothing is removed if a single file may not be removed
+	if err = o.RemoveAll(filepath.Join(dir, "a")); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected ErrPolicyDenied, got %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "a", "file")); err != nil {
+		t.Error(err)
+	}
+
+	// Reload, an invalid file keeps the current rules
+	if err = os.WriteFile(file, []byte(`{"rules": [{"effect": "unknown"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Reload(); err == nil {
+		t.Error("expected reload error")
+	}
+
+	if err = o.Remove(filepath.Join(dir, "a", "archive")); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected ErrPolicyDenied, got %v", err)
+	}
+
+	if err = os.WriteFile(file, []byte(`{"rules": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = o.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPolicyFile(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ParsePolicy([]byte(`{"rules": [{"effect": "deny", "paths": ["` + dir + `/locked", "` + dir + `/locked/**"], "ops": ["list", "chmod", "chown", "write"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Mkdir(filepath.Join(dir, "locked"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "locked", "file"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	o := p.Wrap(Default())
+
+	// Opening for reading is allowed, the methods on the opened files are not
+	d, err := o.Open(filepath.Join(dir, "locked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Close()
+
+	f, err := o.Open(filepath.Join(dir, "locked", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	_, err = d.ReadDir(-1)
+	assertPolicyDenied(t, "readdir", err)
+
+	_, err = d.Readdir(-1)
+	assertPolicyDenied(t, "readdir", err)
+
+	_, err = d.Readdirnames(-1)
+	assertPolicyDenied(t, "readdirnames", err)
+
+	assertPolicyDenied(t, "chmod", d.Chmod(0o700))
+	assertPolicyDenied(t, "chmod", f.Chmod(0o600))
+	assertPolicyDenied(t, "chown", f.Chown(os.Getuid(), os.Getgid()))
+	assertPolicyDenied(t, "truncate", f.Truncate(0))
+}
+
+func assertPolicyDenied(t *testing.T, op string, err error) {
+	t.Helper()
+
+	if !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("%s: expected ErrPolicyDenied, got %v", op, err)
+	}
+}
@@ -0,0 +1,782 @@
+package useros
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// QuotaLimits are the limits of a uid. Zero limits are unlimited.
+// Soft limits may be exceeded during the grace period, hard limits never.
+type QuotaLimits struct {
+	SoftBytes  int64
+	HardBytes  int64
+	SoftInodes int64
+	HardInodes int64
+	Grace      time.Duration
+}
+
+// QuotaUsage is the usage of a uid.
+type QuotaUsage struct {
+	Bytes  int64 `json:"bytes"`
+	Inodes int64 `json:"inodes"`
+
+	// BytesOver and InodesOver are the times at which the soft limits were exceeded, if they are.
+	BytesOver  time.Time `json:"bytes_over,omitempty"`
+	InodesOver time.Time `json:"inodes_over,omitempty"`
+}
+
+// Quota tracks the bytes and inodes used per uid, and enforces limits on the
+// operations of an OS that is wrapped with it. Usage is persisted in a ledger
+// file that is replaced atomically, so it is never torn by a crash. Changes
+// that are lost in a crash are corrected by Reconcile.
+//
+// Files are charged to their owner, new files to the user of the OS.
+type Quota struct {
+	mu       sync.Mutex
+	ledger   string
+	defaults QuotaLimits
+	limits   map[int]QuotaLimits
+	usage    map[int]*QuotaUsage
+	now      func() time.Time
+
+	// version counts the changes of usage.
+	version uint64
+
+	// saveMu orders the writers of the ledger, which don't hold mu during disk I/O.
+	// saved is the version in the ledger, and is guarded by saveMu.
+	saveMu sync.Mutex
+	saved  uint64
+}
+
+type quotaLedger struct {
+	Version int                   `json:"version"`
+	Usage   map[string]QuotaUsage `json:"usage"`
+}
+
+// OpenQuota opens the quota ledger, or starts an empty one if it doesn't exist yet.
+func OpenQuota(ledger string) (*Quota, error) {
+	q := &Quota{
+		ledger: ledger,
+		limits: map[int]QuotaLimits{},
+		usage:  map[int]*QuotaUsage{},
+		now:    time.Now,
+	}
+
+	data, err := os.ReadFile(ledger)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var l quotaLedger
+
+	if err = json.Unmarshal(data, &l); err != nil {
+		return nil, &os.PathError{Op: "open", Path: ledger, Err: err}
+	}
+
+	for key, usage := range l.Usage {
+		uid, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: ledger, Err: err}
+		}
+
+		u := usage
+		q.usage[uid] = &u
+	}
+
+	return q, nil
+}
+
+// SetDefaultLimits sets the limits of uids without own limits.
+func (q *Quota) SetDefaultLimits(l QuotaLimits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.defaults = l
+}
+
+// SetLimits sets the limits of a uid.
+func (q *Quota) SetLimits(uid int, l QuotaLimits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.limits[uid] = l
+}
+
+// Usage returns the usage of a uid.
+func (q *Quota) Usage(uid int) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if u, ok := q.usage[uid]; ok {
+		return *u
+	}
+
+	return QuotaUsage{}
+}
+
+// Reconcile recounts the usage of all files below root, as seen by o, and replaces
+// the usage of all uids by the result. Hard linked files are counted once.
+func (q *Quota) Reconcile(o OS, root string) error {
+	var (
+		usage = map[int]*QuotaUsage{}
+		seen  = map[[2]uint64]struct{}{}
+	)
+
+	err := o.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		ino, ok := inodeOf(info)
+		if !ok {
+			ino.uid = o.CurrentUser().UID
+		} else if ino.nlink > 1 {
+			if _, ok := seen[[2]uint64{ino.dev, ino.ino}]; ok {
+				return nil
+			}
+
+			seen[[2]uint64{ino.dev, ino.ino}] = struct{}{}
+		}
+
+		u, ok := usage[ino.uid]
+		if !ok {
+			u = &QuotaUsage{}
+			usage[ino.uid] = u
+		}
+
+		u.Inodes++
+		u.Bytes += quotaBytes(info)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+
+	// Keep the grace periods that are still running
+	for uid, u := range usage {
+		if old, ok := q.usage[uid]; ok {
+			u.BytesOver, u.InodesOver = old.BytesOver, old.InodesOver
+		}
+
+		q.update(uid, u)
+	}
+
+	q.usage = usage
+	q.version++
+
+	q.mu.Unlock()
+
+	return q.save()
+}
+
+// Flush writes the ledger.
+func (q *Quota) Flush() error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	return q.write()
+}
+
+// save writes the ledger, unless a concurrent writer already wrote the changes
+// so far. The caller must not hold the lock.
+func (q *Quota) save() error {
+	q.mu.Lock()
+	version := q.version
+	q.mu.Unlock()
+
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	if q.saved >= version {
+		return nil
+	}
+
+	return q.write()
+}
+
+// write atomically replaces the ledger. The usage is copied under the lock, but
+// the ledger is written without it, so that the disk I/O doesn't block the
+// accounting of other operations. The caller must hold saveMu.
+func (q *Quota) write() error {
+	l := quotaLedger{
+		Version: 1,
+		Usage:   map[string]QuotaUsage{},
+	}
+
+	q.mu.Lock()
+
+	for uid, u := range q.usage {
+		l.Usage[strconv.Itoa(uid)] = *u
+	}
+
+	version := q.version
+
+	q.mu.Unlock()
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	tmp := q.ledger + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, q.ledger)
+	}
+
+	if err != nil {
+		os.Remove(tmp) //nolint:errcheck
+		return err
+	}
+
+	// Make the rename durable
+	if d, err := os.Open(filepath.Dir(q.ledger)); err == nil {
+		d.Sync() //nolint:errcheck
+		d.Close()
+	}
+
+	q.saved = version
+
+	return nil
+}
+
+func (q *Quota) limitsOf(uid int) QuotaLimits {
+	if l, ok := q.limits[uid]; ok {
+		return l
+	}
+
+	return q.defaults
+}
+
+// reserve checks whether uid may grow by the given bytes and inodes, and charges
+// the growth right away, so that concurrent operations cannot exceed the limits
+// together. The caller settles the reservation with adjust once the operation is
+// done. A shrink is not charged ahead.
+func (q *Quota) reserve(uid int, bytes, inodes int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := q.limitsOf(uid)
+
+	u, ok := q.usage[uid]
+	if !ok {
+		u = &QuotaUsage{}
+	}
+
+	now := q.now()
+
+	if !withinLimit(u.Bytes, bytes, l.SoftBytes, l.HardBytes, u.BytesOver, l.Grace, now) ||
+		!withinLimit(u.Inodes, inodes, l.SoftInodes, l.HardInodes, u.InodesOver, l.Grace, now) {
+		return syscall.EDQUOT
+	}
+
+	q.charge(uid, growth(bytes), growth(inodes))
+
+	return nil
+}
+
+// growth returns the positive part of a change.
+func growth(delta int64) int64 {
+	if delta < 0 {
+		return 0
+	}
+
+	return delta
+}
+
+// adjust adds bytes and inodes to the usage of uid.
+func (q *Quota) adjust(uid int, bytes, inodes int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.charge(uid, bytes, inodes)
+}
+
+func withinLimit(used, delta, soft, hard int64, over time.Time, grace time.Duration, now time.Time) bool {
+	if delta <= 0 {
+		return true
+	}
+
+	if hard > 0 && used+delta > hard {
+		return false
+	}
+
+	// The soft limit may only be exceeded during the grace period
+	return soft == 0 || used+delta <= soft || over.IsZero() || now.Sub(over) <= grace
+}
+
+// charge adds bytes and inodes to the usage of uid. The caller must hold the lock.
+func (q *Quota) charge(uid int, bytes, inodes int64) {
+	if bytes == 0 && inodes == 0 {
+		return
+	}
+
+	u, ok := q.usage[uid]
+	if !ok {
+		u = &QuotaUsage{}
+		q.usage[uid] = u
+	}
+
+	u.Bytes += bytes
+	u.Inodes += inodes
+
+	if u.Bytes < 0 {
+		u.Bytes = 0
+	}
+
+	if u.Inodes < 0 {
+		u.Inodes = 0
+	}
+
+	q.update(uid, u)
+	q.version++
+}
+
+// update starts or stops the grace periods of uid. The caller must hold the lock.
+func (q *Quota) update(uid int, u *QuotaUsage) {
+	l := q.limitsOf(uid)
+	now := q.now()
+
+	switch {
+	case l.SoftBytes == 0 || u.Bytes <= l.SoftBytes:
+		u.BytesOver = time.Time{}
+	case u.BytesOver.IsZero():
+		u.BytesOver = now
+	}
+
+	switch {
+	case l.SoftInodes == 0 || u.Inodes <= l.SoftInodes:
+		u.InodesOver = time.Time{}
+	case u.InodesOver.IsZero():
+		u.InodesOver = now
+	}
+}
+
+// quotaBytes returns the bytes a file is charged for.
+func quotaBytes(fi fs.FileInfo) int64 {
+	if fi == nil || !fi.Mode().IsRegular() {
+		return 0
+	}
+
+	return fi.Size()
+}
+
+// Wrap returns an OS that enforces the quota on o.
+func (q *Quota) Wrap(o OS) OS {
+	return &quotaOS{OS: o, quota: q}
+}
+
+type quotaOS struct {
+	OS
+	quota *Quota
+}
+
+// owner returns the uid that is charged for a file.
+func (o *quotaOS) owner(fi fs.FileInfo) int {
+	if ino, ok := inodeOf(fi); ok {
+		return ino.uid
+	}
+
+	return o.CurrentUser().UID
+}
+
+// freed returns the bytes and inodes that are freed by removing the file.
+func freed(fi fs.FileInfo) (int64, int64) {
+	if ino, ok := inodeOf(fi); ok && ino.nlink > 1 && !fi.IsDir() {
+		return 0, 0
+	}
+
+	return quotaBytes(fi), 1
+}
+
+func (o *quotaOS) lstat(name string) fs.FileInfo {
+	fi, err := o.OS.Lstat(name)
+	if err != nil {
+		return nil
+	}
+
+	return fi
+}
+
+// create performs the creation of an inode by the user of the OS.
+func (o *quotaOS) create(op, name string, fn func() error) error {
+	uid := o.CurrentUser().UID
+
+	if err := o.quota.reserve(uid, 0, 1); err != nil {
+		return logit(&os.PathError{Op: op, Path: name, Err: err})
+	}
+
+	if err := fn(); err != nil {
+		o.quota.adjust(uid, 0, -1)
+		return err
+	}
+
+	return logit(o.quota.save())
+}
+
+// remove performs the removal of a file.
+func (o *quotaOS) remove(fi fs.FileInfo, fn func() error) error {
+	if err := fn(); err != nil || fi == nil {
+		return err
+	}
+
+	bytes, inodes := freed(fi)
+
+	o.quota.adjust(o.owner(fi), -bytes, -inodes)
+
+	return logit(o.quota.save())
+}
+
+// resize performs a change of the size of a file.
+func (o *quotaOS) resize(op, name string, fi fs.FileInfo, size int64, fn func() error) error {
+	if fi == nil || !fi.Mode().IsRegular() {
+		return fn()
+	}
+
+	uid := o.owner(fi)
+	delta := size - fi.Size()
+
+	if err := o.quota.reserve(uid, delta, 0); err != nil {
+		return logit(&os.PathError{Op: op, Path: name, Err: err})
+	}
+
+	if err := fn(); err != nil {
+		o.quota.adjust(uid, -growth(delta), 0)
+		return err
+	}
+
+	// A shrink is only charged once it is done
+	o.quota.adjust(uid, delta-growth(delta), 0)
+
+	return logit(o.quota.save())
+}
+
+func (o *quotaOS) Chown(name string, uid, gid int) error {
+	fi, err := o.OS.Stat(name)
+	if err != nil {
+		return o.OS.Chown(name, uid, gid)
+	}
+
+	return o.transfer("chown", name, fi, uid, func() error { return o.OS.Chown(name, uid, gid) })
+}
+
+func (o *quotaOS) Lchown(name string, uid, gid int) error {
+	return o.transfer("lchown", name, o.lstat(name), uid, func() error { return o.OS.Lchown(name, uid, gid) })
+}
+
+// transfer moves the usage of a file to a new owner.
+func (o *quotaOS) transfer(op, name string, fi fs.FileInfo, uid int, fn func() error) error {
+	if fi == nil || uid < 0 || o.owner(fi) == uid {
+		return fn()
+	}
+
+	from, bytes := o.owner(fi), quotaBytes(fi)
+
+	if err := o.quota.reserve(uid, bytes, 1); err != nil {
+		return logit(&os.PathError{Op: op, Path: name, Err: err})
+	}
+
+	if err := fn(); err != nil {
+		o.quota.adjust(uid, -bytes, -1)
+		return err
+	}
+
+	o.quota.adjust(from, -bytes, -1)
+
+	return logit(o.quota.save())
+}
+
+func (o *quotaOS) Mkdir(name string, perm os.FileMode) error {
+	return o.create("mkdir", name, func() error { return o.OS.Mkdir(name, perm) })
+}
+
+func (o *quotaOS) MkdirAll(path string, perm os.FileMode) error {
+	// Create the missing directories one by one, so each of them is counted
+	var missing []string
+
+	for dir := filepath.Clean(path); o.lstat(dir) == nil; dir = filepath.Dir(dir) {
+		missing = append(missing, dir)
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		err := o.Mkdir(missing[i], perm)
+		if errors.Is(err, fs.ErrExist) {
+			if fi, _ := o.OS.Stat(missing[i]); fi != nil && fi.IsDir() { //nolint:errcheck
+				continue
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *quotaOS) Symlink(oldname, newname string) error {
+	return o.create("symlink", newname, func() error { return o.OS.Symlink(oldname, newname) })
+}
+
+func (o *quotaOS) Remove(name string) error {
+	return o.remove(o.lstat(name), func() error { return o.OS.Remove(name) })
+}
+
+func (o *quotaOS) RemoveAll(path string) error {
+	var files []string
+
+	infos := map[string]fs.FileInfo{}
+
+	o.OS.Walk(path, func(name string, info fs.FileInfo, err error) error { //nolint:errcheck
+		if err == nil {
+			files = append(files, name)
+			infos[name] = info
+		}
+
+		return nil
+	})
+
+	err := o.OS.RemoveAll(path)
+
+	// Only account for the files that are gone
+	for _, name := range files {
+		if o.lstat(name) != nil {
+			continue
+		}
+
+		bytes, inodes := freed(infos[name])
+		o.quota.adjust(o.owner(infos[name]), -bytes, -inodes)
+	}
+
+	if err1 := o.quota.save(); err == nil {
+		err = err1
+	}
+
+	return logit(err)
+}
+
+func (o *quotaOS) Rename(oldpath, newpath string) error {
+	// A replaced file is freed, unless it is the renamed file itself
+	replaced := o.lstat(newpath)
+	if old := o.lstat(oldpath); replaced != nil && old != nil && os.SameFile(old, replaced) {
+		replaced = nil
+	}
+
+	return o.remove(replaced, func() error { return o.OS.Rename(oldpath, newpath) })
+}
+
+func (o *quotaOS) Truncate(name string, size int64) error {
+	fi, err := o.OS.Stat(name)
+	if err != nil {
+		return o.OS.Truncate(name, size)
+	}
+
+	return o.resize("truncate", name, fi, size, func() error { return o.OS.Truncate(name, size) })
+}
+
+func (o *quotaOS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := o.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+
+	return err
+}
+
+func (o *quotaOS) Create(name string) (File, error) {
+	return o.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (o *quotaOS) Open(name string) (File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *quotaOS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fi, _ := o.OS.Stat(name) //nolint:errcheck
+
+	return o.open("open", name, fi, flag, func() (File, error) { return o.OS.OpenFile(name, flag, perm) })
+}
+
+// open performs the opening of a file that had stat fi, and wraps it in a quotaFile.
+// Read-only files are wrapped too, so that directories opened as capabilities are accounted.
+func (o *quotaOS) open(op, name string, fi fs.FileInfo, flag int, fn func() (File, error)) (File, error) {
+	var (
+		f   File
+		err error
+	)
+
+	open := func() error {
+		f, err = fn()
+		return err
+	}
+
+	switch {
+	case flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0:
+		err = open()
+	case fi == nil && flag&os.O_CREATE != 0:
+		err = o.create(op, name, open)
+	case fi != nil && flag&os.O_TRUNC != 0:
+		err = o.resize(op, name, fi, 0, open)
+	default:
+		err = open()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &quotaFile{File: f, os: o}, nil
+}
+
+// quotaFile charges writes to the owner of the file.
+type quotaFile struct {
+	File
+	os *quotaOS
+
+	// dirty is set once the file changed the usage.
+	dirty bool
+}
+
+// grow checks and charges the growth of the file when writing n bytes at off.
+// If off is negative, the current offset is used.
+func (f *quotaFile) grow(op string, off int64, n int, fn func() (int, error)) (int, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return fn()
+	}
+
+	if off < 0 {
+		if off, err = f.File.Seek(0, io.SeekCurrent); err != nil {
+			off = fi.Size()
+		}
+	}
+
+	uid := f.os.CurrentUser().UID
+	if ino, ok := inodeOf(fi); ok {
+		uid = ino.uid
+	}
+
+	delta := growth(off + int64(n) - fi.Size())
+
+	if err = f.os.quota.reserve(uid, delta, 0); err != nil {
+		return 0, logit(&os.PathError{Op: op, Path: f.Name(), Err: err})
+	}
+
+	written, err := fn()
+
+	var actual int64
+
+	if after, err := f.File.Stat(); err == nil {
+		actual = after.Size() - fi.Size()
+	}
+
+	// Refund the part of the reservation that was not written
+	f.os.quota.mu.Lock()
+	f.os.quota.charge(uid, actual-delta, 0)
+	f.dirty = f.dirty || actual != 0
+	f.os.quota.mu.Unlock()
+
+	return written, err
+}
+
+func (f *quotaFile) Write(b []byte) (int, error) {
+	return f.grow("write", -1, len(b), func() (int, error) { return f.File.Write(b) })
+}
+
+func (f *quotaFile) WriteAt(b []byte, off int64) (int, error) {
+	return f.grow("write", off, len(b), func() (int, error) { return f.File.WriteAt(b, off) })
+}
+
+func (f *quotaFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *quotaFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{f}, r)
+}
+
+func (f *quotaFile) Truncate(size int64) error {
+	_, err := f.grow("truncate", size, 0, func() (int, error) { return 0, f.File.Truncate(size) })
+
+	return err
+}
+
+func (f *quotaFile) Openat(name string, flag int, perm os.FileMode) (File, error) {
+	fi, _ := f.File.Statat(name) //nolint:errcheck
+
+	return f.os.open("openat", atPath(f, name), fi, flag, func() (File, error) { return f.File.Openat(name, flag, perm) })
+}
+
+func (f *quotaFile) Mkdirat(name string, perm os.FileMode) error {
+	return f.os.create("mkdirat", atPath(f, name), func() error { return f.File.Mkdirat(name, perm) })
+}
+
+func (f *quotaFile) Unlinkat(name string) error {
+	fi, _ := f.File.Statat(name) //nolint:errcheck
+
+	return f.os.remove(fi, func() error { return f.File.Unlinkat(name) })
+}
+
+func (f *quotaFile) Renameat(oldname string, newdir File, newname string) error {
+	// A replaced file is freed, unless it is the renamed file itself
+	replaced, _ := newdir.Statat(newname)                                                              //nolint:errcheck
+	if old, _ := f.File.Statat(oldname); replaced != nil && old != nil && os.SameFile(old, replaced) { //nolint:errcheck
+		replaced = nil
+	}
+
+	return f.os.remove(replaced, func() error { return f.File.Renameat(oldname, newdir, newname) })
+}
+
+func (f *quotaFile) Close() error {
+	err := f.File.Close()
+
+	f.os.quota.mu.Lock()
+	dirty := f.dirty
+	f.os.quota.mu.Unlock()
+
+	if !dirty {
+		return err
+	}
+
+	if err1 := f.os.quota.Flush(); err == nil {
+		err = err1
+	}
+
+	return err
+}
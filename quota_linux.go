@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+type inodeInfo struct {
+	uid, gid int
+	nlink    uint64
+	dev, ino uint64
+	ctime    int64
+}
+
+// inodeOf returns the owner and identity of a file.
+func inodeOf(fi fs.FileInfo) (inodeInfo, bool) {
+	if fi == nil {
+		return inodeInfo{}, false
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inodeInfo{}, false
+	}
+
+	return inodeInfo{
+		uid:   int(st.Uid),
+		gid:   int(st.Gid),
+		nlink: uint64(st.Nlink),
+		dev:   uint64(st.Dev),
+		ino:   st.Ino,
+		ctime: st.Ctim.Nano(),
+	}, true
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import "io/fs"
+
+type inodeInfo struct {
+	uid, gid int
+	nlink    uint64
+	dev, ino uint64
+	ctime    int64
+}
+
+// inodeOf is not supported on this platform, files are charged to the current user.
+func inodeOf(fs.FileInfo) (inodeInfo, bool) {
+	return inodeInfo{}, false
+}
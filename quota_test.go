@@ -0,0 +1,173 @@
+package useros
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	dir := t.TempDir()
+	ledger := filepath.Join(t.TempDir(), "quota.json")
+
+	q, err := OpenQuota(ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	o := q.Wrap(Default())
+	uid := o.CurrentUser().UID
+
+	q.SetLimits(uid, QuotaLimits{SoftBytes: 100, HardBytes: 200, HardInodes: 5, Grace: time.Hour})
+
+	expect := func(bytes, inodes int64) {
+		t.Helper()
+
+		if u := q.Usage(uid); u.Bytes != bytes || u.Inodes != inodes {
+			t.Fatalf("expected %d bytes and %d inodes, got %d and %d", bytes, inodes, u.Bytes, u.Inodes)
+		}
+	}
+
+	if err = o.MkdirAll(filepath.Join(dir, "a/b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = o.WriteFile(filepath.Join(dir, "a/file"), make([]byte, 50), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(50, 3)
+
+	// Exceed the soft limit during the grace period
+	f, err := o.OpenFile(filepath.Join(dir, "a/file"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(150, 3)
+
+	// Hard limit
+	if _, err = f.Write(make([]byte, 100)); !errors.Is(err, syscall.EDQUOT) {
+		t.Fatalf("expected EDQUOT, got %v", err)
+	}
+
+	// Grace period expired
+	now = now.Add(2 * time.Hour)
+
+	if _, err = f.Write(make([]byte, 1)); !errors.Is(err, syscall.EDQUOT) {
+		t.Fatalf("expected EDQUOT, got %v", err)
+	}
+
+	// Shrinking is always allowed, and resets the grace period
+	if err = f.Truncate(80); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(80, 3)
+
+	if f, err = o.Create(filepath.Join(dir, "a/b/empty")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	if err = o.Symlink("file", filepath.Join(dir, "a/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(80, 5)
+
+	if err = o.Mkdir(filepath.Join(dir, "c"), 0o755); !errors.Is(err, syscall.EDQUOT) {
+		t.Fatalf("expected EDQUOT, got %v", err)
+	}
+
+	// Replacing a file frees it
+	if err = o.Rename(filepath.Join(dir, "a/b/empty"), filepath.Join(dir, "a/file")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(0, 4)
+
+	// The ledger survives
+	q, err = OpenQuota(ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(0, 4)
+
+	if err = q.Wrap(Default()).RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(0, 0)
+
+	// Reconcile corrects drift
+	if err = os.WriteFile(filepath.Join(dir, "untracked"), make([]byte, 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = q.Reconcile(Default(), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(10, 2)
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := OpenQuota(filepath.Join(t.TempDir(), "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := q.Wrap(Default())
+	uid := o.CurrentUser().UID
+
+	q.SetLimits(uid, QuotaLimits{HardBytes: 100})
+
+	files := make([]File, 20)
+
+	for i := range files {
+		if files[i], err = o.Create(filepath.Join(dir, strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Concurrent writes are reserved before they are done, so they cannot exceed the limit together
+	var wg sync.WaitGroup
+
+	for _, f := range files {
+		wg.Add(1)
+
+		go func(f File) {
+			defer wg.Done()
+
+			f.Write(make([]byte, 10)) //nolint:errcheck
+			f.Close()
+		}(f)
+	}
+
+	wg.Wait()
+
+	if u := q.Usage(uid); u.Bytes != 100 {
+		t.Errorf("expected 100 bytes, got %d", u.Bytes)
+	}
+}
@@ -0,0 +1,196 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// removeAll removes path and its contents relative to opened directories. Entries are
+// inspected with fstatat and removed with unlinkat, subdirectories are opened without
+// following symlinks, and permissions are checked on the opened directories. A user
+// who replaces a directory by a symlink during the removal cannot redirect it.
+// The context is checked before each entry.
+func (u *user) removeAll(ctx context.Context, path string) error {
+	path = filepath.Clean(path)
+	parent, name := filepath.Dir(path), filepath.Base(path)
+
+	// The ancestors are checked by path, as for Remove
+	if _, _, err := u.hasInodeAccess(path, Execute, OpDelete); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fd, err := unix.Open(parent, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "open", Path: parent, Err: err}
+	}
+
+	dir, err := u.openRemoveDir(os.NewFile(uintptr(fd), parent), Execute)
+	if err != nil {
+		return err
+	}
+
+	defer dir.f.Close()
+
+	return u.removeAt(ctx, dir, name)
+}
+
+// removeDir is an opened directory whose entries are removed.
+type removeDir struct {
+	f    *os.File
+	stat os.FileInfo
+
+	// write is the error for removing entries from the directory.
+	write error
+}
+
+// openRemoveDir checks the permissions perms on an opened directory, which are
+// needed to descend into it, and the write permission needed to remove entries.
+func (u *user) openRemoveDir(f *os.File, perms Permission) (*removeDir, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d := &removeDir{f: f, stat: stat}
+
+	if u.UID == 0 {
+		return d, nil
+	}
+
+	// The ACL is read through the descriptor
+	a, err := u.getACL(fdPath(osFile{f}), stat)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if perms&Read > 0 {
+		err = on(u.authorize(f.Name(), stat, a, Read, OpList, false), f.Name())
+	}
+
+	if err == nil && perms&Execute > 0 {
+		err = on(u.authorize(f.Name(), stat, a, Execute, OpDelete, true), f.Name())
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d.write = on(u.authorize(f.Name(), stat, a, Write, OpDelete, false), f.Name())
+
+	return d, nil
+}
+
+// removeAt removes the entry name of dir. Like rm -rf, the contents of a
+// subdirectory are removed even if the subdirectory itself cannot be removed.
+func (u *user) removeAt(ctx context.Context, dir *removeDir, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir.f.Name(), name)
+
+	var st unix.Stat_t
+
+	if err := unix.Fstatat(int(dir.f.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err == unix.ENOENT {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "fstatat", Path: path, Err: err}
+	}
+
+	denied := dir.write
+
+	// In a sticky directory, only the owner can remove an entry
+	if denied == nil && dir.stat.Mode()&os.ModeSticky > 0 && u.UID != 0 && st.Uid != uint32(u.UID) {
+		denied = on(os.ErrPermission, path)
+	}
+
+	if denied == nil {
+		denied = u.authorizeObjectAt(osFile{dir.f}, name, OpDelete)
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		if denied != nil {
+			return denied
+		}
+
+		return unlinkAt(dir.f, path, name, 0)
+	}
+
+	// An empty directory needs no permissions on itself
+	if denied == nil {
+		err := unlinkAt(dir.f, path, name, unix.AT_REMOVEDIR)
+		if !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+	}
+
+	err := u.removeContents(ctx, dir, path, name, &st)
+
+	switch {
+	case err != nil:
+		return err
+	case denied != nil:
+		return denied
+	default:
+		return unlinkAt(dir.f, path, name, unix.AT_REMOVEDIR)
+	}
+}
+
+// removeContents removes the entries of the subdirectory name of dir, which had stat st.
+func (u *user) removeContents(ctx context.Context, dir *removeDir, path, name string, st *unix.Stat_t) error {
+	fd, err := unix.Openat(int(dir.f.Fd()), name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "openat", Path: path, Err: err}
+	}
+
+	sub, err := u.openRemoveDir(os.NewFile(uintptr(fd), path), Read|Execute)
+	if err != nil {
+		return err
+	}
+
+	defer sub.f.Close()
+
+	// The directory must not have been replaced since fstatat
+	if s, ok := sub.stat.Sys().(*syscall.Stat_t); !ok || uint64(s.Dev) != uint64(st.Dev) || s.Ino != st.Ino {
+		return &os.PathError{Op: "openat", Path: path, Err: syscall.EAGAIN}
+	}
+
+	names, err := sub.f.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range names {
+		if err1 := u.removeAt(ctx, sub, n); err == nil {
+			err = err1
+		}
+	}
+
+	return err
+}
+
+func unlinkAt(dir *os.File, path, name string, flags int) error {
+	if err := unix.Unlinkat(int(dir.Fd()), name, flags); err != nil && err != unix.ENOENT {
+		return &os.PathError{Op: "unlinkat", Path: path, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveAll(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		o := User{UID: 1000, GID: 1000}.OS()
+
+		dir := filepath.Join(tree.Root, "a", "tree")
+		outside := filepath.Join(tree.Root, "outside")
+
+		tree.AssertSuccess(o.MkdirAll(filepath.Join(dir, "x", "y"), 0o755))
+		tree.AssertSuccess(o.WriteFile(filepath.Join(dir, "x", "y", "f"), nil, 0o644))
+
+		if err := os.Mkdir(outside, 0o777); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(outside, "keep"), nil, 0o666); err != nil {
+			t.Fatal(err)
+		}
+
+		// The parent a cannot be listed, which rm -rf does not need either, and
+		// a symlink is removed, not followed
+		tree.AssertSuccess(o.Symlink(outside, filepath.Join(dir, "link")))
+		tree.AssertSuccess(o.RemoveAll(dir))
+		tree.AssertNotExist(o.Chmod(dir, 0o755))
+
+		if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+			t.Error(err)
+		}
+
+		// A directory that cannot be listed cannot be emptied
+		tree.AssertSuccess(o.MkdirAll(filepath.Join(dir, "x"), 0o755))
+		tree.AssertSuccess(o.WriteFile(filepath.Join(dir, "x", "f"), nil, 0o644))
+		tree.AssertSuccess(o.Chmod(filepath.Join(dir, "x"), 0o300))
+		tree.AssertDenied(o.RemoveAll(dir))
+		tree.AssertSuccess(o.Chmod(filepath.Join(dir, "x"), 0o700))
+		tree.AssertSuccess(o.RemoveAll(dir))
+
+		// The context is checked before each entry
+		tree.AssertSuccess(o.MkdirAll(filepath.Join(dir, "x", "y"), 0o755))
+
+		if err := WithContext(&countdownContext{Context: context.Background(), n: 2}, o).RemoveAll(dir); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancellation, got %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "x", "y")); err != nil {
+			t.Error(err)
+		}
+
+		tree.AssertSuccess(o.RemoveAll(dir))
+
+		// In a sticky directory, entries of other users are kept
+		if err := os.Chmod(outside, 0o777|os.ModeSticky); err != nil {
+			t.Fatal(err)
+		}
+
+		tree.AssertSuccess(o.WriteFile(filepath.Join(outside, "mine"), nil, 0o666))
+		tree.AssertDenied(o.RemoveAll(outside))
+
+		if _, err := os.Stat(filepath.Join(outside, "mine")); !os.IsNotExist(err) {
+			t.Errorf("expected own file to be removed, got %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// countdownContext is cancelled after n checks.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n == 0 {
+		return context.Canceled
+	}
+
+	c.n--
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ResolveFlags control how a Resolver resolves paths. They mirror the RESOLVE_* flags of openat2(2).
+type ResolveFlags int
+
+const (
+	// ResolveNoSymlinks fails with ELOOP if any component is a symlink.
+	ResolveNoSymlinks ResolveFlags = 1 << iota
+
+	// ResolveNoMagicLinks fails with ELOOP if any component is a procfs magic link, e.g. /proc/self/fd/0.
+	ResolveNoMagicLinks
+
+	// ResolveNoXDev fails with EXDEV if the resolution crosses a mount point.
+	ResolveNoXDev
+
+	// ResolveBeneath fails with EXDEV if the path, one of its symlinks or ".." escapes the directory of the resolver.
+	ResolveBeneath
+
+	// ResolveInRoot treats the directory of the resolver as the root directory: absolute paths,
+	// absolute symlinks and ".." at the root stay inside it.
+	ResolveInRoot
+)
+
+// MaxSymlinks is the number of symlinks that are followed to resolve a name before
+// failing with ELOOP, as in linux. It applies to Resolver, Root and OpenFile alike.
+const MaxSymlinks = 40
+
+// Resolver resolves paths component by component.
+type Resolver struct {
+	// Dir is the directory relative paths are resolved against, and the directory
+	// used by ResolveBeneath and ResolveInRoot. If empty, the working directory is used.
+	Dir string
+
+	// Flags control the resolution.
+	Flags ResolveFlags
+}
+
+// StepKind is the kind of a step in a resolution trace.
+type StepKind int
+
+const (
+	// StepLookup is a lookup of a component in a directory.
+	StepLookup StepKind = iota
+
+	// StepParent is a ".." component.
+	StepParent
+
+	// StepSymlink is a symlink that is followed.
+	StepSymlink
+
+	// StepMount is a crossing into another mount.
+	StepMount
+)
+
+func (k StepKind) String() string {
+	switch k {
+	case StepLookup:
+		return "lookup"
+	case StepParent:
+		return "parent"
+	case StepSymlink:
+		return "symlink"
+	case StepMount:
+		return "mount"
+	default:
+		return "unknown"
+	}
+}
+
+// Step is a single step in a resolution trace.
+type Step struct {
+	Kind StepKind
+
+	// Dir is the directory in which the step starts.
+	Dir string
+
+	// Path is the path that is reached.
+	Path string
+
+	// Target is the target of a followed symlink.
+	Target string
+}
+
+// Resolution is the result of resolving a path.
+type Resolution struct {
+	// Path is the resolved path, without symlinks, "." or "..".
+	Path string
+
+	// Dirs are the directories that were searched, in order.
+	// To resolve the path, a user needs execute permission on each of them.
+	Dirs []string
+
+	// Trace lists every step of the resolution.
+	Trace []Step
+}
+
+// Resolve resolves all symlinks in name, including the final one.
+// Components are resolved as the kernel does, so ".." after a symlink
+// refers to the parent of the symlink target. Errors are returned as
+// *os.PathError with the errno that openat2(2) would return.
+func (r Resolver) Resolve(name string) (*Resolution, error) {
+	if name == "" {
+		return nil, &os.PathError{Op: "resolve", Path: name, Err: syscall.ENOENT}
+	}
+
+	confined := r.Flags&(ResolveBeneath|ResolveInRoot) != 0
+
+	dir := r.Dir
+	if confined || !filepath.IsAbs(name) {
+		if dir == "" {
+			dir = "."
+		}
+
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		dir = abs
+	}
+
+	var (
+		root   = string(os.PathSeparator)
+		cur    = root
+		result = &Resolution{}
+		rest   = split(name)
+	)
+
+	switch {
+	case confined:
+		// The directory itself is resolved without restrictions and without trace
+		res, err := Resolver{}.Resolve(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		root, cur = res.Path, res.Path
+
+		if filepath.IsAbs(name) && r.Flags&ResolveInRoot == 0 {
+			return nil, &os.PathError{Op: "resolve", Path: name, Err: syscall.EXDEV}
+		}
+	case !filepath.IsAbs(name):
+		// Traverse the working directory, as permission checks need its directories too
+		rest = append(split(dir), rest...)
+	}
+
+	mount, err := mountID(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	links := 0
+
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			// The directory that is left is searched for its parent
+			if len(result.Dirs) == 0 || result.Dirs[len(result.Dirs)-1] != cur {
+				result.Dirs = append(result.Dirs, cur)
+			}
+
+			if cur == root {
+				if r.Flags&ResolveBeneath != 0 {
+					return nil, &os.PathError{Op: "resolve", Path: name, Err: syscall.EXDEV}
+				}
+
+				// As in the kernel, .. at the root stays at the root
+				continue
+			}
+
+			next := filepath.Dir(cur)
+			result.Trace = append(result.Trace, Step{Kind: StepParent, Dir: cur, Path: next})
+
+			m, err := mountID(next)
+			if err != nil {
+				return nil, err
+			}
+
+			if err = r.cross(result, &mount, m, cur, next, name); err != nil {
+				return nil, err
+			}
+
+			cur = next
+
+			continue
+		}
+
+		next := filepath.Join(cur, c)
+
+		if len(result.Dirs) == 0 || result.Dirs[len(result.Dirs)-1] != cur {
+			result.Dirs = append(result.Dirs, cur)
+		}
+
+		result.Trace = append(result.Trace, Step{Kind: StepLookup, Dir: cur, Path: next})
+
+		n, err := lstatNode(next)
+		if err != nil {
+			return nil, err
+		}
+
+		if n.symlink {
+			if r.Flags&ResolveNoSymlinks != 0 {
+				return nil, &os.PathError{Op: "resolve", Path: next, Err: syscall.ELOOP}
+			}
+
+			if r.Flags&ResolveNoMagicLinks != 0 && isMagicLink(cur) {
+				return nil, &os.PathError{Op: "resolve", Path: next, Err: syscall.ELOOP}
+			}
+
+			if links++; links > MaxSymlinks {
+				return nil, &os.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+			}
+
+			target, err := os.Readlink(next)
+			if err != nil {
+				return nil, err
+			}
+
+			result.Trace = append(result.Trace, Step{Kind: StepSymlink, Dir: cur, Path: next, Target: target})
+
+			if filepath.IsAbs(target) {
+				if r.Flags&ResolveBeneath != 0 {
+					return nil, &os.PathError{Op: "resolve", Path: next, Err: syscall.EXDEV}
+				}
+
+				m, err := mountID(root)
+				if err != nil {
+					return nil, err
+				}
+
+				if err = r.cross(result, &mount, m, cur, root, name); err != nil {
+					return nil, err
+				}
+
+				cur = root
+			}
+
+			rest = append(split(target), rest...)
+
+			continue
+		}
+
+		if err = r.cross(result, &mount, n.mount, cur, next, name); err != nil {
+			return nil, err
+		}
+
+		if !n.dir && len(rest) > 0 {
+			return nil, &os.PathError{Op: "resolve", Path: next, Err: syscall.ENOTDIR}
+		}
+
+		cur = next
+	}
+
+	result.Path = cur
+
+	return result, nil
+}
+
+// cross records a mount crossing if the mount changes.
+func (r Resolver) cross(result *Resolution, mount *uint64, next uint64, from, to, name string) error {
+	if next == *mount {
+		return nil
+	}
+
+	if r.Flags&ResolveNoXDev != 0 {
+		return &os.PathError{Op: "resolve", Path: name, Err: syscall.EXDEV}
+	}
+
+	result.Trace = append(result.Trace, Step{Kind: StepMount, Dir: from, Path: to})
+	*mount = next
+
+	return nil
+}
+
+func split(path string) []string {
+	return strings.Split(path, string(os.PathSeparator))
+}
@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+type node struct {
+	dir     bool
+	symlink bool
+	mount   uint64
+}
+
+// lstatNode returns the type and mount of path, without following a final symlink.
+func lstatNode(path string) (node, error) {
+	var stx unix.Statx_t
+
+	err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_TYPE|unix.STATX_MNT_ID, &stx)
+	if err != nil {
+		return node{}, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+
+	n := node{
+		dir:     stx.Mode&unix.S_IFMT == unix.S_IFDIR,
+		symlink: stx.Mode&unix.S_IFMT == unix.S_IFLNK,
+		mount:   stx.Mnt_id,
+	}
+
+	// Kernels before 5.8 don't report mount ids, fall back to the device
+	if stx.Mask&unix.STATX_MNT_ID == 0 {
+		n.mount = unix.Mkdev(stx.Dev_major, stx.Dev_minor)
+	}
+
+	return n, nil
+}
+
+func mountID(path string) (uint64, error) {
+	n, err := lstatNode(path)
+
+	return n.mount, err
+}
+
+// isMagicLink reports whether symlinks in dir are procfs magic links, i.e. dir is
+// a directory on procfs below /proc/<pid>, such as /proc/<pid>/fd or /proc/<pid> itself.
+func isMagicLink(dir string) bool {
+	var fs unix.Statfs_t
+
+	if err := unix.Statfs(dir, &fs); err != nil || fs.Type != unix.PROC_SUPER_MAGIC {
+		return false
+	}
+
+	// The procfs root contains the ordinary symlinks self, thread-self, mounts, net, ...
+	var st unix.Stat_t
+
+	if err := unix.Stat(filepath.Clean(dir), &st); err != nil {
+		return false
+	}
+
+	return st.Ino != procRootIno
+}
+
+// procRootIno is the inode number of the root of procfs.
+const procRootIno = 1
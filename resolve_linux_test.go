@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestResolver(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, err := range []error{
+		os.MkdirAll(filepath.Join(dir, "a", "b"), 0o755),
+		os.Symlink("a/b", filepath.Join(dir, "rel")),
+		os.Symlink("/a", filepath.Join(dir, "abs")),
+		os.Symlink("../..", filepath.Join(dir, "a", "up")),
+		os.Symlink("loop", filepath.Join(dir, "loop")),
+		os.WriteFile(filepath.Join(dir, "f"), nil, 0o644),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		flags ResolveFlags
+		path  string
+		err   error
+	}{
+		{"rel/..", 0, filepath.Join(dir, "a"), nil},
+		{"rel/../../f", 0, filepath.Join(dir, "f"), nil},
+		{"rel", ResolveNoSymlinks, "", syscall.ELOOP},
+		{"loop", 0, "", syscall.ELOOP},
+		{"f/", 0, "", syscall.ENOTDIR},
+		{"missing", 0, "", syscall.ENOENT},
+		{"../x", ResolveBeneath, "", syscall.EXDEV},
+		{"a/up", ResolveBeneath, "", syscall.EXDEV},
+		{"abs", ResolveBeneath, "", syscall.EXDEV},
+		{"/a", ResolveBeneath, "", syscall.EXDEV},
+		{"abs/b", ResolveInRoot, filepath.Join(dir, "a", "b"), nil},
+		{"a/up/../rel", ResolveInRoot, filepath.Join(dir, "a", "b"), nil},
+		{"/rel/../..", ResolveInRoot, dir, nil},
+	}
+
+	for _, test := range tests {
+		res, err := Resolver{Dir: dir, Flags: test.flags}.Resolve(test.name)
+
+		switch {
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		case test.err == nil && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err == nil && res.Path != test.path:
+			t.Errorf("%s: expected %s, got %s", test.name, test.path, res.Path)
+		}
+	}
+
+	res, err := Resolver{Dir: dir}.Resolve("rel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []StepKind
+
+	for _, step := range res.Trace {
+		if step.Dir != "/" && step.Dir != dir && step.Dir != filepath.Join(dir, "a") {
+			continue
+		}
+
+		kinds = append(kinds, step.Kind)
+	}
+
+	if expected := []StepKind{StepLookup, StepLookup, StepSymlink, StepLookup, StepLookup}; len(kinds) < len(expected) ||
+		!equalKinds(kinds[len(kinds)-len(expected):], expected) {
+		t.Errorf("unexpected trace %v", res.Trace)
+	}
+
+	if last := res.Dirs[len(res.Dirs)-1]; last != filepath.Join(dir, "a") {
+		t.Errorf("unexpected dirs %v", res.Dirs)
+	}
+}
+
+func TestResolverParent(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		// Leaving a directory needs search permission on it
+		tree.AssertSuccess(os.Symlink("a/d/..", filepath.Join(tree.Root, "up")))
+
+		res, err := Resolver{}.Resolve(filepath.Join(tree.Root, "up"))
+		tree.AssertSuccess(err)
+
+		if res != nil && res.Dirs[len(res.Dirs)-1] != filepath.Join(tree.Root, "a", "d") {
+			t.Errorf("unexpected dirs %v", res.Dirs)
+		}
+
+		_, err = User{UID: 1000, GID: 1000}.OS().EvalSymlinks(filepath.Join(tree.Root, "up"))
+		tree.AssertDenied(err)
+	})
+}
+
+func equalKinds(a, b []StepKind) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return len(a) == len(b)
+}
+
+func TestResolverProc(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Resolver{}.Resolve("/proc/self/cwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Path != wd {
+		t.Errorf("expected %s, got %s", wd, res.Path)
+	}
+
+	mounted := false
+
+	for _, step := range res.Trace {
+		mounted = mounted || step.Kind == StepMount && step.Path == "/proc"
+	}
+
+	if !mounted {
+		t.Errorf("expected mount crossing in %v", res.Trace)
+	}
+
+	if _, err = (Resolver{Flags: ResolveNoMagicLinks}).Resolve("/proc/self/cwd"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("expected ELOOP, got %v", err)
+	}
+
+	if _, err = (Resolver{Flags: ResolveNoMagicLinks}).Resolve("/proc/self/status"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = (Resolver{Flags: ResolveNoXDev}).Resolve("/proc/self"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("expected EXDEV, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import "os"
+
+type node struct {
+	dir     bool
+	symlink bool
+	mount   uint64
+}
+
+// lstatNode returns the type of path, without following a final symlink.
+// Mounts are not detected on this platform.
+func lstatNode(path string) (node, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return node{}, err
+	}
+
+	return node{
+		dir:     fi.IsDir(),
+		symlink: fi.Mode()&os.ModeSymlink != 0,
+	}, nil
+}
+
+func mountID(path string) (uint64, error) {
+	_, err := os.Lstat(path)
+
+	return 0, err
+}
+
+// isMagicLink reports whether symlinks in dir are magic links, which only exist on linux.
+func isMagicLink(dir string) bool {
+	return false
+}
@@ -0,0 +1,194 @@
+package useros
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ErrPathEscapes is returned when a path would resolve outside of a Root.
+var ErrPathEscapes = errors.New("path escapes from root")
+
+// Root confines file operations to a directory, like os.Root.
+// Names are relative to the root. Both ".." and symlinks are resolved
+// component by component as the user, and must stay inside the root;
+// absolute names and absolute symlinks are considered to escape.
+// On linux, the root is held open, and names are resolved on descriptors of
+// the directories, which are opened relative to their parent without following
+// symlinks. A directory that is concurrently replaced by a symlink can't move an
+// operation outside the root.
+type Root struct {
+	os   OS
+	name string
+
+	// dir is a descriptor of the root directory, or nil if the at-methods of File
+	// are not available. Names are then resolved by path.
+	dir File
+}
+
+// OpenRoot opens the directory dir as a Root for the user.
+func (u User) OpenRoot(dir string) (*Root, error) {
+	r, err := openRoot(u.OS(), dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.dir, err = openRootDir(r.os, r.name); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func openRoot(o OS, dir string) (*Root, error) {
+	name, err := o.EvalSymlinks(dir)
+	if err != nil {
+		return nil, logit(err)
+	}
+
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return nil, logit(err)
+	}
+
+	fi, err := o.Stat(name)
+	if err != nil {
+		return nil, logit(err)
+	}
+
+	if !fi.IsDir() {
+		return nil, logit(&os.PathError{Op: "openroot", Path: dir, Err: syscall.ENOTDIR})
+	}
+
+	// A root is useless without search permission
+	if u, ok := o.(*user); ok {
+		if err = u.hasObjectAccess(name, Execute, OpStat); err != nil {
+			return nil, logit(err)
+		}
+	}
+
+	return &Root{os: o, name: name}, nil
+}
+
+// Name returns the resolved path of the root directory.
+func (r *Root) Name() string {
+	return r.name
+}
+
+// Close closes the root. Files opened below it remain open.
+func (r *Root) Close() error {
+	if r.dir == nil {
+		return nil
+	}
+
+	return r.dir.Close()
+}
+
+// Open opens the named file for reading.
+func (r *Root) Open(name string) (File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file.
+func (r *Root) Create(name string) (File, error) {
+	return r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+// resolve returns the path of name below the root, resolving all symlinks as the user,
+// the final one only if follow is set or the name ends with a slash. The result is a
+// path, which is resolved again by the operation that uses it.
+func (r *Root) resolve(op, name string, follow bool) (string, error) {
+	if name == "" || filepath.IsAbs(name) {
+		return "", logit(&os.PathError{Op: op, Path: name, Err: ErrPathEscapes})
+	}
+
+	var (
+		resolved []string
+		rest     = strings.Split(name, string(os.PathSeparator))
+		links    int
+	)
+
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", logit(&os.PathError{Op: op, Path: name, Err: ErrPathEscapes})
+			}
+
+			resolved = resolved[:len(resolved)-1]
+
+			continue
+		}
+
+		path := r.join(append(resolved, c))
+		final, trailing := isFinal(rest)
+
+		if final && !follow && !trailing {
+			resolved = append(resolved, c)
+			break
+		}
+
+		fi, err := r.os.Lstat(path)
+		if final && os.IsNotExist(err) {
+			resolved = append(resolved, c)
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, c)
+			continue
+		}
+
+		if links++; links > MaxSymlinks {
+			return "", logit(&os.PathError{Op: op, Path: name, Err: syscall.ELOOP})
+		}
+
+		target, err := r.os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			return "", logit(&os.PathError{Op: op, Path: name, Err: ErrPathEscapes})
+		}
+
+		rest = append(strings.Split(target, string(os.PathSeparator)), rest...)
+	}
+
+	return r.join(resolved), nil
+}
+
+func (r *Root) join(components []string) string {
+	return filepath.Join(append([]string{r.name}, components...)...)
+}
+
+// isFinal reports whether only empty and "." components remain, and whether there are any.
+func isFinal(rest []string) (bool, bool) {
+	for _, c := range rest {
+		if c != "" && c != "." {
+			return false, false
+		}
+	}
+
+	return true, len(rest) > 0
+}
+
+// namedFileInfo reports a different name, e.g. the one of a symlink instead of its target.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string {
+	return fi.name
+}
@@ -0,0 +1,374 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// oNoFollow makes OpenFile fail on a final symlink.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// Flags of open(2) that are checked by OpenFile of a user.
+const (
+	oDirectory = syscall.O_DIRECTORY
+	oNoAtime   = syscall.O_NOATIME
+	oPath      = unix.O_PATH
+)
+
+// openRootDir opens the root directory name with O_PATH, to resolve names relative to it.
+func openRootDir(o OS, name string) (File, error) {
+	return o.OpenFile(name, oPath|oDirectory|oNoFollow, 0)
+}
+
+// OpenRoot opens the named directory below the root as a new Root.
+func (r *Root) OpenRoot(name string) (*Root, error) {
+	e, err := r.resolveAt("openroot", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	defer e.close()
+
+	if e.name == "" {
+		d, err := openRootDir(r.os, r.name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Root{os: r.os, name: r.name, dir: d}, nil
+	}
+
+	d, err := e.dir.Openat(e.name, oPath|oDirectory, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// A root is useless without search permission
+	if u, ok := r.os.(*user); ok {
+		if _, err = u.checkFile(d, Execute, OpStat, true); err != nil {
+			d.Close()
+			return nil, logit(err)
+		}
+	}
+
+	return &Root{os: r.os, name: d.Name(), dir: d}, nil
+}
+
+// OpenFile opens the named file with the given flags, see os.OpenFile.
+func (r *Root) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	// As open(2), O_CREATE|O_EXCL never follows a final symlink
+	follow := flag&oNoFollow == 0 && flag&(os.O_CREATE|os.O_EXCL) != os.O_CREATE|os.O_EXCL
+
+	e, err := r.resolveAt("open", name, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	defer e.close()
+
+	if e.name == "" {
+		return r.os.OpenFile(r.name, flag|oNoFollow, perm)
+	}
+
+	// The final symlink is resolved already, Openat doesn't follow a new one
+	return e.dir.Openat(e.name, flag, perm)
+}
+
+// Mkdir creates the named directory.
+func (r *Root) Mkdir(name string, perm os.FileMode) error {
+	e, err := r.resolveAt("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+
+	defer e.close()
+
+	if e.name == "" {
+		return logit(&os.PathError{Op: "mkdir", Path: name, Err: syscall.EEXIST})
+	}
+
+	return e.dir.Mkdirat(e.name, perm)
+}
+
+// Remove removes the named file or empty directory.
+func (r *Root) Remove(name string) error {
+	e, err := r.resolveAt("remove", name, false)
+	if err != nil {
+		return err
+	}
+
+	defer e.close()
+
+	// As os.Root, the root itself can't be removed
+	if e.name == "" {
+		return logit(&os.PathError{Op: "remove", Path: name, Err: syscall.EINVAL})
+	}
+
+	return e.dir.Unlinkat(e.name)
+}
+
+// Stat returns the file info of the named file, following symlinks.
+func (r *Root) Stat(name string) (os.FileInfo, error) {
+	fi, err := r.stat("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return namedFileInfo{fi, filepath.Base(name)}, nil
+}
+
+// Lstat returns the file info of the named file, not following a final symlink.
+func (r *Root) Lstat(name string) (os.FileInfo, error) {
+	return r.stat("lstat", name, false)
+}
+
+func (r *Root) stat(op, name string, follow bool) (os.FileInfo, error) {
+	e, err := r.resolveAt(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	defer e.close()
+
+	if e.name == "" {
+		return e.dir.Stat()
+	}
+
+	return e.dir.Statat(e.name)
+}
+
+// ReadDir reads the named directory, sorted by name.
+func (r *Root) ReadDir(name string) ([]os.DirEntry, error) {
+	f, err := r.OpenFile(name, os.O_RDONLY|oDirectory, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, err
+}
+
+// Rename renames oldname to newname, both below the root.
+func (r *Root) Rename(oldname, newname string) error {
+	olde, err := r.resolveAt("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+
+	defer olde.close()
+
+	newe, err := r.resolveAt("rename", newname, false)
+	if err != nil {
+		return err
+	}
+
+	defer newe.close()
+
+	if olde.name == "" || newe.name == "" {
+		return logit(&os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL})
+	}
+
+	return olde.dir.Renameat(olde.name, newe.dir, newe.name)
+}
+
+// Symlink creates newname as a symlink to oldname. The target is not checked,
+// but following the link through the root fails if it escapes.
+func (r *Root) Symlink(oldname, newname string) error {
+	e, err := r.resolveAt("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+
+	defer e.close()
+
+	if e.name == "" {
+		return logit(&os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EEXIST})
+	}
+
+	return symlinkAt(e.dir, oldname, e.name)
+}
+
+// rootEntry is the entry name of the directory dir, or the root itself if name is empty.
+type rootEntry struct {
+	dir  File
+	name string
+
+	// opened is set if dir was opened by the resolution, rather than being the root.
+	opened bool
+}
+
+func (e rootEntry) close() {
+	if e.opened {
+		e.dir.Close()
+	}
+}
+
+// resolveAt resolves name below the root like resolve, but on descriptors: each
+// directory is opened relative to its parent, without following a symlink, and
+// the at-methods of its File check the permissions of the user on it. It returns
+// the directory that contains the final component.
+func (r *Root) resolveAt(op, name string, follow bool) (rootEntry, error) {
+	if name == "" || filepath.IsAbs(name) {
+		return rootEntry{}, logit(&os.PathError{Op: op, Path: name, Err: ErrPathEscapes})
+	}
+
+	var (
+		dirs  []File
+		names []string
+		rest  = strings.Split(name, string(os.PathSeparator))
+		links int
+		base  string
+	)
+
+	closeAll := func() {
+		for _, d := range dirs {
+			d.Close()
+		}
+	}
+
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) == 0 {
+				return rootEntry{}, logit(&os.PathError{Op: op, Path: name, Err: ErrPathEscapes})
+			}
+
+			dirs[len(dirs)-1].Close()
+			dirs, names = dirs[:len(dirs)-1], names[:len(names)-1]
+
+			continue
+		}
+
+		dir := r.dir
+		if len(dirs) > 0 {
+			dir = dirs[len(dirs)-1]
+		}
+
+		final, trailing := isFinal(rest)
+
+		if final && !follow && !trailing {
+			base = c
+			break
+		}
+
+		fi, err := dir.Statat(c)
+		if final && (os.IsNotExist(err) || err == nil && fi.Mode()&fs.ModeSymlink == 0) {
+			base = c
+			break
+		} else if err != nil {
+			closeAll()
+			return rootEntry{}, err
+		}
+
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			d, err := dir.Openat(c, oPath|oDirectory, 0)
+			if err != nil {
+				closeAll()
+				return rootEntry{}, err
+			}
+
+			dirs, names = append(dirs, d), append(names, c)
+
+			continue
+		}
+
+		if links++; links > MaxSymlinks {
+			closeAll()
+			return rootEntry{}, logit(&os.PathError{Op: op, Path: name, Err: syscall.ELOOP})
+		}
+
+		target, err := readlinkAt(dir, c)
+		if err == nil && filepath.IsAbs(target) {
+			err = logit(&os.PathError{Op: op, Path: name, Err: ErrPathEscapes})
+		}
+
+		if err != nil {
+			closeAll()
+			return rootEntry{}, err
+		}
+
+		rest = append(strings.Split(target, string(os.PathSeparator)), rest...)
+	}
+
+	// A name that ends in a directory other than the root is looked up in its parent
+	if base == "" && len(dirs) > 0 {
+		base = names[len(names)-1]
+		dirs[len(dirs)-1].Close()
+		dirs = dirs[:len(dirs)-1]
+	}
+
+	if len(dirs) == 0 {
+		return rootEntry{dir: r.dir, name: base}, nil
+	}
+
+	for _, d := range dirs[:len(dirs)-1] {
+		d.Close()
+	}
+
+	return rootEntry{dir: dirs[len(dirs)-1], name: base, opened: true}, nil
+}
+
+// readlinkAt returns the target of the symlink name in dir, read through a descriptor of the symlink.
+func readlinkAt(dir File, name string) (string, error) {
+	f, err := dir.Openat(name, oPath|oNoFollow, 0)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+
+		n, err := unix.Readlinkat(int(f.Fd()), "", buf)
+		if err != nil {
+			return "", logit(&os.PathError{Op: "readlink", Path: f.Name(), Err: err})
+		}
+
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// symlinkAt creates the symlink name to oldname in dir, as the user for the directory of a user.
+func symlinkAt(dir File, oldname, name string) error {
+	f, ok := dir.(*file)
+	if !ok {
+		if err := unix.Symlinkat(oldname, int(dir.Fd()), name); err != nil {
+			return logit(&os.LinkError{Op: "symlink", Old: oldname, New: atPath(dir, name), Err: err})
+		}
+
+		return nil
+	}
+
+	stat, err := f.u.checkFile(f, Execute, OpCreate, true)
+	if err == nil {
+		_, err = f.u.checkFile(f, Write, OpCreate, false)
+	}
+
+	if err != nil {
+		return f.u.logit(err)
+	}
+
+	return f.u.logit(f.u.symlinkAt(int(f.Fd()), oldname, atPath(f, name), name, stat))
+}
@@ -0,0 +1,193 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func (t Tree) AssertError(err, target error) {
+	i++
+
+	if !errors.Is(err, target) {
+		t.T.Errorf("%02d: expected %v, got %v", i, target, err)
+	}
+}
+
+func TestRoot(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		user1 := User{UID: 1000, GID: 1000}
+		user2 := User{UID: 1001, GID: 1000}
+
+		_, err := user2.OpenRoot(filepath.Join(tree.Root, "a"))
+		tree.AssertDenied(err)
+
+		r, err := user1.OpenRoot(filepath.Join(tree.Root, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := r.Create("f")
+		tree.AssertSuccess(err)
+		if f != nil {
+			f.Close()
+		}
+		tree.AssertOwnership(filepath.Join(tree.Root, "a", "f"), 1000, 1000)
+
+		// Every step is checked with the permissions of the user
+		_, err = r.Stat("d/e")
+		tree.AssertDenied(err)
+
+		// Escapes
+		tree.AssertSuccess(r.Symlink("../..", "up"))
+		tree.AssertSuccess(r.Symlink(filepath.Join(tree.Root, "a", "f"), "abs"))
+		_, err = r.Open("../b")
+		tree.AssertError(err, ErrPathEscapes)
+		_, err = r.Open("/etc/passwd")
+		tree.AssertError(err, ErrPathEscapes)
+		_, err = r.Open("up/b")
+		tree.AssertError(err, ErrPathEscapes)
+		_, err = r.Stat("abs")
+		tree.AssertError(err, ErrPathEscapes)
+		_, err = r.Lstat("abs")
+		tree.AssertSuccess(err)
+		tree.AssertError(r.Mkdir("up/x", 0o700), ErrPathEscapes)
+
+		// Symlinks and .. inside the root
+		tree.AssertSuccess(r.Mkdir("x", 0o700))
+		tree.AssertSuccess(r.Symlink("./x/../f", "link"))
+		fi, err := r.Stat("link")
+		tree.AssertSuccess(err)
+		if fi != nil && (fi.Name() != "link" || !fi.Mode().IsRegular()) {
+			t.Errorf("unexpected stat %s %s", fi.Name(), fi.Mode())
+		}
+		fi, err = r.Lstat("link")
+		tree.AssertSuccess(err)
+		if fi != nil && fi.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("unexpected lstat %s", fi.Mode())
+		}
+
+		tree.AssertSuccess(r.Symlink("loop", "loop"))
+		_, err = r.Open("loop")
+		tree.AssertError(err, syscall.ELOOP)
+
+		// Sub roots
+		tree.AssertSuccess(r.Rename("f", "x/f"))
+		entries, err := r.ReadDir("x/.")
+		tree.AssertSuccess(err)
+		if len(entries) != 1 {
+			t.Errorf("unexpected entries %v", entries)
+		}
+
+		sub, err := r.OpenRoot("up/a/x")
+		tree.AssertError(err, ErrPathEscapes)
+		if sub != nil {
+			t.Error("expected no root")
+		}
+
+		sub, err = r.OpenRoot("x/./../x/")
+		tree.AssertSuccess(err)
+		if sub == nil {
+			return
+		}
+
+		f, err = sub.Open("f")
+		tree.AssertSuccess(err)
+		if f != nil {
+			f.Close()
+		}
+		_, err = sub.Open("../link")
+		tree.AssertError(err, ErrPathEscapes)
+
+		// A dangling symlink is created inside the root
+		tree.AssertSuccess(sub.Symlink("g", "dangling"))
+		f, err = sub.OpenFile("dangling", os.O_WRONLY|os.O_CREATE, 0o600)
+		tree.AssertSuccess(err)
+		if f != nil {
+			f.Close()
+		}
+		tree.AssertOwnership(filepath.Join(tree.Root, "a", "x", "g"), 1000, 1000)
+		_, err = sub.OpenFile("dangling", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		tree.AssertError(err, os.ErrExist)
+
+		tree.AssertSuccess(sub.Remove("f"))
+		tree.AssertNotExist(sub.Remove("f"))
+
+		// The root itself is never removed or renamed
+		tree.AssertError(sub.Remove("."), syscall.EINVAL)
+		tree.AssertError(r.Rename("x/..", "y"), syscall.EINVAL)
+		if _, err = os.Stat(filepath.Join(tree.Root, "a", "x")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRootSwap(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		outside := filepath.Join(tree.Root, "outside")
+		x := filepath.Join(tree.Root, "a", "x")
+		y := filepath.Join(tree.Root, "a", "y")
+
+		for _, dir := range []string{outside, x} {
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dir, "secret"), []byte(filepath.Base(dir)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := os.Symlink(outside, y); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := User{UID: 1000, GID: 1000}.OpenRoot(filepath.Join(tree.Root, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer r.Close()
+
+		// Swap the directory x and a symlink to outside the root while it is resolved
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					unix.Renameat2(unix.AT_FDCWD, x, unix.AT_FDCWD, y, unix.RENAME_EXCHANGE) //nolint:errcheck
+				}
+			}
+		}()
+
+		for i := 0; i < 5000; i++ {
+			f, err := r.Open("x/secret")
+			if err != nil {
+				continue
+			}
+
+			data, err := io.ReadAll(f)
+			f.Close()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != "x" {
+				t.Fatalf("read %s outside the root", data)
+			}
+		}
+	})
+}
@@ -0,0 +1,139 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// oNoFollow is not available on all platforms, Root only resolves final symlinks itself.
+const oNoFollow = 0
+
+// Flags of open(2) that are checked by OpenFile of a user, if available.
+const (
+	oDirectory = 0
+	oNoAtime   = 0
+	oPath      = 0
+)
+
+// openRootDir returns nil, names are resolved by path without the at-methods of File.
+func openRootDir(o OS, name string) (File, error) {
+	return nil, nil
+}
+
+// OpenRoot opens the named directory below the root as a new Root.
+func (r *Root) OpenRoot(name string) (*Root, error) {
+	path, err := r.resolve("openroot", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return openRoot(r.os, path)
+}
+
+// OpenFile opens the named file with the given flags, see os.OpenFile.
+func (r *Root) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	// As open(2), O_CREATE|O_EXCL never follows a final symlink
+	follow := flag&oNoFollow == 0 && flag&(os.O_CREATE|os.O_EXCL) != os.O_CREATE|os.O_EXCL
+
+	path, err := r.resolve("open", name, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	// The final symlink is resolved already, don't follow a new one
+	return r.os.OpenFile(path, flag|oNoFollow, perm)
+}
+
+// Mkdir creates the named directory.
+func (r *Root) Mkdir(name string, perm os.FileMode) error {
+	path, err := r.resolve("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+
+	return r.os.Mkdir(path, perm)
+}
+
+// Remove removes the named file or empty directory.
+func (r *Root) Remove(name string) error {
+	path, err := r.resolve("remove", name, false)
+	if err != nil {
+		return err
+	}
+
+	// As os.Root, the root itself can't be removed
+	if path == r.name {
+		return logit(&os.PathError{Op: "remove", Path: name, Err: syscall.EINVAL})
+	}
+
+	return r.os.Remove(path)
+}
+
+// Stat returns the file info of the named file, following symlinks.
+func (r *Root) Stat(name string) (os.FileInfo, error) {
+	path, err := r.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := r.os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return namedFileInfo{fi, filepath.Base(name)}, nil
+}
+
+// Lstat returns the file info of the named file, not following a final symlink.
+func (r *Root) Lstat(name string) (os.FileInfo, error) {
+	path, err := r.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.os.Lstat(path)
+}
+
+// ReadDir reads the named directory.
+func (r *Root) ReadDir(name string) ([]os.DirEntry, error) {
+	path, err := r.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.os.ReadDir(path)
+}
+
+// Rename renames oldname to newname, both below the root.
+func (r *Root) Rename(oldname, newname string) error {
+	oldpath, err := r.resolve("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+
+	newpath, err := r.resolve("rename", newname, false)
+	if err != nil {
+		return err
+	}
+
+	if oldpath == r.name || newpath == r.name {
+		return logit(&os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL})
+	}
+
+	return r.os.Rename(oldpath, newpath)
+}
+
+// Symlink creates newname as a symlink to oldname. The target is not checked,
+// but following the link through the root fails if it escapes.
+func (r *Root) Symlink(oldname, newname string) error {
+	path, err := r.resolve("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+
+	return r.os.Symlink(oldname, path)
+}
@@ -0,0 +1,280 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm        = "AWS4-HMAC-SHA256"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	amzDateFormat    = "20060102T150405Z"
+	maxClockSkew     = 15 * time.Minute
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// signature describes the signature version 4 of a request,
+// either taken from the Authorization header or from a presigned url.
+type signature struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+}
+
+// parseSignature extracts the signature from the request.
+func parseSignature(r *http.Request) (*signature, error) {
+	q := r.URL.Query()
+
+	if q.Get("X-Amz-Algorithm") != "" {
+		return parsePresigned(r, q)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errAccessDenied
+	}
+
+	if !strings.HasPrefix(auth, algorithm+" ") {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	s := &signature{}
+
+	for _, field := range strings.Split(strings.TrimPrefix(auth, algorithm+" "), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, errAuthorizationHeaderMalformed
+		}
+
+		switch k {
+		case "Credential":
+			if err := s.parseCredential(v); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			s.signedHeaders = strings.Split(v, ";")
+		case "Signature":
+			s.signature = v
+		}
+	}
+
+	if s.signature == "" || len(s.signedHeaders) == 0 {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	t, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAccessDenied
+	}
+
+	s.amzDate = t
+
+	if d := time.Since(t); d > maxClockSkew || d < -maxClockSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+
+	s.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if s.payloadHash == "" {
+		return nil, errInvalidRequest
+	}
+
+	return s, nil
+}
+
+func parsePresigned(r *http.Request, q url.Values) (*signature, error) {
+	if q.Get("X-Amz-Algorithm") != algorithm {
+		return nil, errAuthorizationQueryParametersError
+	}
+
+	s := &signature{
+		signedHeaders: strings.Split(q.Get("X-Amz-SignedHeaders"), ";"),
+		signature:     q.Get("X-Amz-Signature"),
+		payloadHash:   unsignedPayload,
+		presigned:     true,
+	}
+
+	if err := s.parseCredential(q.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+
+	t, err := time.Parse(amzDateFormat, q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAuthorizationQueryParametersError
+	}
+
+	s.amzDate = t
+
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignExpiry {
+		return nil, errAuthorizationQueryParametersError
+	}
+
+	if time.Now().After(t.Add(time.Duration(expires) * time.Second)) {
+		return nil, errExpiredToken
+	}
+
+	if s.signature == "" {
+		return nil, errAuthorizationQueryParametersError
+	}
+
+	return s, nil
+}
+
+// parseCredential parses <access key>/<date>/<region>/<service>/aws4_request.
+func (s *signature) parseCredential(v string) error {
+	parts := strings.Split(v, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return errAuthorizationHeaderMalformed
+	}
+
+	s.accessKey = parts[0]
+	s.date = parts[1]
+	s.region = parts[2]
+	s.service = parts[3]
+
+	return nil
+}
+
+func (s *signature) scope() string {
+	return strings.Join([]string{s.date, s.region, s.service, "aws4_request"}, "/")
+}
+
+// compute calculates the signature of the request using the given secret key.
+func (s *signature) compute(r *http.Request, secret string) string {
+	canonical := strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, s.signedHeaders),
+		strings.Join(s.signedHeaders, ";"),
+		s.payloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonical))
+
+	stringToSign := strings.Join([]string{
+		algorithm,
+		s.amzDate.UTC().Format(amzDateFormat),
+		s.scope(),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), s.date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// verify checks the signature of the request against the given secret key.
+func (s *signature) verify(r *http.Request, secret, region string) error {
+	if s.service != "s3" || (region != "" && s.region != region) || s.date != s.amzDate.UTC().Format("20060102") {
+		return errAuthorizationHeaderMalformed
+	}
+
+	expected := s.compute(r, secret)
+
+	if !hmac.Equal([]byte(expected), []byte(s.signature)) {
+		return errSignatureDoesNotMatch
+	}
+
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+
+	for k := range q {
+		if k != "X-Amz-Signature" {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	var parts []string
+
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+func canonicalHeaders(r *http.Request, signed []string) string {
+	var b strings.Builder
+
+	for _, name := range signed {
+		var value string
+
+		if name == "host" {
+			value = r.Host
+		} else {
+			values := append([]string{}, r.Header.Values(name)...)
+			for i, v := range values {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+
+			value = strings.Join(values, ",")
+		}
+
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
+
+// uriEncode encodes a string as specified for signature version 4:
+// every byte except the unreserved characters is percent-encoded.
+// Slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexdigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexdigits[c>>4])
+			b.WriteByte(hexdigits[c&15])
+		}
+	}
+
+	return b.String()
+}
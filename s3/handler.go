@@ -0,0 +1,314 @@
+// Package s3 implements the core of the S3 REST API on top of useros.
+// The top-level directories of the root are exposed as buckets, and every
+// request is performed through the OS of the user that belongs to the
+// access key of the request. Requests must be signed with signature
+// version 4, which is verified against locally configured secrets.
+//
+// Only path-style requests are supported, e.g. http://host/bucket/key.
+package s3
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterverraedt/useros"
+)
+
+// Credential is the secret key and user that belong to an access key.
+type Credential struct {
+	SecretKey string
+	User      useros.User
+}
+
+// Handler serves the S3 REST API for the directory tree below Root.
+type Handler struct {
+	// Root is the directory that contains the buckets.
+	Root string
+
+	// Region is the region that requests must be signed for. If empty, any region is accepted.
+	Region string
+
+	// Credentials maps access keys to their secret key and user.
+	Credentials map[string]Credential
+}
+
+// request holds the state of a single authenticated request.
+type request struct {
+	*http.Request
+	h      *Handler
+	os     useros.OS
+	user   useros.User
+	sig    *signature
+	bucket string
+	key    string
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := req.serve(w); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+func (h *Handler) authenticate(r *http.Request) (*request, error) {
+	sig, err := parseSignature(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cred, ok := h.Credentials[sig.accessKey]
+	if !ok {
+		return nil, errInvalidAccessKeyID
+	}
+
+	if err := sig.verify(r, cred.SecretKey, h.Region); err != nil {
+		return nil, err
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	req := &request{
+		Request: r,
+		h:       h,
+		os:      cred.User.OS(),
+		user:    cred.User,
+		sig:     sig,
+		bucket:  bucket,
+		key:     key,
+	}
+
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// validate refuses bucket names and keys that would not map to a path below the bucket.
+func (r *request) validate() error {
+	if r.bucket == "" {
+		if r.key != "" {
+			return errInvalidBucketName
+		}
+
+		return nil
+	}
+
+	if r.bucket == "." || r.bucket == ".." || strings.HasPrefix(r.bucket, ".") {
+		return errInvalidBucketName
+	}
+
+	if r.key == "" {
+		return nil
+	}
+
+	for i, part := range strings.Split(r.key, "/") {
+		last := i == strings.Count(r.key, "/")
+
+		if part == "." || part == ".." || (part == "" && !last) || strings.HasPrefix(part, internalPrefix) {
+			return errInvalidKey
+		}
+	}
+
+	return nil
+}
+
+func (r *request) serve(w http.ResponseWriter) error {
+	q := r.URL.Query()
+
+	switch {
+	case r.bucket == "" && r.Method == http.MethodGet:
+		return r.listBuckets(w)
+	case r.bucket == "":
+		return errMethodNotAllowed
+	case r.key == "" && r.Method == http.MethodHead:
+		return r.headBucket(w)
+	case r.key == "" && r.Method == http.MethodGet && q.Get("list-type") == "2":
+		if err := r.checkBucket(); err != nil {
+			return err
+		}
+
+		return r.listObjects(w)
+	case r.key == "":
+		return errNotImplemented
+	}
+
+	// Requests other than uploads have no or a small body, verify it upfront
+	if r.Method != http.MethodPut || r.Header.Get("X-Amz-Copy-Source") != "" {
+		if err := r.verifyBody(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.checkBucket(); err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return r.getObject(w)
+	case http.MethodPut:
+		switch {
+		case q.Has("uploadId") && q.Has("partNumber"):
+			return r.uploadPart(w)
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			return r.copyObject(w)
+		default:
+			return r.putObject(w)
+		}
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			return r.createMultipartUpload(w)
+		case q.Has("uploadId"):
+			return r.completeMultipartUpload(w)
+		}
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			return r.abortMultipartUpload(w)
+		}
+
+		return r.deleteObject(w)
+	}
+
+	return errMethodNotAllowed
+}
+
+// maxBodySize is the maximal size of request bodies that are not object data.
+const maxBodySize = 1 << 20
+
+// verifyBody reads the complete request body and verifies its payload hash.
+// The body is replaced so that it can be read again by the handler.
+func (r *request) verifyBody() error {
+	v := newVerifier(io.LimitReader(r.Body, maxBodySize), r.sig.payloadHash)
+
+	data, err := io.ReadAll(v)
+	if err != nil {
+		return err
+	}
+
+	if err := v.verify(); err != nil {
+		return err
+	}
+
+	r.Body = io.NopCloser(strings.NewReader(string(data)))
+
+	return nil
+}
+
+// checkBucket verifies that the bucket exists and is a directory the user can access.
+func (r *request) checkBucket() error {
+	fi, err := r.os.Stat(r.bucketPath())
+	if err != nil {
+		return toError(err, errNoSuchBucket)
+	}
+
+	if !fi.IsDir() {
+		return errNoSuchBucket
+	}
+
+	return nil
+}
+
+func (r *request) bucketPath() string {
+	return filepath.Join(r.h.Root, r.bucket)
+}
+
+func (r *request) objectPath(key string) string {
+	return filepath.Join(r.h.Root, r.bucket, filepath.FromSlash(key))
+}
+
+func (r *request) resource() string {
+	return path.Join("/", r.bucket, r.key)
+}
+
+// Error is an S3 error response.
+type Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+var (
+	errAccessDenied                      = &Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errAuthorizationHeaderMalformed      = &Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errAuthorizationQueryParametersError = &Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "The authorization query parameters are malformed."}
+	errBadDigest                         = &Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errExpiredToken                      = &Error{http.StatusForbidden, "AccessDenied", "Request has expired."}
+	errInternalError                     = &Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	errInvalidAccessKeyID                = &Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	errInvalidArgument                   = &Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errInvalidBucketName                 = &Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid."}
+	errInvalidKey                        = &Error{http.StatusBadRequest, "InvalidArgument", "The specified key is not valid."}
+	errInvalidPart                       = &Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found."}
+	errInvalidPartOrder                  = &Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	errInvalidRequest                    = &Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256."}
+	errMalformedXML                      = &Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed."}
+	errMethodNotAllowed                  = &Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errNoSuchBucket                      = &Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errNoSuchKey                         = &Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchUpload                      = &Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errNotImplemented                    = &Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errRequestTimeTooSkewed              = &Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errSignatureDoesNotMatch             = &Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+)
+
+// toError converts an error of the OS to an S3 error.
+func toError(err error, notExist *Error) *Error {
+	var e *Error
+
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, os.ErrNotExist):
+		return notExist
+	case errors.Is(err, os.ErrPermission):
+		return errAccessDenied
+	default:
+		return errInternalError
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := toError(err, errNoSuchKey)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string   `xml:"Code"`
+		Message  string   `xml:"Message"`
+		Resource string   `xml:"Resource"`
+	}{
+		Code:     e.Code,
+		Message:  e.Message,
+		Resource: r.URL.Path,
+	})
+}
+
+func writeXML(w io.Writer, v interface{}) {
+	io.WriteString(w, xml.Header) //nolint:errcheck
+
+	xml.NewEncoder(w).Encode(v) //nolint:errcheck
+}
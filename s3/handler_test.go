@@ -0,0 +1,264 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/peterverraedt/useros"
+)
+
+type client struct {
+	t         *testing.T
+	server    *httptest.Server
+	accessKey string
+	secretKey string
+}
+
+// do signs and sends a request, and returns the status code and body of the response.
+func (c *client) do(method, path string, body []byte, header map[string]string) (int, []byte) {
+	req, err := http.NewRequest(method, c.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	sum := sha256.Sum256(body)
+	now := time.Now().UTC()
+
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+
+	if header["X-Amz-Content-Sha256"] != "" {
+		req.Header.Set("X-Amz-Content-Sha256", header["X-Amz-Content-Sha256"])
+	}
+
+	req.Host = req.URL.Host
+
+	sig := &signature{
+		accessKey:     c.accessKey,
+		date:          now.Format("20060102"),
+		region:        "us-east-1",
+		service:       "s3",
+		signedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+		amzDate:       now,
+		payloadHash:   req.Header.Get("X-Amz-Content-Sha256"),
+	}
+
+	req.Header.Set("Authorization", algorithm+" Credential="+c.accessKey+"/"+sig.scope()+
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="+sig.compute(req, c.secretKey))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return resp.StatusCode, data
+}
+
+func (c *client) expect(status int, method, path string, body []byte, header map[string]string) []byte {
+	code, data := c.do(method, path, body, header)
+	if code != status {
+		c.t.Errorf("%s %s: expected status %d, got %d: %s", method, path, status, code, data)
+	}
+
+	return data
+}
+
+func newHandler(t *testing.T) *Handler {
+	if syscall.Geteuid() != 0 {
+		t.Skip("must run as root")
+	}
+
+	root, err := os.MkdirTemp("/tmp", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	if err := os.Chmod(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, uid := range map[string]int{"data": 1000, "private": 1001} {
+		if err := os.Mkdir(filepath.Join(root, name), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chown(filepath.Join(root, name), uid, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &Handler{
+		Root:   root,
+		Region: "us-east-1",
+		Credentials: map[string]Credential{
+			"user1": {SecretKey: "secret1", User: useros.User{UID: 1000, GID: 1000, Groups: []int{1000}}},
+			"user2": {SecretKey: "secret2", User: useros.User{UID: 1001, GID: 1001, Groups: []int{1001}}},
+		},
+	}
+}
+
+func TestObjects(t *testing.T) {
+	h := newHandler(t)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	c := &client{t: t, server: server, accessKey: "user1", secretKey: "secret1"}
+
+	data := c.expect(http.StatusOK, http.MethodGet, "/", nil, nil)
+	if !bytes.Contains(data, []byte("<Name>data</Name>")) || !bytes.Contains(data, []byte("<Name>private</Name>")) {
+		t.Errorf("unexpected bucket list: %s", data)
+	}
+
+	body := []byte("hello world")
+
+	c.expect(http.StatusOK, http.MethodPut, "/data/dir/hello.txt", body, nil)
+
+	fi, err := os.Stat(filepath.Join(h.Root, "data", "dir", "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 1000 {
+		t.Errorf("object has invalid ownership %d:%d", st.Uid, st.Gid)
+	}
+
+	data = c.expect(http.StatusPartialContent, http.MethodGet, "/data/dir/hello.txt", nil, map[string]string{"Range": "bytes=1-3"})
+	if string(data) != "ell" {
+		t.Errorf("unexpected range content %q", data)
+	}
+
+	c.expect(http.StatusOK, http.MethodHead, "/data/dir/hello.txt", nil, nil)
+	c.expect(http.StatusNotFound, http.MethodHead, "/data/dir/missing", nil, nil)
+
+	c.expect(http.StatusOK, http.MethodPut, "/data/copy.txt", nil, map[string]string{"X-Amz-Copy-Source": "/data/dir/hello.txt"})
+
+	data = c.expect(http.StatusOK, http.MethodGet, "/data?list-type=2&delimiter=%2F", nil, nil)
+	if !bytes.Contains(data, []byte("<Prefix>dir/</Prefix>")) || !bytes.Contains(data, []byte("<Key>copy.txt</Key>")) || bytes.Contains(data, []byte("hello.txt")) {
+		t.Errorf("unexpected object list: %s", data)
+	}
+
+	data = c.expect(http.StatusOK, http.MethodGet, "/data?list-type=2&prefix=dir%2Fh", nil, nil)
+	if !bytes.Contains(data, []byte("<Key>dir/hello.txt</Key>")) || bytes.Contains(data, []byte("copy.txt")) {
+		t.Errorf("unexpected object list: %s", data)
+	}
+
+	// Temporary files that are left behind are not objects
+	if err = os.WriteFile(filepath.Join(h.Root, "data", "dir", internalPrefix+"leftover"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	data = c.expect(http.StatusOK, http.MethodGet, "/data?list-type=2&prefix=dir%2F", nil, nil)
+	if !bytes.Contains(data, []byte("<Key>dir/hello.txt</Key>")) || bytes.Contains(data, []byte(internalPrefix)) {
+		t.Errorf("unexpected object list: %s", data)
+	}
+
+	c.expect(http.StatusBadRequest, http.MethodPut, "/data/dir/"+internalPrefix+"leftover", body, nil)
+
+	c.expect(http.StatusNoContent, http.MethodDelete, "/data/copy.txt", nil, nil)
+	c.expect(http.StatusNotFound, http.MethodGet, "/data/copy.txt", nil, nil)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	h := newHandler(t)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	c := &client{t: t, server: server, accessKey: "user1", secretKey: "secret1"}
+
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+
+	if err := xml.Unmarshal(c.expect(http.StatusOK, http.MethodPost, "/data/big?uploads", nil, nil), &initiate); err != nil {
+		t.Fatal(err)
+	}
+
+	parts := []string{"first part,", "second part"}
+
+	var complete bytes.Buffer
+
+	complete.WriteString("<CompleteMultipartUpload>")
+
+	for i, part := range parts {
+		n := string(rune('1' + i))
+		c.expect(http.StatusOK, http.MethodPut, "/data/big?partNumber="+n+"&uploadId="+initiate.UploadID, []byte(part), nil)
+
+		sum := md5sum(part)
+		complete.WriteString("<Part><PartNumber>" + n + "</PartNumber><ETag>\"" + sum + "\"</ETag></Part>")
+	}
+
+	complete.WriteString("</CompleteMultipartUpload>")
+
+	c.expect(http.StatusOK, http.MethodPost, "/data/big?uploadId="+initiate.UploadID, complete.Bytes(), nil)
+
+	data := c.expect(http.StatusOK, http.MethodGet, "/data/big", nil, nil)
+	if string(data) != strings.Join(parts, "") {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	if _, err := os.Stat(filepath.Join(h.Root, "data", uploadDir, initiate.UploadID)); !os.IsNotExist(err) {
+		t.Errorf("upload directory not cleaned up: %v", err)
+	}
+}
+
+func TestDenied(t *testing.T) {
+	h := newHandler(t)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	c := &client{t: t, server: server, accessKey: "user2", secretKey: "secret2"}
+
+	c.expect(http.StatusForbidden, http.MethodPut, "/data/f", []byte("x"), nil)
+	c.expect(http.StatusOK, http.MethodPut, "/private/f", []byte("x"), nil)
+	c.expect(http.StatusBadRequest, http.MethodPut, "/private/../data/f", []byte("x"), nil)
+	c.expect(http.StatusBadRequest, http.MethodPut, "/private/g", []byte("x"), map[string]string{
+		"X-Amz-Content-Sha256": strings.Repeat("0", 64),
+	})
+
+	c.accessKey = "user1"
+	c.secretKey = "secret1"
+
+	c.expect(http.StatusForbidden, http.MethodGet, "/private/f", nil, nil)
+	c.expect(http.StatusForbidden, http.MethodGet, "/private?list-type=2", nil, nil)
+
+	c.secretKey = "wrong"
+
+	data := c.expect(http.StatusForbidden, http.MethodGet, "/", nil, nil)
+	if !bytes.Contains(data, []byte("SignatureDoesNotMatch")) {
+		t.Errorf("unexpected error: %s", data)
+	}
+
+	c.accessKey = "unknown"
+
+	c.expect(http.StatusForbidden, http.MethodGet, "/", nil, nil)
+}
+
+func md5sum(s string) string {
+	sum := md5.Sum([]byte(s)) //nolint:gosec
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,262 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/peterverraedt/useros"
+)
+
+// internalPrefix starts the names of the entries that the handler keeps in
+// a bucket: the upload directory and temporary files. They are not valid in keys.
+const internalPrefix = ".s3-"
+
+// uploadDir is the directory in each bucket that holds the parts of
+// multipart uploads, written as the user that initiated the upload.
+const uploadDir = internalPrefix + "uploads"
+
+const maxPartNumber = 10000
+
+// uploadPath returns the directory of the upload with the given id,
+// after validating the id.
+func (r *request) uploadPath(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", errNoSuchUpload
+	}
+
+	dir := filepath.Join(r.bucketPath(), uploadDir, id)
+
+	key, err := r.os.ReadFile(filepath.Join(dir, "key"))
+	if err != nil {
+		return "", toError(err, errNoSuchUpload)
+	}
+
+	if string(key) != r.key {
+		return "", errNoSuchUpload
+	}
+
+	return dir, nil
+}
+
+func (r *request) createMultipartUpload(w http.ResponseWriter) error {
+	id := randomID()
+	dir := filepath.Join(r.bucketPath(), uploadDir, id)
+
+	if err := r.os.MkdirAll(dir, 0777); err != nil {
+		return toError(err, errNoSuchBucket)
+	}
+
+	if err := r.os.WriteFile(filepath.Join(dir, "key"), []byte(r.key), 0666); err != nil {
+		r.os.RemoveAll(dir) //nolint:errcheck
+		return toError(err, errNoSuchBucket)
+	}
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{
+		Xmlns:    xmlns,
+		Bucket:   r.bucket,
+		Key:      r.key,
+		UploadID: id,
+	})
+
+	return nil
+}
+
+func (r *request) uploadPart(w http.ResponseWriter) error {
+	q := r.URL.Query()
+
+	n, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || n < 1 || n > maxPartNumber {
+		return errInvalidArgument
+	}
+
+	dir, err := r.uploadPath(q.Get("uploadId"))
+	if err != nil {
+		return err
+	}
+
+	v := newVerifier(r.Body, r.sig.payloadHash)
+
+	sum, err := r.store(filepath.Join(dir, strconv.Itoa(n)), v, v.verify)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (r *request) completeMultipartUpload(w http.ResponseWriter) error {
+	dir, err := r.uploadPath(r.URL.Query().Get("uploadId"))
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	for i, part := range body.Parts {
+		if i > 0 && part.PartNumber <= body.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+	}
+
+	dst := r.objectPath(r.key)
+
+	if err := r.os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return toError(err, errNoSuchBucket)
+	}
+
+	parts := &partsReader{
+		os:    r.os,
+		dir:   dir,
+		parts: body.Parts,
+	}
+
+	if _, err := r.store(dst, parts, parts.verify); err != nil {
+		parts.close()
+		return err
+	}
+
+	r.os.RemoveAll(dir) //nolint:errcheck
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{
+		Xmlns:    xmlns,
+		Location: r.resource(),
+		Bucket:   r.bucket,
+		Key:      r.key,
+		ETag:     parts.etag(),
+	})
+
+	return nil
+}
+
+func (r *request) abortMultipartUpload(w http.ResponseWriter) error {
+	dir, err := r.uploadPath(r.URL.Query().Get("uploadId"))
+	if err != nil {
+		return err
+	}
+
+	if err := r.os.RemoveAll(dir); err != nil {
+		return toError(err, errNoSuchUpload)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// partsReader concatenates the parts of an upload and checks their entity tags.
+type partsReader struct {
+	os      useros.OS
+	dir     string
+	parts   []completedPart
+	current useros.File
+	h       hash.Hash
+	sums    []byte
+	bad     bool
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			f, err := p.os.Open(filepath.Join(p.dir, strconv.Itoa(p.parts[0].PartNumber)))
+			if os.IsNotExist(err) {
+				return 0, errInvalidPart
+			} else if err != nil {
+				return 0, err
+			}
+
+			p.current = f
+			p.h = md5.New() //nolint:gosec
+		}
+
+		n, err := p.current.Read(b)
+		p.h.Write(b[:n])
+
+		if err == io.EOF {
+			p.next()
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+// next finishes the current part and compares its md5 sum with the entity tag.
+func (p *partsReader) next() {
+	p.current.Close()
+	p.current = nil
+
+	sum := p.h.Sum(nil)
+
+	if hex.EncodeToString(sum) != strings.Trim(p.parts[0].ETag, `"`) {
+		p.bad = true
+	}
+
+	p.sums = append(p.sums, sum...)
+	p.parts = p.parts[1:]
+}
+
+func (p *partsReader) verify() error {
+	if p.bad {
+		return errInvalidPart
+	}
+
+	return nil
+}
+
+func (p *partsReader) close() {
+	if p.current != nil {
+		p.current.Close()
+	}
+}
+
+// etag returns the entity tag of the completed upload, which is
+// the md5 sum of the md5 sums of the parts followed by the number of parts.
+func (p *partsReader) etag() string {
+	sum := md5.Sum(p.sums) //nolint:gosec
+	return `"` + hex.EncodeToString(sum[:]) + "-" + strconv.Itoa(len(p.sums)/md5.Size) + `"`
+}
@@ -0,0 +1,547 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterverraedt/useros"
+)
+
+const (
+	xmlns      = "http://s3.amazonaws.com/doc/2006-03-01/"
+	timeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+type bucketEntry struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func (r *request) owner() owner {
+	id := strconv.Itoa(r.user.UID)
+	return owner{ID: id, DisplayName: id}
+}
+
+func (r *request) listBuckets(w http.ResponseWriter) error {
+	entries, err := r.os.ReadDir(r.h.Root)
+	if err != nil {
+		return toError(err, errInternalError)
+	}
+
+	result := struct {
+		XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Owner   owner         `xml:"Owner"`
+		Buckets []bucketEntry `xml:"Buckets>Bucket"`
+	}{
+		Xmlns: xmlns,
+		Owner: r.owner(),
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		result.Buckets = append(result.Buckets, bucketEntry{
+			Name:         entry.Name(),
+			CreationDate: info.ModTime().UTC().Format(timeFormat),
+		})
+	}
+
+	writeXML(w, result)
+
+	return nil
+}
+
+func (r *request) headBucket(w http.ResponseWriter) error {
+	if err := r.checkBucket(); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func (r *request) listObjects(w http.ResponseWriter) error {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	startAfter := q.Get("start-after")
+	token := q.Get("continuation-token")
+	maxKeys := 1000
+
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	after := startAfter
+
+	if token != "" {
+		t, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return errInvalidArgument
+		}
+
+		after = string(t)
+	}
+
+	objects, err := r.collect(prefix, delimiter)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Xmlns                 string         `xml:"xmlns,attr"`
+		Name                  string         `xml:"Name"`
+		Prefix                string         `xml:"Prefix"`
+		Delimiter             string         `xml:"Delimiter,omitempty"`
+		MaxKeys               int            `xml:"MaxKeys"`
+		KeyCount              int            `xml:"KeyCount"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		StartAfter            string         `xml:"StartAfter,omitempty"`
+		Contents              []object       `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{
+		Xmlns:             xmlns,
+		Name:              r.bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: token,
+		StartAfter:        startAfter,
+	}
+
+	for _, o := range objects {
+		if o.Key <= after {
+			continue
+		}
+
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(after))
+
+			break
+		}
+
+		if o.StorageClass == "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: o.Key})
+		} else {
+			result.Contents = append(result.Contents, o)
+		}
+
+		after = o.Key
+		result.KeyCount++
+	}
+
+	writeXML(w, result)
+
+	return nil
+}
+
+// collect returns the sorted list of objects and common prefixes below the prefix.
+// Common prefixes are returned as objects without storage class.
+// Only entries that the user can discover are returned.
+func (r *request) collect(prefix, delimiter string) ([]object, error) {
+	root := r.bucketPath()
+
+	// Start walking in the deepest directory that is fully part of the prefix
+	start := root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = r.objectPath(prefix[:i])
+	}
+
+	var (
+		result   []object
+		prefixes = map[string]struct{}{}
+	)
+
+	err := r.os.Walk(start, func(name string, info fs.FileInfo, err error) error {
+		switch {
+		case err != nil && name == start && !os.IsNotExist(err):
+			return err
+		case err != nil && info != nil && info.IsDir():
+			// Skip what the user cannot access, or what disappeared
+			return filepath.SkipDir
+		case err != nil:
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, name)
+		if err != nil || rel == "." {
+			return nil
+		}
+
+		key := filepath.ToSlash(rel)
+
+		// Skip the upload directory and temporary files
+		if strings.HasPrefix(info.Name(), internalPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.IsDir() {
+			dir := key + "/"
+
+			// Prune directories that cannot contain keys with the prefix
+			if !strings.HasPrefix(dir, prefix) && !strings.HasPrefix(prefix, dir) {
+				return filepath.SkipDir
+			}
+
+			// All keys below the directory share the same common prefix
+			if delimiter != "" && strings.HasPrefix(dir, prefix) {
+				if i := strings.Index(dir[len(prefix):], delimiter); i >= 0 {
+					prefixes[dir[:len(prefix)+i+len(delimiter)]] = struct{}{}
+					return filepath.SkipDir
+				}
+			}
+
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				prefixes[key[:len(prefix)+i+len(delimiter)]] = struct{}{}
+				return nil
+			}
+		}
+
+		result = append(result, object{
+			Key:          key,
+			LastModified: info.ModTime().UTC().Format(timeFormat),
+			ETag:         etag(info),
+			Size:         info.Size(),
+			StorageClass: "STANDARD",
+		})
+
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, toError(err, errNoSuchBucket)
+	}
+
+	for p := range prefixes {
+		result = append(result, object{Key: p})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+
+	return result, nil
+}
+
+// etag returns the entity tag of a file. Computing the md5 sum of every file
+// is too expensive, so it is derived from the modification time and size.
+// Clients treat entity tags containing a dash as opaque.
+func etag(info fs.FileInfo) string {
+	return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16) + `"`
+}
+
+func (r *request) getObject(w http.ResponseWriter) error {
+	if strings.HasSuffix(r.key, "/") {
+		return errNoSuchKey
+	}
+
+	f, err := r.os.Open(r.objectPath(r.key))
+	if err != nil {
+		return toError(err, errNoSuchKey)
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return toError(err, errNoSuchKey)
+	}
+
+	if !info.Mode().IsRegular() {
+		return errNoSuchKey
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(r.key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag(info))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	http.ServeContent(w, r.Request, "", info.ModTime(), f)
+
+	return nil
+}
+
+func (r *request) putObject(w http.ResponseWriter) error {
+	// Keys ending in a slash are directory markers
+	if strings.HasSuffix(r.key, "/") {
+		if err := r.verifyBody(); err != nil {
+			return err
+		}
+
+		if err := r.os.MkdirAll(r.objectPath(r.key), 0777); err != nil {
+			return toError(err, errNoSuchBucket)
+		}
+
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.WriteHeader(http.StatusOK)
+
+		return nil
+	}
+
+	dst := r.objectPath(r.key)
+
+	if err := r.os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return toError(err, errNoSuchBucket)
+	}
+
+	v := newVerifier(r.Body, r.sig.payloadHash)
+
+	sum, err := r.store(dst, v, v.verify)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// store writes the data to a temporary file next to dst and renames it into place
+// once check succeeds. It returns the hex encoded md5 sum of the data.
+func (r *request) store(dst string, data io.Reader, check func() error) (string, error) {
+	tmp, err := r.tempFile(filepath.Dir(dst))
+	if err != nil {
+		return "", toError(err, errNoSuchKey)
+	}
+
+	h := md5.New() //nolint:gosec
+
+	_, err = io.Copy(tmp, io.TeeReader(data, h))
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+
+	if err == nil && check != nil {
+		err = check()
+	}
+
+	if err == nil {
+		err = r.os.Rename(tmp.Name(), dst)
+	}
+
+	if err != nil {
+		r.os.Remove(tmp.Name()) //nolint:errcheck
+		return "", toError(err, errNoSuchKey)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// tempFile creates a new hidden file in dir as the user.
+func (r *request) tempFile(dir string) (useros.File, error) {
+	for {
+		name := filepath.Join(dir, internalPrefix+randomID())
+
+		f, err := r.os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+
+		return f, err
+	}
+}
+
+func (r *request) copyObject(w http.ResponseWriter) error {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return errInvalidArgument
+	}
+
+	source, _, _ = strings.Cut(source, "?")
+
+	src := &request{
+		Request: r.Request,
+		h:       r.h,
+		os:      r.os,
+		user:    r.user,
+	}
+
+	src.bucket, src.key, _ = strings.Cut(strings.TrimPrefix(source, "/"), "/")
+
+	if err := src.validate(); err != nil || src.key == "" || strings.HasSuffix(src.key, "/") {
+		return errInvalidArgument
+	}
+
+	if err := src.checkBucket(); err != nil {
+		return err
+	}
+
+	f, err := r.os.Open(src.objectPath(src.key))
+	if err != nil {
+		return toError(err, errNoSuchKey)
+	}
+
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return errNoSuchKey
+	}
+
+	dst := r.objectPath(r.key)
+
+	if err := r.os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return toError(err, errNoSuchBucket)
+	}
+
+	sum, err := r.store(dst, f, nil)
+	if err != nil {
+		return err
+	}
+
+	info, err := r.os.Stat(dst)
+	if err != nil {
+		return toError(err, errNoSuchKey)
+	}
+
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}{
+		LastModified: info.ModTime().UTC().Format(timeFormat),
+		ETag:         `"` + sum + `"`,
+	})
+
+	return nil
+}
+
+func (r *request) deleteObject(w http.ResponseWriter) error {
+	name := r.objectPath(r.key)
+
+	info, err := r.os.Lstat(name)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	} else if err != nil {
+		return toError(err, errNoSuchKey)
+	}
+
+	// Only directory markers may remove directories
+	if info.IsDir() != strings.HasSuffix(r.key, "/") {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if err := r.os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return toError(err, errNoSuchKey)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// verifier computes the sha256 sum of the data read through it,
+// to compare it with the payload hash of the signature at the end.
+type verifier struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+}
+
+func newVerifier(r io.Reader, expected string) *verifier {
+	return &verifier{
+		r:        r,
+		h:        sha256.New(),
+		expected: expected,
+	}
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+
+	return n, err
+}
+
+func (v *verifier) verify() error {
+	switch {
+	case v.expected == unsignedPayload:
+		return nil
+	case strings.HasPrefix(v.expected, "STREAMING-"):
+		return errNotImplemented
+	case hex.EncodeToString(v.h.Sum(nil)) != strings.ToLower(v.expected):
+		return errBadDigest
+	default:
+		return nil
+	}
+}
+
+func randomID() string {
+	var b [16]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		// Fall back to the time, uniqueness is checked by the callers
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(b[:])
+}
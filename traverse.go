@@ -1,10 +1,7 @@
 package useros
 
 import (
-	"os"
 	"path/filepath"
-	"strings"
-	"syscall"
 )
 
 // TraversedDirectories returns the list of directories that is followed to get the the specified inode.
@@ -16,83 +13,17 @@ func TraversedDirectories(path string) ([]string, error) {
 	return ResolveSymlinks(filepath.Dir(filepath.Clean(path)))
 }
 
-// ResolveSymlinks returns the list of paths that is followed to get the the specified path.
+// ResolveSymlinks returns the list of paths that is followed to get the the specified path,
+// i.e. the directories searched by a Resolver followed by the resolved path.
 func ResolveSymlinks(path string) ([]string, error) {
-	if len(path) == 0 {
-		return nil, os.ErrInvalid
-	}
-
-	path, err := filepath.Abs(path)
+	res, err := Resolver{}.Resolve(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if path[0] == '.' {
-		return nil, os.ErrInvalid
+	if n := len(res.Dirs); n > 0 && res.Dirs[n-1] == res.Path {
+		return res.Dirs, nil
 	}
 
-	p := strings.IndexRune(path, os.PathSeparator)
-	curdir := path[:p+1]
-	result := []string{curdir}
-
-	nlinks := 0
-
-	for {
-		// Find next part of the url
-		n := strings.IndexRune(path[p+1:], os.PathSeparator) + p + 1
-
-		next := path[:n]
-
-		if n < p+1 {
-			// Arrived at the last part
-			n = len(path)
-			next = path
-		}
-
-		fi, err := os.Lstat(next)
-		if err != nil {
-			return nil, err
-		}
-
-		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
-			nlinks++
-			if nlinks > 16 {
-				return nil, os.ErrInvalid
-			}
-
-			// Follow symlink
-			target, err := os.Readlink(next)
-			if err != nil {
-				return nil, err
-			}
-
-			if !os.IsPathSeparator(target[0]) {
-				target = filepath.Join(curdir, target)
-			}
-
-			// Move to target
-			path = filepath.Clean(target)
-			p = strings.IndexRune(path, os.PathSeparator)
-			curdir = path[:p+1]
-			result = append(result, curdir)
-
-			continue
-		}
-
-		if !fi.IsDir() && n < len(path) {
-			return nil, syscall.ENOTDIR
-		}
-
-		// Resolved last path
-		if n >= len(path) {
-			result = append(result, next)
-
-			return result, nil
-		}
-
-		// nextdir is a directory
-		p = n
-		curdir = next
-		result = append(result, curdir)
-	}
+	return append(res.Dirs, res.Path), nil
 }
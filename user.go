@@ -1,6 +1,7 @@
 package useros
 
 import (
+	"context"
 	"io"
 	"io/fs"
 	"os"
@@ -66,18 +67,46 @@ type File interface {
 	Write(b []byte) (int, error)
 	WriteAt(b []byte, off int64) (int, error)
 	WriteString(s string) (int, error)
+
+	// Lock, RLock, TryLock and Unlock manage an advisory flock on the file.
+	Lock() error
+	RLock() error
+	TryLock() (bool, error)
+	Unlock() error
+
+	// LockRange, TryLockRange and UnlockRange manage advisory byte-range locks of the open file description.
+	LockRange(ctx context.Context, start, length int64, exclusive bool) error
+	TryLockRange(start, length int64, exclusive bool) (bool, error)
+	UnlockRange(start, length int64) error
+
+	// Openat, Mkdirat, Unlinkat, Renameat and Statat operate on an entry of the directory
+	// of the file, so that it can be used as a capability. The name of the entry must be
+	// a single path component, and a symlink is never followed.
+	Openat(name string, flag int, perm os.FileMode) (File, error)
+	Mkdirat(name string, perm os.FileMode) error
+	Unlinkat(name string) error
+	Renameat(oldname string, newdir File, newname string) error
+	Statat(name string) (os.FileInfo, error)
 }
 
 // OS returns a simulated version of os as if the user would run the commands.
+// If Groups is empty, the groups of the current process are used. Use LookupUser,
+// LookupUID, FromPID or FromUnixConn to obtain a user with its supplementary groups.
 func (u User) OS() OS {
 	return u.os()
 }
 
+// OSWithAuthorizer returns the OS of the user, whose permission checks are decided by the authorizer.
+// Unlike OS, permissions are also checked if the user equals the user of the process.
+func (u User) OSWithAuthorizer(a Authorizer) OS {
+	return u.osWithAuthorizer(a)
+}
+
 // CanWriteInode checks whether the user can write to the file inode at the specified path.
 // The inode itself doesn't have to exist, its parent directory should exist.
 // If nil is returned, the inode is writable by the user.
 func (u User) CanWriteInode(path string) error {
-	_, _, err := u.hasInodeAccess(path, Write)
+	_, _, err := (&user{User: u}).hasInodeAccess(path, Write, OpWrite)
 	return logit(err)
 }
 
@@ -86,7 +115,7 @@ func (u User) CanWriteInode(path string) error {
 // The inode itself doesn't have to exist, its parent directory should exist.
 // If nil is returned, the inode is readable by the user.
 func (u User) CanReadInode(path string) error {
-	_, _, err := u.hasInodeAccess(path, Execute)
+	_, _, err := (&user{User: u}).hasInodeAccess(path, Execute, OpStat)
 	return logit(err)
 }
 
@@ -94,14 +123,14 @@ func (u User) CanReadInode(path string) error {
 // The file or directory needs to exist, as its permission bits are checked. Symlinks are followed.
 // If nil is returned, the object is writable by the user.
 func (u User) CanWriteObject(path string) error {
-	return logit(u.hasObjectAccess(path, Write))
+	return logit((&user{User: u}).hasObjectAccess(path, Write, OpWrite))
 }
 
 // CanReadObject checks whether the user can read the file or directory at the specified path.
 // The file or directory needs to exist, as its permission bits are checked. Symlinks are followed.
 // If nil is returned, the object is readable by the user.
 func (u User) CanReadObject(path string) error {
-	return logit(u.hasObjectAccess(path, Read))
+	return logit((&user{User: u}).hasObjectAccess(path, Read, OpRead))
 }
 
 // Owns checks whether the user owns the file or directory at the specified path.
@@ -120,6 +149,24 @@ func (u User) Lowns(path string) error {
 
 type user struct {
 	User
+	auth  Authorizer
+	log   func(error)
+	cache *PermissionCache
+
+	// umask replaces the umask of the process for new files and directories, if set.
+	umask *os.FileMode
+}
+
+// canReadInode checks whether the inode can be statted for the operation, see CanReadInode.
+func (u *user) canReadInode(path string, op Op) error {
+	_, _, err := u.hasInodeAccess(path, Execute, op)
+	return err
+}
+
+// canWriteInode checks whether the inode can be created or removed for the operation, see CanWriteInode.
+func (u *user) canWriteInode(path string, op Op) error {
+	_, _, err := u.hasInodeAccess(path, Write, op)
+	return err
 }
 
 func (u *user) CurrentUser() User {
@@ -127,89 +174,98 @@ func (u *user) CurrentUser() User {
 }
 
 func (u *user) Chmod(name string, mode os.FileMode) error {
-	if err := u.CanReadInode(name); err != nil {
-		return logit(err)
+	if err := u.canReadInode(name, OpChmod); err != nil {
+		return u.logit(err)
 	}
 
 	if err := u.Owns(name); err != nil {
-		return logit(err)
+		return u.logit(err)
+	}
+
+	if err := u.authorizeObject(name, OpChmod, true); err != nil {
+		return u.logit(err)
 	}
 
-	return logit(os.Chmod(name, mode))
+	return u.logit(os.Chmod(name, mode))
 }
 
 func (u *user) Chown(name string, uid, gid int) error {
-	if err := u.CanReadInode(name); err != nil {
-		return logit(err)
+	if err := u.canReadInode(name, OpChown); err != nil {
+		return u.logit(err)
 	}
 
 	if err := u.Owns(name); err != nil {
-		return logit(err)
+		return u.logit(err)
+	}
+
+	if err := u.checkChown(uid, gid); err != nil {
+		return u.logit(err)
 	}
 
+	if err := u.authorizeObject(name, OpChown, true); err != nil {
+		return u.logit(err)
+	}
+
+	return u.logit(os.Chown(name, uid, gid))
+}
+
+// checkChown checks whether the user may give an owned file the given ownership.
+func (u User) checkChown(uid, gid int) error {
 	if u.UID == 0 {
-		return logit(os.Chown(name, uid, gid))
+		return nil
 	}
 
 	if uid != u.UID {
-		return logit(os.ErrPermission)
+		return os.ErrPermission
 	}
 
 	if gid != u.GID && !contains(u.Groups, gid) {
-		return logit(os.ErrPermission)
+		return os.ErrPermission
 	}
 
-	return logit(os.Chown(name, uid, gid))
+	return nil
 }
 
 // TODO: check permission checks
 func (u *user) Chtimes(name string, atime, mtime time.Time) error {
-	if err := u.CanReadInode(name); err != nil {
-		return logit(err)
+	if err := u.canReadInode(name, OpChtimes); err != nil {
+		return u.logit(err)
 	}
 
-	if err := u.CanWriteObject(name); err != nil {
-		return logit(err)
+	if err := u.hasObjectAccess(name, Write, OpChtimes); err != nil {
+		return u.logit(err)
 	}
 
-	return logit(os.Chtimes(name, atime, mtime))
+	return u.logit(os.Chtimes(name, atime, mtime))
 }
 
 func (u *user) Lchown(name string, uid, gid int) error {
-	if err := u.CanReadInode(name); err != nil {
-		return logit(err)
+	if err := u.canReadInode(name, OpChown); err != nil {
+		return u.logit(err)
 	}
 
 	if err := u.Lowns(name); err != nil {
-		return logit(err)
+		return u.logit(err)
 	}
 
-	if u.UID == 0 {
-		return logit(os.Lchown(name, uid, gid))
-	}
-
-	if uid != u.UID {
-		return logit(os.ErrPermission)
+	if err := u.checkChown(uid, gid); err != nil {
+		return u.logit(err)
 	}
 
-	if gid != u.GID && !contains(u.Groups, gid) {
-		return logit(os.ErrPermission)
+	if err := u.authorizeObject(name, OpChown, false); err != nil {
+		return u.logit(err)
 	}
 
-	return logit(os.Lchown(name, uid, gid))
+	return u.logit(os.Lchown(name, uid, gid))
 }
 
 func (u *user) Mkdir(name string, perm os.FileMode) error {
-	stat, _, err := u.hasInodeAccess(name, Write)
+	stat, _, err := u.hasInodeAccess(name, Write, OpCreate)
 	if err != nil {
-		return logit(err)
-	}
-
-	if err = os.Mkdir(name, perm); err != nil {
-		return logit(err)
+		return u.logit(err)
 	}
 
-	return logit(u.chownNewFile(name, u.gidForNewFiles(stat)))
+	return u.logit(u.mkdirNew(name, perm, stat))
 }
 
 func (u *user) MkdirAll(path string, perm os.FileMode) error {
@@ -217,10 +273,10 @@ func (u *user) MkdirAll(path string, perm os.FileMode) error {
 	dir, err := u.Stat(path)
 	if err == nil {
 		if dir.IsDir() {
-			return logit(nil)
+			return u.logit(nil)
 		}
 
-		return logit(&os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR})
+		return u.logit(&os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR})
 	}
 
 	// Slow path: make sure parent exists and then call Mkdir for path.
@@ -240,7 +296,7 @@ func (u *user) MkdirAll(path string, perm os.FileMode) error {
 		// Create parent.
 		err = u.MkdirAll(path[:j-1], perm)
 		if err != nil {
-			return logit(err)
+			return u.logit(err)
 		}
 	}
 
@@ -251,19 +307,19 @@ func (u *user) MkdirAll(path string, perm os.FileMode) error {
 		// double-checking that directory doesn't exist.
 		dir, err1 := u.Lstat(path)
 		if err1 == nil && dir.IsDir() {
-			return logit(nil)
+			return u.logit(nil)
 		}
 
-		return logit(err)
+		return u.logit(err)
 	}
 
-	return logit(nil)
+	return u.logit(nil)
 }
 
 func (u *user) ReadFile(name string) ([]byte, error) {
 	f, err := u.Open(name)
 	if err != nil {
-		return nil, logit(err)
+		return nil, u.logit(err)
 	}
 
 	defer f.Close()
@@ -303,164 +359,60 @@ func (u *user) ReadFile(name string) ([]byte, error) {
 				err = nil
 			}
 
-			return data, logit(err)
+			return data, u.logit(err)
 		}
 	}
 }
 
 func (u *user) Readlink(name string) (string, error) {
-	if err := u.CanReadInode(name); err != nil {
-		return "", logit(err)
+	if err := u.canReadInode(name, OpRead); err != nil {
+		return "", u.logit(err)
 	}
 
 	r, err := os.Readlink(name)
 
-	return r, logit(err)
+	return r, u.logit(err)
 }
 
 func (u *user) Remove(name string) error {
-	stat, _, err := u.hasInodeAccess(name, Write)
+	stat, _, err := u.hasInodeAccess(name, Write, OpDelete)
 	if err != nil {
-		return logit(err)
+		return u.logit(err)
 	}
 
 	if stat.Mode()&os.ModeSticky > 0 {
 		err = u.Lowns(name)
 		if err != nil {
-			return logit(err)
+			return u.logit(err)
 		}
 	}
 
-	return logit(os.Remove(name))
+	if err = u.authorizeObject(name, OpDelete, false); err != nil {
+		return u.logit(err)
+	}
+
+	return u.logit(os.Remove(name))
 }
 
 func (u *user) RemoveAll(path string) error {
+	return u.removeAllContext(context.Background(), path)
+}
+
+// removeAllContext is RemoveAll, which checks ctx before each entry.
+func (u *user) removeAllContext(ctx context.Context, path string) error {
 	if path == "" {
 		// fail silently to retain compatibility with previous behavior
 		// of RemoveAll. See issue 28830.
-		return logit(nil)
+		return u.logit(nil)
 	}
 
 	// The rmdir system call does not permit removing ".",
 	// so we don't permit it either.
 	if endsWithDot(path) {
-		return logit(&os.PathError{Op: "RemoveAll", Path: path, Err: syscall.EINVAL})
-	}
-
-	// Simple case: if Remove works, we're done.
-	err := u.Remove(path)
-	if err == nil || os.IsNotExist(err) {
-		return logit(nil)
-	}
-
-	// Otherwise, is this a directory we need to recurse into?
-	dir, serr := u.Lstat(path)
-	if serr != nil {
-		if serr, ok := serr.(*os.PathError); ok && (os.IsNotExist(serr.Err) || serr.Err == syscall.ENOTDIR) {
-			return logit(nil)
-		}
-
-		return logit(serr)
-	}
-
-	if !dir.IsDir() {
-		// Not a directory; return the error from Remove.
-		return logit(err)
-	}
-
-	// Remove contents & return first error.
-	err = nil
-	for {
-		fd, err := u.Open(path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				// Already deleted by someone else.
-				return logit(nil)
-			}
-
-			return logit(err)
-		}
-
-		const reqSize = 1024
-		var names []string
-		var readErr error
-
-		for {
-			numErr := 0
-			names, readErr = fd.Readdirnames(reqSize)
-
-			for _, name := range names {
-				err1 := u.RemoveAll(path + string(os.PathSeparator) + name)
-				if err == nil {
-					err = err1
-				}
-
-				if err1 != nil {
-					numErr++
-				}
-			}
-
-			// If we can delete any entry, break to start new iteration.
-			// Otherwise, we discard current names, get next entries and try deleting them.
-			if numErr != reqSize {
-				break
-			}
-		}
-
-		// Removing files from the directory may have caused
-		// the OS to reshuffle it. Simply calling Readdirnames
-		// again may skip some entries. The only reliable way
-		// to avoid this is to close and re-open the
-		// directory. See issue 20841.
-		fd.Close()
-
-		if readErr == io.EOF {
-			break
-		}
-
-		// If Readdirnames returned an error, use it.
-		if err == nil {
-			err = readErr
-		}
-
-		if len(names) == 0 {
-			break
-		}
-
-		// We don't want to re-open unnecessarily, so if we
-		// got fewer than request names from Readdirnames, try
-		// simply removing the directory now. If that
-		// succeeds, we are done.
-		if len(names) < reqSize {
-			err1 := u.Remove(path)
-			if err1 == nil || os.IsNotExist(err1) {
-				return logit(nil)
-			}
-
-			if err != nil {
-				// We got some error removing the
-				// directory contents, and since we
-				// read fewer names than we requested
-				// there probably aren't more files to
-				// remove. Don't loop around to read
-				// the directory again. We'll probably
-				// just get the same error.
-				return logit(err)
-			}
-		}
-	}
-
-	// Remove directory.
-	err1 := u.Remove(path)
-	if err1 == nil || os.IsNotExist(err1) {
-		return logit(nil)
+		return u.logit(&os.PathError{Op: "RemoveAll", Path: path, Err: syscall.EINVAL})
 	}
 
-	if err == nil {
-		err = err1
-	}
-
-	return logit(err)
+	return u.logit(u.removeAll(ctx, path))
 }
 
 func endsWithDot(path string) bool {
@@ -474,33 +426,38 @@ func endsWithDot(path string) bool {
 }
 
 func (u *user) Rename(oldpath, newpath string) error {
-	if err := u.CanWriteInode(oldpath); err != nil {
-		return logit(err)
+	if err := u.canWriteInode(oldpath, OpDelete); err != nil {
+		return u.logit(err)
+	}
+
+	if err := u.canWriteInode(newpath, OpCreate); err != nil {
+		return u.logit(err)
 	}
 
-	if err := u.CanWriteInode(newpath); err != nil {
-		return logit(err)
+	if err := u.authorizeObject(oldpath, OpDelete, false); err != nil {
+		return u.logit(err)
+	}
+
+	// An existing entry at newpath is replaced
+	if err := u.authorizeObject(newpath, OpDelete, false); err != nil && !os.IsNotExist(err) {
+		return u.logit(err)
 	}
 
 	return os.Rename(oldpath, newpath)
 }
 
 func (u *user) Symlink(oldname, newname string) error {
-	stat, _, err := u.hasInodeAccess(newname, Write)
+	stat, _, err := u.hasInodeAccess(newname, Write, OpCreate)
 	if err != nil {
-		return logit(err)
-	}
-
-	if err = os.Symlink(oldname, newname); err != nil {
-		return logit(err)
+		return u.logit(err)
 	}
 
-	return u.chownNewFile(newname, u.gidForNewFiles(stat))
+	return u.logit(u.symlinkNew(oldname, newname, stat))
 }
 
 func (u *user) Truncate(name string, size int64) error {
-	if err := u.CanWriteObject(name); err != nil {
-		return logit(err)
+	if err := u.hasObjectAccess(name, Write, OpWrite); err != nil {
+		return u.logit(err)
 	}
 
 	return os.Truncate(name, size)
@@ -509,7 +466,7 @@ func (u *user) Truncate(name string, size int64) error {
 func (u *user) WriteFile(name string, data []byte, perm os.FileMode) error {
 	f, err := u.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
-		return logit(err)
+		return u.logit(err)
 	}
 
 	_, err = f.Write(data)
@@ -517,162 +474,335 @@ func (u *user) WriteFile(name string, data []byte, perm os.FileMode) error {
 		err = err1
 	}
 
-	return logit(err)
+	return u.logit(err)
 }
 
 func (u *user) Stat(name string) (os.FileInfo, error) {
-	if err := u.CanReadInode(name); err != nil {
-		return nil, logit(err)
+	if err := u.canReadInode(name, OpStat); err != nil {
+		return nil, u.logit(err)
+	}
+
+	if err := u.authorizeObject(name, OpStat, true); err != nil {
+		return nil, u.logit(err)
 	}
 
 	s, err := os.Stat(name)
 
-	return s, logit(err)
+	return s, u.logit(err)
 }
 
 func (u *user) Lstat(name string) (os.FileInfo, error) {
-	if err := u.CanReadInode(name); err != nil {
-		return nil, logit(err)
+	if err := u.canReadInode(name, OpStat); err != nil {
+		return nil, u.logit(err)
+	}
+
+	if err := u.authorizeObject(name, OpStat, false); err != nil {
+		return nil, u.logit(err)
 	}
 
 	s, err := os.Lstat(name)
 
-	return s, logit(err)
+	return s, u.logit(err)
 }
 
 type file struct {
-	*os.File
+	osFile
 	u *user
 }
 
+// The methods of file check the permissions on the inode of the descriptor, so that
+// they apply to the opened file even if its path has been renamed or replaced.
+
 func (f *file) Chdir() error {
-	if err := f.u.checkDirExecuteOnly(f.Name()); err != nil {
-		return logit(err)
+	if _, err := f.u.checkFile(f, Execute, OpList, true); err != nil {
+		return f.u.logit(err)
 	}
 
-	return logit(f.File.Chdir())
+	return f.u.logit(f.File.Chdir())
 }
 
 func (f *file) Chmod(mode os.FileMode) error {
-	return logit(f.u.Chmod(f.Name(), mode))
+	if _, err := f.u.ownsFile(f); err != nil {
+		return f.u.logit(err)
+	}
+
+	if err := f.u.authorizeFile(f, OpChmod); err != nil {
+		return f.u.logit(err)
+	}
+
+	return f.u.logit(f.File.Chmod(mode))
 }
 
 func (f *file) Chown(uid, gid int) error {
-	return logit(f.u.Chown(f.Name(), uid, gid))
+	if _, err := f.u.ownsFile(f); err != nil {
+		return f.u.logit(err)
+	}
+
+	if err := f.u.authorizeFile(f, OpChown); err != nil {
+		return f.u.logit(err)
+	}
+
+	if err := f.u.checkChown(uid, gid); err != nil {
+		return f.u.logit(err)
+	}
+
+	return f.u.logit(f.File.Chown(uid, gid))
 }
 
 func (f *file) Readdir(n int) ([]os.FileInfo, error) {
-	if err := f.u.checkDirExecuteOnly(f.Name()); err != nil {
-		return nil, logit(err)
+	if _, err := f.u.checkFile(f, Execute, OpList, true); err != nil {
+		return nil, f.u.logit(err)
 	}
 
 	l, err := f.File.Readdir(n)
 
-	return l, logit(err)
+	return l, f.u.logit(err)
 }
 
-// Create checks for permissions and calls os.Create.
-func (u *user) Create(name string) (File, error) {
-	stat, _, err := u.hasInodeAccess(name, Write)
-	if err != nil {
-		return nil, logit(err)
+func (f *file) ReadDir(n int) ([]os.DirEntry, error) {
+	if _, err := f.u.checkFile(f, Execute, OpList, true); err != nil {
+		return nil, f.u.logit(err)
 	}
 
-	f, err := os.Create(name)
-	if err != nil {
-		return nil, logit(err)
-	}
+	l, err := f.File.ReadDir(n)
 
-	err = u.chownNewFile(name, u.gidForNewFiles(stat))
-	if err != nil {
-		f.Close()
-		os.Remove(name) //nolint:errcheck
+	return l, f.u.logit(err)
+}
 
-		return nil, logit(err)
+func (f *file) Readdirnames(n int) ([]string, error) {
+	if _, err := f.u.checkFile(f, Execute, OpList, true); err != nil {
+		return nil, f.u.logit(err)
 	}
 
-	return &file{f, u}, logit(nil)
+	l, err := f.File.Readdirnames(n)
+
+	return l, f.u.logit(err)
+}
+
+// Create checks for permissions and creates or truncates the named file, see os.Create.
+func (u *user) Create(name string) (File, error) {
+	return u.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
 }
 
 func (u *user) Open(name string) (File, error) {
-	if err := u.CanReadObject(name); err != nil {
-		return nil, logit(err)
+	if err := u.hasObjectAccess(name, Read, OpRead); err != nil {
+		return nil, u.logit(err)
 	}
 
 	f, err := os.Open(name)
 	if err != nil {
-		return nil, logit(err)
+		return nil, u.logit(err)
 	}
 
-	return &file{f, u}, logit(nil)
+	return &file{osFile{f}, u}, u.logit(nil)
 }
 
 func (u *user) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
-	stat, a, err := u.hasInodeAccess(name, Execute)
+	f, err := u.openFile(name, flag, perm, 0)
 	if err != nil {
-		return nil, logit(err)
+		return nil, u.logit(err)
 	}
 
-	var f *os.File
+	return f, u.logit(nil)
+}
 
-	for {
-		// Try to open file exclusively first
-		f, err = os.OpenFile(name, flag, perm|fs.FileMode(os.O_EXCL))
+// openFile opens a file like open(2). links is the number of dangling symlinks followed so far.
+func (u *user) openFile(name string, flag int, perm os.FileMode, links int) (File, error) {
+	if flag&oPath != 0 {
+		return u.openPath(name, flag)
+	}
 
-		// If the file exists, proceed to open an existing file, but only if O_EXCL wasn't passed as option
-		if os.IsExist(err) && perm&fs.FileMode(os.O_EXCL) == 0 {
-			p := Write
+	if flag&oDirectory != 0 && flag&os.O_CREATE != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+
+	stat, a, err := u.hasInodeAccess(name, Execute, openOp(flag))
+	if err != nil {
+		return nil, err
+	}
+
+	// Without O_CREATE the file must exist, never fall through to the creation path below
+	if flag&os.O_CREATE == 0 {
+		if err = u.checkOpenExisting(name, flag); err != nil {
+			return nil, err
+		}
+
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+
+		return &file{osFile{f}, u}, nil
+	}
 
-			if perm&fs.FileMode(os.O_RDONLY) > 0 {
-				p = Read
+	// Check permission for creating a new file before anything is created
+	denied := u.authorize(filepath.Dir(name), stat, a, Write, OpCreate, false)
+	if u.UID == 0 {
+		denied = nil
+	}
+
+	for {
+		// Proceed to open an existing file, but only if O_EXCL wasn't passed as option
+		if _, err = os.Lstat(name); err == nil {
+			if flag&os.O_EXCL != 0 {
+				return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
 			}
 
 			// Check permission for accessing the existing file
-			err := u.hasObjectAccess(name, p)
+			err := u.checkOpenExisting(name, flag)
 			if os.IsNotExist(err) {
-				// The file disappeared in between OpenFile and Stat
-				// Retry exclusive OpenFile, it makes no sense to return
-				// file not found since O_EXCL was not passed as option.
+				// A dangling symlink is followed to create its target
+				if target, ok := danglingTarget(name); ok {
+					if links++; links > MaxSymlinks {
+						return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
+					}
+
+					return u.openFile(target, flag, perm, links)
+				}
+
+				// The file disappeared in between Lstat and Stat, retry
 				continue
 			} else if err != nil {
-				return nil, logit(err)
+				return nil, err
 			}
 
-			f, err := os.OpenFile(name, flag, perm)
+			f, err := os.OpenFile(name, flag&^os.O_CREATE, perm)
 			if err != nil {
-				return nil, logit(err)
+				return nil, err
 			}
 
-			return &file{f, u}, nil
+			return &file{osFile{f}, u}, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if denied != nil {
+			return nil, denied
+		}
+
+		f, err := u.createFile(name, flag, perm, stat)
+		if os.IsExist(err) {
+			// The file was created in the meantime
+			continue
 		} else if err != nil {
-			return nil, logit(err)
+			return nil, err
 		}
 
-		break
+		return &file{osFile{f}, u}, nil
+	}
+}
+
+// openPath opens a file with O_PATH, which only needs search permission on its directories.
+func (u *user) openPath(name string, flag int) (File, error) {
+	if _, _, err := u.hasInodeAccess(name, Execute, OpStat); err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Lstat(name)
+	if err == nil && flag&oNoFollow == 0 && stat.Mode()&os.ModeSymlink != 0 {
+		stat, err = os.Stat(name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&oDirectory != 0 && !stat.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	f, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file{osFile{f}, u}, nil
+}
+
+// danglingTarget returns the target of name if it is a symlink to a file that does not exist.
+func danglingTarget(name string) (string, bool) {
+	target, err := os.Readlink(name)
+	if err != nil {
+		return "", false
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(name), target)
+	}
+
+	if _, err = os.Lstat(target); !os.IsNotExist(err) {
+		return "", false
 	}
 
-	// Check permission for creating a new file
-	if err = u.checkPermission(stat, a, Write); err != nil && u.UID > 0 {
-		os.Remove(name) //nolint:errcheck
-		f.Close()
+	return target, true
+}
+
+// openOp returns the operation performed by opening a file with the given flags.
+func openOp(flag int) Op {
+	switch {
+	case flag&os.O_CREATE != 0:
+		return OpCreate
+	case flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0:
+		return OpWrite
+	default:
+		return OpRead
+	}
+}
+
+// checkOpenExisting checks the permissions to open an existing file with the given flags,
+// in the order of the kernel: the type of the file, the access mode, and O_NOATIME.
+func (u *user) checkOpenExisting(name string, flag int) error {
+	stat, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+
+	if stat.Mode()&os.ModeSymlink != 0 {
+		if flag&oNoFollow != 0 {
+			return &os.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
+		}
+
+		if stat, err = os.Stat(name); err != nil {
+			return err
+		}
+	}
+
+	mode := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
 
-		return nil, logit(err)
+	switch {
+	case flag&oDirectory != 0 && !stat.IsDir():
+		return &os.PathError{Op: "open", Path: name, Err: syscall.ENOTDIR}
+	case stat.IsDir() && (mode != os.O_RDONLY || flag&os.O_TRUNC != 0):
+		return &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
 	}
 
-	if err = u.chownNewFile(name, u.gidForNewFiles(stat)); err != nil {
-		os.Remove(name) //nolint:errcheck
-		f.Close()
+	if mode != os.O_WRONLY {
+		if err := u.hasObjectAccess(name, Read, OpRead); err != nil {
+			return err
+		}
+	}
 
-		return nil, logit(err)
+	// O_TRUNC needs write permission, also for a file opened read-only
+	if mode != os.O_RDONLY || flag&os.O_TRUNC != 0 {
+		if err := u.hasObjectAccess(name, Write, OpWrite); err != nil {
+			return err
+		}
 	}
 
-	return &file{f, u}, logit(nil)
+	// Only the owner may suppress the update of the access time
+	if flag&oNoAtime != 0 && u.UID != 0 {
+		if err := u.owns(name); err != nil {
+			return &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+		}
+	}
+
+	return nil
 }
 
 func (u *user) ReadDir(name string) ([]os.DirEntry, error) {
 	f, err := u.Open(name)
 	if err != nil {
-		return nil, logit(err)
+		return nil, u.logit(err)
 	}
 
 	defer f.Close()
@@ -680,30 +810,26 @@ func (u *user) ReadDir(name string) ([]os.DirEntry, error) {
 	dirs, err := f.ReadDir(-1)
 	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
 
-	return dirs, logit(err)
+	return dirs, u.logit(err)
 }
 
 func (u *user) EvalSymlinks(name string) (string, error) {
 	name = filepath.Clean(name)
 
 	// Resolve symlinks
-	intermediate, err := ResolveSymlinks(name)
+	res, err := Resolver{}.Resolve(name)
 	if err != nil {
-		return "", logit(err)
-	}
-
-	if len(intermediate) == 0 {
-		return "", logit(os.ErrInvalid)
+		return "", u.logit(err)
 	}
 
 	// Check whether directories are traversable
-	for _, dir := range intermediate[:len(intermediate)-1] {
-		if err := u.checkDirExecuteOnly(dir); err != nil {
-			return "", logit(err)
+	for _, dir := range res.Dirs {
+		if err := u.checkDirExecuteOnly(dir, OpStat); err != nil {
+			return "", u.logit(err)
 		}
 	}
 
-	return intermediate[len(intermediate)-1], logit(nil)
+	return res.Path, u.logit(nil)
 }
 
 func (u *user) Walk(root string, fn filepath.WalkFunc) error {
@@ -715,16 +841,16 @@ func (u *user) Walk(root string, fn filepath.WalkFunc) error {
 	}
 
 	if err == filepath.SkipDir || err == filepath.SkipAll {
-		return logit(nil)
+		return u.logit(nil)
 	}
 
-	return logit(err)
+	return u.logit(err)
 }
 
 // walk recursively descends path, calling walkFn.
 func (u *user) walk(path string, info fs.FileInfo, walkFn filepath.WalkFunc) error {
 	if !info.IsDir() {
-		return logit(walkFn(path, info, nil))
+		return u.logit(walkFn(path, info, nil))
 	}
 
 	names, err := u.readDirNames(path)
@@ -737,7 +863,7 @@ func (u *user) walk(path string, info fs.FileInfo, walkFn filepath.WalkFunc) err
 		// by walkFn. walkFn may ignore err and return nil.
 		// If walkFn returns SkipDir or SkipAll, it will be handled by the caller.
 		// So walk should return whatever walkFn returns.
-		return logit(err)
+		return u.logit(err)
 	}
 
 	for _, name := range names {
@@ -746,19 +872,19 @@ func (u *user) walk(path string, info fs.FileInfo, walkFn filepath.WalkFunc) err
 		fileInfo, err := u.Lstat(filename)
 		if err != nil {
 			if err := walkFn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
-				return logit(err)
+				return u.logit(err)
 			}
 		} else {
 			err = u.walk(filename, fileInfo, walkFn)
 			if err != nil {
 				if !fileInfo.IsDir() || err != filepath.SkipDir {
-					return logit(err)
+					return u.logit(err)
 				}
 			}
 		}
 	}
 
-	return logit(nil)
+	return u.logit(nil)
 }
 
 // readDirNames reads the directory named by dirname and returns
@@ -766,7 +892,7 @@ func (u *user) walk(path string, info fs.FileInfo, walkFn filepath.WalkFunc) err
 func (u *user) readDirNames(dirname string) ([]string, error) {
 	f, err := u.Open(dirname)
 	if err != nil {
-		return nil, logit(err)
+		return nil, u.logit(err)
 	}
 
 	names, err := f.Readdirnames(-1)
@@ -774,10 +900,10 @@ func (u *user) readDirNames(dirname string) ([]string, error) {
 	f.Close()
 
 	if err != nil {
-		return nil, logit(err)
+		return nil, u.logit(err)
 	}
 
 	sort.Strings(names)
 
-	return names, logit(nil)
+	return names, u.logit(nil)
 }
@@ -8,7 +8,41 @@ import (
 )
 
 func (u User) os() OS {
-	// Assign default values if necessary
+	// Check whether we are impersonating a user
+	if u.isProcess() {
+		return &def{}
+	}
+
+	u, _ = u.withDefaults()
+
+	return &user{User: u}
+}
+
+// isProcess reports whether the user equals the user of the process.
+func (u User) isProcess() bool {
+	u, groups := u.withDefaults()
+
+	return u.UID == syscall.Geteuid() && u.GID == syscall.Getegid() && equal(u.Groups, groups)
+}
+
+func (u User) osWithAuthorizer(a Authorizer) OS {
+	u, _ = u.withDefaults()
+
+	return &user{User: u, auth: a}
+}
+
+func (u User) newOS(c *config) (OS, error) {
+	if !c.needsChecks() && u.isProcess() {
+		return &def{log: c.log}, nil
+	}
+
+	u, _ = u.withDefaults()
+
+	return &user{User: u, auth: c.auth, log: c.log, umask: c.umask, cache: c.cache}, nil
+}
+
+// withDefaults assigns the ids of the process to unset fields, and returns the process groups.
+func (u User) withDefaults() (User, []int) {
 	if u.UID < 0 {
 		u.UID = syscall.Geteuid()
 	}
@@ -23,10 +57,5 @@ func (u User) os() OS {
 		u.Groups = groups
 	}
 
-	// Check whether we are impersonating a user
-	if u.UID == syscall.Geteuid() && u.GID == syscall.Getegid() && equal(u.Groups, groups) {
-		return &def{}
-	}
-
-	return &user{u}
+	return u, groups
 }
@@ -3,6 +3,34 @@
 
 package useros
 
+import (
+	"fmt"
+	"syscall"
+)
+
 func (u User) os() OS {
 	return &def{}
 }
+
+func (u User) osWithAuthorizer(a Authorizer) OS {
+	return &def{}
+}
+
+// newOS returns the default OS, as permissions are not checked on this platform.
+// It fails if the configuration can only be honoured by checking them.
+func (u User) newOS(c *config) (OS, error) {
+	if !u.isProcess() {
+		return nil, fmt.Errorf("uid %d: %w", u.UID, ErrCannotImpersonate)
+	}
+
+	if c.needsChecks() {
+		return nil, fmt.Errorf("permission checks: %w", syscall.ENOTSUP)
+	}
+
+	return &def{log: c.log}, nil
+}
+
+// isProcess reports whether the user equals the user of the process. Groups are not compared.
+func (u User) isProcess() bool {
+	return (u.UID < 0 || u.UID == syscall.Geteuid()) && (u.GID < 0 || u.GID == syscall.Getegid())
+}
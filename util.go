@@ -2,7 +2,10 @@ package useros
 
 import "errors"
 
-var ErrTypeAssertion = errors.New("type assertion")
+var (
+	ErrTypeAssertion = errors.New("type assertion")
+	ErrNotSupported  = errors.New("not supported on this platform")
+)
 
 func equal(a, b []int) bool {
 	for _, k := range a {
@@ -0,0 +1,241 @@
+package useros
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// maxPrefetch is the number of directory listings that WalkDirParallel reads ahead per worker.
+const maxPrefetch = 16
+
+// WalkDir walks the file tree rooted at root as the user of o, like filepath.WalkDir:
+// fn is called for each file and directory in lexical order, with the fs.DirEntry
+// of its directory listing, and symlinks are not followed. For the OS of a user,
+// permissions are checked incrementally: the ancestors of root are checked once,
+// and every directory below it is only checked itself.
+func WalkDir(o OS, root string, fn fs.WalkDirFunc) error {
+	return WalkDirParallel(o, root, 1, fn)
+}
+
+// WalkDirParallel walks the file tree like WalkDir, but reads up to workers directories
+// concurrently, ahead of the walk. The walk itself is not affected: fn is called in the
+// same order as by WalkDir, and always from the goroutine of the caller.
+func WalkDirParallel(o OS, root string, workers int, fn fs.WalkDirFunc) error {
+	return walkDir(o, root, workers, func(path string, d fs.DirEntry, search error, err error) error {
+		if search != nil && d != nil {
+			d = deniedEntry{DirEntry: d, path: path}
+		}
+
+		return fn(path, d, err)
+	})
+}
+
+// deniedEntry is an entry listed in a directory that the user cannot search,
+// so that it cannot be statted either.
+type deniedEntry struct {
+	fs.DirEntry
+	path string
+}
+
+func (d deniedEntry) Info() (fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "lstat", Path: d.path, Err: syscall.EACCES}
+}
+
+// walkDirFunc is called by walkDir with the search error of the directory of the entry.
+// If it is set, the entry is listed, but its directory cannot be searched for it.
+type walkDirFunc func(path string, d fs.DirEntry, search error, err error) error
+
+func walkDir(o OS, root string, workers int, fn walkDirFunc) error {
+	info, err := o.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, nil, err)
+	} else {
+		w := &dirWalker{
+			o:       o,
+			fn:      fn,
+			pending: map[string]chan dirListing{},
+		}
+
+		w.u, _ = o.(*user)
+
+		if workers > 1 {
+			w.sem = make(chan struct{}, workers)
+			w.max = workers * maxPrefetch
+		}
+
+		err = w.walk(root, fs.FileInfoToDirEntry(info), nil, nil)
+	}
+
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+
+	return err
+}
+
+// dirListing is the result of reading a directory.
+type dirListing struct {
+	entries []fs.DirEntry
+	err     error
+
+	// search is the error for searching the directory, i.e. for reading its subdirectories.
+	search error
+
+	// dir is the opened directory, relative to which the subdirectories are opened.
+	// It is nil if the directory cannot be searched, or for an OS other than that of a user.
+	dir *os.File
+}
+
+// close closes the opened directory of the listing.
+func (l dirListing) close() {
+	if l.dir != nil {
+		l.dir.Close()
+	}
+}
+
+type dirWalker struct {
+	o  OS
+	u  *user
+	fn walkDirFunc
+
+	// sem limits the concurrent reads, it is nil if the walk is sequential.
+	sem chan struct{}
+
+	// pending are the listings read ahead, at most max. They are only accessed by the walk.
+	pending map[string]chan dirListing
+	max     int
+}
+
+// walk walks the entry path, whose directory is opened as parent for the OS of a user.
+func (w *dirWalker) walk(path string, d fs.DirEntry, search error, parent *os.File) error {
+	if err := w.fn(path, d, search, nil); err != nil || !d.IsDir() {
+		w.discard(path)
+
+		if err == filepath.SkipDir && d.IsDir() {
+			err = nil
+		}
+
+		return err
+	}
+
+	l := w.listing(path, search, parent)
+	defer l.close()
+
+	if l.err != nil {
+		if err := w.fn(path, d, search, l.err); err != nil {
+			if err == filepath.SkipDir {
+				err = nil
+			}
+
+			return err
+		}
+	}
+
+	w.prefetch(path, l)
+
+	for i, d1 := range l.entries {
+		if err := w.walk(filepath.Join(path, d1.Name()), d1, l.search, l.dir); err != nil {
+			// Drop the listings of the skipped entries
+			for _, d2 := range l.entries[i+1:] {
+				w.discard(filepath.Join(path, d2.Name()))
+			}
+
+			if err == filepath.SkipDir {
+				break
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listing returns the listing of a directory, read ahead or now.
+func (w *dirWalker) listing(path string, search error, parent *os.File) dirListing {
+	if ch, ok := w.pending[path]; ok {
+		delete(w.pending, path)
+		return <-ch
+	}
+
+	return w.read(path, search, parent)
+}
+
+// prefetch starts reading the subdirectories of a listing in the background.
+func (w *dirWalker) prefetch(path string, l dirListing) {
+	if w.sem == nil || l.search != nil {
+		return
+	}
+
+	for _, d := range l.entries {
+		if len(w.pending) >= w.max {
+			return
+		}
+
+		if !d.IsDir() {
+			continue
+		}
+
+		name := filepath.Join(path, d.Name())
+		ch := make(chan dirListing, 1)
+		w.pending[name] = ch
+
+		go func() {
+			w.sem <- struct{}{}
+			defer func() { <-w.sem }()
+
+			ch <- w.read(name, nil, l.dir)
+		}()
+	}
+}
+
+// discard forgets a listing that was read ahead. It waits for the read,
+// which may still use the opened parent directory.
+func (w *dirWalker) discard(path string) {
+	if ch, ok := w.pending[path]; ok {
+		delete(w.pending, path)
+		(<-ch).close()
+	}
+}
+
+// read reads a directory whose parent has search error search. For the OS of a user,
+// the directory is opened relative to its opened parent without following symlinks,
+// and the permissions are checked on the opened descriptor, so that a directory that
+// is replaced during the walk cannot redirect it.
+func (w *dirWalker) read(path string, search error, parent *os.File) dirListing {
+	if search != nil {
+		return dirListing{err: search, search: search}
+	}
+
+	if w.u == nil {
+		entries, err := w.o.ReadDir(path)
+		return dirListing{entries: entries, err: err}
+	}
+
+	dir, err := openDir(parent, path)
+	if err != nil {
+		return dirListing{err: err, search: err}
+	}
+
+	_, list := w.u.checkFile(osFile{dir}, Read, OpList, false)
+	_, search = w.u.checkFile(osFile{dir}, Execute, OpList, true)
+
+	if list != nil {
+		dir.Close()
+		return dirListing{err: list, search: search}
+	}
+
+	entries, err := dir.ReadDir(-1)
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	if search != nil {
+		dir.Close()
+		dir = nil
+	}
+
+	return dirListing{entries: entries, err: err, search: search, dir: dir}
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDir opens the directory path for reading without following a symlink,
+// relative to the opened directory parent if it is set.
+func openDir(parent *os.File, path string) (*os.File, error) {
+	var (
+		fd  int
+		err error
+	)
+
+	const flags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+
+	if parent == nil {
+		fd, err = unix.Open(path, flags, 0)
+	} else {
+		fd, err = unix.Openat(int(parent.Fd()), filepath.Base(path), flags, 0)
+	}
+
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package useros
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkDirPermissions(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		for _, dir := range []struct {
+			name string
+			perm os.FileMode
+		}{{"f", 0o755}, {"f/g", 0o700}, {"h", 0o744}, {"h/i", 0o755}} {
+			if err := os.Mkdir(filepath.Join(tree.Root, dir.name), dir.perm); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chmod(filepath.Join(tree.Root, dir.name), dir.perm); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected := []string{".", "a", "a!", "b", "b!", "c", "c!", "d", "e", "f", "f/g", "f/g!", "h", "h/i", "h/i!"}
+
+		for _, workers := range []int{1, 4} {
+			var paths []string
+
+			err := WalkDirParallel(User{UID: 1000, GID: 1000}.OS(), tree.Root, workers, func(path string, d fs.DirEntry, err error) error {
+				rel, _ := filepath.Rel(tree.Root, path) //nolint:errcheck
+
+				if err != nil {
+					tree.AssertDenied(err)
+					rel += "!"
+				}
+
+				// Entries of a directory that cannot be searched cannot be statted
+				if _, ierr := d.Info(); rel == "h/i" {
+					tree.AssertDenied(ierr)
+				} else if rel == "f/g" {
+					tree.AssertSuccess(ierr)
+				}
+
+				paths = append(paths, rel)
+
+				return nil
+			})
+			tree.AssertSuccess(err)
+
+			if !reflect.DeepEqual(paths, expected) {
+				t.Errorf("%d workers: expected %v, got %v", workers, expected, paths)
+			}
+		}
+	})
+}
+
+func TestWalkDirReplaced(t *testing.T) {
+	New(t).Test(func(tree Tree) {
+		root := filepath.Join(tree.Root, "w")
+		outside := filepath.Join(tree.Root, "outside")
+
+		for _, dir := range []string{filepath.Join(root, "x"), outside} {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := os.WriteFile(filepath.Join(outside, "secret"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+
+		// Replace x by a symlink after it is visited, but before it is read
+		err := WalkDir(User{UID: 1000, GID: 1000}.OS(), root, func(path string, d fs.DirEntry, err error) error {
+			rel, _ := filepath.Rel(root, path) //nolint:errcheck
+
+			if err != nil {
+				rel += "!"
+			} else if rel == "x" {
+				if err = os.Rename(path, filepath.Join(root, "old")); err == nil {
+					err = os.Symlink(outside, path)
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			paths = append(paths, rel)
+
+			return nil
+		})
+		tree.AssertSuccess(err)
+
+		if expected := []string{".", "x", "x!"}; !reflect.DeepEqual(paths, expected) {
+			t.Errorf("expected %v, got %v", expected, paths)
+		}
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package useros
+
+import (
+	"os"
+)
+
+// openDir opens the directory path for reading.
+func openDir(parent *os.File, path string) (*os.File, error) {
+	return os.Open(path)
+}
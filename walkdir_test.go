@@ -0,0 +1,75 @@
+package useros
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkDir(t *testing.T) {
+	dir := t.TempDir()
+
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			name := filepath.Join(dir, fmt.Sprintf("d%d/e%d", i, j))
+
+			if err := os.MkdirAll(name, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filepath.Join(name, "file"), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := os.Symlink("d0", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	collect := func(walk func(root string, fn fs.WalkDirFunc) error) []string {
+		var paths []string
+
+		err := walk(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			paths = append(paths, path)
+
+			if d.Name() == "e3" {
+				return filepath.SkipDir
+			}
+
+			if path == filepath.Join(dir, "d3", "e4") {
+				return filepath.SkipAll
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return paths
+	}
+
+	expected := collect(filepath.WalkDir)
+
+	if len(expected) != 40 {
+		t.Fatalf("unexpected walk of %d entries", len(expected))
+	}
+
+	if paths := collect(func(root string, fn fs.WalkDirFunc) error { return WalkDir(Default(), root, fn) }); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	for _, workers := range []int{2, 8} {
+		if paths := collect(func(root string, fn fs.WalkDirFunc) error { return WalkDirParallel(Default(), root, workers, fn) }); !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%d workers: expected %v, got %v", workers, expected, paths)
+		}
+	}
+}